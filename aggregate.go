@@ -5,6 +5,8 @@
 
 package eventsourcing
 
+import "reflect"
+
 //AggregateRoot is the interface that all aggregates should implement
 type AggregateRoot interface {
 	AggregateID() string
@@ -20,13 +22,17 @@ type AggregateRoot interface {
 // AggregateBase is a type that can be embedded in an AggregateRoot
 // implementation to handle common aggragate behaviour
 //
-// All required methods to implement an aggregate are here, to implement the
-// Aggregate root interface your aggregate will need to implement the Apply
-// method that will contain behaviour specific to your aggregate.
+// All required methods to implement an aggregate are here. The Apply method
+// routes events to the appliers registered with RegisterApplier or
+// RegisterOnMethods, or your aggregate can implement its own Apply method that
+// will contain behaviour specific to your aggregate.
 type AggregateBase struct {
-	id      string
-	version int64
-	changes []EventMessage
+	id       string
+	version  int64
+	changes  []EventMessage
+	appliers map[reflect.Type]func(interface{})
+	ignored  map[reflect.Type]struct{}
+	applyErr error
 }
 
 // NewAggregateBase contructs a new AggregateBase.
@@ -68,6 +74,14 @@ func (a *AggregateBase) IncrementVersion() {
 	a.version++
 }
 
+// SetVersion sets the version of the aggregate.
+//
+// This is used by the repository to set the version of an aggregate that is
+// restored from a snapshot rather than by applying every event.
+func (a *AggregateBase) SetVersion(version int64) {
+	a.version = version
+}
+
 // TrackChange stores the EventMessage in the changes collection.
 //
 // Changes are new, unpersisted events that have been applied to the aggregate.
@@ -31,6 +31,14 @@ func (s *AggregateBaseSuite) TestIncrementVersion(c *C) {
 	c.Assert(agg.CurrentVersion(), Equals, int64(0))
 }
 
+func (s *AggregateBaseSuite) TestSetVersion(c *C) {
+	agg := NewAggregateBase(NewUUID())
+
+	agg.SetVersion(41)
+	c.Assert(agg.OriginalVersion(), Equals, int64(41))
+	c.Assert(agg.CurrentVersion(), Equals, int64(41))
+}
+
 func (s *AggregateBaseSuite) TestTrackOneChange(c *C) {
 	ev := NewTestEventMessage(NewUUID())
 	agg := NewSomeAggregate(ev.AggregateID())
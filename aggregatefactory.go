@@ -22,22 +22,33 @@ type AggregateFactory interface {
 // that supports registration of delegate functions to perform aggregate instantiation.
 type DelegateAggregateFactory struct {
 	delegates map[string]func(string) AggregateRoot
+	types     *TypeRegistry
 }
 
 // NewDelegateAggregateFactory contructs a new DelegateAggregateFactory
 func NewDelegateAggregateFactory() *DelegateAggregateFactory {
 	return &DelegateAggregateFactory{
 		delegates: make(map[string]func(string) AggregateRoot),
+		types:     DefaultTypeRegistry,
 	}
 }
 
+// SetTypeRegistry sets the registry used to name the aggregate types. The
+// DefaultTypeRegistry is used by default.
+func (t *DelegateAggregateFactory) SetTypeRegistry(types *TypeRegistry) {
+	t.types = types
+}
+
 // RegisterDelegate is used to register a new funtion for instantiation of an
 // aggregate instance.
 //
 // 	func(id string) AggregateRoot {return NewMyAggregateType(id)}
 // 	func(id string) AggregateRoot { return &MyAggregateType{AggregateBase:NewAggregateBase(id)} }
 func (t *DelegateAggregateFactory) RegisterDelegate(aggregate AggregateRoot, delegate func(string) AggregateRoot) error {
-	typeName := typeOf(aggregate)
+	typeName, err := t.types.Name(aggregate)
+	if err != nil {
+		return err
+	}
 	if _, ok := t.delegates[typeName]; ok {
 		return fmt.Errorf("factory delegate already registered for type: \"%s\"", typeName)
 	}
@@ -46,8 +57,10 @@ func (t *DelegateAggregateFactory) RegisterDelegate(aggregate AggregateRoot, del
 }
 
 // GetAggregate calls the delegate for the type specified and returns the result.
+//
+// An alias of the aggregate type is resolved to its name.
 func (t *DelegateAggregateFactory) GetAggregate(typeName string, id string) AggregateRoot {
-	if f, ok := t.delegates[typeName]; ok {
+	if f, ok := t.delegates[t.types.Resolve(typeName)]; ok {
 		return f(id)
 	}
 	return nil
@@ -0,0 +1,202 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// RegisterApplier registers a function that applies events of type E to the
+// aggregate. Events of type E and *E are both passed to apply as *E.
+//
+//	func NewOrder(id string) *Order {
+//		order := &Order{AggregateBase: eventsourcing.NewAggregateBase(id)}
+//		eventsourcing.RegisterApplier(order.AggregateBase, func(e *OrderCreated) {
+//			order.Created = true
+//		})
+//		return order
+//	}
+//
+// A later registration for the same type replaces the earlier one.
+func RegisterApplier[E any](a *AggregateBase, apply func(*E)) {
+	a.setApplier(reflect.TypeOf((*E)(nil)).Elem(), func(event interface{}) {
+		switch e := event.(type) {
+		case *E:
+			apply(e)
+		case E:
+			apply(&e)
+		}
+	})
+}
+
+// RegisterOnMethods registers the methods of the aggregate that are named On
+// followed by the name of an event type, and take that event or a pointer to
+// it, as the appliers of their event type.
+//
+//	func (o *Order) OnOrderCreated(e *OrderCreated) {
+//		o.Created = true
+//	}
+//
+// The methods of each aggregate type are discovered once and the result is
+// cached.
+func (a *AggregateBase) RegisterOnMethods(aggregate interface{}) {
+	v := reflect.ValueOf(aggregate)
+	for _, m := range onMethods(v.Type()) {
+		method, m := v.Method(m.index), m
+		a.setApplier(m.eventType, func(event interface{}) {
+			method.Call([]reflect.Value{m.arg(event)})
+		})
+	}
+}
+
+// IgnoreEvents registers event types that have no applier, because the
+// aggregate no longer applies them or its own Apply method does, so that Apply
+// skips events of those types rather than recording an *ErrNoApplier.
+//
+//	order.IgnoreEvents(&OrderPriced{})
+func (a *AggregateBase) IgnoreEvents(events ...interface{}) {
+	if a.ignored == nil {
+		a.ignored = make(map[reflect.Type]struct{})
+	}
+	for _, event := range events {
+		if t := eventTypeOf(event); t != nil {
+			a.ignored[t] = struct{}{}
+		}
+	}
+}
+
+// Apply tracks the event if it is new and passes it to the applier registered
+// for its type.
+//
+// An event without an applier is an error, as it is for Raise, unless its type
+// is ignored with IgnoreEvents. As Apply can not return the error, the first
+// one is recorded and returned by ApplyErr, which the repository checks when
+// it loads the aggregate.
+func (a *AggregateBase) Apply(event EventMessage, isNew bool) {
+	if isNew {
+		a.TrackChange(event)
+	}
+	apply, ok := a.applier(event.Event())
+	if ok {
+		apply(event.Event())
+		return
+	}
+	if _, ignored := a.ignored[eventTypeOf(event.Event())]; !ignored && a.applyErr == nil {
+		a.applyErr = &ErrNoApplier{AggregateID: a.id, EventType: eventTypeName(event.Event())}
+	}
+}
+
+// ApplyErr returns the first error recorded by Apply, or nil if every event
+// was applied or ignored.
+func (a *AggregateBase) ApplyErr() error {
+	return a.applyErr
+}
+
+// Raise applies a new event to the aggregate and tracks it as a change. The
+// event message is given the version that follows the current version of the
+// aggregate.
+//
+// Raise passes the event to the applier registered for its type and returns
+// an *ErrNoApplier if there is none. It does not call the Apply method of an
+// aggregate that implements its own.
+func (a *AggregateBase) Raise(event interface{}) error {
+	apply, ok := a.applier(event)
+	if !ok {
+		return &ErrNoApplier{AggregateID: a.id, EventType: eventTypeName(event)}
+	}
+
+	em := NewEventMessage(a.id, event, Int64(a.CurrentVersion()+1))
+	a.TrackChange(em)
+	apply(event)
+	return nil
+}
+
+func (a *AggregateBase) setApplier(eventType reflect.Type, apply func(interface{})) {
+	if a.appliers == nil {
+		a.appliers = make(map[reflect.Type]func(interface{}))
+	}
+	a.appliers[eventType] = apply
+}
+
+func (a *AggregateBase) applier(event interface{}) (func(interface{}), bool) {
+	t := eventTypeOf(event)
+	if t == nil {
+		return nil, false
+	}
+	apply, ok := a.appliers[t]
+	return apply, ok
+}
+
+// eventTypeOf returns the type of the event, or the type it points to.
+func eventTypeOf(event interface{}) reflect.Type {
+	t := reflect.TypeOf(event)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// eventTypeName returns the name of the event in the DefaultTypeRegistry or,
+// if it can not be named, its Go type.
+func eventTypeName(event interface{}) string {
+	if name, err := DefaultTypeRegistry.Name(event); err == nil {
+		return name
+	}
+	return fmt.Sprintf("%T", event)
+}
+
+// onMethod is a method of an aggregate type that applies an event.
+type onMethod struct {
+	index     int
+	eventType reflect.Type
+	pointer   bool
+}
+
+// arg returns the event as the argument the method takes.
+func (m onMethod) arg(event interface{}) reflect.Value {
+	v := reflect.ValueOf(event)
+	switch {
+	case m.pointer && v.Kind() != reflect.Ptr:
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		return p
+	case !m.pointer && v.Kind() == reflect.Ptr:
+		return v.Elem()
+	}
+	return v
+}
+
+var onMethodCache sync.Map
+
+// onMethods discovers the On<EventName> methods of the aggregate type.
+func onMethods(t reflect.Type) []onMethod {
+	if cached, ok := onMethodCache.Load(t); ok {
+		return cached.([]onMethod)
+	}
+
+	var methods []onMethod
+	for i := 0; i < t.NumMethod(); i++ {
+		method := t.Method(i)
+		if !strings.HasPrefix(method.Name, "On") || method.Type.NumIn() != 2 || method.Type.NumOut() != 0 {
+			continue
+		}
+
+		eventType, pointer := method.Type.In(1), false
+		if eventType.Kind() == reflect.Ptr {
+			eventType, pointer = eventType.Elem(), true
+		}
+		if eventType.Kind() != reflect.Struct || method.Name != "On"+eventType.Name() {
+			continue
+		}
+		methods = append(methods, onMethod{index: i, eventType: eventType, pointer: pointer})
+	}
+
+	onMethodCache.Store(t, methods)
+	return methods
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"reflect"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ApplierSuite{})
+
+type ApplierSuite struct{}
+
+// RoutedAggregate registers an applier function for SomeEvent.
+type RoutedAggregate struct {
+	*AggregateBase
+	Items []string
+	Count int
+}
+
+func NewRoutedAggregate(id string) *RoutedAggregate {
+	a := &RoutedAggregate{AggregateBase: NewAggregateBase(id)}
+	RegisterApplier(a.AggregateBase, func(e *SomeEvent) {
+		a.Items = append(a.Items, e.Item)
+		a.Count += e.Count
+	})
+	return a
+}
+
+// ConventionAggregate applies events with On<EventName> methods.
+type ConventionAggregate struct {
+	*AggregateBase
+	Items  []string
+	Orders []string
+}
+
+func NewConventionAggregate(id string) *ConventionAggregate {
+	a := &ConventionAggregate{AggregateBase: NewAggregateBase(id)}
+	a.RegisterOnMethods(a)
+	return a
+}
+
+func (a *ConventionAggregate) OnSomeEvent(e *SomeEvent) {
+	a.Items = append(a.Items, e.Item)
+}
+
+func (a *ConventionAggregate) OnSomeOtherEvent(e SomeOtherEvent) {
+	a.Orders = append(a.Orders, e.OrderID)
+}
+
+// OnSomethingElse does not match the name of its event and is not routed.
+func (a *ConventionAggregate) OnSomethingElse(e *SomeEvent) {
+	a.Items = append(a.Items, "wrong")
+}
+
+func (s *ApplierSuite) TestRegisterApplier(c *C) {
+	a := NewRoutedAggregate(NewUUID())
+
+	a.Apply(NewEventMessage(a.AggregateID(), &SomeEvent{Item: "a", Count: 1}, Int64(0)), false)
+	a.Apply(NewEventMessage(a.AggregateID(), SomeEvent{Item: "b", Count: 2}, Int64(1)), true)
+	a.Apply(NewEventMessage(a.AggregateID(), &SomeOtherEvent{}, Int64(2)), false)
+
+	c.Assert(a.Items, DeepEquals, []string{"a", "b"})
+	c.Assert(a.Count, Equals, 3)
+	c.Assert(a.GetChanges(), HasLen, 1)
+}
+
+func (s *ApplierSuite) TestRegisterOnMethods(c *C) {
+	a := NewConventionAggregate(NewUUID())
+
+	a.Apply(NewEventMessage(a.AggregateID(), &SomeEvent{Item: "a"}, nil), false)
+	a.Apply(NewEventMessage(a.AggregateID(), SomeEvent{Item: "b"}, nil), false)
+	a.Apply(NewEventMessage(a.AggregateID(), &SomeOtherEvent{OrderID: "o"}, nil), false)
+
+	c.Assert(a.Items, DeepEquals, []string{"a", "b"})
+	c.Assert(a.Orders, DeepEquals, []string{"o"})
+}
+
+func (s *ApplierSuite) TestOnMethodsAreDiscoveredOnce(c *C) {
+	a := NewConventionAggregate(NewUUID())
+	methods := onMethods(reflect.TypeOf(a))
+
+	c.Assert(methods, HasLen, 2)
+	cached, ok := onMethodCache.Load(reflect.TypeOf(a))
+	c.Assert(ok, Equals, true)
+	c.Assert(cached, DeepEquals, methods)
+}
+
+func (s *ApplierSuite) TestRaise(c *C) {
+	a := NewRoutedAggregate(NewUUID())
+	a.SetVersion(4)
+
+	c.Assert(a.Raise(&SomeEvent{Item: "a", Count: 1}), IsNil)
+	c.Assert(a.Raise(&SomeEvent{Item: "b", Count: 2}), IsNil)
+
+	c.Assert(a.Count, Equals, 3)
+	changes := a.GetChanges()
+	c.Assert(changes, HasLen, 2)
+	c.Assert(*changes[0].Version(), Equals, int64(5))
+	c.Assert(*changes[1].Version(), Equals, int64(6))
+	c.Assert(changes[1].AggregateID(), Equals, a.AggregateID())
+	c.Assert(changes[1].Event(), DeepEquals, &SomeEvent{Item: "b", Count: 2})
+	c.Assert(a.CurrentVersion(), Equals, int64(6))
+}
+
+func (s *ApplierSuite) TestRaiseWithoutApplierReturnsAnError(c *C) {
+	a := NewRoutedAggregate("id")
+
+	err := a.Raise(&SomeOtherEvent{})
+	c.Assert(err, DeepEquals, &ErrNoApplier{AggregateID: "id", EventType: "eventsourcing.SomeOtherEvent"})
+	c.Assert(err, ErrorMatches, "No applier. AggregateID: id has no applier registered for event type: eventsourcing.SomeOtherEvent")
+	c.Assert(a.GetChanges(), HasLen, 0)
+}
+
+func (s *ApplierSuite) TestApplyWithoutApplierRecordsAnError(c *C) {
+	a := NewRoutedAggregate("id")
+	a.Apply(NewEventMessage("id", &SomeEvent{Item: "a"}, Int64(0)), false)
+	c.Assert(a.ApplyErr(), IsNil)
+
+	a.Apply(NewEventMessage("id", SomeOtherEvent{}, Int64(1)), false)
+	a.Apply(NewEventMessage("id", &SomeEvent{Item: "b"}, Int64(2)), false)
+	c.Assert(a.ApplyErr(), DeepEquals, &ErrNoApplier{AggregateID: "id", EventType: "eventsourcing.SomeOtherEvent"})
+	c.Assert(a.Items, DeepEquals, []string{"a", "b"})
+
+	ignoring := NewRoutedAggregate("id")
+	ignoring.IgnoreEvents(&SomeOtherEvent{})
+	ignoring.Apply(NewEventMessage("id", SomeOtherEvent{}, Int64(0)), false)
+	ignoring.Apply(NewEventMessage("id", &SomeOtherEvent{}, Int64(1)), false)
+	c.Assert(ignoring.ApplyErr(), IsNil)
+}
+
+func (s *ApplierSuite) TestLoadingEventsWithoutApplierReturnsAnError(c *C) {
+	common, err := NewCommonDomainRepository(NewInMemoryEventStore(), &MockEventBus{})
+	c.Assert(err, IsNil)
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	_ = eventFactory.RegisterDelegate(&SomeOtherEvent{},
+		func() interface{} { return &SomeOtherEvent{} })
+	common.SetEventFactory(eventFactory)
+
+	repo, err := NewRepository(common, NewRoutedAggregate)
+	c.Assert(err, IsNil)
+
+	a := NewRoutedAggregate(NewUUID())
+	_ = a.Raise(&SomeEvent{Item: "a", Count: 1})
+	a.Apply(NewEventMessage(a.AggregateID(), &SomeOtherEvent{}, Int64(a.CurrentVersion()+1)), true)
+	c.Assert(repo.Save(a, nil), IsNil)
+
+	_, err = repo.Load(a.AggregateID())
+	c.Assert(err, DeepEquals, &ErrNoApplier{AggregateID: a.AggregateID(), EventType: "eventsourcing.SomeOtherEvent"})
+
+	ignoring, err := NewRepository(common, func(id string) *RoutedAggregate {
+		a := NewRoutedAggregate(id)
+		a.IgnoreEvents(&SomeOtherEvent{})
+		return a
+	})
+	c.Assert(err, IsNil)
+	loaded, err := ignoring.Load(a.AggregateID())
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Items, DeepEquals, []string{"a"})
+	c.Assert(loaded.CurrentVersion(), Equals, int64(1))
+}
+
+func (s *ApplierSuite) TestRoutedAggregateWithRepository(c *C) {
+	common, err := NewCommonDomainRepository(NewInMemoryEventStore(), &MockEventBus{})
+	c.Assert(err, IsNil)
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	common.SetEventFactory(eventFactory)
+	repo, err := NewRepository(common, NewRoutedAggregate)
+	c.Assert(err, IsNil)
+
+	a := NewRoutedAggregate(NewUUID())
+	_ = a.Raise(&SomeEvent{Item: "a", Count: 1})
+	_ = a.Raise(&SomeEvent{Item: "b", Count: 2})
+	c.Assert(repo.Save(a, nil), IsNil)
+
+	loaded, err := repo.Load(a.AggregateID())
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Items, DeepEquals, []string{"a", "b"})
+	c.Assert(loaded.CurrentVersion(), Equals, int64(1))
+
+	_ = loaded.Raise(&SomeEvent{Item: "c"})
+	c.Assert(repo.Save(loaded, nil), IsNil)
+}
@@ -0,0 +1,399 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// BackpressurePolicy determines what an AsyncEventBus does when the queue of
+// a handler is full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock blocks the publisher until there is room in the queue
+	// or the context of the publish is done.
+	BackpressureBlock BackpressurePolicy = iota
+
+	// BackpressureDrop drops the event for the handler whose queue is full.
+	BackpressureDrop
+
+	// BackpressureError drops the event for the handler whose queue is full
+	// and returns an *ErrQueueFull from Publish.
+	BackpressureError
+)
+
+// AsyncEventBusConfig holds the configuration of an AsyncEventBus.
+//
+// Zero values are replaced with the defaults.
+type AsyncEventBusConfig struct {
+	// Workers is the number of workers that call each handler. Defaults to 1.
+	Workers int
+
+	// QueueSize is the size of the queue of each worker. Defaults to 100.
+	QueueSize int
+
+	// Backpressure is the policy applied when a queue is full. Defaults to
+	// BackpressureBlock.
+	Backpressure BackpressurePolicy
+
+	// RetryPolicy determines how handlers that fail or panic are retried.
+	// Defaults to a single attempt.
+	RetryPolicy RetryPolicy
+
+	// DeadLetterSink, if set, receives the events that handlers fail to handle
+	// after all retries.
+	DeadLetterSink DeadLetterSink
+
+	// ErrorHandler, if set, is called when an event is dropped because a queue
+	// is full and when a handler fails or panics after all retries.
+	ErrorHandler func(EventMessage, EventHandler, error)
+
+	// TypeRegistry is the registry used to name event types. Defaults to the
+	// DefaultTypeRegistry.
+	TypeRegistry *TypeRegistry
+}
+
+// AsyncEventBus is an in process event bus that publishes events to handlers
+// asynchronously.
+//
+// Each handler has its own queues and workers so that a slow handler does not
+// hold up the publisher or the other handlers. Events for the same aggregate
+// are always handled by the same worker so each handler sees the events of an
+// aggregate in the order they were published.
+//
+// Handlers receive the context of the publish without its cancellation so
+// that request scoped values are available after the request has completed.
+type AsyncEventBus struct {
+	mu            sync.RWMutex
+	config        AsyncEventBusConfig
+	handlers      []*asyncHandler
+	eventHandlers map[string][]*asyncHandler
+	shutdown      bool
+	wg            sync.WaitGroup
+
+	// done is closed when the bus is shut down and drained once the
+	// publishes in progress at that time have returned.
+	done       chan struct{}
+	drained    chan struct{}
+	publishers sync.WaitGroup
+}
+
+type asyncHandler struct {
+	handler EventHandler
+	queues  []chan asyncEnvelope
+}
+
+type asyncEnvelope struct {
+	ctx   context.Context
+	event EventMessage
+}
+
+// NewAsyncEventBus constructs a new AsyncEventBus
+func NewAsyncEventBus(config AsyncEventBusConfig) *AsyncEventBus {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+	if config.TypeRegistry == nil {
+		config.TypeRegistry = DefaultTypeRegistry
+	}
+
+	return &AsyncEventBus{
+		config:        config,
+		eventHandlers: make(map[string][]*asyncHandler),
+		done:          make(chan struct{}),
+		drained:       make(chan struct{}),
+	}
+}
+
+// PublishEvent queues the event for all registered event handlers.
+func (b *AsyncEventBus) PublishEvent(event EventMessage) {
+	_ = b.Publish(context.Background(), event)
+}
+
+// PublishEventContext queues the event and the context for all registered
+// event handlers.
+func (b *AsyncEventBus) PublishEventContext(ctx context.Context, event EventMessage) {
+	_ = b.Publish(ctx, event)
+}
+
+// Publish queues the event for all registered event handlers and returns any
+// error that prevented the event being queued.
+//
+// An *ErrEventBusShutdown is returned if the bus has been shut down. With the
+// BackpressureError policy an *ErrQueueFull is returned if the queue of any of
+// the handlers is full. With the BackpressureBlock policy the context error is
+// returned if the context is done before the event could be queued, and an
+// *ErrEventBusShutdown if the bus is shut down while waiting. An error is
+// returned if the type of the event can not be named.
+//
+// Delivery is at least once. The event is queued for one handler after
+// another, so if it can not be queued for a handler after it was queued for
+// others, those handlers still handle it. The error is then wrapped in an
+// *ErrPartialPublish that names them. Publishing the event again delivers it
+// to them a second time unless they are idempotent, Republish with their names
+// does not.
+//
+// The lock of the bus is not held while waiting for room in a queue, so that
+// handlers can publish events and be added while a publisher is blocked.
+func (b *AsyncEventBus) Publish(ctx context.Context, event EventMessage) error {
+	return b.publish(ctx, event, nil)
+}
+
+// Republish queues the event for the registered event handlers, other than
+// those named in handled, as Publish does.
+func (b *AsyncEventBus) Republish(ctx context.Context, event EventMessage, handled []string) error {
+	return b.publish(ctx, event, handled)
+}
+
+func (b *AsyncEventBus) publish(ctx context.Context, event EventMessage, skip []string) error {
+	b.mu.RLock()
+	if b.shutdown {
+		b.mu.RUnlock()
+		return &ErrEventBusShutdown{}
+	}
+
+	typeName, err := b.config.TypeRegistry.Name(event.Event())
+	if err != nil {
+		b.mu.RUnlock()
+		return err
+	}
+
+	handlers := b.eventHandlers[typeName]
+	b.publishers.Add(1)
+	b.mu.RUnlock()
+	defer b.publishers.Done()
+
+	envelope := asyncEnvelope{ctx: context.WithoutCancel(ctx), event: event}
+
+	var ret error
+	var queued []string
+	for _, h := range handlers {
+		if containsString(skip, handlerName(h.handler)) {
+			continue
+		}
+		queue := h.queues[partition(event.AggregateID(), len(h.queues))]
+
+		switch b.config.Backpressure {
+		case BackpressureBlock:
+			select {
+			case queue <- envelope:
+			case <-b.done:
+				return partialPublish(typeName, queued, &ErrEventBusShutdown{})
+			case <-ctx.Done():
+				return partialPublish(typeName, queued, ctx.Err())
+			}
+		default:
+			select {
+			case queue <- envelope:
+			default:
+				err := &ErrQueueFull{EventType: typeName}
+				b.reportError(event, h.handler, err)
+				if b.config.Backpressure == BackpressureError && ret == nil {
+					ret = err
+				}
+				continue
+			}
+		}
+		queued = append(queued, handlerName(h.handler))
+	}
+	if ret != nil {
+		return partialPublish(typeName, queued, ret)
+	}
+	return nil
+}
+
+// partialPublish returns the error of a publish, wrapped in an
+// *ErrPartialPublish if the event was queued for any of the handlers.
+func partialPublish(eventType string, queued []string, err error) error {
+	if len(queued) == 0 {
+		return err
+	}
+	return &ErrPartialPublish{EventType: eventType, Handlers: queued, Err: err}
+}
+
+// AddHandler registers an event handler for all of the events specified in the
+// variadic events parameter using the configured number of workers.
+//
+// AddHandler panics if the type of an event can not be named. Use
+// RegisterHandler to have the error returned.
+func (b *AsyncEventBus) AddHandler(handler EventHandler, events ...interface{}) {
+	b.AddHandlerWithWorkers(handler, b.config.Workers, events...)
+}
+
+// AddHandlerWithWorkers registers an event handler for all of the events
+// specified with the number of workers specified, as
+// RegisterHandlerWithWorkers does, and panics if the type of an event can not
+// be named.
+func (b *AsyncEventBus) AddHandlerWithWorkers(handler EventHandler, workers int, events ...interface{}) {
+	if err := b.RegisterHandlerWithWorkers(handler, workers, events...); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterHandler registers an event handler for all of the events specified
+// in the variadic events parameter using the configured number of workers.
+//
+// If the type of any of the events can not be named an error is returned and
+// the handler is not registered for any of them.
+func (b *AsyncEventBus) RegisterHandler(handler EventHandler, events ...interface{}) error {
+	return b.RegisterHandlerWithWorkers(handler, b.config.Workers, events...)
+}
+
+// RegisterHandlerWithWorkers registers an event handler for all of the events
+// specified with the number of workers specified.
+//
+// If the handler is already registered the workers it was first registered
+// with are used. If the type of any of the events can not be named an error is
+// returned and the handler is not registered for any of them. Handlers added
+// after the bus is shut down are ignored.
+func (b *AsyncEventBus) RegisterHandlerWithWorkers(handler EventHandler, workers int, events ...interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.shutdown {
+		return nil
+	}
+
+	typeNames, err := nameTypes(b.config.TypeRegistry, events)
+	if err != nil {
+		return err
+	}
+
+	h := b.findHandler(handler)
+	if h == nil {
+		h = b.startHandler(handler, workers)
+	}
+
+	for _, typeName := range typeNames {
+		registered := false
+		for _, existing := range b.eventHandlers[typeName] {
+			if existing == h {
+				registered = true
+			}
+		}
+		if !registered {
+			b.eventHandlers[typeName] = append(b.eventHandlers[typeName], h)
+		}
+	}
+	return nil
+}
+
+// Shutdown stops the bus accepting events and waits until all queued events
+// have been handled or the context is done.
+func (b *AsyncEventBus) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.shutdown {
+		b.shutdown = true
+		close(b.done)
+
+		// The workers drain their queues once no publisher can add to them.
+		go func() {
+			b.publishers.Wait()
+			close(b.drained)
+		}()
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *AsyncEventBus) findHandler(handler EventHandler) *asyncHandler {
+	for _, h := range b.handlers {
+		if containsHandler([]EventHandler{h.handler}, handler) {
+			return h
+		}
+	}
+	return nil
+}
+
+func (b *AsyncEventBus) startHandler(handler EventHandler, workers int) *asyncHandler {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	h := &asyncHandler{
+		handler: handler,
+		queues:  make([]chan asyncEnvelope, workers),
+	}
+
+	for i := range h.queues {
+		h.queues[i] = make(chan asyncEnvelope, b.config.QueueSize)
+		b.wg.Add(1)
+		go b.work(h.handler, h.queues[i])
+	}
+
+	b.handlers = append(b.handlers, h)
+	return h
+}
+
+func (b *AsyncEventBus) work(handler EventHandler, queue chan asyncEnvelope) {
+	defer b.wg.Done()
+	for {
+		select {
+		case envelope := <-queue:
+			b.handle(handler, envelope)
+		case <-b.drained:
+			for {
+				select {
+				case envelope := <-queue:
+					b.handle(handler, envelope)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *AsyncEventBus) handle(handler EventHandler, envelope asyncEnvelope) {
+	err := deliverEvent(envelope.ctx, recoverEvent, handler, envelope.event,
+		b.config.RetryPolicy, b.config.DeadLetterSink)
+	if err != nil {
+		b.reportError(envelope.event, handler, err)
+	}
+}
+
+// recoverEvent calls the handler and returns a panic in the handler as an
+// error so that a worker is not lost to a panic.
+func recoverEvent(ctx context.Context, handler EventHandler, event EventMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic handling event %s: %v", event.EventType(), r)
+		}
+	}()
+	return handleEvent(ctx, handler, event)
+}
+
+func (b *AsyncEventBus) reportError(event EventMessage, handler EventHandler, err error) {
+	if b.config.ErrorHandler != nil {
+		b.config.ErrorHandler(event, handler, err)
+	}
+}
+
+// partition returns the worker that handles events for the aggregate.
+func partition(aggregateID string, workers int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(aggregateID))
+	return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,376 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AsyncEventBusSuite{})
+
+type AsyncEventBusSuite struct {
+	ctx context.Context
+}
+
+func (s *AsyncEventBusSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+}
+
+// SyncEventHandler records events and is safe for concurrent use.
+type SyncEventHandler struct {
+	mu     sync.Mutex
+	events []EventMessage
+	block  chan struct{}
+}
+
+func (h *SyncEventHandler) Handle(event EventMessage) {
+	if h.block != nil {
+		<-h.block
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *SyncEventHandler) Events() []EventMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]EventMessage(nil), h.events...)
+}
+
+func (s *AsyncEventBusSuite) TestPublishesEventsToHandlers(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{})
+	h1 := &SyncEventHandler{}
+	h2 := &SyncEventHandler{}
+	bus.AddHandler(h1, &SomeEvent{})
+	bus.AddHandler(h2, &SomeEvent{}, &SomeOtherEvent{})
+
+	ev1 := NewTestEventMessage(NewUUID())
+	ev2 := NewEventMessage(NewUUID(), &SomeOtherEvent{OrderID: NewUUID()}, nil)
+	c.Assert(bus.Publish(s.ctx, ev1), IsNil)
+	c.Assert(bus.Publish(s.ctx, ev2), IsNil)
+
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+	c.Assert(h1.Events(), DeepEquals, []EventMessage{ev1})
+	c.Assert(h2.Events(), DeepEquals, []EventMessage{ev1, ev2})
+}
+
+func (s *AsyncEventBusSuite) TestEventsForAnAggregateAreHandledInOrder(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{Workers: 4})
+	h := &SyncEventHandler{}
+	bus.AddHandler(h, &SomeEvent{})
+
+	ids := []string{NewUUID(), NewUUID(), NewUUID(), NewUUID(), NewUUID()}
+	for i := 0; i < 50; i++ {
+		for _, id := range ids {
+			_ = bus.Publish(s.ctx, NewEventMessage(id, &SomeEvent{Count: i}, nil))
+		}
+	}
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+
+	last := make(map[string]int)
+	for _, em := range h.Events() {
+		count := em.Event().(*SomeEvent).Count
+		if prev, ok := last[em.AggregateID()]; ok {
+			c.Assert(count, Equals, prev+1)
+		}
+		last[em.AggregateID()] = count
+	}
+	c.Assert(h.Events(), HasLen, 250)
+}
+
+func (s *AsyncEventBusSuite) TestBackpressureErrorReturnsErrQueueFull(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{QueueSize: 1, Backpressure: BackpressureError})
+	h := &SyncEventHandler{block: make(chan struct{})}
+	bus.AddHandler(h, &SomeEvent{})
+	id := NewUUID()
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = bus.Publish(s.ctx, NewTestEventMessage(id))
+	}
+
+	c.Assert(err, DeepEquals, &ErrQueueFull{EventType: "eventsourcing.SomeEvent"})
+	close(h.block)
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+}
+
+func (s *AsyncEventBusSuite) TestBackpressureDropReportsDroppedEvents(c *C) {
+	var mu sync.Mutex
+	dropped := 0
+	bus := NewAsyncEventBus(AsyncEventBusConfig{
+		QueueSize:    1,
+		Backpressure: BackpressureDrop,
+		ErrorHandler: func(event EventMessage, handler EventHandler, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dropped++
+		},
+	})
+	h := &SyncEventHandler{block: make(chan struct{})}
+	bus.AddHandler(h, &SomeEvent{})
+	id := NewUUID()
+
+	for i := 0; i < 5; i++ {
+		c.Assert(bus.Publish(s.ctx, NewTestEventMessage(id)), IsNil)
+	}
+	close(h.block)
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(dropped+len(h.Events()), Equals, 5)
+	c.Assert(dropped > 0, Equals, true)
+}
+
+func (s *AsyncEventBusSuite) TestBackpressureBlockReturnsWhenContextIsDone(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{QueueSize: 1})
+	h := &SyncEventHandler{block: make(chan struct{})}
+	bus.AddHandler(h, &SomeEvent{})
+	id := NewUUID()
+
+	ctx, cancel := context.WithTimeout(s.ctx, 20*time.Millisecond)
+	defer cancel()
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = bus.Publish(ctx, NewTestEventMessage(id))
+	}
+
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	close(h.block)
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+}
+
+func (s *AsyncEventBusSuite) TestPartialPublishNamesTheHandlersThatQueuedTheEvent(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{QueueSize: 1})
+	h1 := &SyncEventHandler{}
+	h2 := &SyncEventHandler{block: make(chan struct{})}
+	bus.AddHandler(h1, &SomeEvent{})
+	bus.AddHandler(h2, &SomeEvent{})
+	id := NewUUID()
+
+	// The second handler is blocked on the first event and its queue is
+	// filled by the second, so the third is only queued for the first handler.
+	c.Assert(bus.Publish(s.ctx, NewTestEventMessage(id)), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(bus.Publish(s.ctx, NewTestEventMessage(id)), IsNil)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 20*time.Millisecond)
+	defer cancel()
+	err := bus.Publish(ctx, NewTestEventMessage(id))
+
+	c.Assert(err, DeepEquals, &ErrPartialPublish{
+		EventType: "eventsourcing.SomeEvent",
+		Handlers:  []string{"*eventsourcing.SyncEventHandler"},
+		Err:       context.DeadlineExceeded,
+	})
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	close(h2.block)
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+	c.Assert(h1.Events(), HasLen, 3)
+	c.Assert(h2.Events(), HasLen, 2)
+}
+
+func (s *AsyncEventBusSuite) TestRepublishSkipsTheHandlersTheEventWasQueuedFor(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{})
+	queued := &SyncEventHandler{}
+	skipped := &FailingEventHandler{}
+	bus.AddHandler(queued, &SomeEvent{})
+	bus.AddHandler(skipped, &SomeEvent{})
+
+	c.Assert(bus.Republish(s.ctx, NewTestEventMessage(NewUUID()), []string{"failing"}), IsNil)
+
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+	c.Assert(queued.Events(), HasLen, 1)
+	c.Assert(skipped.calls, Equals, 0)
+}
+
+func (s *AsyncEventBusSuite) TestRegisterHandlerReturnsNamingErrors(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{})
+	h := &SyncEventHandler{}
+
+	c.Assert(bus.RegisterHandler(h, &SomeEvent{}, nil), FitsTypeOf, &ErrInvalidType{})
+	c.Assert(func() { bus.AddHandler(h, nil) }, PanicMatches, "Invalid type.*")
+	c.Assert(bus.Publish(s.ctx, NewTestEventMessage(NewUUID())), IsNil)
+
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+	c.Assert(h.Events(), HasLen, 0)
+}
+
+func (s *AsyncEventBusSuite) TestHandlerCanPublishWhilePublisherIsBlocked(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{QueueSize: 1})
+	release := make(chan struct{})
+	handled := make(chan struct{}, 10)
+	first := true
+	bus.AddHandler(EventHandlerFunc(func(ctx context.Context, event EventMessage) error {
+		if first {
+			first = false
+			<-release
+			if err := bus.Publish(ctx, NewEventMessage(NewUUID(), &SomeOtherEvent{}, nil)); err != nil {
+				return err
+			}
+		}
+		handled <- struct{}{}
+		return nil
+	}), &SomeEvent{})
+	id := NewUUID()
+
+	// The first event is being handled and the second fills the queue, so the
+	// third publish blocks.
+	c.Assert(bus.Publish(s.ctx, NewTestEventMessage(id)), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(bus.Publish(s.ctx, NewTestEventMessage(id)), IsNil)
+	go func() { _ = bus.Publish(s.ctx, NewTestEventMessage(id)) }()
+	time.Sleep(10 * time.Millisecond)
+
+	added := make(chan struct{})
+	go func() {
+		bus.AddHandler(&SyncEventHandler{}, &SomeOtherEvent{})
+		close(added)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			c.Fatal("the bus deadlocked")
+		}
+	}
+	<-added
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+}
+
+func (s *AsyncEventBusSuite) TestShutdownReleasesBlockedPublisher(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{QueueSize: 1})
+	h := &SyncEventHandler{block: make(chan struct{})}
+	bus.AddHandler(h, &SomeEvent{})
+	id := NewUUID()
+	_ = bus.Publish(s.ctx, NewTestEventMessage(id))
+	time.Sleep(10 * time.Millisecond)
+	_ = bus.Publish(s.ctx, NewTestEventMessage(id))
+
+	published := make(chan error, 1)
+	go func() { published <- bus.Publish(s.ctx, NewTestEventMessage(id)) }()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Millisecond)
+	defer cancel()
+	c.Assert(bus.Shutdown(ctx), Equals, context.DeadlineExceeded)
+	c.Assert(<-published, DeepEquals, &ErrEventBusShutdown{})
+
+	close(h.block)
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+	c.Assert(h.Events(), HasLen, 2)
+}
+
+func (s *AsyncEventBusSuite) TestPublishAfterShutdownReturnsAnError(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{})
+	bus.AddHandler(&SyncEventHandler{}, &SomeEvent{})
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+
+	err := bus.Publish(s.ctx, NewTestEventMessage(NewUUID()))
+
+	c.Assert(err, DeepEquals, &ErrEventBusShutdown{})
+}
+
+func (s *AsyncEventBusSuite) TestShutdownReturnsWhenContextIsDone(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{})
+	h := &SyncEventHandler{block: make(chan struct{})}
+	bus.AddHandler(h, &SomeEvent{})
+	_ = bus.Publish(s.ctx, NewTestEventMessage(NewUUID()))
+
+	ctx, cancel := context.WithTimeout(s.ctx, 20*time.Millisecond)
+	defer cancel()
+
+	c.Assert(bus.Shutdown(ctx), Equals, context.DeadlineExceeded)
+	close(h.block)
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+}
+
+func (s *AsyncEventBusSuite) TestPanicInHandlerIsReported(c *C) {
+	reported := make(chan error, 1)
+	bus := NewAsyncEventBus(AsyncEventBusConfig{
+		ErrorHandler: func(event EventMessage, handler EventHandler, err error) {
+			reported <- err
+		},
+	})
+	bus.AddHandler(EventHandlerFunc(func(ctx context.Context, event EventMessage) error {
+		panic("boom")
+	}), &SomeEvent{})
+
+	_ = bus.Publish(s.ctx, NewTestEventMessage(NewUUID()))
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+
+	c.Assert(<-reported, ErrorMatches, "panic handling event eventsourcing.SomeEvent: boom")
+}
+
+func (s *AsyncEventBusSuite) TestHandlerReceivesContextValuesWithoutCancellation(c *C) {
+	received := make(chan context.Context, 1)
+	bus := NewAsyncEventBus(AsyncEventBusConfig{})
+	bus.AddHandler(EventHandlerFunc(func(ctx context.Context, event EventMessage) error {
+		received <- ctx
+		return nil
+	}), &SomeEvent{})
+
+	ctx, cancel := context.WithCancel(context.WithValue(s.ctx, ctxKey("trace"), "abc"))
+	bus.PublishEventContext(ctx, NewTestEventMessage(NewUUID()))
+	cancel()
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+
+	got := <-received
+	c.Assert(got.Value(ctxKey("trace")), Equals, "abc")
+	c.Assert(got.Err(), IsNil)
+}
+
+func (s *AsyncEventBusSuite) TestConcurrentAddHandlerAndPublish(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{Workers: 2})
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			bus.AddHandler(&SyncEventHandler{}, &SomeEvent{})
+		}()
+		go func() {
+			defer wg.Done()
+			bus.PublishEvent(NewTestEventMessage(NewUUID()))
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+}
+
+func (s *AsyncEventBusSuite) TestFailuresAreRetriedAndDeadLettered(c *C) {
+	sink := NewInMemoryDeadLetterSink()
+	reported := make(chan error, 1)
+	bus := NewAsyncEventBus(AsyncEventBusConfig{
+		RetryPolicy:    RetryPolicy{Attempts: 2, Backoff: time.Millisecond},
+		DeadLetterSink: sink,
+		ErrorHandler: func(event EventMessage, handler EventHandler, err error) {
+			reported <- err
+		},
+	})
+	h := &FailingEventHandler{Failures: 10}
+	bus.AddHandler(h, &SomeEvent{})
+
+	_ = bus.Publish(s.ctx, NewTestEventMessage(NewUUID()))
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+
+	c.Assert(<-reported, ErrorMatches, "failure 2")
+	c.Assert(h.calls, Equals, 2)
+	c.Assert(sink.DeadLetters(), HasLen, 1)
+	c.Assert(sink.DeadLetters()[0].HandlerName, Equals, "failing")
+}
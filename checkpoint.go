@@ -0,0 +1,248 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CheckpointStore is the interface that a store of projection checkpoints
+// must implement.
+//
+// A checkpoint is the position of the last event a projection has processed.
+// Projections are identified by name.
+type CheckpointStore interface {
+	// GetCheckpoint returns the checkpoint of the projection, or PositionStart
+	// if the projection has no checkpoint.
+	GetCheckpoint(ctx context.Context, name string) (Position, error)
+
+	// SaveCheckpoint sets the checkpoint of the projection.
+	SaveCheckpoint(ctx context.Context, name string, position Position) error
+
+	// ResetCheckpoint removes the checkpoint of the projection so that it is
+	// rebuilt from the start the next time it runs.
+	ResetCheckpoint(ctx context.Context, name string) error
+}
+
+type eventPositionKey struct{}
+
+// withEventPosition returns a context that carries the position of the event
+// being handled.
+func withEventPosition(ctx context.Context, position Position) context.Context {
+	return context.WithValue(ctx, eventPositionKey{}, position)
+}
+
+// EventPosition returns the position of the event being handled when an event
+// handler is called by a Subscription.
+//
+// A projection that stores its read model in the same database as its
+// checkpoint can use the position to save the checkpoint in the same
+// transaction as its own writes.
+func EventPosition(ctx context.Context) (Position, bool) {
+	position, ok := ctx.Value(eventPositionKey{}).(Position)
+	return position, ok
+}
+
+// InMemoryCheckpointStore keeps checkpoints in memory.
+type InMemoryCheckpointStore struct {
+	mu          sync.RWMutex
+	checkpoints map[string]Position
+}
+
+// NewInMemoryCheckpointStore constructs a new InMemoryCheckpointStore
+func NewInMemoryCheckpointStore() *InMemoryCheckpointStore {
+	return &InMemoryCheckpointStore{
+		checkpoints: make(map[string]Position),
+	}
+}
+
+// GetCheckpoint returns the checkpoint of the projection.
+func (s *InMemoryCheckpointStore) GetCheckpoint(ctx context.Context, name string) (Position, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if position, ok := s.checkpoints[name]; ok {
+		return position, nil
+	}
+	return PositionStart, nil
+}
+
+// SaveCheckpoint sets the checkpoint of the projection.
+func (s *InMemoryCheckpointStore) SaveCheckpoint(ctx context.Context, name string, position Position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[name] = position
+	return nil
+}
+
+// ResetCheckpoint removes the checkpoint of the projection.
+func (s *InMemoryCheckpointStore) ResetCheckpoint(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.checkpoints, name)
+	return nil
+}
+
+// FileCheckpointStore keeps each checkpoint in a file in a directory, in the
+// format returned by Position.String.
+//
+// A checkpoint is written to a temporary file that is then renamed so that a
+// crash never leaves a partly written checkpoint.
+type FileCheckpointStore struct {
+	dir string
+}
+
+// NewFileCheckpointStore constructs a new FileCheckpointStore that keeps
+// checkpoints in the directory specified, creating it if necessary.
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create checkpoint directory %s. Error: %+v", dir, err)
+	}
+
+	return &FileCheckpointStore{
+		dir: dir,
+	}, nil
+}
+
+// GetCheckpoint returns the checkpoint of the projection.
+func (s *FileCheckpointStore) GetCheckpoint(ctx context.Context, name string) (Position, error) {
+	b, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return PositionStart, nil
+	}
+	if err != nil {
+		return PositionStart, fmt.Errorf("could not read checkpoint %s. Error: %+v", name, err)
+	}
+
+	position, err := ParsePosition(string(b))
+	if err != nil {
+		return PositionStart, fmt.Errorf("could not parse checkpoint %s. Error: %+v", name, err)
+	}
+	return position, nil
+}
+
+// SaveCheckpoint sets the checkpoint of the projection.
+func (s *FileCheckpointStore) SaveCheckpoint(ctx context.Context, name string, position Position) error {
+	tmp, err := os.CreateTemp(s.dir, ".checkpoint-*")
+	if err != nil {
+		return fmt.Errorf("could not save checkpoint %s. Error: %+v", name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(position.String())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(name))
+	}
+	if err != nil {
+		return fmt.Errorf("could not save checkpoint %s. Error: %+v", name, err)
+	}
+	return nil
+}
+
+// ResetCheckpoint removes the checkpoint of the projection.
+func (s *FileCheckpointStore) ResetCheckpoint(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not reset checkpoint %s. Error: %+v", name, err)
+	}
+	return nil
+}
+
+func (s *FileCheckpointStore) path(name string) string {
+	return filepath.Join(s.dir, url.PathEscape(name)+".checkpoint")
+}
+
+// DefaultCheckpointTable is the name of the table used by a
+// SQLCheckpointStore unless another is set.
+const DefaultCheckpointTable = "checkpoints"
+
+// SQLCheckpointStore keeps checkpoints in a table of a SQL database.
+//
+// The table has a name column that is the primary key and the commit and
+// prepare positions of the checkpoint. It can be created with CreateTable. The statements use $n placeholders and
+// an upsert with ON CONFLICT, which are supported by PostgreSQL and SQLite.
+type SQLCheckpointStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLCheckpointStore constructs a new SQLCheckpointStore that keeps
+// checkpoints in the DefaultCheckpointTable of the database.
+func NewSQLCheckpointStore(db *sql.DB) (*SQLCheckpointStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("nil database injected into SQLCheckpointStore")
+	}
+
+	return &SQLCheckpointStore{
+		db:    db,
+		table: DefaultCheckpointTable,
+	}, nil
+}
+
+// SetTable sets the name of the table that holds the checkpoints.
+func (s *SQLCheckpointStore) SetTable(table string) {
+	s.table = table
+}
+
+// CreateTable creates the table that holds the checkpoints if it does not
+// exist.
+func (s *SQLCheckpointStore) CreateTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (name VARCHAR(255) PRIMARY KEY, commit_position BIGINT NOT NULL, prepare_position BIGINT NOT NULL)`, s.table))
+	return err
+}
+
+// GetCheckpoint returns the checkpoint of the projection.
+func (s *SQLCheckpointStore) GetCheckpoint(ctx context.Context, name string) (Position, error) {
+	var position Position
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT commit_position, prepare_position FROM %s WHERE name = $1`, s.table), name).
+		Scan(&position.Commit, &position.Prepare)
+	if err == sql.ErrNoRows {
+		return PositionStart, nil
+	}
+	if err != nil {
+		return PositionStart, err
+	}
+	return position, nil
+}
+
+// SaveCheckpoint sets the checkpoint of the projection.
+func (s *SQLCheckpointStore) SaveCheckpoint(ctx context.Context, name string, position Position) error {
+	_, err := s.db.ExecContext(ctx, s.upsert(), name, position.Commit, position.Prepare)
+	return err
+}
+
+// SaveCheckpointTx sets the checkpoint of the projection in the transaction
+// so that it is committed atomically with the writes of the projection.
+func (s *SQLCheckpointStore) SaveCheckpointTx(ctx context.Context, tx *sql.Tx, name string, position Position) error {
+	_, err := tx.ExecContext(ctx, s.upsert(), name, position.Commit, position.Prepare)
+	return err
+}
+
+// ResetCheckpoint removes the checkpoint of the projection.
+func (s *SQLCheckpointStore) ResetCheckpoint(ctx context.Context, name string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE name = $1`, s.table), name)
+	return err
+}
+
+func (s *SQLCheckpointStore) upsert() string {
+	return fmt.Sprintf(`INSERT INTO %s (name, commit_position, prepare_position) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET commit_position = excluded.commit_position, prepare_position = excluded.prepare_position`, s.table)
+}
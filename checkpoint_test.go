@@ -0,0 +1,135 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+	_ "modernc.org/sqlite"
+)
+
+var _ = Suite(&CheckpointStoreSuite{})
+
+type CheckpointStoreSuite struct {
+	ctx context.Context
+}
+
+func (s *CheckpointStoreSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+}
+
+// openTestDB opens an SQLite database in a temporary directory.
+func openTestDB(c *C) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(c.MkDir(), "test.db"))
+	c.Assert(err, IsNil)
+	return db
+}
+
+// assertCheckpointStore checks the behaviour common to all checkpoint stores.
+func (s *CheckpointStoreSuite) assertCheckpointStore(c *C, store CheckpointStore) {
+	position, err := store.GetCheckpoint(s.ctx, "orders")
+	c.Assert(err, IsNil)
+	c.Assert(position, Equals, PositionStart)
+
+	c.Assert(store.SaveCheckpoint(s.ctx, "orders", LogPosition(3)), IsNil)
+	c.Assert(store.SaveCheckpoint(s.ctx, "orders", Position{Commit: 7, Prepare: 6}), IsNil)
+	c.Assert(store.SaveCheckpoint(s.ctx, "pallets", LogPosition(2)), IsNil)
+
+	position, err = store.GetCheckpoint(s.ctx, "orders")
+	c.Assert(err, IsNil)
+	c.Assert(position, Equals, Position{Commit: 7, Prepare: 6})
+
+	c.Assert(store.ResetCheckpoint(s.ctx, "orders"), IsNil)
+	c.Assert(store.ResetCheckpoint(s.ctx, "missing"), IsNil)
+
+	position, err = store.GetCheckpoint(s.ctx, "orders")
+	c.Assert(err, IsNil)
+	c.Assert(position, Equals, PositionStart)
+
+	position, err = store.GetCheckpoint(s.ctx, "pallets")
+	c.Assert(err, IsNil)
+	c.Assert(position, Equals, LogPosition(2))
+}
+
+func (s *CheckpointStoreSuite) TestInMemoryCheckpointStore(c *C) {
+	s.assertCheckpointStore(c, NewInMemoryCheckpointStore())
+}
+
+func (s *CheckpointStoreSuite) TestFileCheckpointStore(c *C) {
+	dir := filepath.Join(c.MkDir(), "checkpoints")
+	store, err := NewFileCheckpointStore(dir)
+	c.Assert(err, IsNil)
+
+	s.assertCheckpointStore(c, store)
+
+	_ = store.SaveCheckpoint(s.ctx, "orders/list", LogPosition(5))
+	reopened, _ := NewFileCheckpointStore(dir)
+	position, err := reopened.GetCheckpoint(s.ctx, "orders/list")
+	c.Assert(err, IsNil)
+	c.Assert(position, Equals, LogPosition(5))
+}
+
+func (s *CheckpointStoreSuite) TestFileCheckpointStoreReadsLogPositions(c *C) {
+	dir := c.MkDir()
+	store, _ := NewFileCheckpointStore(dir)
+	c.Assert(os.WriteFile(filepath.Join(dir, "orders.checkpoint"), []byte("5"), 0o644), IsNil)
+
+	position, err := store.GetCheckpoint(s.ctx, "orders")
+	c.Assert(err, IsNil)
+	c.Assert(position, Equals, LogPosition(5))
+}
+
+func (s *CheckpointStoreSuite) TestSQLCheckpointStore(c *C) {
+	db := openTestDB(c)
+	defer db.Close()
+	store, err := NewSQLCheckpointStore(db)
+	c.Assert(err, IsNil)
+	c.Assert(store.CreateTable(s.ctx), IsNil)
+
+	s.assertCheckpointStore(c, store)
+}
+
+func (s *CheckpointStoreSuite) TestSQLCheckpointStoreSavesInTransaction(c *C) {
+	db := openTestDB(c)
+	defer db.Close()
+	store, _ := NewSQLCheckpointStore(db)
+	store.SetTable("projection_checkpoints")
+	c.Assert(store.CreateTable(s.ctx), IsNil)
+
+	tx, err := db.BeginTx(s.ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(store.SaveCheckpointTx(s.ctx, tx, "orders", LogPosition(4)), IsNil)
+	c.Assert(tx.Rollback(), IsNil)
+
+	position, _ := store.GetCheckpoint(s.ctx, "orders")
+	c.Assert(position, Equals, PositionStart)
+
+	tx, _ = db.BeginTx(s.ctx, nil)
+	c.Assert(store.SaveCheckpointTx(s.ctx, tx, "orders", LogPosition(4)), IsNil)
+	c.Assert(tx.Commit(), IsNil)
+
+	position, _ = store.GetCheckpoint(s.ctx, "orders")
+	c.Assert(position, Equals, LogPosition(4))
+}
+
+func (s *CheckpointStoreSuite) TestNewSQLCheckpointStoreRequiresDB(c *C) {
+	store, err := NewSQLCheckpointStore(nil)
+	c.Assert(store, IsNil)
+	c.Assert(err, NotNil)
+}
+
+func (s *CheckpointStoreSuite) TestEventPosition(c *C) {
+	_, ok := EventPosition(s.ctx)
+	c.Assert(ok, Equals, false)
+
+	position, ok := EventPosition(withEventPosition(s.ctx, LogPosition(12)))
+	c.Assert(ok, Equals, true)
+	c.Assert(position, Equals, LogPosition(12))
+}
@@ -55,7 +55,7 @@ func (s *CommandSuite) TestShouldGetTypeOfCommand(c *C) {
 
 	typeString := cm.CommandType()
 
-	c.Assert(typeString, Equals, "SomeCommand")
+	c.Assert(typeString, Equals, "eventsourcing.SomeCommand")
 }
 
 func (s *CommandSuite) TestShouldGetHeaders(c *C) {
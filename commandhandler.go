@@ -5,14 +5,45 @@
 
 package eventsourcing
 
+import (
+	"context"
+)
+
 // CommandHandler is the interface that all command handlers should implement.
 type CommandHandler interface {
 	Handle(CommandMessage) error
 }
 
-// CommandHandlerBase is an embedded type that supports chaining of command handlers
-// through provision of a next field that will hold a reference to the next handler
-// in the chain.
-// type CommandHandlerBase struct {
-// 	next CommandHandler
-// }
+// ContextCommandHandler is the interface that command handlers implement to
+// receive the context of the dispatch.
+//
+// The context carries cancellation, deadlines and request scoped values such
+// as tenant or trace IDs and should be passed on to the repository.
+type ContextCommandHandler interface {
+	HandleContext(context.Context, CommandMessage) error
+}
+
+// CommandHandlerFunc is an adapter to allow the use of ordinary functions as
+// command handlers.
+//
+// A CommandHandlerFunc implements both CommandHandler and ContextCommandHandler.
+type CommandHandlerFunc func(context.Context, CommandMessage) error
+
+// Handle calls f with a background context.
+func (f CommandHandlerFunc) Handle(command CommandMessage) error {
+	return f(context.Background(), command)
+}
+
+// HandleContext calls f.
+func (f CommandHandlerFunc) HandleContext(ctx context.Context, command CommandMessage) error {
+	return f(ctx, command)
+}
+
+// handleCommand passes the context to the handler if it is a
+// ContextCommandHandler, otherwise the context is dropped.
+func handleCommand(ctx context.Context, handler CommandHandler, command CommandMessage) error {
+	if h, ok := handler.(ContextCommandHandler); ok {
+		return h.HandleContext(ctx, command)
+	}
+	return handler.Handle(command)
+}
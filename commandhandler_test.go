@@ -6,6 +6,8 @@
 package eventsourcing
 
 import (
+	"context"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -35,3 +37,47 @@ func (m *MockRepository) Save(aggregate AggregateRoot) error {
 	m.aggregates[aggregate.AggregateID()] = aggregate
 	return nil
 }
+
+type TestContextCommandHandler struct {
+	ctx     context.Context
+	command CommandMessage
+}
+
+func (t *TestContextCommandHandler) Handle(command CommandMessage) error {
+	return t.HandleContext(context.Background(), command)
+}
+
+func (t *TestContextCommandHandler) HandleContext(ctx context.Context, command CommandMessage) error {
+	t.ctx = ctx
+	t.command = command
+	return nil
+}
+
+type ctxKey string
+
+func (s *CommandHandlerSuite) TestCommandHandlerFuncHandleContext(c *C) {
+	var got context.Context
+	handler := CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		got = ctx
+		return nil
+	})
+	ctx := context.WithValue(context.Background(), ctxKey("tenant"), "acme")
+
+	err := handler.HandleContext(ctx, NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(err, IsNil)
+	c.Assert(got.Value(ctxKey("tenant")), Equals, "acme")
+}
+
+func (s *CommandHandlerSuite) TestCommandHandlerFuncHandle(c *C) {
+	var got context.Context
+	handler := CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		got = ctx
+		return nil
+	})
+
+	err := handler.Handle(NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(err, IsNil)
+	c.Assert(got, NotNil)
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RetryPolicy determines how many times an event bus calls an event handler
+// that fails to handle an event and how long it waits between calls.
+//
+// The zero value calls the handler once.
+type RetryPolicy struct {
+	// Attempts is the number of times the handler is called. Values below 1
+	// are treated as 1.
+	Attempts int
+
+	// Backoff is the wait before the first retry.
+	Backoff time.Duration
+
+	// Multiplier is applied to the backoff after each retry. Values below 1
+	// are treated as 1.
+	Multiplier float64
+
+	// MaxBackoff, if set, is the longest wait between retries.
+	MaxBackoff time.Duration
+}
+
+// backoff returns the wait before the retry specified, starting at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := float64(p.Backoff)
+	for i := 1; i < retry && p.Multiplier > 1; i++ {
+		backoff *= p.Multiplier
+	}
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	return time.Duration(backoff)
+}
+
+// DeadLetter records an event that an event handler failed to handle.
+//
+// A dead letter put by an OutboxRelay has no Handler, and for an event that
+// could not be decoded no Event, only the Recorded event as it was persisted.
+type DeadLetter struct {
+	Event       EventMessage
+	Recorded    *RecordedEvent
+	Handler     EventHandler
+	HandlerName string
+	Err         error
+	Attempts    int
+	Failed      time.Time
+}
+
+// DeadLetterSink is the interface that a store of dead letters must implement.
+type DeadLetterSink interface {
+	PutDeadLetter(context.Context, DeadLetter) error
+}
+
+// InMemoryDeadLetterSink keeps dead letters in memory so that they can be
+// inspected and replayed.
+type InMemoryDeadLetterSink struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+// NewInMemoryDeadLetterSink constructs a new InMemoryDeadLetterSink
+func NewInMemoryDeadLetterSink() *InMemoryDeadLetterSink {
+	return &InMemoryDeadLetterSink{}
+}
+
+// PutDeadLetter adds the dead letter to the sink.
+func (s *InMemoryDeadLetterSink) PutDeadLetter(ctx context.Context, letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+// DeadLetters returns the dead letters in the order they were added.
+func (s *InMemoryDeadLetterSink) DeadLetters() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]DeadLetter(nil), s.letters...)
+}
+
+// Replay calls the handler of each dead letter with its event again.
+//
+// Dead letters that are handled are removed from the sink. Those that fail
+// again stay in the sink with the new error and attempt count. Replay stops
+// when the context is done and returns the context error.
+func (s *InMemoryDeadLetterSink) Replay(ctx context.Context) error {
+	s.mu.Lock()
+	letters := s.letters
+	s.letters = nil
+	s.mu.Unlock()
+
+	var failed []DeadLetter
+	for i, letter := range letters {
+		if err := ctx.Err(); err != nil {
+			failed = append(failed, letters[i:]...)
+			s.requeue(failed)
+			return err
+		}
+		if letter.Handler == nil {
+			failed = append(failed, letter)
+			continue
+		}
+
+		if err := handleEvent(ctx, letter.Handler, letter.Event); err != nil {
+			letter.Err = err
+			letter.Attempts++
+			letter.Failed = time.Now()
+			failed = append(failed, letter)
+		}
+	}
+
+	s.requeue(failed)
+	return nil
+}
+
+// requeue puts dead letters that could not be replayed back in front of those
+// added during the replay.
+func (s *InMemoryDeadLetterSink) requeue(letters []DeadLetter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters = append(letters, s.letters...)
+}
+
+// deliverEvent calls handle with the handler and event, retrying as the
+// policy specifies. If the handler still fails the event is put in the sink,
+// if there is one, and the error of the last attempt is returned.
+func deliverEvent(ctx context.Context, handle func(context.Context, EventHandler, EventMessage) error,
+	handler EventHandler, event EventMessage, policy RetryPolicy, sink DeadLetterSink) error {
+
+	attempts := policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	attempt := 1
+retry:
+	for ; ; attempt++ {
+		if err = handle(ctx, handler, event); err == nil {
+			return nil
+		}
+		if attempt >= attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			break retry
+		case <-time.After(policy.backoff(attempt)):
+		}
+	}
+
+	if sink != nil {
+		_ = sink.PutDeadLetter(ctx, DeadLetter{
+			Event:       event,
+			Handler:     handler,
+			HandlerName: handlerName(handler),
+			Err:         err,
+			Attempts:    attempt,
+			Failed:      time.Now(),
+		})
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&DeadLetterSuite{})
+
+type DeadLetterSuite struct {
+	ctx  context.Context
+	sink *InMemoryDeadLetterSink
+}
+
+func (s *DeadLetterSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+	s.sink = NewInMemoryDeadLetterSink()
+}
+
+// FailingEventHandler fails to handle the first Failures events it receives.
+type FailingEventHandler struct {
+	Failures int
+	calls    int
+}
+
+func (h *FailingEventHandler) Handle(event EventMessage) {}
+
+func (h *FailingEventHandler) HandleEvent(ctx context.Context, event EventMessage) error {
+	h.calls++
+	if h.calls <= h.Failures {
+		return fmt.Errorf("failure %d", h.calls)
+	}
+	return nil
+}
+
+func (h *FailingEventHandler) HandlerName() string {
+	return "failing"
+}
+
+func (s *DeadLetterSuite) TestRetryPolicyBackoff(c *C) {
+	policy := RetryPolicy{Backoff: 10 * time.Millisecond, Multiplier: 2, MaxBackoff: 50 * time.Millisecond}
+
+	c.Assert(policy.backoff(1), Equals, 10*time.Millisecond)
+	c.Assert(policy.backoff(2), Equals, 20*time.Millisecond)
+	c.Assert(policy.backoff(3), Equals, 40*time.Millisecond)
+	c.Assert(policy.backoff(4), Equals, 50*time.Millisecond)
+	c.Assert(RetryPolicy{Backoff: time.Second}.backoff(3), Equals, time.Second)
+}
+
+func (s *DeadLetterSuite) TestDeliverEventRetriesUntilHandled(c *C) {
+	h := &FailingEventHandler{Failures: 2}
+
+	err := deliverEvent(s.ctx, handleEvent, h, NewTestEventMessage(NewUUID()), RetryPolicy{Attempts: 3}, s.sink)
+
+	c.Assert(err, IsNil)
+	c.Assert(h.calls, Equals, 3)
+	c.Assert(s.sink.DeadLetters(), HasLen, 0)
+}
+
+func (s *DeadLetterSuite) TestDeliverEventPutsDeadLetterAfterAllAttempts(c *C) {
+	h := &FailingEventHandler{Failures: 5}
+	ev := NewTestEventMessage(NewUUID())
+
+	err := deliverEvent(s.ctx, handleEvent, h, ev, RetryPolicy{Attempts: 2}, s.sink)
+
+	c.Assert(err, ErrorMatches, "failure 2")
+	letters := s.sink.DeadLetters()
+	c.Assert(letters, HasLen, 1)
+	c.Assert(letters[0].Event, Equals, ev)
+	c.Assert(letters[0].Handler, Equals, h)
+	c.Assert(letters[0].HandlerName, Equals, "failing")
+	c.Assert(letters[0].Err, ErrorMatches, "failure 2")
+	c.Assert(letters[0].Attempts, Equals, 2)
+}
+
+func (s *DeadLetterSuite) TestDeliverEventStopsRetryingWhenContextIsDone(c *C) {
+	h := &FailingEventHandler{Failures: 5}
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+
+	err := deliverEvent(ctx, handleEvent, h, NewTestEventMessage(NewUUID()), RetryPolicy{Attempts: 5, Backoff: time.Hour}, s.sink)
+
+	c.Assert(err, ErrorMatches, "failure 1")
+	c.Assert(s.sink.DeadLetters()[0].Attempts, Equals, 1)
+}
+
+func (s *DeadLetterSuite) TestReplayRemovesHandledDeadLetters(c *C) {
+	recovered := &FailingEventHandler{Failures: 1}
+	broken := &FailingEventHandler{Failures: 5}
+	_ = deliverEvent(s.ctx, handleEvent, recovered, NewTestEventMessage(NewUUID()), RetryPolicy{}, s.sink)
+	_ = deliverEvent(s.ctx, handleEvent, broken, NewTestEventMessage(NewUUID()), RetryPolicy{}, s.sink)
+
+	c.Assert(s.sink.Replay(s.ctx), IsNil)
+
+	letters := s.sink.DeadLetters()
+	c.Assert(letters, HasLen, 1)
+	c.Assert(letters[0].Handler, Equals, broken)
+	c.Assert(letters[0].Attempts, Equals, 2)
+	c.Assert(letters[0].Err, ErrorMatches, "failure 2")
+}
+
+func (s *DeadLetterSuite) TestReplayKeepsDeadLettersWhenContextIsDone(c *C) {
+	_ = deliverEvent(s.ctx, handleEvent, &FailingEventHandler{Failures: 1}, NewTestEventMessage(NewUUID()), RetryPolicy{}, s.sink)
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+
+	c.Assert(s.sink.Replay(ctx), Equals, context.Canceled)
+	c.Assert(s.sink.DeadLetters(), HasLen, 1)
+}
+
+func (s *DeadLetterSuite) TestHandlerName(c *C) {
+	c.Assert(handlerName(&FailingEventHandler{}), Equals, "failing")
+	c.Assert(handlerName(&SyncEventHandler{}), Equals, "*eventsourcing.SyncEventHandler")
+}
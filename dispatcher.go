@@ -6,6 +6,7 @@
 package eventsourcing
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -27,32 +28,102 @@ type Dispatcher interface {
 	RegisterHandler(CommandHandler, ...interface{}) error
 }
 
+// ContextDispatcher is the interface that should be implemented by a command
+// dispatcher that passes a context on to command handlers.
+//
+// Command handlers that implement ContextCommandHandler receive the context,
+// other command handlers are called without it.
+type ContextDispatcher interface {
+	Dispatcher
+	DispatchContext(context.Context, CommandMessage) error
+}
+
+// dispatchCommand passes the context to the dispatcher if it is a
+// ContextDispatcher, otherwise the context is dropped.
+func dispatchCommand(ctx context.Context, dispatcher Dispatcher, command CommandMessage) error {
+	if d, ok := dispatcher.(ContextDispatcher); ok {
+		return d.DispatchContext(ctx, command)
+	}
+	return dispatcher.Dispatch(command)
+}
+
 //InMemoryDispatcher provides a lightweight and performant in process dispatcher
+//
+//Middleware can be added for all commands with Use and for a command type with
+//UseFor. Middleware added for all commands runs before middleware added for a
+//command type.
 type InMemoryDispatcher struct {
-	handlers map[string]CommandHandler
+	handlers          map[string]CommandHandler
+	middleware        []Middleware
+	commandMiddleware map[string][]Middleware
+	types             *TypeRegistry
 }
 
 //NewInMemoryDispatcher constructs a new in memory dispatcher
 func NewInMemoryDispatcher() *InMemoryDispatcher {
 	b := &InMemoryDispatcher{
-		handlers: make(map[string]CommandHandler),
+		handlers:          make(map[string]CommandHandler),
+		commandMiddleware: make(map[string][]Middleware),
+		types:             DefaultTypeRegistry,
 	}
 	return b
 }
 
+//SetTypeRegistry sets the registry used to name command types. The
+//DefaultTypeRegistry is used by default.
+func (b *InMemoryDispatcher) SetTypeRegistry(types *TypeRegistry) {
+	b.types = types
+}
+
+//Use adds middleware that decorates the handlers of all commands.
+func (b *InMemoryDispatcher) Use(middleware ...Middleware) {
+	b.middleware = append(b.middleware, middleware...)
+}
+
+//UseFor adds middleware that decorates the handler of the command type specified.
+//
+//An error is returned if the type of the command can not be named.
+func (b *InMemoryDispatcher) UseFor(command interface{}, middleware ...Middleware) error {
+	typeName, err := b.types.Name(command)
+	if err != nil {
+		return err
+	}
+	b.commandMiddleware[typeName] = append(b.commandMiddleware[typeName], middleware...)
+	return nil
+}
+
 //Dispatch passes the CommandMessage on to all registered command handlers.
 func (b *InMemoryDispatcher) Dispatch(command CommandMessage) error {
-	if handler, ok := b.handlers[command.CommandType()]; ok {
-		return handler.Handle(command)
+	return b.DispatchContext(context.Background(), command)
+}
+
+//DispatchContext passes the CommandMessage and the context on to the registered
+//command handler.
+//
+//An error is returned if the type of the command can not be named.
+func (b *InMemoryDispatcher) DispatchContext(ctx context.Context, command CommandMessage) error {
+	typeName, err := b.types.Name(command.Command())
+	if err != nil {
+		return err
+	}
+	if handler, ok := b.handlers[typeName]; ok {
+		middleware := append(append([]Middleware{}, b.middleware...), b.commandMiddleware[typeName]...)
+		return handleCommand(ctx, Chain(handler, middleware...), command)
 	}
-	return fmt.Errorf("the command bus does not have a handler for commands of type: %s", command.CommandType())
+	return fmt.Errorf("the command bus does not have a handler for commands of type: %s", typeName)
 }
 
 //RegisterHandler registers a command handler for the command types specified by the
 //variadic commands parameter.
+//
+//An error is returned if a command type can not be named or is already
+//registered.
 func (b *InMemoryDispatcher) RegisterHandler(handler CommandHandler, commands ...interface{}) error {
 	for _, command := range commands {
-		typeName := typeOf(command)
+		typeName, err := b.types.Name(command)
+		if err != nil {
+			return err
+		}
 		if _, ok := b.handlers[typeName]; ok {
 			return fmt.Errorf("duplicate command handler registration with command bus for command of type: %s", typeName)
 		}
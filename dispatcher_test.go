@@ -6,6 +6,7 @@
 package eventsourcing
 
 import (
+	"context"
 	"fmt"
 
 	. "gopkg.in/check.v1"
@@ -60,3 +61,26 @@ func (s *InternalCommandBusSuite) TestCanRegisterMultipleCommandsForTheSameHandl
 	c.Assert(err, IsNil)
 
 }
+
+func (s *InternalCommandBusSuite) TestDispatchContextPassesContextToHandler(c *C) {
+	handler := &TestContextCommandHandler{}
+	_ = s.bus.RegisterHandler(handler, &SomeCommand{})
+	ctx := context.WithValue(context.Background(), ctxKey("tenant"), "acme")
+	cmd := NewSomeCommandMessage(NewUUID())
+
+	err := s.bus.DispatchContext(ctx, cmd)
+
+	c.Assert(err, IsNil)
+	c.Assert(handler.command, Equals, cmd)
+	c.Assert(handler.ctx.Value(ctxKey("tenant")), Equals, "acme")
+}
+
+func (s *InternalCommandBusSuite) TestDispatchContextToHandlerWithoutContext(c *C) {
+	_ = s.bus.RegisterHandler(s.stubhandler, &SomeCommand{})
+	cmd := NewSomeCommandMessage(NewUUID())
+
+	err := s.bus.DispatchContext(context.Background(), cmd)
+
+	c.Assert(err, IsNil)
+	c.Assert(s.stubhandler.command, Equals, cmd)
+}
@@ -1,6 +1,9 @@
 package eventsourcing
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // ErrCommandExecution is the error returned in response to a failed command.
 type ErrCommandExecution struct {
@@ -18,7 +21,7 @@ func (e *ErrCommandExecution) Error() string {
 // the expected version.
 type ErrConcurrencyViolation struct {
 	Aggregate       AggregateRoot
-	ExpectedVersion *int
+	ExpectedVersion *int64
 	StreamName      string
 }
 
@@ -47,7 +50,11 @@ func (e *ErrUnexpected) Error() string {
 }
 
 // ErrRepositoryUnavailable is returned when the eventstore is temporarily unavailable
-type ErrRepositoryUnavailable struct{}
+//
+// The original error, if any, is available for inspection in the Err field.
+type ErrRepositoryUnavailable struct {
+	Err error
+}
 
 func (e *ErrRepositoryUnavailable) Error() string {
 	return "The repository is temporarily unavailable."
@@ -64,3 +71,206 @@ func (e *ErrAggregateNotFound) Error() string {
 		e.AggregateType,
 		e.AggregateID)
 }
+
+// ErrWrongExpectedVersion is returned by an EventStore when events are appended
+// to a stream and the version of the stream does not match the expected version.
+type ErrWrongExpectedVersion struct {
+	StreamName      string
+	ExpectedVersion int64
+	ActualVersion   int64
+}
+
+func (e *ErrWrongExpectedVersion) Error() string {
+	return fmt.Sprintf("Wrong expected version. StreamName: %s ExpectedVersion: %d ActualVersion: %d",
+		e.StreamName,
+		e.ExpectedVersion,
+		e.ActualVersion)
+}
+
+// ErrStreamNotFound is returned by an EventStore when a stream that does not
+// exist is read.
+type ErrStreamNotFound struct {
+	StreamName string
+}
+
+func (e *ErrStreamNotFound) Error() string {
+	return fmt.Sprintf("Stream not found. StreamName: %s", e.StreamName)
+}
+
+// ErrQueueFull is returned by an event bus when the queue of a handler for the
+// event is full and the bus is configured to return an error.
+type ErrQueueFull struct {
+	EventType string
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("Event handler queue is full. EventType: %s", e.EventType)
+}
+
+// ErrEventBusShutdown is returned when an event is published to an event bus
+// that has been shut down.
+type ErrEventBusShutdown struct{}
+
+func (e *ErrEventBusShutdown) Error() string {
+	return "The event bus has been shut down."
+}
+
+// ErrPartialPublish is returned by an event bus when an event could not be
+// queued for all of its handlers but was queued for the handlers named.
+type ErrPartialPublish struct {
+	EventType string
+	Handlers  []string
+	Err       error
+}
+
+func (e *ErrPartialPublish) Error() string {
+	return fmt.Sprintf("Event partially published. EventType: %s Queued for: %s Error: %s",
+		e.EventType, strings.Join(e.Handlers, ", "), e.Err)
+}
+
+// Unwrap returns the error that stopped the event being queued.
+func (e *ErrPartialPublish) Unwrap() error {
+	return e.Err
+}
+
+// HandlerFailure records the error returned by an event handler.
+type HandlerFailure struct {
+	HandlerName string
+	Err         error
+}
+
+// ErrEventHandlerFailed is returned by an event bus when one or more event
+// handlers fail to handle an event. Handled names the handlers that handled
+// it.
+type ErrEventHandlerFailed struct {
+	Event    EventMessage
+	Failures []HandlerFailure
+	Handled  []string
+}
+
+func (e *ErrEventHandlerFailed) Error() string {
+	msg := fmt.Sprintf("Event handler failed. EventType: %s", e.Event.EventType())
+	for _, f := range e.Failures {
+		msg += fmt.Sprintf(" %s: %s;", f.HandlerName, f.Err)
+	}
+	return strings.TrimSuffix(msg, ";")
+}
+
+// Unwrap returns the errors of the handlers that failed.
+func (e *ErrEventHandlerFailed) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// ErrInvalidType is returned when a value can not be named by a TypeRegistry.
+type ErrInvalidType struct {
+	Type   string
+	Reason string
+}
+
+func (e *ErrInvalidType) Error() string {
+	return fmt.Sprintf("Invalid type. Type: %s Reason: %s", e.Type, e.Reason)
+}
+
+// ErrTypeNameConflict is returned by a TypeRegistry when a name is taken by
+// another type.
+type ErrTypeNameConflict struct {
+	Name       string
+	Registered string
+	Type       string
+}
+
+func (e *ErrTypeNameConflict) Error() string {
+	return fmt.Sprintf("Type name conflict. Name: %s is registered for %s and can not be used for %s",
+		e.Name, e.Registered, e.Type)
+}
+
+// ErrUnknownContentType is returned when there is no Serializer for the
+// content type of a persisted event or snapshot.
+type ErrUnknownContentType struct {
+	ContentType string
+}
+
+func (e *ErrUnknownContentType) Error() string {
+	return fmt.Sprintf("Unknown content type. There is no serializer for content type: %s", e.ContentType)
+}
+
+// ErrCorruptSegment is returned when a record in a segment file of a
+// FileEventStore fails its checksum or can not be decoded.
+type ErrCorruptSegment struct {
+	Segment string
+	Offset  int64
+	Reason  string
+}
+
+func (e *ErrCorruptSegment) Error() string {
+	return fmt.Sprintf("Corrupt segment. Segment: %s Offset: %d Reason: %s", e.Segment, e.Offset, e.Reason)
+}
+
+// ErrRecordTooLarge is returned by a FileEventStore when the events of an
+// append are larger than the largest record a segment file can hold.
+type ErrRecordTooLarge struct {
+	StreamName string
+	Size       int64
+	MaxSize    int64
+}
+
+func (e *ErrRecordTooLarge) Error() string {
+	return fmt.Sprintf("Record too large. StreamName: %s Size: %d MaxSize: %d", e.StreamName, e.Size, e.MaxSize)
+}
+
+// ErrNoApplier is returned when an event is raised on, or loaded into, an
+// aggregate that has no applier registered for the type of the event.
+type ErrNoApplier struct {
+	AggregateID string
+	EventType   string
+}
+
+func (e *ErrNoApplier) Error() string {
+	return fmt.Sprintf("No applier. AggregateID: %s has no applier registered for event type: %s", e.AggregateID, e.EventType)
+}
+
+// ErrUndeliverableEvent is reported by an OutboxRelay when an event can not be
+// decoded, or fails to be published after the maximum number of attempts, and
+// is skipped so that the events after it can be published.
+type ErrUndeliverableEvent struct {
+	EventID   string
+	EventType string
+	Attempts  int
+	Err       error
+}
+
+func (e *ErrUndeliverableEvent) Error() string {
+	return fmt.Sprintf("Undeliverable event. EventID: %s EventType: %s Attempts: %d Error: %s",
+		e.EventID, e.EventType, e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *ErrUndeliverableEvent) Unwrap() error {
+	return e.Err
+}
+
+// ErrCommandInProgress is returned by the DeduplicationMiddleware when a
+// command is dispatched while a command with the same CommandID is being
+// handled.
+type ErrCommandInProgress struct {
+	CommandID string
+}
+
+func (e *ErrCommandInProgress) Error() string {
+	return fmt.Sprintf("Command in progress. CommandID: %s is already being handled", e.CommandID)
+}
+
+// ErrNoEventIdentity is returned by a ProcessManagerHandler when an event has
+// neither an EventID header nor a version to identify it by.
+type ErrNoEventIdentity struct {
+	AggregateID string
+	EventType   string
+}
+
+func (e *ErrNoEventIdentity) Error() string {
+	return fmt.Sprintf("No event identity. AggregateID: %s EventType: %s has no EventID header or version", e.AggregateID, e.EventType)
+}
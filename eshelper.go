@@ -15,9 +15,6 @@
 package eventsourcing
 
 import (
-	"fmt"
-	"reflect"
-
 	"github.com/gofrs/uuid"
 )
 
@@ -26,13 +23,12 @@ import (
 // This is used so commonly throughout the code that it is better to
 // have this convenience function and also allows for changing the scheme
 // used for the type name more easily if desired.
+//
+// The name is taken from the DefaultTypeRegistry. An empty string is returned
+// if the type can not be named.
 func typeOf(i interface{}) string {
-	t := reflect.TypeOf(i)
-	if t == nil {
-		panic(fmt.Sprintf("Type not found for: %T\n", i))
-	}
-
-	return t.Elem().Name()
+	name, _ := DefaultTypeRegistry.Name(i)
+	return name
 }
 
 // NewUUID returns a new v4 uuid as a string
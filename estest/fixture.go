@@ -0,0 +1,409 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package estest provides fixtures for testing aggregates, command handlers
+// and projections.
+package estest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fabiobentoluiz/eventsourcing"
+)
+
+// T is the part of *testing.T that the fixtures use. A *check.C from gocheck
+// can be used as well.
+type T interface {
+	Fatalf(format string, args ...interface{})
+}
+
+// helper marks the caller as a test helper if the T supports it.
+func helper(t T) {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+}
+
+// Fixture tests the command handlers of an aggregate in the Given/When/Then
+// style.
+//
+// The handlers are registered with a real InMemoryDispatcher and load and save
+// aggregates with a Repository over an InMemoryEventStore. Given saves the
+// events of an aggregate as its history, When dispatches a command and Then
+// checks the events that were saved as a result, or ThenError the error that
+// was returned.
+//
+//	estest.NewFixture(t, NewProductionOrder, register).
+//		Given(id, &ProductionOrderCreated{ID: id}).
+//		When(eventsourcing.NewCommandMessage(id, &StartProductionOrder{})).
+//		Then(&ProductionOrderStarted{ID: id})
+type Fixture[A eventsourcing.AggregateRoot] struct {
+	t            T
+	ctx          context.Context
+	store        *eventsourcing.InMemoryEventStore
+	bus          *recordingEventBus
+	eventFactory *eventsourcing.DelegateEventFactory
+	repository   *eventsourcing.Repository[A]
+	dispatcher   *eventsourcing.InMemoryDispatcher
+	newAggregate func(id string) A
+	dispatched   bool
+	err          error
+}
+
+// NewFixture constructs a new Fixture for the aggregates returned by
+// newAggregate. register is called to register the command handlers under
+// test with the dispatcher, using the repository of the fixture.
+func NewFixture[A eventsourcing.AggregateRoot](t T, newAggregate func(id string) A,
+	register func(eventsourcing.Dispatcher, *eventsourcing.Repository[A]) error) *Fixture[A] {
+	helper(t)
+
+	f := &Fixture[A]{
+		t:            t,
+		ctx:          context.Background(),
+		store:        eventsourcing.NewInMemoryEventStore(),
+		bus:          &recordingEventBus{},
+		eventFactory: eventsourcing.NewDelegateEventFactory(),
+		dispatcher:   eventsourcing.NewInMemoryDispatcher(),
+		newAggregate: newAggregate,
+	}
+
+	common, err := eventsourcing.NewCommonDomainRepository(f.store, f.bus)
+	if err != nil {
+		t.Fatalf("could not construct the repository: %v", err)
+	}
+	common.SetEventFactory(f.eventFactory)
+
+	f.repository, err = eventsourcing.NewRepository(common, newAggregate)
+	if err != nil {
+		t.Fatalf("could not construct the repository: %v", err)
+	}
+	if err := register(f.dispatcher, f.repository); err != nil {
+		t.Fatalf("could not register the command handlers: %v", err)
+	}
+	return f
+}
+
+// Repository returns the repository the command handlers are registered
+// with.
+func (f *Fixture[A]) Repository() *eventsourcing.Repository[A] {
+	return f.repository
+}
+
+// Given saves the events as the history of the aggregate with the ID
+// specified. The events are saved as they are, without being applied, and are
+// not checked by Then.
+func (f *Fixture[A]) Given(id string, events ...interface{}) *Fixture[A] {
+	helper(f.t)
+
+	aggregate := f.newAggregate(id)
+	for _, event := range events {
+		f.register(event)
+		aggregate.TrackChange(eventsourcing.NewEventMessage(id, event, nil))
+	}
+
+	err := f.repository.SaveContext(f.ctx, aggregate, eventsourcing.Int64(eventsourcing.ExpectedVersionAny))
+	if err != nil {
+		f.t.Fatalf("could not save the given events: %v", err)
+	}
+	return f
+}
+
+// When dispatches the command to the command handlers.
+func (f *Fixture[A]) When(command eventsourcing.CommandMessage) *Fixture[A] {
+	f.bus.reset()
+	f.err = f.dispatcher.DispatchContext(f.ctx, command)
+	f.dispatched = true
+
+	// Register the saved events too so that later commands can load them.
+	for _, event := range f.Events() {
+		f.register(event)
+	}
+	return f
+}
+
+// Then checks that the command succeeded and that the events saved as a result
+// are equal to the events specified, in order. Then with no events checks
+// that no events were saved.
+func (f *Fixture[A]) Then(events ...interface{}) {
+	helper(f.t)
+	if !f.checkDispatched() {
+		return
+	}
+
+	if f.err != nil {
+		f.t.Fatalf("expected %d events but the command failed: %v", len(events), f.err)
+		return
+	}
+	if diff := DiffEvents(events, f.Events()); diff != "" {
+		f.t.Fatalf("events do not match\n%s", diff)
+	}
+}
+
+// ThenError checks that the command failed with the error specified. The
+// error matches if errors.Is reports it does, or if it is of the same type and
+// has the same message.
+func (f *Fixture[A]) ThenError(expected error) {
+	helper(f.t)
+	if !f.checkDispatched() {
+		return
+	}
+
+	if f.err == nil {
+		f.t.Fatalf("expected error %q but the command succeeded with events:\n%s", expected, formatEvents(f.Events()))
+		return
+	}
+	if !sameError(expected, f.err) {
+		f.t.Fatalf("errors do not match\nexpected: %T %q\nactual:   %T %q", expected, expected, f.err, f.err)
+	}
+}
+
+// ThenErrorMatches checks that the command failed with an error whose message
+// matches the regular expression in full.
+func (f *Fixture[A]) ThenErrorMatches(pattern string) {
+	helper(f.t)
+	if !f.checkDispatched() {
+		return
+	}
+
+	if f.err == nil {
+		f.t.Fatalf("expected an error matching %q but the command succeeded with events:\n%s", pattern, formatEvents(f.Events()))
+		return
+	}
+	matchError(f.t, pattern, f.err)
+}
+
+// Events returns the events saved as a result of the command.
+func (f *Fixture[A]) Events() []interface{} {
+	return f.bus.events()
+}
+
+// Err returns the error returned by the command handler.
+func (f *Fixture[A]) Err() error {
+	return f.err
+}
+
+func (f *Fixture[A]) checkDispatched() bool {
+	helper(f.t)
+	if !f.dispatched {
+		f.t.Fatalf("no command was dispatched, call When before Then")
+	}
+	return f.dispatched
+}
+
+// register registers the type of the event with the event factory so that the
+// aggregate can be loaded.
+func (f *Fixture[A]) register(event interface{}) {
+	name, err := eventsourcing.DefaultTypeRegistry.Name(event)
+	if err != nil {
+		f.t.Fatalf("invalid given event %T: %v", event, err)
+		return
+	}
+	if f.eventFactory.GetEvent(name) != nil {
+		return
+	}
+
+	t := reflect.TypeOf(event)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	_ = f.eventFactory.RegisterDelegate(event, func() interface{} {
+		return reflect.New(t).Interface()
+	})
+}
+
+// sameError reports whether errors.Is reports that actual is expected, or
+// whether they are of the same type and have the same message.
+func sameError(expected error, actual error) bool {
+	if errors.Is(actual, expected) {
+		return true
+	}
+	return reflect.TypeOf(actual) == reflect.TypeOf(expected) && actual.Error() == expected.Error()
+}
+
+// matchError checks that the message of err matches the regular expression in
+// full.
+func matchError(t T, pattern string, err error) {
+	helper(t)
+	matched, perr := regexp.MatchString("^(?:"+pattern+")$", err.Error())
+	if perr != nil {
+		t.Fatalf("invalid pattern %q: %v", pattern, perr)
+		return
+	}
+	if !matched {
+		t.Fatalf("error does not match\npattern: %q\nactual:  %q", pattern, err)
+	}
+}
+
+// recordingEventBus is the event bus of a Fixture. It records the events
+// published by the repository.
+type recordingEventBus struct {
+	mu        sync.Mutex
+	published []eventsourcing.EventMessage
+}
+
+// PublishEvent records the event.
+func (b *recordingEventBus) PublishEvent(event eventsourcing.EventMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, event)
+}
+
+// AddHandler does nothing as the events are only recorded.
+func (b *recordingEventBus) AddHandler(eventsourcing.EventHandler, ...interface{}) {}
+
+func (b *recordingEventBus) events() []interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make([]interface{}, len(b.published))
+	for i, em := range b.published {
+		events[i] = em.Event()
+	}
+	return events
+}
+
+func (b *recordingEventBus) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = nil
+}
+
+// DiffEvents returns a readable description of the differences between the
+// expected and actual events, or "" if they are equal.
+//
+// Events are compared with reflect.DeepEqual after pointers are followed, so
+// an expected *E matches an actual E with the same fields.
+func DiffEvents(expected []interface{}, actual []interface{}) string {
+	var diff strings.Builder
+	n := len(expected)
+	if len(actual) > n {
+		n = len(actual)
+	}
+
+	for i := 0; i < n; i++ {
+		switch {
+		case i >= len(actual):
+			fmt.Fprintf(&diff, "event %d: missing\n  expected: %s\n", i, formatEvent(expected[i]))
+		case i >= len(expected):
+			fmt.Fprintf(&diff, "event %d: unexpected\n  actual:   %s\n", i, formatEvent(actual[i]))
+		default:
+			e, a := indirect(expected[i]), indirect(actual[i])
+			if reflect.DeepEqual(e, a) {
+				continue
+			}
+			fmt.Fprintf(&diff, "event %d: differs\n  expected: %s\n  actual:   %s\n", i, formatEvent(expected[i]), formatEvent(actual[i]))
+			for _, field := range diffFields(e, a) {
+				fmt.Fprintf(&diff, "    %s\n", field)
+			}
+		}
+	}
+	return diff.String()
+}
+
+// diffFields describes the fields that differ between two structs of the
+// same type.
+func diffFields(expected interface{}, actual interface{}) []string {
+	e, a := reflect.ValueOf(expected), reflect.ValueOf(actual)
+	if !e.IsValid() || !a.IsValid() || e.Type() != a.Type() || e.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []string
+	for i := 0; i < e.NumField(); i++ {
+		field := e.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		ef, af := e.Field(i).Interface(), a.Field(i).Interface()
+		if !reflect.DeepEqual(ef, af) {
+			fields = append(fields, fmt.Sprintf("%s: expected %s, actual %s", field.Name, format(ef), format(af)))
+		}
+	}
+	return fields
+}
+
+// indirect follows pointers to the value they point to.
+func indirect(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil
+	}
+	return rv.Interface()
+}
+
+func formatEvent(event interface{}) string {
+	return format(indirect(event))
+}
+
+// format formats the value like %#v does, but follows pointers so that
+// values that hold pointers can be compared by reading them.
+func format(v interface{}) string {
+	if v == nil {
+		return "nil"
+	}
+	return formatValue(reflect.ValueOf(v))
+}
+
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return "nil"
+		}
+		return formatValue(v.Elem())
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.IsExported() {
+				fields = append(fields, field.Name+":"+formatValue(v.Field(i)))
+			}
+		}
+		return v.Type().String() + "{" + strings.Join(fields, ", ") + "}"
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return "nil"
+		}
+		elems := make([]string, v.Len())
+		for i := range elems {
+			elems[i] = formatValue(v.Index(i))
+		}
+		return v.Type().String() + "{" + strings.Join(elems, ", ") + "}"
+	case reflect.Map:
+		if v.IsNil() {
+			return "nil"
+		}
+		entries := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			entries = append(entries, formatValue(key)+":"+formatValue(v.MapIndex(key)))
+		}
+		sort.Strings(entries)
+		return v.Type().String() + "{" + strings.Join(entries, ", ") + "}"
+	}
+	if !v.CanInterface() {
+		return v.String()
+	}
+	return fmt.Sprintf("%#v", v.Interface())
+}
+
+func formatEvents(events []interface{}) string {
+	if len(events) == 0 {
+		return "  (none)"
+	}
+	lines := make([]string, len(events))
+	for i, event := range events {
+		lines[i] = fmt.Sprintf("  %d: %s", i, formatEvent(event))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package estest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fabiobentoluiz/eventsourcing"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&FixtureSuite{})
+
+type FixtureSuite struct{}
+
+type Counter struct {
+	*eventsourcing.AggregateBase
+	Count int
+}
+
+func NewCounter(id string) *Counter {
+	return &Counter{AggregateBase: eventsourcing.NewAggregateBase(id)}
+}
+
+func (a *Counter) Apply(event eventsourcing.EventMessage, isNew bool) {
+	if isNew {
+		a.TrackChange(event)
+	}
+	if e, ok := event.Event().(*Incremented); ok {
+		a.Count += e.By
+	}
+}
+
+type Increment struct {
+	By int
+}
+
+type Incremented struct {
+	By    int
+	Total int
+}
+
+var errLimit = errors.New("limit reached")
+
+func registerCounter(dispatcher eventsourcing.Dispatcher, repo *eventsourcing.Repository[*Counter]) error {
+	return eventsourcing.HandleCommand(dispatcher, func(ctx context.Context, m eventsourcing.CommandMessage, cmd *Increment) error {
+		counter, err := repo.LoadContext(ctx, m.AggregateID())
+		if _, ok := err.(*eventsourcing.ErrAggregateNotFound); ok {
+			counter, err = NewCounter(m.AggregateID()), nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if cmd.By <= 0 {
+			return &eventsourcing.ErrCommandExecution{Command: m, Reason: "can only count up"}
+		}
+		if counter.Count+cmd.By > 10 {
+			return fmt.Errorf("could not increment %s: %w", m.AggregateID(), errLimit)
+		}
+		counter.Apply(eventsourcing.NewEventMessage(m.AggregateID(), &Incremented{By: cmd.By, Total: counter.Count + cmd.By}, nil), true)
+		return repo.SaveContext(ctx, counter, nil)
+	})
+}
+
+// fakeT records the failure of a fixture.
+type fakeT struct {
+	failures []string
+}
+
+func (t *fakeT) Fatalf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func (s *FixtureSuite) TestThen(c *C) {
+	NewFixture(c, NewCounter, registerCounter).
+		Given("1", &Incremented{By: 2, Total: 2}, &Incremented{By: 3, Total: 5}).
+		When(eventsourcing.NewCommandMessage("1", &Increment{By: 1})).
+		Then(&Incremented{By: 1, Total: 6})
+}
+
+func (s *FixtureSuite) TestThenWithoutHistory(c *C) {
+	f := NewFixture(c, NewCounter, registerCounter)
+
+	f.When(eventsourcing.NewCommandMessage("1", &Increment{By: 4})).
+		Then(&Incremented{By: 4, Total: 4})
+
+	counter, err := f.Repository().Load("1")
+	c.Assert(err, IsNil)
+	c.Assert(counter.Count, Equals, 4)
+}
+
+func (s *FixtureSuite) TestThenError(c *C) {
+	f := NewFixture(c, NewCounter, registerCounter).
+		Given("1", &Incremented{By: 9, Total: 9})
+
+	f.When(eventsourcing.NewCommandMessage("1", &Increment{By: 2})).ThenError(errLimit)
+	f.When(eventsourcing.NewCommandMessage("1", &Increment{By: 0})).
+		ThenError(&eventsourcing.ErrCommandExecution{
+			Command: eventsourcing.NewCommandMessage("1", &Increment{}),
+			Reason:  "can only count up",
+		})
+	f.When(eventsourcing.NewCommandMessage("1", &Increment{By: 0})).ThenErrorMatches("Invalid Operation.*count up")
+}
+
+func (s *FixtureSuite) TestThenReportsDifferences(c *C) {
+	t := &fakeT{}
+
+	NewFixture(t, NewCounter, registerCounter).
+		Given("1", &Incremented{By: 2, Total: 2}).
+		When(eventsourcing.NewCommandMessage("1", &Increment{By: 1})).
+		Then(&Incremented{By: 1, Total: 2}, &Incremented{By: 1, Total: 4})
+
+	c.Assert(t.failures, HasLen, 1)
+	c.Assert(t.failures[0], Equals, `events do not match
+event 0: differs
+  expected: estest.Incremented{By:1, Total:2}
+  actual:   estest.Incremented{By:1, Total:3}
+    Total: expected 2, actual 3
+event 1: missing
+  expected: estest.Incremented{By:1, Total:4}
+`)
+}
+
+func (s *FixtureSuite) TestThenReportsFailedCommand(c *C) {
+	t := &fakeT{}
+
+	NewFixture(t, NewCounter, registerCounter).
+		When(eventsourcing.NewCommandMessage("1", &Increment{By: 11})).
+		Then(&Incremented{By: 11, Total: 11})
+
+	c.Assert(t.failures, DeepEquals, []string{"expected 1 events but the command failed: could not increment 1: limit reached"})
+}
+
+func (s *FixtureSuite) TestThenErrorReportsSuccess(c *C) {
+	t := &fakeT{}
+
+	f := NewFixture(t, NewCounter, registerCounter)
+	f.When(eventsourcing.NewCommandMessage("1", &Increment{By: 1})).ThenError(errLimit)
+	f.When(eventsourcing.NewCommandMessage("1", &Increment{By: 0})).ThenError(errLimit)
+	f.When(eventsourcing.NewCommandMessage("1", &Increment{By: 0})).ThenErrorMatches("limit.*")
+
+	c.Assert(t.failures, HasLen, 3)
+	c.Assert(t.failures[0], Equals, `expected error "limit reached" but the command succeeded with events:
+  0: estest.Incremented{By:1, Total:1}`)
+	c.Assert(t.failures[1], Matches, "(?s)errors do not match\n.*")
+	c.Assert(t.failures[2], Matches, "(?s)error does not match\n.*")
+}
+
+func (s *FixtureSuite) TestThenRequiresWhen(c *C) {
+	t := &fakeT{}
+
+	NewFixture(t, NewCounter, registerCounter).Given("1", &Incremented{By: 1}).Then()
+
+	c.Assert(t.failures, DeepEquals, []string{"no command was dispatched, call When before Then"})
+}
+
+func (s *FixtureSuite) TestDiffEvents(c *C) {
+	c.Assert(DiffEvents([]interface{}{&Incremented{By: 1}}, []interface{}{Incremented{By: 1}}), Equals, "")
+	c.Assert(DiffEvents(nil, []interface{}{&Incremented{By: 1}}), Equals,
+		"event 0: unexpected\n  actual:   estest.Incremented{By:1, Total:0}\n")
+}
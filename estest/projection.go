@@ -0,0 +1,278 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package estest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/fabiobentoluiz/eventsourcing"
+)
+
+// Projection tests an event handler that builds a read model.
+//
+// Given feeds the events that the read model is built from, When feeds the
+// events under test and Then checks the state of the read model, as returned by
+// the state function, or ThenError the error that the handler returned.
+// ThenIdempotent checks that the handler can be fed the same events again and
+// ThenInOrder that each event was fed after the previous version of its
+// aggregate.
+//
+//	p := estest.NewProjection(t, view, view.Orders)
+//	p.Given(p.Event(id, &ProductionOrderCreated{Name: "order"})).
+//		When(p.Event(id, &ProductionOrderRenamed{Name: "renamed"})).
+//		Then([]OrderDto{{ID: id, Name: "renamed"}})
+//
+// The state function should return a copy of the read model, or values that
+// are not changed by later events, so that ThenIdempotent can compare the
+// state before and after the events are fed again.
+type Projection[S any] struct {
+	t          T
+	ctx        context.Context
+	handler    eventsourcing.EventHandler
+	state      func() S
+	versions   map[string]int64
+	handled    []eventsourcing.EventMessage
+	last       map[string]int64
+	outOfOrder []string
+	fed        bool
+	err        error
+}
+
+// NewProjection constructs a new Projection that feeds events to the handler
+// and reads the state of the read model with the state function.
+func NewProjection[S any](t T, handler eventsourcing.EventHandler, state func() S) *Projection[S] {
+	helper(t)
+	if handler == nil {
+		t.Fatalf("nil EventHandler injected into Projection")
+	}
+	if state == nil {
+		t.Fatalf("nil state function injected into Projection")
+	}
+
+	return &Projection[S]{
+		t:        t,
+		ctx:      context.Background(),
+		handler:  handler,
+		state:    state,
+		versions: make(map[string]int64),
+		last:     make(map[string]int64),
+	}
+}
+
+// Event returns an event message for the event with the next version of the
+// aggregate, starting at 0, and a unique event ID.
+func (p *Projection[S]) Event(aggregateID string, event interface{}) eventsourcing.EventMessage {
+	version := p.versions[aggregateID]
+	return p.EventAt(aggregateID, version, event)
+}
+
+// EventAt returns an event message for the event with the version specified,
+// for tests that feed events out of order. Later calls to Event continue from
+// the version after it.
+func (p *Projection[S]) EventAt(aggregateID string, version int64, event interface{}) eventsourcing.EventMessage {
+	if version >= p.versions[aggregateID] {
+		p.versions[aggregateID] = version + 1
+	}
+
+	em := eventsourcing.NewEventMessage(aggregateID, event, eventsourcing.Int64(version))
+	em.SetHeader(eventsourcing.HeaderEventID, fmt.Sprintf("%s-%d", aggregateID, version))
+	return em
+}
+
+// Given feeds the events that the read model is built from to the handler.
+// The test fails if the handler returns an error.
+func (p *Projection[S]) Given(events ...eventsourcing.EventMessage) *Projection[S] {
+	helper(p.t)
+	if err := p.feed(events); err != nil {
+		p.t.Fatalf("could not handle the given events: %v", err)
+	}
+	return p
+}
+
+// When feeds the events under test to the handler, stopping at the first
+// event the handler returns an error for.
+func (p *Projection[S]) When(events ...eventsourcing.EventMessage) *Projection[S] {
+	p.err = p.feed(events)
+	p.fed = true
+	return p
+}
+
+// Then checks that the handler handled the events and that the state of the
+// read model is equal to the state specified.
+func (p *Projection[S]) Then(expected S) {
+	helper(p.t)
+	if !p.checkFed() {
+		return
+	}
+
+	if p.err != nil {
+		p.t.Fatalf("expected the events to be handled but the handler failed: %v", p.err)
+		return
+	}
+	if diff := diffState(expected, p.state()); diff != "" {
+		p.t.Fatalf("state does not match\n%s", diff)
+	}
+}
+
+// ThenError checks that the handler failed with the error specified. The
+// error matches if errors.Is reports it does, or if it is of the same type and
+// has the same message.
+func (p *Projection[S]) ThenError(expected error) {
+	helper(p.t)
+	if !p.checkFed() {
+		return
+	}
+
+	if p.err == nil {
+		p.t.Fatalf("expected error %q but the events were handled", expected)
+		return
+	}
+	if !sameError(expected, p.err) {
+		p.t.Fatalf("errors do not match\nexpected: %T %q\nactual:   %T %q", expected, expected, p.err, p.err)
+	}
+}
+
+// ThenErrorMatches checks that the handler failed with an error whose message
+// matches the regular expression in full.
+func (p *Projection[S]) ThenErrorMatches(pattern string) {
+	helper(p.t)
+	if !p.checkFed() {
+		return
+	}
+
+	if p.err == nil {
+		p.t.Fatalf("expected an error matching %q but the events were handled", pattern)
+		return
+	}
+	matchError(p.t, pattern, p.err)
+}
+
+// ThenIdempotent feeds every event that has been handled so far to the handler
+// a second time and checks that it handles them without error and without
+// changing the state of the read model.
+func (p *Projection[S]) ThenIdempotent() {
+	helper(p.t)
+
+	before := p.state()
+	for _, event := range append([]eventsourcing.EventMessage(nil), p.handled...) {
+		if err := p.handle(event); err != nil {
+			p.t.Fatalf("handling %s again failed: %v", describeEvent(event), err)
+			return
+		}
+		if diff := diffState(before, p.state()); diff != "" {
+			p.t.Fatalf("handling %s again changed the state\n%s", describeEvent(event), diff)
+			return
+		}
+	}
+}
+
+// ThenInOrder checks that each event was fed after the previous version of
+// its aggregate.
+func (p *Projection[S]) ThenInOrder() {
+	helper(p.t)
+	if len(p.outOfOrder) > 0 {
+		p.t.Fatalf("events were fed out of order\n%s", strings.Join(p.outOfOrder, "\n"))
+	}
+}
+
+// State returns the state of the read model.
+func (p *Projection[S]) State() S {
+	return p.state()
+}
+
+// Err returns the error returned by the handler.
+func (p *Projection[S]) Err() error {
+	return p.err
+}
+
+// OutOfOrder describes the events that were fed out of order.
+func (p *Projection[S]) OutOfOrder() []string {
+	return p.outOfOrder
+}
+
+func (p *Projection[S]) checkFed() bool {
+	helper(p.t)
+	if !p.fed {
+		p.t.Fatalf("no events were fed, call When before Then")
+	}
+	return p.fed
+}
+
+func (p *Projection[S]) feed(events []eventsourcing.EventMessage) error {
+	for _, event := range events {
+		p.checkOrder(event)
+		if err := p.handle(event); err != nil {
+			return err
+		}
+		p.handled = append(p.handled, event)
+	}
+	return nil
+}
+
+// checkOrder records the event if it is not the version after the last
+// version fed for its aggregate. Events without a version are not checked.
+func (p *Projection[S]) checkOrder(event eventsourcing.EventMessage) {
+	if event.Version() == nil {
+		return
+	}
+	version := *event.Version()
+
+	last, ok := p.last[event.AggregateID()]
+	expected := int64(0)
+	if ok {
+		expected = last + 1
+	}
+	if version != expected {
+		if ok {
+			p.outOfOrder = append(p.outOfOrder, fmt.Sprintf("%s fed after version %d", describeEvent(event), last))
+		} else {
+			p.outOfOrder = append(p.outOfOrder, fmt.Sprintf("%s fed first", describeEvent(event)))
+		}
+	}
+	if !ok || version > last {
+		p.last[event.AggregateID()] = version
+	}
+}
+
+// handle feeds the event to the handler using the richest interface it
+// implements, as event buses do.
+func (p *Projection[S]) handle(event eventsourcing.EventMessage) error {
+	switch h := p.handler.(type) {
+	case eventsourcing.ErrorEventHandler:
+		return h.HandleEvent(p.ctx, event)
+	case eventsourcing.ContextEventHandler:
+		h.HandleContext(p.ctx, event)
+	default:
+		p.handler.Handle(event)
+	}
+	return nil
+}
+
+func describeEvent(event eventsourcing.EventMessage) string {
+	if event.Version() == nil {
+		return fmt.Sprintf("%s of %s", event.EventType(), event.AggregateID())
+	}
+	return fmt.Sprintf("%s %d of %s", event.EventType(), *event.Version(), event.AggregateID())
+}
+
+// diffState returns a readable description of the differences between the
+// expected and actual state, or "" if they are equal.
+func diffState(expected interface{}, actual interface{}) string {
+	e, a := indirect(expected), indirect(actual)
+	if reflect.DeepEqual(e, a) {
+		return ""
+	}
+
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "expected: %s\nactual:   %s\n", format(e), format(a))
+	for _, field := range diffFields(e, a) {
+		fmt.Fprintf(&diff, "  %s\n", field)
+	}
+	return diff.String()
+}
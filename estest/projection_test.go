@@ -0,0 +1,201 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package estest
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fabiobentoluiz/eventsourcing"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ProjectionSuite{})
+
+type ProjectionSuite struct{}
+
+// CounterView sums the increments of each counter. With versioned set it
+// ignores the events of versions it has already handled.
+type CounterView struct {
+	totals    map[string]int
+	versions  map[string]int64
+	versioned bool
+}
+
+func NewCounterView() *CounterView {
+	return &CounterView{totals: make(map[string]int), versions: make(map[string]int64)}
+}
+
+var errNegative = errors.New("negative increment")
+
+func (v *CounterView) HandleEvent(ctx context.Context, message eventsourcing.EventMessage) error {
+	e, ok := message.Event().(*Incremented)
+	if !ok {
+		return nil
+	}
+	if e.By < 0 {
+		return errNegative
+	}
+	if v.versioned {
+		if last, ok := v.versions[message.AggregateID()]; ok && *message.Version() <= last {
+			return nil
+		}
+		v.versions[message.AggregateID()] = *message.Version()
+	}
+	v.totals[message.AggregateID()] += e.By
+	return nil
+}
+
+func (v *CounterView) Handle(message eventsourcing.EventMessage) {
+	_ = v.HandleEvent(context.Background(), message)
+}
+
+// Totals returns a copy of the totals.
+func (v *CounterView) Totals() map[string]int {
+	totals := make(map[string]int, len(v.totals))
+	for id, total := range v.totals {
+		totals[id] = total
+	}
+	return totals
+}
+
+func (s *ProjectionSuite) TestThen(c *C) {
+	view := NewCounterView()
+	p := NewProjection(c, view, view.Totals)
+
+	p.Given(p.Event("1", &Incremented{By: 2, Total: 2})).
+		When(p.Event("1", &Incremented{By: 3, Total: 5}), p.Event("2", &Incremented{By: 1, Total: 1})).
+		Then(map[string]int{"1": 5, "2": 1})
+
+	p.ThenInOrder()
+	c.Assert(p.State(), DeepEquals, map[string]int{"1": 5, "2": 1})
+}
+
+func (s *ProjectionSuite) TestEventVersions(c *C) {
+	p := NewProjection(c, NewCounterView(), NewCounterView().Totals)
+
+	c.Assert(*p.Event("1", &Incremented{}).Version(), Equals, int64(0))
+	c.Assert(*p.Event("1", &Incremented{}).Version(), Equals, int64(1))
+	c.Assert(*p.Event("2", &Incremented{}).Version(), Equals, int64(0))
+	c.Assert(*p.EventAt("1", 5, &Incremented{}).Version(), Equals, int64(5))
+
+	em := p.Event("1", &Incremented{})
+	c.Assert(*em.Version(), Equals, int64(6))
+	c.Assert(em.GetHeaders()[eventsourcing.HeaderEventID], Equals, "1-6")
+}
+
+func (s *ProjectionSuite) TestThenReportsDifferences(c *C) {
+	t := &fakeT{}
+	view := NewCounterView()
+	p := NewProjection(t, view, view.Totals)
+
+	p.When(p.Event("1", &Incremented{By: 2, Total: 2})).Then(map[string]int{"1": 3})
+
+	c.Assert(t.failures, DeepEquals, []string{"state does not match\n" +
+		"expected: map[string]int{\"1\":3}\n" +
+		"actual:   map[string]int{\"1\":2}\n"})
+}
+
+func (s *ProjectionSuite) TestThenError(c *C) {
+	view := NewCounterView()
+	p := NewProjection(c, view, view.Totals)
+
+	p.When(p.Event("1", &Incremented{By: 1}), p.Event("1", &Incremented{By: -1}), p.Event("1", &Incremented{By: 1}))
+
+	p.ThenError(errNegative)
+	p.ThenErrorMatches("negative.*")
+	c.Assert(p.State(), DeepEquals, map[string]int{"1": 1})
+}
+
+func (s *ProjectionSuite) TestThenReportsFailedHandler(c *C) {
+	t := &fakeT{}
+	view := NewCounterView()
+	p := NewProjection(t, view, view.Totals)
+
+	p.When(p.Event("1", &Incremented{By: -1})).Then(map[string]int{})
+	p.When().ThenError(errNegative)
+
+	c.Assert(t.failures, DeepEquals, []string{
+		"expected the events to be handled but the handler failed: negative increment",
+		`expected error "negative increment" but the events were handled`,
+	})
+}
+
+func (s *ProjectionSuite) TestThenIdempotent(c *C) {
+	view := NewCounterView()
+	view.versioned = true
+	p := NewProjection(c, view, view.Totals)
+
+	p.Given(p.Event("1", &Incremented{By: 2, Total: 2})).
+		When(p.Event("1", &Incremented{By: 3, Total: 5})).
+		ThenIdempotent()
+
+	c.Assert(p.State(), DeepEquals, map[string]int{"1": 5})
+}
+
+func (s *ProjectionSuite) TestThenIdempotentReportsChanges(c *C) {
+	t := &fakeT{}
+	view := NewCounterView()
+	p := NewProjection(t, view, view.Totals)
+
+	p.Given(p.Event("1", &Incremented{By: 2, Total: 2})).ThenIdempotent()
+
+	c.Assert(t.failures, DeepEquals, []string{"handling estest.Incremented 0 of 1 again changed the state\n" +
+		"expected: map[string]int{\"1\":2}\n" +
+		"actual:   map[string]int{\"1\":4}\n"})
+}
+
+func (s *ProjectionSuite) TestIdempotentEventHandler(c *C) {
+	view := NewCounterView()
+	handler := eventsourcing.NewIdempotentEventHandler(view, eventsourcing.NewInMemoryProcessedEventStore())
+	p := NewProjection(c, handler, view.Totals)
+
+	p.Given(p.Event("1", &Incremented{By: 2}), p.Event("1", &Incremented{By: 3})).ThenIdempotent()
+
+	c.Assert(p.State(), DeepEquals, map[string]int{"1": 5})
+}
+
+func (s *ProjectionSuite) TestThenInOrderReportsOutOfOrderEvents(c *C) {
+	t := &fakeT{}
+	view := NewCounterView()
+	p := NewProjection(t, view, view.Totals)
+
+	p.When(
+		p.EventAt("1", 1, &Incremented{By: 1}),
+		p.EventAt("1", 0, &Incremented{By: 1}),
+		p.EventAt("2", 0, &Incremented{By: 1}),
+		p.EventAt("2", 2, &Incremented{By: 1}),
+		p.EventAt("2", 3, &Incremented{By: 1}),
+	).ThenInOrder()
+
+	c.Assert(p.OutOfOrder(), DeepEquals, []string{
+		"estest.Incremented 1 of 1 fed first",
+		"estest.Incremented 0 of 1 fed after version 1",
+		"estest.Incremented 2 of 2 fed after version 0",
+	})
+	c.Assert(t.failures, HasLen, 1)
+	c.Assert(t.failures[0], Matches, "(?s)events were fed out of order\n.*")
+}
+
+func (s *ProjectionSuite) TestThenRequiresWhen(c *C) {
+	t := &fakeT{}
+	view := NewCounterView()
+
+	NewProjection(t, view, view.Totals).Then(nil)
+
+	c.Assert(t.failures, DeepEquals, []string{"no events were fed, call When before Then"})
+}
+
+func (s *ProjectionSuite) TestNewProjectionRequiresDependencies(c *C) {
+	t := &fakeT{}
+
+	NewProjection[map[string]int](t, nil, nil)
+
+	c.Assert(t.failures, DeepEquals, []string{
+		"nil EventHandler injected into Projection",
+		"nil state function injected into Projection",
+	})
+}
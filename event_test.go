@@ -44,7 +44,7 @@ func (s *EventSuite) TestNewEventMessage(c *C) {
 func (s *EventSuite) TestShouldGetTypeOfEvent(c *C) {
 	se := &SomeEvent{"Some String", 42}
 	em := &EventDescriptor{event: se}
-	c.Assert(em.EventType(), Equals, "SomeEvent")
+	c.Assert(em.EventType(), Equals, "eventsourcing.SomeEvent")
 }
 
 //TODO: Do i need this still?
@@ -5,49 +5,247 @@
 
 package eventsourcing
 
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
 // EventBus is the inteface that an event bus must implement.
 type EventBus interface {
 	PublishEvent(EventMessage)
 	AddHandler(EventHandler, ...interface{})
 }
 
+// ContextEventBus is the interface that an event bus that passes a context on
+// to event handlers must implement.
+//
+// Event handlers that implement ContextEventHandler receive the context, other
+// event handlers are called without it.
+type ContextEventBus interface {
+	EventBus
+	PublishEventContext(context.Context, EventMessage)
+}
+
+// ErrorEventBus is the interface that an event bus implements to report the
+// failure to publish an event or of a handler to handle it.
+type ErrorEventBus interface {
+	EventBus
+	Publish(context.Context, EventMessage) error
+}
+
+// RepublishEventBus is the interface that an event bus implements to publish
+// an event again to the handlers that have not handled it, such as when some
+// of them failed.
+//
+// Handlers are identified by their names, so handlers of the same type for an
+// event should implement NamedEventHandler with distinct names.
+type RepublishEventBus interface {
+	ErrorEventBus
+	Republish(ctx context.Context, event EventMessage, handled []string) error
+}
+
+// publishEvent passes the context to the event bus if it is a ContextEventBus,
+// otherwise the context is dropped.
+func publishEvent(ctx context.Context, bus EventBus, event EventMessage) {
+	if b, ok := bus.(ContextEventBus); ok {
+		b.PublishEventContext(ctx, event)
+		return
+	}
+	bus.PublishEvent(event)
+}
+
+// publishEventErr publishes the event with Publish if the event bus is an
+// ErrorEventBus, otherwise the event is published as by publishEvent and no
+// error is reported.
+func publishEventErr(ctx context.Context, bus EventBus, event EventMessage) error {
+	if b, ok := bus.(ErrorEventBus); ok {
+		return b.Publish(ctx, event)
+	}
+	publishEvent(ctx, bus, event)
+	return nil
+}
+
 // InternalEventBus provides a lightweight in process event bus
+//
+// Events are published synchronously, each handler is called in turn before
+// PublishEvent returns. Handlers can be added while events are published.
+//
+// A handler that implements ErrorEventHandler and fails is retried according
+// to the retry policy and then, if a dead-letter sink is set, the event is put
+// in the sink.
 type InternalEventBus struct {
-	eventHandlers map[string]map[EventHandler]struct{}
+	mu             sync.RWMutex
+	eventHandlers  map[string][]EventHandler
+	retryPolicy    RetryPolicy
+	deadLetterSink DeadLetterSink
+	types          *TypeRegistry
 }
 
 // NewInternalEventBus constructs a new InternalEventBus
 func NewInternalEventBus() *InternalEventBus {
 	b := &InternalEventBus{
-		eventHandlers: make(map[string]map[EventHandler]struct{}),
+		eventHandlers: make(map[string][]EventHandler),
+		types:         DefaultTypeRegistry,
 	}
 	return b
 }
 
+// SetTypeRegistry sets the registry used to name event types. The
+// DefaultTypeRegistry is used by default.
+func (b *InternalEventBus) SetTypeRegistry(types *TypeRegistry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.types = types
+}
+
 // PublishEvent publishes events to all registered event handlers
 func (b *InternalEventBus) PublishEvent(event EventMessage) {
-	if handlers, ok := b.eventHandlers[event.EventType()]; ok {
-		for handler := range handlers {
-			handler.Handle(event)
+	b.PublishEventContext(context.Background(), event)
+}
+
+// PublishEventContext publishes events and the context to all registered
+// event handlers
+func (b *InternalEventBus) PublishEventContext(ctx context.Context, event EventMessage) {
+	_ = b.Publish(ctx, event)
+}
+
+// Publish publishes the event and the context to all registered event handlers
+// and returns an *ErrEventHandlerFailed if any of them failed.
+//
+// Every handler is called even if an earlier one fails. An error is returned
+// without calling any handler if the type of the event can not be named.
+func (b *InternalEventBus) Publish(ctx context.Context, event EventMessage) error {
+	return b.publish(ctx, event, nil)
+}
+
+// Republish publishes the event to the registered event handlers, other than
+// those named in handled, as Publish does.
+func (b *InternalEventBus) Republish(ctx context.Context, event EventMessage, handled []string) error {
+	return b.publish(ctx, event, handled)
+}
+
+func (b *InternalEventBus) publish(ctx context.Context, event EventMessage, skip []string) error {
+	b.mu.RLock()
+	typeName, err := b.types.Name(event.Event())
+	handlers := b.eventHandlers[typeName]
+	policy, sink := b.retryPolicy, b.deadLetterSink
+	b.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	var failures []HandlerFailure
+	var handled []string
+	for _, handler := range handlers {
+		name := handlerName(handler)
+		if containsString(skip, name) {
+			continue
+		}
+		if err := deliverEvent(ctx, handleEvent, handler, event, policy, sink); err != nil {
+			failures = append(failures, HandlerFailure{HandlerName: name, Err: err})
+			continue
 		}
+		handled = append(handled, name)
+	}
+
+	if len(failures) > 0 {
+		return &ErrEventHandlerFailed{Event: event, Failures: failures, Handled: handled}
 	}
+	return nil
+}
+
+// SetRetryPolicy sets the policy used to retry handlers that fail.
+func (b *InternalEventBus) SetRetryPolicy(policy RetryPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retryPolicy = policy
+}
+
+// SetDeadLetterSink sets the sink that receives events that handlers fail to
+// handle after all retries.
+func (b *InternalEventBus) SetDeadLetterSink(sink DeadLetterSink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadLetterSink = sink
 }
 
 // AddHandler registers an event handler for all of the events specified in the
 // variadic events parameter.
+//
+// AddHandler panics if the type of an event can not be named, for example
+// because another type has the same name. Use RegisterHandler to have the
+// error returned.
 func (b *InternalEventBus) AddHandler(handler EventHandler, events ...interface{}) {
+	if err := b.RegisterHandler(handler, events...); err != nil {
+		panic(err)
+	}
+}
 
-	for _, event := range events {
-		typeName := typeOf(event)
+// RegisterHandler registers an event handler for all of the events specified
+// in the variadic events parameter.
+//
+// If the type of any of the events can not be named an error is returned and
+// the handler is not registered for any of them.
+func (b *InternalEventBus) RegisterHandler(handler EventHandler, events ...interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-		// There can be multiple handlers for any event.
-		// Here we check that a map is initialized to hold these handlers
-		// for a given type. If not we create one.
-		if _, ok := b.eventHandlers[typeName]; !ok {
-			b.eventHandlers[typeName] = make(map[EventHandler]struct{})
+	typeNames, err := nameTypes(b.types, events)
+	if err != nil {
+		return err
+	}
+
+	for _, typeName := range typeNames {
+		// There can be multiple handlers for any event but each handler is
+		// only added once for a given type.
+		if containsHandler(b.eventHandlers[typeName], handler) {
+			continue
 		}
 
 		// Add this handler to the collection of handlers for the type.
-		b.eventHandlers[typeName][handler] = struct{}{}
+		b.eventHandlers[typeName] = append(b.eventHandlers[typeName], handler)
+	}
+	return nil
+}
+
+// nameTypes returns the names of the types of the values, or the error for the
+// first that can not be named.
+func nameTypes(types *TypeRegistry, values []interface{}) ([]string, error) {
+	names := make([]string, len(values))
+	for i, value := range values {
+		name, err := types.Name(value)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = name
+	}
+	return names, nil
+}
+
+// containsHandler reports whether the handler is in the collection.
+//
+// Handlers that are not comparable, such as an EventHandlerFunc, are never
+// considered to be in the collection.
+func containsHandler(handlers []EventHandler, handler EventHandler) bool {
+	if !reflect.TypeOf(handler).Comparable() {
+		return false
+	}
+
+	for _, h := range handlers {
+		if reflect.TypeOf(h) == reflect.TypeOf(handler) && h == handler {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString reports whether the string is in the collection.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
+	return false
 }
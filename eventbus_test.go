@@ -6,6 +6,10 @@
 package eventsourcing
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -61,3 +65,96 @@ func (m *MockEventBus) PublishEvent(event EventMessage) {
 func (m *MockEventBus) AddHandler(handler EventHandler, event ...interface{}) {}
 func (m *MockEventBus) AddLocalHandler(handler EventHandler)                  {}
 func (m *MockEventBus) AddGlobalHandler(handler EventHandler)                 {}
+
+func (s *InternalEventBusSuite) TestHandlerIsOnlyAddedOnceForAnEvent(c *C) {
+	h := NewMockEventHandler()
+	s.bus.AddHandler(h, &SomeEvent{})
+	s.bus.AddHandler(h, &SomeEvent{})
+
+	s.bus.PublishEvent(NewTestEventMessage(NewUUID()))
+
+	c.Assert(h.events, HasLen, 1)
+}
+
+func (s *InternalEventBusSuite) TestPublishEventContextPassesContextToHandlers(c *C) {
+	var got context.Context
+	s.bus.AddHandler(EventHandlerFunc(func(ctx context.Context, event EventMessage) error {
+		got = ctx
+		return nil
+	}), &SomeEvent{})
+	ctx := context.WithValue(context.Background(), ctxKey("trace"), "abc")
+
+	s.bus.PublishEventContext(ctx, NewTestEventMessage(NewUUID()))
+
+	c.Assert(got, NotNil)
+	c.Assert(got.Value(ctxKey("trace")), Equals, "abc")
+}
+
+func (s *InternalEventBusSuite) TestConcurrentAddHandlerAndPublish(c *C) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.bus.AddHandler(&SyncEventHandler{}, &SomeEvent{})
+		}()
+		go func() {
+			defer wg.Done()
+			s.bus.PublishEvent(NewTestEventMessage(NewUUID()))
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *InternalEventBusSuite) TestPublishReturnsHandlerFailures(c *C) {
+	ok := NewMockEventHandler()
+	failing := &FailingEventHandler{Failures: 1}
+	s.bus.AddHandler(failing, &SomeEvent{})
+	s.bus.AddHandler(ok, &SomeEvent{})
+	ev := NewTestEventMessage(NewUUID())
+
+	err := s.bus.Publish(context.Background(), ev)
+
+	c.Assert(err, FitsTypeOf, &ErrEventHandlerFailed{})
+	failed := err.(*ErrEventHandlerFailed)
+	c.Assert(failed.Event, Equals, ev)
+	c.Assert(failed.Failures, HasLen, 1)
+	c.Assert(failed.Failures[0].HandlerName, Equals, "failing")
+	c.Assert(failed.Failures[0].Err, ErrorMatches, "failure 1")
+	c.Assert(failed.Handled, DeepEquals, []string{"*eventsourcing.MockEventHandler"})
+	c.Assert(ok.events, HasLen, 1)
+}
+
+func (s *InternalEventBusSuite) TestRepublishSkipsTheHandlersThatHandledTheEvent(c *C) {
+	ok := NewMockEventHandler()
+	failing := &FailingEventHandler{Failures: 1}
+	s.bus.AddHandler(failing, &SomeEvent{})
+	s.bus.AddHandler(ok, &SomeEvent{})
+	ev := NewTestEventMessage(NewUUID())
+
+	err := s.bus.Publish(context.Background(), ev)
+	c.Assert(err, NotNil)
+	err = s.bus.Republish(context.Background(), ev, err.(*ErrEventHandlerFailed).Handled)
+
+	c.Assert(err, IsNil)
+	c.Assert(failing.calls, Equals, 2)
+	c.Assert(ok.events, HasLen, 1)
+}
+
+func (s *InternalEventBusSuite) TestPublishRetriesAndDeadLettersFailures(c *C) {
+	sink := NewInMemoryDeadLetterSink()
+	s.bus.SetRetryPolicy(RetryPolicy{Attempts: 3, Backoff: time.Millisecond})
+	s.bus.SetDeadLetterSink(sink)
+	recovers := &FailingEventHandler{Failures: 2}
+	broken := &FailingEventHandler{Failures: 10}
+	s.bus.AddHandler(recovers, &SomeEvent{})
+	s.bus.AddHandler(broken, &SomeEvent{})
+
+	err := s.bus.Publish(context.Background(), NewTestEventMessage(NewUUID()))
+
+	c.Assert(err, NotNil)
+	c.Assert(recovers.calls, Equals, 3)
+	c.Assert(broken.calls, Equals, 3)
+	c.Assert(sink.DeadLetters(), HasLen, 1)
+	c.Assert(sink.DeadLetters()[0].Handler, Equals, broken)
+}
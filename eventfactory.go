@@ -19,6 +19,8 @@ import (
 // The eventstore will return a string describing the event type. To unmarshal
 // the contents of the persisted event which will typically be in some serialised
 // format such as JSON an instance of the event type will need to be created.
+// The instance is then populated by the Serializer for the content type of the
+// persisted event.
 type EventFactory interface {
 	GetEvent(string) interface{}
 }
@@ -27,22 +29,33 @@ type EventFactory interface {
 // given the name of the event type as a string.
 type DelegateEventFactory struct {
 	eventFactories map[string]func() interface{}
+	types          *TypeRegistry
 }
 
 // NewDelegateEventFactory constructs a new DelegateEventFactory
 func NewDelegateEventFactory() *DelegateEventFactory {
 	return &DelegateEventFactory{
 		eventFactories: make(map[string]func() interface{}),
+		types:          DefaultTypeRegistry,
 	}
 }
 
+// SetTypeRegistry sets the registry used to name the event types. The
+// DefaultTypeRegistry is used by default.
+func (t *DelegateEventFactory) SetTypeRegistry(types *TypeRegistry) {
+	t.types = types
+}
+
 // RegisterDelegate registers a delegate that will return an event instance given
 // an event type name as a string.
 //
 // If an attempt is made to register multiple delegates for an event type, an error
 // is returned.
 func (t *DelegateEventFactory) RegisterDelegate(event interface{}, delegate func() interface{}) error {
-	typeName := typeOf(event)
+	typeName, err := t.types.Name(event)
+	if err != nil {
+		return err
+	}
 	if _, ok := t.eventFactories[typeName]; ok {
 		return fmt.Errorf("factory delegate already registered for type: \"%s\"", typeName)
 	}
@@ -54,8 +67,9 @@ func (t *DelegateEventFactory) RegisterDelegate(event interface{}, delegate func
 //
 // An appropriate delegate must be registered for the event type.
 // If an appropriate delegate is not registered, the method will return nil.
+// An alias of the event type is resolved to its name.
 func (t *DelegateEventFactory) GetEvent(typeName string) interface{} {
-	if f, ok := t.eventFactories[typeName]; ok {
+	if f, ok := t.eventFactories[t.types.Resolve(typeName)]; ok {
 		return f()
 	}
 	return nil
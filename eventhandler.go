@@ -5,6 +5,80 @@
 
 package eventsourcing
 
+import (
+	"context"
+	"fmt"
+)
+
 type EventHandler interface {
 	Handle(EventMessage)
 }
+
+// ContextEventHandler is the interface that event handlers implement to
+// receive the context the event was published with.
+type ContextEventHandler interface {
+	HandleContext(context.Context, EventMessage)
+}
+
+// ErrorEventHandler is the interface that event handlers implement to report
+// a failure to handle an event.
+//
+// Event buses call HandleEvent in preference to Handle and HandleContext, so
+// that a failure can be retried and, if it persists, recorded as a dead letter.
+type ErrorEventHandler interface {
+	HandleEvent(context.Context, EventMessage) error
+}
+
+// NamedEventHandler is the interface that event handlers implement to provide
+// the name that identifies them in dead letters.
+//
+// Handlers that do not implement it are identified by their type.
+type NamedEventHandler interface {
+	HandlerName() string
+}
+
+// EventHandlerFunc is an adapter to allow the use of ordinary functions as
+// event handlers.
+//
+// An EventHandlerFunc implements EventHandler, ContextEventHandler and
+// ErrorEventHandler.
+type EventHandlerFunc func(context.Context, EventMessage) error
+
+// Handle calls f with a background context.
+func (f EventHandlerFunc) Handle(event EventMessage) {
+	_ = f(context.Background(), event)
+}
+
+// HandleContext calls f.
+func (f EventHandlerFunc) HandleContext(ctx context.Context, event EventMessage) {
+	_ = f(ctx, event)
+}
+
+// HandleEvent calls f.
+func (f EventHandlerFunc) HandleEvent(ctx context.Context, event EventMessage) error {
+	return f(ctx, event)
+}
+
+// handleEvent calls the handler using the richest interface it implements.
+//
+// Handlers that do not implement ErrorEventHandler never fail and handlers that
+// do not implement ContextEventHandler are called without the context.
+func handleEvent(ctx context.Context, handler EventHandler, event EventMessage) error {
+	if h, ok := handler.(ErrorEventHandler); ok {
+		return h.HandleEvent(ctx, event)
+	}
+	if h, ok := handler.(ContextEventHandler); ok {
+		h.HandleContext(ctx, event)
+		return nil
+	}
+	handler.Handle(event)
+	return nil
+}
+
+// handlerName returns the name that identifies the handler.
+func handlerName(handler EventHandler) string {
+	if h, ok := handler.(NamedEventHandler); ok {
+		return h.HandlerName()
+	}
+	return fmt.Sprintf("%T", handler)
+}
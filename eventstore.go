@@ -0,0 +1,148 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ExpectedVersionAny disables the optimistic concurrency check when
+	// appending events to a stream.
+	ExpectedVersionAny int64 = -2
+
+	// ExpectedVersionNoStream specifies that the stream must not exist when
+	// appending events to it.
+	//
+	// This matches the OriginalVersion of a newly created aggregate.
+	ExpectedVersionNoStream int64 = -1
+
+	// StreamStart is the event number of the first event in a stream.
+	StreamStart int64 = 0
+
+	// StreamEnd is used when reading backwards to start from the last
+	// event in a stream.
+	StreamEnd int64 = -1
+)
+
+// PositionStart is the global position before the first event in the store.
+var PositionStart = Position{Commit: -1, Prepare: -1}
+
+// Position is the position of an event in the global log of all events in an
+// EventStore.
+//
+// Stores that give each event a position of its own, such as the
+// InMemoryEventStore, set Commit and Prepare to the same value. GetEventStore
+// gives the events appended together the same commit position and tells them
+// apart by their prepare positions, so both are needed to resume after any
+// one of them.
+type Position struct {
+	Commit  int64
+	Prepare int64
+}
+
+// LogPosition returns the Position of the event at the position specified in
+// a store that gives each event a position of its own.
+func LogPosition(position int64) Position {
+	return Position{Commit: position, Prepare: position}
+}
+
+// After reports if the position is after the other position.
+func (p Position) After(other Position) bool {
+	if p.Commit != other.Commit {
+		return p.Commit > other.Commit
+	}
+	return p.Prepare > other.Prepare
+}
+
+// String returns the position as the commit position followed by the prepare
+// position, such as 1024/960.
+func (p Position) String() string {
+	return fmt.Sprintf("%d/%d", p.Commit, p.Prepare)
+}
+
+// ParsePosition parses a position in the format returned by String. A single
+// number is parsed as a LogPosition.
+func ParsePosition(s string) (Position, error) {
+	commit, prepare, found := strings.Cut(strings.TrimSpace(s), "/")
+	c, err := strconv.ParseInt(commit, 10, 64)
+	if err != nil {
+		return PositionStart, fmt.Errorf("invalid position %q. Error: %+v", s, err)
+	}
+	if !found {
+		return LogPosition(c), nil
+	}
+	p, err := strconv.ParseInt(prepare, 10, 64)
+	if err != nil {
+		return PositionStart, fmt.Errorf("invalid position %q. Error: %+v", s, err)
+	}
+	return Position{Commit: c, Prepare: p}, nil
+}
+
+// EventStore is the interface that an event store must implement.
+//
+// An event store is the storage mechanism behind a CommonDomainRepository.
+// Events are appended to named streams and can be read back from a single
+// stream or from the global ordered log of all events in the store.
+//
+// Implementations should return an *ErrRepositoryUnavailable when the
+// underlying storage can not be reached so that callers can distinguish
+// transient failures from other errors.
+type EventStore interface {
+
+	// AppendToStream appends events to the stream specified and returns the
+	// event number of the last event in the stream after the append.
+	//
+	// The expectedVersion is the event number of the last event in the stream,
+	// ExpectedVersionNoStream if the stream should not yet exist or
+	// ExpectedVersionAny to append regardless of the current stream version.
+	AppendToStream(ctx context.Context, streamName string, expectedVersion int64, events []EventData) (int64, error)
+
+	// ReadStreamForwards reads at most count events from the stream starting
+	// from and including the event number specified.
+	//
+	// If the stream does not exist an *ErrStreamNotFound is returned.
+	ReadStreamForwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error)
+
+	// ReadStreamBackwards reads at most count events from the stream in
+	// reverse order starting from and including the event number specified.
+	//
+	// Use StreamEnd to start reading from the last event in the stream.
+	// If the stream does not exist an *ErrStreamNotFound is returned.
+	ReadStreamBackwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error)
+
+	// ReadAll reads at most count events from the global log of all events
+	// in the store with a position greater than the one specified.
+	//
+	// Use PositionStart to read from the beginning of the log.
+	ReadAll(ctx context.Context, after Position, count int) ([]RecordedEvent, error)
+}
+
+// EventData is an event that is to be appended to a stream.
+type EventData struct {
+	EventID     string
+	EventType   string
+	ContentType string
+	Data        []byte
+	Metadata    []byte
+}
+
+// RecordedEvent is an event that has been read from a stream.
+type RecordedEvent struct {
+	EventID     string
+	EventType   string
+	ContentType string
+	StreamName  string
+	EventNumber int64
+	Position    Position
+	Created     time.Time
+	Data        []byte
+	Metadata    []byte
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&PositionSuite{})
+
+type PositionSuite struct{}
+
+func (s *PositionSuite) TestPositionsAreOrderedByCommitThenPrepare(c *C) {
+	c.Assert(Position{Commit: 2, Prepare: 1}.After(Position{Commit: 1, Prepare: 5}), Equals, true)
+	c.Assert(Position{Commit: 2, Prepare: 6}.After(Position{Commit: 2, Prepare: 5}), Equals, true)
+	c.Assert(Position{Commit: 2, Prepare: 5}.After(Position{Commit: 2, Prepare: 5}), Equals, false)
+	c.Assert(LogPosition(0).After(PositionStart), Equals, true)
+}
+
+func (s *PositionSuite) TestParsePosition(c *C) {
+	position, err := ParsePosition(Position{Commit: 1024, Prepare: 960}.String())
+	c.Assert(err, IsNil)
+	c.Assert(position, Equals, Position{Commit: 1024, Prepare: 960})
+
+	position, err = ParsePosition("7\n")
+	c.Assert(err, IsNil)
+	c.Assert(position, Equals, LogPosition(7))
+
+	_, err = ParsePosition("7/x")
+	c.Assert(err, ErrorMatches, `invalid position "7/x". .*`)
+}
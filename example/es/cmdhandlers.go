@@ -1,7 +1,7 @@
 package example
 
 import (
-	"log"
+	"context"
 
 	"github.com/fabiobentoluiz/eventsourcing"
 )
@@ -9,8 +9,8 @@ import (
 //########## Orders
 
 type ProductionOrderRepository interface {
-	Load(string, string) (*ProductionOrder, error)
-	Save(eventsourcing.AggregateRoot, *int64) error
+	Load(id string) (*ProductionOrder, error)
+	Save(*ProductionOrder, *int64) error
 }
 
 type ProductionOrderCommandHandler struct {
@@ -25,34 +25,27 @@ func NewProductionOrderCommandHandler(repo ProductionOrderRepository) *Productio
 	return &handler
 }
 
-func (handler *ProductionOrderCommandHandler) Handle(cmdMessage eventsourcing.CommandMessage) error {
-
-	switch cmd := cmdMessage.Command().(type) {
-	case *CreateProductionOrder:
-		order := NewProductionOrder(cmdMessage.AggregateID())
-		if err := order.Create(cmd); err != nil {
-			return &eventsourcing.ErrCommandExecution{Command: cmdMessage, Reason: err.Error()}
-		}
-
-		return handler.repo.Save(order, eventsourcing.Int64(order.OriginalVersion()))
-
-		// case *DeactivateInventoryItem:
+// Register registers the handlers of the production order commands with the
+// dispatcher.
+func (handler *ProductionOrderCommandHandler) Register(dispatcher eventsourcing.Dispatcher) error {
+	return eventsourcing.HandleCommand(dispatcher, handler.Create)
+}
 
-		// item, _ = h.repo.Load(reflect.TypeOf(&InventoryItem{}).Elem().Name(), message.AggregateID())
-		// if err := item.Deactivate(); err != nil {
-		// 	return &ycq.ErrCommandExecution{Command: message, Reason: err.Error()}
-		// }
-		// return h.repo.Save(item, ycq.Int(item.OriginalVersion()))
+// Create creates a production order.
+func (handler *ProductionOrderCommandHandler) Create(ctx context.Context, cmdMessage eventsourcing.CommandMessage, cmd *CreateProductionOrder) error {
+	order := NewProductionOrder(cmdMessage.AggregateID())
+	if err := order.Create(cmd); err != nil {
+		return &eventsourcing.ErrCommandExecution{Command: cmdMessage, Reason: err.Error()}
 	}
 
-	return nil
+	return handler.repo.Save(order, eventsourcing.Int64(order.OriginalVersion()))
 }
 
 //########## Pallets
 
 type PalletRepository interface {
-	Load(string, string) (*Pallet, error)
-	Save(eventsourcing.AggregateRoot, *int64) error
+	Load(id string) (*Pallet, error)
+	Save(*Pallet, *int64) error
 }
 
 type PalletCommandHandler struct {
@@ -67,19 +60,16 @@ func NewPalletCommandHandler(repo PalletRepository) *PalletCommandHandler {
 	return &handler
 }
 
-func (handler *PalletCommandHandler) Handle(cmdMessage eventsourcing.CommandMessage) error {
-
-	switch cmd := cmdMessage.Command().(type) {
-	case *CreatePallet:
-		pallet := NewPallet(cmdMessage.AggregateID())
-		if err := pallet.Create(cmd); err != nil {
-			return &eventsourcing.ErrCommandExecution{Command: cmdMessage, Reason: err.Error()}
-		}
-		return handler.repo.Save(pallet, eventsourcing.Int64(pallet.OriginalVersion()))
+// Register registers the handlers of the pallet commands with the dispatcher.
+func (handler *PalletCommandHandler) Register(dispatcher eventsourcing.Dispatcher) error {
+	return eventsourcing.HandleCommand(dispatcher, handler.Create)
+}
 
-	default:
-		log.Printf("there is no handler for the command %s", cmd)
+// Create creates a pallet.
+func (handler *PalletCommandHandler) Create(ctx context.Context, cmdMessage eventsourcing.CommandMessage, cmd *CreatePallet) error {
+	pallet := NewPallet(cmdMessage.AggregateID())
+	if err := pallet.Create(cmd); err != nil {
+		return &eventsourcing.ErrCommandExecution{Command: cmdMessage, Reason: err.Error()}
 	}
-
-	return nil
+	return handler.repo.Save(pallet, eventsourcing.Int64(pallet.OriginalVersion()))
 }
@@ -15,33 +15,22 @@ func NewPallet(id string) *Pallet {
 	pallet := Pallet{
 		AggregateBase: eventsourcing.NewAggregateBase(id),
 	}
+	pallet.RegisterOnMethods(&pallet)
 
 	return &pallet
 }
 
 func (pallet *Pallet) Create(cmd *CreatePallet) error {
-
-	created := PalletCreated{
+	return pallet.Raise(&PalletCreated{
 		ID:      pallet.AggregateID(),
 		Bags:    cmd.Bags,
 		OrderID: cmd.OrderID,
-	}
-
-	em := eventsourcing.NewEventMessage(pallet.AggregateID(), &created, eventsourcing.Int64(pallet.CurrentVersion()))
-	pallet.Apply(em, true)
-
-	return nil
+	})
 }
 
-func (pallet *Pallet) Apply(evtMessage eventsourcing.EventMessage, isNew bool) {
-	if isNew {
-		pallet.TrackChange(evtMessage)
-	}
-
-	switch e := evtMessage.Event().(type) {
-	case *PalletCreated:
-		pallet.Bags = e.Bags
-		pallet.ID = e.ID
-		pallet.OrderID = e.OrderID
-	}
+// OnPalletCreated applies PalletCreated events.
+func (pallet *Pallet) OnPalletCreated(e *PalletCreated) {
+	pallet.Bags = e.Bags
+	pallet.ID = e.ID
+	pallet.OrderID = e.OrderID
 }
@@ -14,31 +14,18 @@ func NewProductionOrder(id string) *ProductionOrder {
 	order := ProductionOrder{
 		AggregateBase: eventsourcing.NewAggregateBase(id),
 	}
+	eventsourcing.RegisterApplier(order.AggregateBase, func(e *ProductionOrderCreated) {
+		order.Activated = true
+		order.BagsToProduce = e.BagsToProduce
+	})
 
 	return &order
 }
 
 func (order *ProductionOrder) Create(cmd *CreateProductionOrder) error {
-	created := ProductionOrderCreated{
+	return order.Raise(&ProductionOrderCreated{
 		ID:            order.AggregateID(),
 		Name:          cmd.Name,
 		BagsToProduce: cmd.BagsToProduce,
-	}
-
-	em := eventsourcing.NewEventMessage(order.AggregateID(), &created, eventsourcing.Int64(order.CurrentVersion()))
-	order.Apply(em, true)
-
-	return nil
-}
-
-func (order *ProductionOrder) Apply(evtMessage eventsourcing.EventMessage, isNew bool) {
-	if isNew {
-		order.TrackChange(evtMessage)
-	}
-
-	switch e := evtMessage.Event().(type) {
-	case *ProductionOrderCreated:
-		order.Activated = true
-		order.BagsToProduce = e.BagsToProduce
-	}
+	})
 }
@@ -1,7 +1,13 @@
 package example
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 
 	"github.com/fabiobentoluiz/eventsourcing"
 )
@@ -45,6 +51,51 @@ func NewFakeDatabase() *FakeDatabase {
 	}
 }
 
+// LoadFakeDatabase reads a FakeDatabase saved with SaveFile. An empty database
+// is returned if the file does not exist.
+func LoadFakeDatabase(path string) (*FakeDatabase, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewFakeDatabase(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	db := NewFakeDatabase()
+	if err := json.Unmarshal(b, db); err != nil {
+		return nil, fmt.Errorf("could not read database %s. Error: %+v", path, err)
+	}
+	return db, nil
+}
+
+// SaveFile writes the database to a file as JSON. The file is replaced
+// atomically so a failed save leaves the previous contents in place.
+func (db *FakeDatabase) SaveFile(path string) error {
+	b, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err
+}
+
 // ReadModelFacade is an interface for the readmodel facade
 type ReadModelFacade interface {
 	GetProductionOrders() []*ProductionOrderListDto
@@ -69,9 +120,13 @@ func (m *ReadModel) GetPallets() []*PalletListDto {
 // ProductionOrderListView handles messages related to orders and builds an
 // in memory read model of order summaries in a list.
 type ProductionOrderListView struct {
+	db *FakeDatabase
 }
 
+// PalletListView handles messages related to pallets and builds an in memory
+// read model of pallet summaries in a list.
 type PalletListView struct {
+	db *FakeDatabase
 }
 
 // NewProductionOrderListView constructs a new ProductionOrderListView
@@ -80,7 +135,7 @@ func NewProductionOrderListView() *ProductionOrderListView {
 		fakeDatabase = NewFakeDatabase()
 	}
 
-	return &ProductionOrderListView{}
+	return &ProductionOrderListView{db: fakeDatabase}
 }
 
 // NewPalletListView constructs a new PalletListView
@@ -89,17 +144,34 @@ func NewPalletListView() *PalletListView {
 		fakeDatabase = NewFakeDatabase()
 	}
 
-	return &PalletListView{}
+	return &PalletListView{db: fakeDatabase}
+}
+
+// SetDatabase sets the database the view writes to in place of the shared one.
+func (v *ProductionOrderListView) SetDatabase(db *FakeDatabase) {
+	v.db = db
+}
+
+// SetDatabase sets the database the view writes to in place of the shared one.
+func (v *PalletListView) SetDatabase(db *FakeDatabase) {
+	v.db = db
 }
 
-// Handle processes events related to order and builds an in memory read model
+// Handle processes events related to order and logs any failure
 func (v *ProductionOrderListView) Handle(message eventsourcing.EventMessage) {
+	if err := v.HandleEvent(context.Background(), message); err != nil {
+		log.Print(err)
+	}
+}
+
+// HandleEvent processes events related to order and builds an in memory read model
+func (v *ProductionOrderListView) HandleEvent(ctx context.Context, message eventsourcing.EventMessage) error {
 
 	switch event := message.Event().(type) {
 
 	case *ProductionOrderCreated:
 
-		fakeDatabase.Orders = append(fakeDatabase.Orders, &ProductionOrderListDto{
+		v.db.Orders = append(v.db.Orders, &ProductionOrderListDto{
 			ID:            message.AggregateID(),
 			Name:          event.Name,
 			BagsToProduce: event.BagsToProduce,
@@ -107,7 +179,7 @@ func (v *ProductionOrderListView) Handle(message eventsourcing.EventMessage) {
 		})
 
 	default:
-		log.Printf("there is no handler for the event %s", event)
+		return fmt.Errorf("there is no handler for the event %T", event)
 
 		/*case *InventoryItemRenamed:
 
@@ -134,16 +206,24 @@ func (v *ProductionOrderListView) Handle(message eventsourcing.EventMessage) {
 				)
 			}*/
 	}
+	return nil
 }
 
-// Handle processes events related to pallets and builds an in memory read model
+// Handle processes events related to pallets and logs any failure
 func (v *PalletListView) Handle(message eventsourcing.EventMessage) {
+	if err := v.HandleEvent(context.Background(), message); err != nil {
+		log.Print(err)
+	}
+}
+
+// HandleEvent processes events related to pallets and builds an in memory read model
+func (v *PalletListView) HandleEvent(ctx context.Context, message eventsourcing.EventMessage) error {
 
 	switch event := message.Event().(type) {
 
 	case *PalletCreated:
 
-		fakeDatabase.Pallets = append(fakeDatabase.Pallets, &PalletListDto{
+		v.db.Pallets = append(v.db.Pallets, &PalletListDto{
 			ID:      message.AggregateID(),
 			Bags:    event.Bags,
 			OrderID: event.OrderID,
@@ -151,6 +231,7 @@ func (v *PalletListView) Handle(message eventsourcing.EventMessage) {
 		})
 
 	default:
-		log.Printf("there is no handler for the event %s", event)
+		return fmt.Errorf("there is no handler for the event %T", event)
 	}
+	return nil
 }
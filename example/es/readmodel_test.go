@@ -0,0 +1,81 @@
+package example
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/fabiobentoluiz/eventsourcing"
+	"github.com/fabiobentoluiz/eventsourcing/estest"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&ReadModelSuite{})
+
+type ReadModelSuite struct {
+	db *FakeDatabase
+}
+
+func (s *ReadModelSuite) SetUpTest(c *C) {
+	s.db = NewFakeDatabase()
+}
+
+func (s *ReadModelSuite) orders() []ProductionOrderListDto {
+	orders := make([]ProductionOrderListDto, len(s.db.Orders))
+	for i, order := range s.db.Orders {
+		orders[i] = *order
+	}
+	return orders
+}
+
+func (s *ReadModelSuite) TestProductionOrderListView(c *C) {
+	view := NewProductionOrderListView()
+	view.SetDatabase(s.db)
+	p := estest.NewProjection(c, view, s.orders)
+
+	p.When(p.Event("1", &ProductionOrderCreated{ID: "1", Name: "order", BagsToProduce: 10})).
+		Then([]ProductionOrderListDto{{ID: "1", Name: "order", BagsToProduce: 10}})
+}
+
+func (s *ReadModelSuite) TestProductionOrderListViewRejectsOtherEvents(c *C) {
+	view := NewProductionOrderListView()
+	view.SetDatabase(s.db)
+	p := estest.NewProjection(c, view, s.orders)
+
+	p.When(p.Event("1", &PalletCreated{ID: "1"})).
+		ThenErrorMatches("there is no handler for the event .*PalletCreated")
+}
+
+func (s *ReadModelSuite) TestPalletListViewIsIdempotentWhenDecorated(c *C) {
+	view := NewPalletListView()
+	view.SetDatabase(s.db)
+	handler := eventsourcing.NewIdempotentEventHandler(view, eventsourcing.NewInMemoryProcessedEventStore())
+	p := estest.NewProjection(c, handler, func() int { return len(s.db.Pallets) })
+
+	p.Given(p.Event("1", &PalletCreated{ID: "1", Bags: 5, OrderID: "order"})).
+		When(p.Event("2", &PalletCreated{ID: "2", Bags: 3, OrderID: "order"})).
+		Then(2)
+	p.ThenIdempotent()
+	p.ThenInOrder()
+}
+
+func (s *ReadModelSuite) TestDatabaseSurvivesSavingAndLoading(c *C) {
+	path := filepath.Join(c.MkDir(), "readmodel.json")
+	s.db.Orders = append(s.db.Orders, &ProductionOrderListDto{ID: "1", Name: "order", BagsToProduce: 10})
+	s.db.Pallets = append(s.db.Pallets, &PalletListDto{ID: "2", OrderID: "1", Bags: 5})
+
+	c.Assert(s.db.SaveFile(path), IsNil)
+	loaded, err := LoadFakeDatabase(path)
+
+	c.Assert(err, IsNil)
+	c.Assert(loaded, DeepEquals, s.db)
+}
+
+func (s *ReadModelSuite) TestLoadingAMissingDatabaseReturnsAnEmptyOne(c *C) {
+	loaded, err := LoadFakeDatabase(filepath.Join(c.MkDir(), "missing.json"))
+
+	c.Assert(err, IsNil)
+	c.Assert(loaded, DeepEquals, NewFakeDatabase())
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/EventStore/EventStore-Client-Go/client"
 	"github.com/fabiobentoluiz/eventsourcing"
@@ -31,6 +32,10 @@ func init() {
 
 	// Create an EventBus
 	eventBus := eventsourcing.NewInternalEventBus()
+	// Retry handlers that fail and keep the events they could not handle
+	// so that they can be inspected and replayed.
+	eventBus.SetRetryPolicy(eventsourcing.RetryPolicy{Attempts: 3, Backoff: 10 * time.Millisecond})
+	eventBus.SetDeadLetterSink(eventsourcing.NewInMemoryDeadLetterSink())
 	// Register the listView as an event handler on the event bus
 	// for the events specified.
 	eventBus.AddHandler(orderListView,
@@ -41,37 +46,52 @@ func init() {
 	eventBus.AddHandler(palletListView,
 		&example.PalletCreated{})
 
-	// Here we use an in memory event repository.
-	orderRepo := example.NewInMemoryOrderRepo(eventBus)
+	// Here we use an in memory event store.
+	var eventStore eventsourcing.EventStore = eventsourcing.NewInMemoryEventStore()
 
 	// Here we use EventStoreDB with the EventStore-Client-Go client
 	// https://github.com/EventStore/EventStore-Client-Go/client
-	// Uncomment the following code and comment out the previous in memory repository
-	// client := newEventStoreDBClient()
-	// orderRepo, err := example.NewProductionOrderRepo(client, eventBus)
+	// Uncomment the following code and comment out the previous in memory event store
+	// eventStore, err := eventsourcing.NewGetEventStore(newEventStoreDBClient())
 	// if err != nil {
 	// 	log.Fatal(err)
 	// }
 
+	repo, err := example.NewDomainRepository(eventStore, eventBus)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	orderRepo, err := example.NewProductionOrderRepo(repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Create an ProductionOrderCommandHandler instance
 	productionOrderCommandHandler := example.NewProductionOrderCommandHandler(orderRepo)
 
 	// Create a dispatcher
-	dispatcher = eventsourcing.NewInMemoryDispatcher()
-	// Register the production order command handlers instance as a command handler
-	// for the events specified.
-	err := dispatcher.RegisterHandler(productionOrderCommandHandler,
-		&example.CreateProductionOrder{})
+	inMemoryDispatcher := eventsourcing.NewInMemoryDispatcher()
+	// Middleware decorates every command handler registered with the dispatcher.
+	inMemoryDispatcher.Use(
+		eventsourcing.RecoveryMiddleware(),
+		eventsourcing.ValidationMiddleware())
+	dispatcher = inMemoryDispatcher
+	// Register the production order command handlers with the dispatcher. Each
+	// handler is registered for the type of command it receives.
+	err = productionOrderCommandHandler.Register(dispatcher)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	palletRepo := example.NewInMemoryPalletRepo(eventBus)
+	palletRepo, err := example.NewPalletRepo(repo)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	palletCommandHandler := example.NewPalletCommandHandler(palletRepo)
 
-	err = dispatcher.RegisterHandler(palletCommandHandler,
-		&example.CreatePallet{})
+	err = palletCommandHandler.Register(dispatcher)
 	if err != nil {
 		log.Fatal(err)
 	}
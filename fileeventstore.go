@@ -0,0 +1,729 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy determines when a FileEventStore flushes appended events to
+// stable storage with fsync.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs each append before it returns, so an event that was
+	// appended is never lost.
+	SyncAlways SyncPolicy = iota
+
+	// SyncPeriodically syncs at the sync interval. The events appended since
+	// the last sync can be lost if the machine fails.
+	SyncPeriodically
+
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// DefaultSegmentSize is the size a segment file of a FileEventStore grows to
+// before a new segment is started.
+const DefaultSegmentSize = 64 << 20
+
+// maxRecordSize is the size of the largest record that is written to or read
+// from a segment. A larger size in a record header means the header is
+// corrupt.
+var maxRecordSize int64 = 1 << 30
+
+const (
+	segmentExt       = ".seg"
+	recordHeaderSize = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileEventStoreConfig holds the configuration of a FileEventStore.
+//
+// Zero values are replaced with the defaults.
+type FileEventStoreConfig struct {
+	// SegmentSize is the size in bytes a segment grows to before a new one is
+	// started. Defaults to DefaultSegmentSize.
+	SegmentSize int64
+
+	// SyncPolicy determines when appends are synced. Defaults to SyncAlways.
+	SyncPolicy SyncPolicy
+
+	// SyncInterval is the interval of SyncPeriodically. Defaults to one
+	// second.
+	SyncInterval time.Duration
+}
+
+// FileEventStore is an implementation of the EventStore interface that keeps
+// events in append only segment files in a directory, for single node
+// deployments without a database server.
+//
+// Each append is written to the last segment as one record, a header with the
+// length and a CRC-32C checksum of the record followed by the events, so an
+// append is either wholly in the log or not at all. When the store is opened
+// the segments are read to rebuild the index of the streams and of the global
+// log in memory. A record at the end of the last segment that was only partly
+// written when the process stopped is truncated. A record that fails its
+// checksum anywhere else is reported as an *ErrCorruptSegment, as are records
+// that fail their checksum when they are read.
+//
+// It implements AllSubscriber so that subscriptions are pushed events as they
+// are appended. Close the store to release its files.
+type FileEventStore struct {
+	mu       sync.RWMutex
+	dir      string
+	config   FileEventStoreConfig
+	segments []*fileSegment
+	streams  map[string][]int64
+	all      []eventLocation
+	appended chan struct{}
+	closed   bool
+	dirty    bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// fileSegment is a segment file. Only the last segment is written to.
+type fileSegment struct {
+	file *os.File
+	path string
+	size int64
+}
+
+// eventLocation is where an event is in the segments.
+type eventLocation struct {
+	segment *fileSegment
+	offset  int64
+	size    int64
+	index   int
+}
+
+// fileRecord is the record of an append.
+type fileRecord struct {
+	streamName  string
+	eventNumber int64
+	created     time.Time
+	events      []EventData
+}
+
+// NewFileEventStore opens the FileEventStore in the directory specified,
+// creating the directory if necessary, and recovers the events in it.
+func NewFileEventStore(dir string, config FileEventStoreConfig) (*FileEventStore, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DefaultSegmentSize
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = time.Second
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create event store directory %s. Error: %+v", dir, err)
+	}
+
+	s := &FileEventStore{
+		dir:      dir,
+		config:   config,
+		streams:  make(map[string][]int64),
+		appended: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+
+	if config.SyncPolicy == SyncPeriodically {
+		s.wg.Add(1)
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+// Close syncs and closes the segment files. The store can not be used once it
+// is closed.
+func (s *FileEventStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.sync()
+	s.closeSegments()
+	close(s.appended)
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// AppendToStream appends events to the stream specified and returns the event
+// number of the last event in the stream.
+//
+// If the expectedVersion does not match the version of the stream an
+// *ErrWrongExpectedVersion is returned and no events are appended. The events
+// of an append are written as one record, of at most 1 GiB, and an
+// *ErrRecordTooLarge is returned for larger appends.
+func (s *FileEventStore) AppendToStream(ctx context.Context, streamName string, expectedVersion int64, events []EventData) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, fmt.Errorf("file event store %s is closed", s.dir)
+	}
+
+	stream := s.streams[streamName]
+	current := int64(len(stream)) - 1
+
+	if expectedVersion != ExpectedVersionAny && expectedVersion != current {
+		return 0, &ErrWrongExpectedVersion{
+			StreamName:      streamName,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   current,
+		}
+	}
+	if len(events) == 0 {
+		return current, nil
+	}
+
+	record, err := encodeRecord(fileRecord{
+		streamName:  streamName,
+		eventNumber: current + 1,
+		created:     time.Now().UTC(),
+		events:      events,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	segment, err := s.writableSegment()
+	if err != nil {
+		return 0, err
+	}
+	offset := segment.size
+	if _, err := segment.file.WriteAt(record, offset); err != nil {
+		// Leave nothing of the record behind so the next append is not
+		// written after a torn record.
+		_ = segment.file.Truncate(offset)
+		return 0, fmt.Errorf("could not append to stream %s. Error: %+v", streamName, err)
+	}
+	segment.size += int64(len(record))
+	s.dirty = true
+
+	if s.config.SyncPolicy == SyncAlways {
+		if err := s.sync(); err != nil {
+			_ = segment.file.Truncate(offset)
+			segment.size = offset
+			return 0, err
+		}
+	}
+
+	s.index(segment, offset, int64(len(record)), streamName, len(events))
+
+	// Wake up any subscribers waiting for events.
+	close(s.appended)
+	s.appended = make(chan struct{})
+	return current + int64(len(events)), nil
+}
+
+// ReadStreamForwards reads at most count events from the stream starting
+// from and including the event number specified.
+//
+// If the stream does not exist an *ErrStreamNotFound is returned.
+func (s *FileEventStore) ReadStreamForwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stream, ok := s.streams[streamName]
+	if !ok {
+		return nil, &ErrStreamNotFound{StreamName: streamName}
+	}
+	if from < 0 {
+		from = 0
+	}
+
+	var positions []int64
+	for i := from; i < int64(len(stream)) && len(positions) < count; i++ {
+		positions = append(positions, stream[i])
+	}
+	return s.read(positions)
+}
+
+// ReadStreamBackwards reads at most count events from the stream in reverse
+// order starting from and including the event number specified.
+//
+// If the stream does not exist an *ErrStreamNotFound is returned.
+func (s *FileEventStore) ReadStreamBackwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stream, ok := s.streams[streamName]
+	if !ok {
+		return nil, &ErrStreamNotFound{StreamName: streamName}
+	}
+	if from == StreamEnd || from >= int64(len(stream)) {
+		from = int64(len(stream)) - 1
+	}
+
+	var positions []int64
+	for i := from; i >= 0 && len(positions) < count; i-- {
+		positions = append(positions, stream[i])
+	}
+	return s.read(positions)
+}
+
+// ReadAll reads at most count events from the global log with a position
+// greater than the one specified.
+func (s *FileEventStore) ReadAll(ctx context.Context, after Position, count int) ([]RecordedEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start := after.Commit + 1
+	if start < 0 {
+		start = 0
+	}
+
+	var positions []int64
+	for i := start; i < int64(len(s.all)) && len(positions) < count; i++ {
+		positions = append(positions, i)
+	}
+	return s.read(positions)
+}
+
+// SubscribeToAll calls handle with each event in the global log with a
+// position greater than the one specified, waiting for events to be appended,
+// until the context is done or handle returns an error.
+func (s *FileEventStore) SubscribeToAll(ctx context.Context, after Position, handle func(RecordedEvent) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.mu.RLock()
+		appended := s.appended
+		closed := s.closed
+		s.mu.RUnlock()
+		if closed {
+			return fmt.Errorf("file event store %s is closed", s.dir)
+		}
+
+		events, err := s.ReadAll(ctx, after, DefaultReadBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if err := handle(event); err != nil {
+				return err
+			}
+			after = event.Position
+		}
+
+		if len(events) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-appended:
+			}
+		}
+	}
+}
+
+// read returns the events at the positions. The lock must be held.
+func (s *FileEventStore) read(positions []int64) ([]RecordedEvent, error) {
+	ret := []RecordedEvent{}
+
+	var last eventLocation
+	var record fileRecord
+	for _, position := range positions {
+		loc := s.all[position]
+		if loc.segment != last.segment || loc.offset != last.offset || record.events == nil {
+			var err error
+			record, err = readRecord(loc.segment, loc.offset, loc.size)
+			if err != nil {
+				return nil, err
+			}
+			last = loc
+		}
+
+		e := record.events[loc.index]
+		ret = append(ret, RecordedEvent{
+			EventID:     e.EventID,
+			EventType:   e.EventType,
+			ContentType: e.ContentType,
+			StreamName:  record.streamName,
+			EventNumber: record.eventNumber + int64(loc.index),
+			Position:    LogPosition(position),
+			Created:     record.created,
+			Data:        e.Data,
+			Metadata:    e.Metadata,
+		})
+	}
+	return ret, nil
+}
+
+// index adds the events of a record to the index. The lock must be held.
+func (s *FileEventStore) index(segment *fileSegment, offset int64, size int64, streamName string, count int) {
+	for i := 0; i < count; i++ {
+		s.streams[streamName] = append(s.streams[streamName], int64(len(s.all)))
+		s.all = append(s.all, eventLocation{
+			segment: segment,
+			offset:  offset,
+			size:    size,
+			index:   i,
+		})
+	}
+}
+
+// writableSegment returns the last segment, starting a new one if it is full.
+// The lock must be held.
+func (s *FileEventStore) writableSegment() (*fileSegment, error) {
+	if n := len(s.segments); n > 0 && s.segments[n-1].size < s.config.SegmentSize {
+		return s.segments[n-1], nil
+	}
+
+	if err := s.sync(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", len(s.all), segmentExt))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create segment %s. Error: %+v", path, err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	segment := &fileSegment{file: file, path: path}
+	s.segments = append(s.segments, segment)
+	return segment, nil
+}
+
+// sync flushes the last segment if it has been written to since it was last
+// synced. The lock must be held.
+func (s *FileEventStore) sync() error {
+	if !s.dirty || len(s.segments) == 0 {
+		return nil
+	}
+	segment := s.segments[len(s.segments)-1]
+	if err := segment.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync segment %s. Error: %+v", segment.path, err)
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *FileEventStore) syncPeriodically() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if !s.closed {
+				_ = s.sync()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// recover opens the segments in the directory and rebuilds the index from
+// their records, truncating a torn record at the end of the last segment.
+func (s *FileEventStore) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("could not read event store directory %s. Error: %+v", s.dir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), segmentExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		path := filepath.Join(s.dir, name)
+		first, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil || first != int64(len(s.all)) {
+			return &ErrCorruptSegment{Segment: path, Reason: fmt.Sprintf("segment should start at position %d", len(s.all))}
+		}
+
+		file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+		if err != nil {
+			return fmt.Errorf("could not open segment %s. Error: %+v", path, err)
+		}
+		segment := &fileSegment{file: file, path: path}
+		s.segments = append(s.segments, segment)
+
+		last := i == len(names)-1
+		if err := s.recoverSegment(segment, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverSegment indexes the records of the segment.
+func (s *FileEventStore) recoverSegment(segment *fileSegment, last bool) error {
+	info, err := segment.file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not open segment %s. Error: %+v", segment.path, err)
+	}
+	end := info.Size()
+
+	var offset int64
+	for offset < end {
+		size, record, err := scanRecord(segment, offset, end)
+		if err != nil {
+			// Only the last record of the last segment can have been torn by
+			// the process stopping while it was written.
+			var corrupt *ErrCorruptSegment
+			if !last || !errors.As(err, &corrupt) || (size > 0 && offset+size < end) {
+				return err
+			}
+
+			if err := segment.file.Truncate(offset); err != nil {
+				return fmt.Errorf("could not truncate segment %s. Error: %+v", segment.path, err)
+			}
+			if err := segment.file.Sync(); err != nil {
+				return fmt.Errorf("could not sync segment %s. Error: %+v", segment.path, err)
+			}
+			break
+		}
+
+		if n := int64(len(s.streams[record.streamName])); record.eventNumber != n {
+			return &ErrCorruptSegment{
+				Segment: segment.path,
+				Offset:  offset,
+				Reason:  fmt.Sprintf("event %d of stream %s follows event %d", record.eventNumber, record.streamName, n-1),
+			}
+		}
+		s.index(segment, offset, size, record.streamName, len(record.events))
+		offset += size
+	}
+
+	segment.size = offset
+	return nil
+}
+
+// scanRecord reads the record at the offset of a segment that ends at end and
+// returns its size, which is 0 if the header of the record is not complete.
+func scanRecord(segment *fileSegment, offset int64, end int64) (int64, fileRecord, error) {
+	if end-offset < recordHeaderSize {
+		return 0, fileRecord{}, &ErrCorruptSegment{Segment: segment.path, Offset: offset, Reason: "record header is incomplete"}
+	}
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := segment.file.ReadAt(header, offset); err != nil {
+		return 0, fileRecord{}, fmt.Errorf("could not read segment %s. Error: %+v", segment.path, err)
+	}
+	length := int64(binary.LittleEndian.Uint32(header))
+	if length > maxRecordSize || end-offset-recordHeaderSize < length {
+		return 0, fileRecord{}, &ErrCorruptSegment{Segment: segment.path, Offset: offset, Reason: "record is incomplete"}
+	}
+	if length == 0 {
+		return 0, fileRecord{}, &ErrCorruptSegment{Segment: segment.path, Offset: offset, Reason: "record is empty"}
+	}
+
+	size := recordHeaderSize + length
+	record, err := readRecord(segment, offset, size)
+	return size, record, err
+}
+
+// readRecord reads and verifies the record of the size specified at the
+// offset of the segment.
+func readRecord(segment *fileSegment, offset int64, size int64) (fileRecord, error) {
+	b := make([]byte, size)
+	if n, err := segment.file.ReadAt(b, offset); n < len(b) {
+		return fileRecord{}, fmt.Errorf("could not read segment %s. Error: %+v", segment.path, err)
+	}
+
+	payload := b[recordHeaderSize:]
+	if int64(binary.LittleEndian.Uint32(b)) != int64(len(payload)) {
+		return fileRecord{}, &ErrCorruptSegment{Segment: segment.path, Offset: offset, Reason: "record length does not match"}
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(b[4:]) {
+		return fileRecord{}, &ErrCorruptSegment{Segment: segment.path, Offset: offset, Reason: "checksum does not match"}
+	}
+
+	record, err := decodeRecord(payload)
+	if err != nil {
+		return fileRecord{}, &ErrCorruptSegment{Segment: segment.path, Offset: offset, Reason: err.Error()}
+	}
+	return record, nil
+}
+
+// closeSegments closes the segment files. The lock must be held.
+func (s *FileEventStore) closeSegments() {
+	for _, segment := range s.segments {
+		_ = segment.file.Close()
+	}
+}
+
+// encodeRecord returns the header and payload of the record, or an
+// *ErrRecordTooLarge if the payload is larger than the maxRecordSize.
+func encodeRecord(r fileRecord) ([]byte, error) {
+	b := make([]byte, recordHeaderSize, 256)
+	b = appendString(b, r.streamName)
+	b = binary.AppendVarint(b, r.eventNumber)
+	b = binary.AppendVarint(b, r.created.UnixNano())
+	b = binary.AppendUvarint(b, uint64(len(r.events)))
+	for _, e := range r.events {
+		b = appendString(b, e.EventID)
+		b = appendString(b, e.EventType)
+		b = appendString(b, e.ContentType)
+		b = appendBytes(b, e.Data)
+		b = appendBytes(b, e.Metadata)
+	}
+
+	payload := b[recordHeaderSize:]
+	if int64(len(payload)) > maxRecordSize {
+		return nil, &ErrRecordTooLarge{StreamName: r.streamName, Size: int64(len(payload)), MaxSize: maxRecordSize}
+	}
+	binary.LittleEndian.PutUint32(b, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(payload, crcTable))
+	return b, nil
+}
+
+// decodeRecord decodes the payload of a record.
+func decodeRecord(payload []byte) (fileRecord, error) {
+	d := &recordDecoder{b: payload}
+
+	var r fileRecord
+	r.streamName = d.string()
+	r.eventNumber = d.varint()
+	r.created = time.Unix(0, d.varint()).UTC()
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(payload)) {
+		d.err = fmt.Errorf("record has %d events", n)
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		r.events = append(r.events, EventData{
+			EventID:     d.string(),
+			EventType:   d.string(),
+			ContentType: d.string(),
+			Data:        d.bytes(),
+			Metadata:    d.bytes(),
+		})
+	}
+	if d.err == nil && len(r.events) == 0 {
+		d.err = fmt.Errorf("record has no events")
+	}
+	return r, d.err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendBytes(b []byte, p []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+// recordDecoder reads the fields of a record payload, keeping the first error.
+type recordDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("record is truncated")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *recordDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("record is truncated")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *recordDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = fmt.Errorf("record is truncated")
+		return nil
+	}
+	p := append([]byte(nil), d.b[:n]...)
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *recordDecoder) string() string {
+	return string(d.bytes())
+}
+
+// syncDir syncs a directory so that the files created in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not sync directory %s. Error: %+v", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync directory %s. Error: %+v", dir, err)
+	}
+	return nil
+}
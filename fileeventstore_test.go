@@ -0,0 +1,287 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&FileEventStoreSuite{})
+
+type FileEventStoreSuite struct {
+	ctx   context.Context
+	dir   string
+	store *FileEventStore
+}
+
+func (s *FileEventStoreSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+	s.dir = c.MkDir()
+	s.store = s.open(c, FileEventStoreConfig{})
+}
+
+func (s *FileEventStoreSuite) TearDownTest(c *C) {
+	c.Assert(s.store.Close(), IsNil)
+}
+
+func (s *FileEventStoreSuite) open(c *C, config FileEventStoreConfig) *FileEventStore {
+	store, err := NewFileEventStore(s.dir, config)
+	c.Assert(err, IsNil)
+	return store
+}
+
+// reopen closes the store and opens it again from its directory.
+func (s *FileEventStoreSuite) reopen(c *C, config FileEventStoreConfig) {
+	c.Assert(s.store.Close(), IsNil)
+	s.store = s.open(c, config)
+}
+
+// lastSegment returns the path of the last segment file.
+func (s *FileEventStoreSuite) lastSegment(c *C) string {
+	segments, err := filepath.Glob(filepath.Join(s.dir, "*.seg"))
+	c.Assert(err, IsNil)
+	c.Assert(len(segments) > 0, Equals, true)
+	return segments[len(segments)-1]
+}
+
+func (s *FileEventStoreSuite) TestAppendAndRead(c *C) {
+	events := NewTestEventData(3)
+	events[0].Metadata = []byte(`{"UserID":"user"}`)
+
+	version, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, events)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, int64(2))
+
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 3)
+	for i, e := range got {
+		c.Assert(e.EventID, Equals, events[i].EventID)
+		c.Assert(e.EventType, Equals, events[i].EventType)
+		c.Assert(e.ContentType, Equals, events[i].ContentType)
+		c.Assert(e.StreamName, Equals, "stream")
+		c.Assert(e.EventNumber, Equals, int64(i))
+		c.Assert(e.Position, Equals, LogPosition(int64(i)))
+		c.Assert(e.Data, DeepEquals, events[i].Data)
+	}
+	c.Assert(string(got[0].Metadata), Equals, `{"UserID":"user"}`)
+
+	got, err = s.store.ReadStreamBackwards(s.ctx, "stream", StreamEnd, 2)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0].EventNumber, Equals, int64(2))
+	c.Assert(got[1].EventNumber, Equals, int64(1))
+}
+
+func (s *FileEventStoreSuite) TestAppendWithWrongExpectedVersionReturnsAnError(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(2))
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", 0, NewTestEventData(1))
+
+	c.Assert(err, DeepEquals, &ErrWrongExpectedVersion{
+		StreamName:      "stream",
+		ExpectedVersion: 0,
+		ActualVersion:   1,
+	})
+	_, err = s.store.AppendToStream(s.ctx, "stream", 1, NewTestEventData(1))
+	c.Assert(err, IsNil)
+}
+
+func (s *FileEventStoreSuite) TestReadMissingStreamReturnsStreamNotFound(c *C) {
+	_, err := s.store.ReadStreamForwards(s.ctx, "missing", StreamStart, 10)
+	c.Assert(err, DeepEquals, &ErrStreamNotFound{StreamName: "missing"})
+
+	_, err = s.store.ReadStreamBackwards(s.ctx, "missing", StreamEnd, 10)
+	c.Assert(err, DeepEquals, &ErrStreamNotFound{StreamName: "missing"})
+}
+
+func (s *FileEventStoreSuite) TestReadAllAcrossStreams(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "a", ExpectedVersionAny, NewTestEventData(2))
+	_, _ = s.store.AppendToStream(s.ctx, "b", ExpectedVersionAny, NewTestEventData(1))
+	_, _ = s.store.AppendToStream(s.ctx, "a", ExpectedVersionAny, NewTestEventData(1))
+
+	got, err := s.store.ReadAll(s.ctx, LogPosition(1), 10)
+
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0].Position, Equals, LogPosition(2))
+	c.Assert(got[0].StreamName, Equals, "b")
+	c.Assert(got[1].EventNumber, Equals, int64(2))
+}
+
+func (s *FileEventStoreSuite) TestEventsSurviveReopening(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "a", ExpectedVersionNoStream, NewTestEventData(2))
+	_, _ = s.store.AppendToStream(s.ctx, "b", ExpectedVersionNoStream, NewTestEventData(1))
+
+	s.reopen(c, FileEventStoreConfig{})
+
+	got, err := s.store.ReadAll(s.ctx, PositionStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 3)
+	c.Assert(got[2].StreamName, Equals, "b")
+	_, err = s.store.AppendToStream(s.ctx, "a", 1, NewTestEventData(1))
+	c.Assert(err, IsNil)
+}
+
+func (s *FileEventStoreSuite) TestSegmentsRollOver(c *C) {
+	s.reopen(c, FileEventStoreConfig{SegmentSize: 200})
+
+	for i := 0; i < 10; i++ {
+		_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionAny, NewTestEventData(2))
+		c.Assert(err, IsNil)
+	}
+	segments, _ := filepath.Glob(filepath.Join(s.dir, "*.seg"))
+	c.Assert(len(segments) > 1, Equals, true)
+
+	s.reopen(c, FileEventStoreConfig{SegmentSize: 200})
+
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 100)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 20)
+	c.Assert(got[19].EventNumber, Equals, int64(19))
+	c.Assert(got[19].Position, Equals, LogPosition(19))
+}
+
+func (s *FileEventStoreSuite) TestTornAppendIsTruncated(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(2))
+	c.Assert(s.store.Close(), IsNil)
+
+	path := s.lastSegment(c)
+	info, _ := os.Stat(path)
+	torn, err := encodeRecord(fileRecord{streamName: "stream", eventNumber: 2, events: NewTestEventData(1)})
+	c.Assert(err, IsNil)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	c.Assert(err, IsNil)
+	_, _ = f.Write(torn[:len(torn)-3])
+	_ = f.Close()
+
+	s.store = s.open(c, FileEventStoreConfig{})
+
+	info2, _ := os.Stat(path)
+	c.Assert(info2.Size(), Equals, info.Size())
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	_, err = s.store.AppendToStream(s.ctx, "stream", 1, NewTestEventData(1))
+	c.Assert(err, IsNil)
+}
+
+func (s *FileEventStoreSuite) TestCorruptRecordIsReported(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(1))
+	_, _ = s.store.AppendToStream(s.ctx, "stream", 0, NewTestEventData(1))
+
+	path := s.lastSegment(c)
+	b, _ := os.ReadFile(path)
+	b[recordHeaderSize+3] ^= 0xff
+	c.Assert(os.WriteFile(path, b, 0o644), IsNil)
+
+	_, err := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(err, FitsTypeOf, &ErrCorruptSegment{})
+	c.Assert(err, ErrorMatches, ".*checksum does not match")
+
+	c.Assert(s.store.Close(), IsNil)
+	_, err = NewFileEventStore(s.dir, FileEventStoreConfig{})
+	c.Assert(err, FitsTypeOf, &ErrCorruptSegment{})
+
+	// Leave a store for TearDownTest to close.
+	c.Assert(os.Remove(path), IsNil)
+	s.store = s.open(c, FileEventStoreConfig{})
+}
+
+func (s *FileEventStoreSuite) TestOversizeAppendIsRejected(c *C) {
+	defer func(size int64) { maxRecordSize = size }(maxRecordSize)
+	maxRecordSize = 1024
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(1))
+	c.Assert(err, IsNil)
+
+	events := NewTestEventData(1)
+	events[0].Data = make([]byte, 1024)
+	_, err = s.store.AppendToStream(s.ctx, "stream", 0, events)
+	c.Assert(err, FitsTypeOf, &ErrRecordTooLarge{})
+
+	s.reopen(c, FileEventStoreConfig{})
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 1)
+}
+
+func (s *FileEventStoreSuite) TestSyncPeriodically(c *C) {
+	s.reopen(c, FileEventStoreConfig{SyncPolicy: SyncPeriodically, SyncInterval: time.Millisecond})
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(1))
+	c.Assert(err, IsNil)
+	time.Sleep(5 * time.Millisecond)
+
+	s.reopen(c, FileEventStoreConfig{SyncPolicy: SyncNever})
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 1)
+}
+
+func (s *FileEventStoreSuite) TestClosedStoreRejectsAppends(c *C) {
+	c.Assert(s.store.Close(), IsNil)
+	c.Assert(s.store.Close(), IsNil)
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionAny, NewTestEventData(1))
+	c.Assert(err, ErrorMatches, "file event store .* is closed")
+
+	s.store = s.open(c, FileEventStoreConfig{})
+}
+
+func (s *FileEventStoreSuite) TestSubscribeToAll(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionAny, NewTestEventData(1))
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	received := make(chan RecordedEvent, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.store.SubscribeToAll(ctx, PositionStart, func(e RecordedEvent) error {
+			received <- e
+			return nil
+		})
+	}()
+	c.Assert((<-received).Position, Equals, LogPosition(0))
+
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionAny, NewTestEventData(1))
+	c.Assert((<-received).Position, Equals, LogPosition(1))
+
+	cancel()
+	c.Assert(<-done, Equals, context.Canceled)
+}
+
+func (s *FileEventStoreSuite) TestRepository(c *C) {
+	common, err := NewCommonDomainRepository(s.store, &MockEventBus{})
+	c.Assert(err, IsNil)
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	common.SetEventFactory(eventFactory)
+	repo, err := NewRepository(common, newTypedSnapshotAggregate)
+	c.Assert(err, IsNil)
+
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 2}, nil), true)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 3}, nil), true)
+	c.Assert(repo.Save(agg, nil), IsNil)
+
+	s.reopen(c, FileEventStoreConfig{})
+	common, _ = NewCommonDomainRepository(s.store, &MockEventBus{})
+	common.SetEventFactory(eventFactory)
+	repo, _ = NewRepository(common, newTypedSnapshotAggregate)
+
+	loaded, err := repo.Load(id)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Total, Equals, 5)
+	c.Assert(loaded.CurrentVersion(), Equals, int64(1))
+}
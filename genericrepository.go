@@ -0,0 +1,131 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Repository is a type safe repository for aggregates of type T.
+//
+// Load returns a T so there is no need to pass the name of the aggregate type
+// or to assert the type of the aggregate returned. The aggregate type name is
+// the name of T in the TypeRegistry of the CommonDomainRepository when the
+// Repository is constructed and, by default, the stream name is the aggregate
+// type name and the aggregate ID separated by a hyphen.
+//
+// A Repository persists events with a CommonDomainRepository so the event
+// factory, metadata codec, snapshots and publish mode of the
+// CommonDomainRepository apply. The aggregate factory and stream name
+// delegate of the CommonDomainRepository are not used.
+type Repository[T AggregateRoot] struct {
+	repository         *CommonDomainRepository
+	newAggregate       func(id string) T
+	aggregateType      string
+	streamNameDelegate func(string, string) string
+}
+
+// NewRepository constructs a new Repository for the aggregates that
+// newAggregate constructs.
+//
+//	orders, err := NewRepository(repo, NewOrder)
+func NewRepository[T AggregateRoot](repository *CommonDomainRepository, newAggregate func(id string) T) (*Repository[T], error) {
+	if repository == nil {
+		return nil, fmt.Errorf("nil CommonDomainRepository injected into repository")
+	}
+	if newAggregate == nil {
+		return nil, fmt.Errorf("nil aggregate constructor injected into repository")
+	}
+
+	if t := reflect.TypeOf((*T)(nil)).Elem(); t.Kind() == reflect.Interface {
+		return nil, &ErrInvalidType{Type: t.String(), Reason: "an interface can not be an aggregate type"}
+	}
+
+	var zero T
+	aggregateType, err := repository.types.Name(zero)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Repository[T]{
+		repository:    repository,
+		newAggregate:  newAggregate,
+		aggregateType: aggregateType,
+		streamNameDelegate: func(t string, id string) string {
+			return t + "-" + id
+		},
+	}, nil
+}
+
+// SetStreamNameDelegate sets the function that constructs the stream name
+// from the aggregate type name and aggregate ID.
+func (r *Repository[T]) SetStreamNameDelegate(delegate func(string, string) string) {
+	r.streamNameDelegate = delegate
+}
+
+// AggregateType returns the aggregate type name of T.
+func (r *Repository[T]) AggregateType() string {
+	return r.aggregateType
+}
+
+// StreamName returns the name of the stream of the aggregate with the ID
+// specified.
+func (r *Repository[T]) StreamName(id string) string {
+	return r.streamNameDelegate(r.aggregateType, id)
+}
+
+// Load loads the aggregate with the ID specified in the same way as the Load
+// method of CommonDomainRepository.
+//
+// If the stream does not exist an *ErrAggregateNotFound is returned.
+func (r *Repository[T]) Load(id string) (T, error) {
+	return r.LoadContext(context.Background(), id)
+}
+
+// LoadContext loads the aggregate in the same way as Load using the context
+// for all reads.
+func (r *Repository[T]) LoadContext(ctx context.Context, id string) (T, error) {
+	aggregate := r.newAggregate(id)
+	if err := r.repository.load(ctx, aggregate, r.aggregateType, r.StreamName(id)); err != nil {
+		var zero T
+		return zero, err
+	}
+	return aggregate, nil
+}
+
+// Save persists the aggregate in the same way as the Save method of
+// CommonDomainRepository.
+func (r *Repository[T]) Save(aggregate T, expectedVersion *int64) error {
+	return r.SaveContext(context.Background(), aggregate, expectedVersion)
+}
+
+// SaveContext persists the aggregate in the same way as Save using the
+// context for the append and when publishing events.
+func (r *Repository[T]) SaveContext(ctx context.Context, aggregate T, expectedVersion *int64) error {
+	return r.repository.save(ctx, aggregate, r.StreamName(aggregate.AggregateID()), expectedVersion)
+}
+
+// SaveSnapshot takes a snapshot of the aggregate on demand in the same way as
+// the SaveSnapshot method of CommonDomainRepository.
+func (r *Repository[T]) SaveSnapshot(aggregate T) error {
+	return r.SaveSnapshotContext(context.Background(), aggregate)
+}
+
+// SaveSnapshotContext takes a snapshot of the aggregate in the same way as
+// SaveSnapshot using the context when storing the snapshot.
+func (r *Repository[T]) SaveSnapshotContext(ctx context.Context, aggregate T) error {
+	if r.repository.snapshotStore == nil {
+		return fmt.Errorf("the common domain repository has no snapshot store")
+	}
+
+	if len(aggregate.GetChanges()) > 0 {
+		return fmt.Errorf("can not snapshot aggregate %s with unsaved changes", aggregate.AggregateID())
+	}
+
+	return r.repository.saveSnapshot(ctx, aggregate, r.StreamName(aggregate.AggregateID()), aggregate.OriginalVersion())
+}
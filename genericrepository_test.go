@@ -0,0 +1,154 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RepositorySuite{})
+
+type RepositorySuite struct {
+	store  *InMemoryEventStore
+	bus    *MockEventBus
+	common *CommonDomainRepository
+	repo   *Repository[*SnapshotAggregate]
+}
+
+func newTypedSnapshotAggregate(id string) *SnapshotAggregate {
+	return NewSnapshotAggregate(id).(*SnapshotAggregate)
+}
+
+func (s *RepositorySuite) SetUpTest(c *C) {
+	s.store = NewInMemoryEventStore()
+	s.bus = &MockEventBus{}
+
+	common, err := NewCommonDomainRepository(s.store, s.bus)
+	c.Assert(err, IsNil)
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	common.SetEventFactory(eventFactory)
+	s.common = common
+
+	repo, err := NewRepository(common, newTypedSnapshotAggregate)
+	c.Assert(err, IsNil)
+	s.repo = repo
+}
+
+func (s *RepositorySuite) TestNewRepositoryRequiresDependencies(c *C) {
+	_, err := NewRepository[*SnapshotAggregate](nil, newTypedSnapshotAggregate)
+	c.Assert(err, ErrorMatches, "nil CommonDomainRepository injected into repository")
+
+	_, err = NewRepository[*SnapshotAggregate](s.common, nil)
+	c.Assert(err, ErrorMatches, "nil aggregate constructor injected into repository")
+}
+
+func (s *RepositorySuite) TestNewRepositoryRequiresConcreteType(c *C) {
+	_, err := NewRepository(s.common, NewSomeAggregate)
+	c.Assert(err, DeepEquals, &ErrInvalidType{
+		Type:   "eventsourcing.AggregateRoot",
+		Reason: "an interface can not be an aggregate type",
+	})
+}
+
+func (s *RepositorySuite) TestDerivesTypeAndStreamName(c *C) {
+	c.Assert(s.repo.AggregateType(), Equals, "eventsourcing.SnapshotAggregate")
+	c.Assert(s.repo.StreamName("1"), Equals, "eventsourcing.SnapshotAggregate-1")
+
+	s.repo.SetStreamNameDelegate(func(t string, id string) string { return "orders-" + id })
+	c.Assert(s.repo.StreamName("1"), Equals, "orders-1")
+}
+
+func (s *RepositorySuite) TestSaveAndLoad(c *C) {
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Item: "one", Count: 2}, nil), true)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Item: "two", Count: 3}, nil), true)
+
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+	c.Assert(s.bus.events, HasLen, 2)
+
+	loaded, err := s.repo.Load(id)
+
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Total, Equals, 5)
+	c.Assert(loaded.CurrentVersion(), Equals, int64(1))
+
+	events, err := s.store.ReadStreamForwards(context.Background(), "eventsourcing.SnapshotAggregate-"+id, StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 2)
+}
+
+func (s *RepositorySuite) TestSaveRaiseAndSaveAgain(c *C) {
+	common, err := NewCommonDomainRepository(s.store, s.bus)
+	c.Assert(err, IsNil)
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	common.SetEventFactory(eventFactory)
+	repo, err := NewRepository(common, NewRoutedAggregate)
+	c.Assert(err, IsNil)
+
+	agg := NewRoutedAggregate(NewUUID())
+	c.Assert(agg.Raise(&SomeEvent{Item: "one", Count: 1}), IsNil)
+	c.Assert(repo.Save(agg, nil), IsNil)
+
+	c.Assert(agg.Raise(&SomeEvent{Item: "two", Count: 2}), IsNil)
+	c.Assert(*agg.GetChanges()[0].Version(), Equals, int64(1))
+	c.Assert(repo.Save(agg, nil), IsNil)
+
+	loaded, err := repo.Load(agg.AggregateID())
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Items, DeepEquals, []string{"one", "two"})
+	c.Assert(loaded.CurrentVersion(), Equals, int64(1))
+}
+
+func (s *RepositorySuite) TestLoadReturnsNotFound(c *C) {
+	loaded, err := s.repo.Load("missing")
+
+	c.Assert(loaded, IsNil)
+	c.Assert(err, DeepEquals, &ErrAggregateNotFound{AggregateID: "missing", AggregateType: "eventsourcing.SnapshotAggregate"})
+}
+
+func (s *RepositorySuite) TestSaveDetectsConcurrencyViolation(c *C) {
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 1}, nil), true)
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+
+	stale := newTypedSnapshotAggregate(id)
+	stale.Apply(NewEventMessage(id, &SomeEvent{Count: 1}, nil), true)
+
+	c.Assert(s.repo.Save(stale, nil), FitsTypeOf, &ErrConcurrencyViolation{})
+}
+
+func (s *RepositorySuite) TestSaveSnapshot(c *C) {
+	c.Assert(s.repo.SaveSnapshot(newTypedSnapshotAggregate("1")), ErrorMatches, ".*no snapshot store")
+
+	snapshots := NewInMemorySnapshotStore()
+	s.common.SetSnapshotStore(snapshots)
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 4}, nil), true)
+	c.Assert(s.repo.SaveSnapshot(agg), ErrorMatches, "can not snapshot .* unsaved changes")
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+
+	loaded, err := s.repo.Load(id)
+	c.Assert(err, IsNil)
+	c.Assert(s.repo.SaveSnapshot(loaded), IsNil)
+
+	snapshot, err := snapshots.GetSnapshot(context.Background(), "eventsourcing.SnapshotAggregate-"+id)
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Version, Equals, int64(0))
+
+	loaded, err = s.repo.Load(id)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Total, Equals, 4)
+	c.Assert(loaded.applied, Equals, 0)
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	esDb "github.com/EventStore/EventStore-Client-Go/client"
+	"github.com/EventStore/EventStore-Client-Go/direction"
+	esErrors "github.com/EventStore/EventStore-Client-Go/errors"
+	"github.com/EventStore/EventStore-Client-Go/messages"
+	"github.com/EventStore/EventStore-Client-Go/position"
+	"github.com/EventStore/EventStore-Client-Go/streamrevision"
+	"github.com/gofrs/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetEventStore is an implementation of the EventStore interface that persists
+// events in GetEventStore using the EventStore-Client-Go client.
+type GetEventStore struct {
+	client *esDb.Client
+}
+
+// NewGetEventStore constructs a new GetEventStore
+func NewGetEventStore(client *esDb.Client) (*GetEventStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("nil Eventstore client injected into GetEventStore")
+	}
+
+	return &GetEventStore{
+		client: client,
+	}, nil
+}
+
+// AppendToStream appends events to the stream specified and returns the event
+// number of the last event in the stream.
+//
+// The expected version is translated into the exact expected stream revision.
+// If GetEventStore rejects the append because the stream is not at that
+// revision an *ErrWrongExpectedVersion is returned. If GetEventStore can not
+// be reached an *ErrRepositoryUnavailable is returned.
+func (s *GetEventStore) AppendToStream(ctx context.Context, streamName string, expectedVersion int64, events []EventData) (int64, error) {
+	proposed := make([]messages.ProposedEvent, len(events))
+
+	for k, v := range events {
+		eventID, err := uuid.FromString(v.EventID)
+		if err != nil {
+			return 0, fmt.Errorf("invalid event id %s. Error: %+v", v.EventID, err)
+		}
+
+		proposed[k] = messages.ProposedEvent{
+			EventID:      eventID,
+			EventType:    v.EventType,
+			ContentType:  v.ContentType,
+			UserMetadata: v.Metadata,
+			Data:         v.Data,
+		}
+	}
+
+	result, err := s.client.AppendToStream(ctx, streamName, streamRevision(expectedVersion), proposed)
+	if errors.Is(err, esErrors.ErrWrongExpectedStreamRevision) {
+		return 0, &ErrWrongExpectedVersion{
+			StreamName:      streamName,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   s.currentVersion(ctx, streamName),
+		}
+	}
+	if err != nil {
+		return 0, storeError(streamName, err)
+	}
+	return int64(result.NextExpectedVersion), nil
+}
+
+// currentVersion returns the event number of the last event in the stream or
+// ExpectedVersionNoStream if the stream could not be read.
+func (s *GetEventStore) currentVersion(ctx context.Context, streamName string) int64 {
+	events, err := s.client.ReadStreamEvents(ctx, direction.Backwards, streamName, streamrevision.StreamRevisionEnd, 1, false)
+	if err != nil || len(events) == 0 {
+		return ExpectedVersionNoStream
+	}
+	return int64(events[0].EventNumber)
+}
+
+// ReadStreamForwards reads at most count events from the stream starting
+// from and including the event number specified.
+func (s *GetEventStore) ReadStreamForwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	events, err := s.client.ReadStreamEvents(ctx, direction.Forwards, streamName, uint64(from), uint64(count), false)
+	if err != nil {
+		return nil, storeError(streamName, err)
+	}
+	return recordedEvents(events), nil
+}
+
+// ReadStreamBackwards reads at most count events from the stream in reverse
+// order starting from and including the event number specified.
+func (s *GetEventStore) ReadStreamBackwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	revision := streamrevision.StreamRevisionEnd
+	if from != StreamEnd {
+		revision = uint64(from)
+	}
+
+	events, err := s.client.ReadStreamEvents(ctx, direction.Backwards, streamName, revision, uint64(count), false)
+	if err != nil {
+		return nil, storeError(streamName, err)
+	}
+	return recordedEvents(events), nil
+}
+
+// ReadAll reads at most count events from the $all stream with a position
+// greater than the one specified. Positions are compared by commit position
+// and then by prepare position, so reading can resume after any event of
+// a transaction.
+//
+// System events, those with an event type prefixed with $, are skipped.
+func (s *GetEventStore) ReadAll(ctx context.Context, after Position, count int) ([]RecordedEvent, error) {
+	from := allPosition(after)
+
+	ret := []RecordedEvent{}
+	for len(ret) < count {
+		events, err := s.client.ReadAllEvents(ctx, direction.Forwards, from, uint64(count+1), false)
+		if err != nil {
+			return nil, storeError("$all", err)
+		}
+
+		for _, e := range events {
+			from = e.Position
+			if !eventPosition(e.Position).After(after) || strings.HasPrefix(e.EventType, "$") {
+				continue
+			}
+			if len(ret) < count {
+				ret = append(ret, recordedEvent(e))
+			}
+		}
+
+		if len(events) <= count {
+			break
+		}
+		after = eventPosition(from)
+	}
+
+	return ret, nil
+}
+
+// SubscribeToAll subscribes to the $all stream and calls handle with each
+// event with a position greater than the one specified.
+//
+// System events are skipped. If the subscription is dropped an
+// *ErrRepositoryUnavailable is returned.
+func (s *GetEventStore) SubscribeToAll(ctx context.Context, after Position, handle func(RecordedEvent) error) error {
+	from := allPosition(after)
+
+	eventAppeared := make(chan messages.RecordedEvent)
+	checkpointReached := make(chan position.Position)
+	subscriptionDropped := make(chan string, 1)
+
+	sub, err := s.client.SubscribeToAll(ctx, from, false, eventAppeared, checkpointReached, subscriptionDropped)
+	if err != nil {
+		return unavailable(storeError("$all", err))
+	}
+	if err := sub.Start(); err != nil {
+		return unavailable(storeError("$all", err))
+	}
+	defer sub.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case reason := <-subscriptionDropped:
+			return &ErrRepositoryUnavailable{Err: fmt.Errorf("subscription to $all dropped: %s", reason)}
+		case <-checkpointReached:
+		case e := <-eventAppeared:
+			if !eventPosition(e.Position).After(after) || strings.HasPrefix(e.EventType, "$") {
+				continue
+			}
+			if err := handle(recordedEvent(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// storeError translates an error returned by the client into the errors
+// described by the EventStore interface.
+//
+// A missing stream is reported as an *ErrStreamNotFound and failures to reach
+// GetEventStore are reported as an *ErrRepositoryUnavailable.
+func storeError(streamName string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, esErrors.ErrStreamNotFound) {
+		return &ErrStreamNotFound{StreamName: streamName}
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return &ErrRepositoryUnavailable{Err: err}
+	}
+
+	return err
+}
+
+// streamRevision translates an expected version into a stream revision.
+func streamRevision(expectedVersion int64) streamrevision.StreamRevision {
+	switch expectedVersion {
+	case ExpectedVersionAny:
+		return streamrevision.StreamRevisionAny
+	case ExpectedVersionNoStream:
+		return streamrevision.StreamRevisionNoStream
+	default:
+		return streamrevision.NewStreamRevision(uint64(expectedVersion))
+	}
+}
+
+// allPosition translates a position into the position in the $all stream to
+// read from. Reads from a position include the event at it.
+func allPosition(after Position) position.Position {
+	if !after.After(PositionStart) {
+		return position.StartPosition
+	}
+	return position.Position{Commit: uint64(after.Commit), Prepare: uint64(after.Prepare)}
+}
+
+// eventPosition translates the position of an event in the $all stream.
+func eventPosition(p position.Position) Position {
+	return Position{Commit: int64(p.Commit), Prepare: int64(p.Prepare)}
+}
+
+func recordedEvents(events []messages.RecordedEvent) []RecordedEvent {
+	ret := make([]RecordedEvent, len(events))
+	for k, v := range events {
+		ret[k] = recordedEvent(v)
+	}
+	return ret
+}
+
+func recordedEvent(event messages.RecordedEvent) RecordedEvent {
+	return RecordedEvent{
+		EventID:     event.EventID.String(),
+		EventType:   event.EventType,
+		ContentType: event.ContentType,
+		StreamName:  event.StreamID,
+		EventNumber: int64(event.EventNumber),
+		Position:    eventPosition(event.Position),
+		Created:     event.CreatedDate,
+		Data:        event.Data,
+		Metadata:    event.UserMetadata,
+	}
+}
+
+// GetEventStoreCommonDomainRepo is an implementation of the DomainRepository
+// that uses GetEventStore for persistence
+type GetEventStoreCommonDomainRepo struct {
+	*CommonDomainRepository
+}
+
+// NewGetEventStoreCommonDomainRepo constructs a CommonDomainRepository over
+// a GetEventStore using the client provided.
+func NewGetEventStoreCommonDomainRepo(client *esDb.Client, eventBus EventBus) (*GetEventStoreCommonDomainRepo, error) {
+	eventStore, err := NewGetEventStore(client)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewCommonDomainRepository(eventStore, eventBus)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GetEventStoreCommonDomainRepo{
+		CommonDomainRepository: r,
+	}, nil
+}
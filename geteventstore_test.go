@@ -0,0 +1,67 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"fmt"
+
+	esErrors "github.com/EventStore/EventStore-Client-Go/errors"
+	"github.com/EventStore/EventStore-Client-Go/messages"
+	"github.com/EventStore/EventStore-Client-Go/position"
+	"github.com/EventStore/EventStore-Client-Go/streamrevision"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&GetEventStoreSuite{})
+
+type GetEventStoreSuite struct{}
+
+func (s *GetEventStoreSuite) TestStreamRevisionForExpectedVersionAny(c *C) {
+	c.Assert(streamRevision(ExpectedVersionAny), Equals, streamrevision.StreamRevisionAny)
+}
+
+func (s *GetEventStoreSuite) TestStreamRevisionForNewStream(c *C) {
+	c.Assert(streamRevision(ExpectedVersionNoStream), Equals, streamrevision.StreamRevisionNoStream)
+}
+
+func (s *GetEventStoreSuite) TestStreamRevisionForExactVersion(c *C) {
+	c.Assert(streamRevision(41), Equals, streamrevision.NewStreamRevision(41))
+}
+
+func (s *GetEventStoreSuite) TestNewGetEventStoreRequiresClient(c *C) {
+	store, err := NewGetEventStore(nil)
+	c.Assert(store, IsNil)
+	c.Assert(err, NotNil)
+}
+
+func (s *GetEventStoreSuite) TestStoreErrorMapsStreamNotFound(c *C) {
+	err := storeError("stream", esErrors.ErrStreamNotFound)
+	c.Assert(err, DeepEquals, &ErrStreamNotFound{StreamName: "stream"})
+}
+
+func (s *GetEventStoreSuite) TestStoreErrorMapsUnavailable(c *C) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	err := storeError("stream", unavailable)
+	c.Assert(err, DeepEquals, &ErrRepositoryUnavailable{Err: unavailable})
+}
+
+func (s *GetEventStoreSuite) TestStoreErrorPassesThroughOtherErrors(c *C) {
+	other := fmt.Errorf("some error")
+	c.Assert(storeError("stream", other), Equals, other)
+	c.Assert(storeError("stream", nil), IsNil)
+}
+
+func (s *GetEventStoreSuite) TestRecordedEventsKeepTheirPreparePosition(c *C) {
+	e := recordedEvent(messages.RecordedEvent{Position: position.Position{Commit: 1024, Prepare: 960}})
+	c.Assert(e.Position, Equals, Position{Commit: 1024, Prepare: 960})
+}
+
+func (s *GetEventStoreSuite) TestAllPosition(c *C) {
+	c.Assert(allPosition(PositionStart), Equals, position.StartPosition)
+	c.Assert(allPosition(Position{Commit: 1024, Prepare: 960}), Equals, position.Position{Commit: 1024, Prepare: 960})
+}
@@ -0,0 +1,201 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// InMemoryEventStore is an implementation of the EventStore interface that
+// holds all streams in memory.
+//
+// It is safe for concurrent use and is intended for tests and for running
+// the same repository code that is used in production without a database.
+//
+// Calls made with a context that is already cancelled return the context error.
+//
+// It implements AllSubscriber so that it can stand in for GetEventStore when
+// testing subscriptions.
+type InMemoryEventStore struct {
+	mu       sync.RWMutex
+	streams  map[string][]RecordedEvent
+	all      []RecordedEvent
+	appended chan struct{}
+}
+
+// NewInMemoryEventStore constructs a new InMemoryEventStore
+func NewInMemoryEventStore() *InMemoryEventStore {
+	return &InMemoryEventStore{
+		streams:  make(map[string][]RecordedEvent),
+		all:      []RecordedEvent{},
+		appended: make(chan struct{}),
+	}
+}
+
+// AppendToStream appends events to the stream specified and returns the event
+// number of the last event in the stream.
+//
+// If the expectedVersion does not match the version of the stream an
+// *ErrWrongExpectedVersion is returned and no events are appended.
+func (s *InMemoryEventStore) AppendToStream(ctx context.Context, streamName string, expectedVersion int64, events []EventData) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream := s.streams[streamName]
+	current := int64(len(stream)) - 1
+
+	if expectedVersion != ExpectedVersionAny && expectedVersion != current {
+		return 0, &ErrWrongExpectedVersion{
+			StreamName:      streamName,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   current,
+		}
+	}
+
+	for _, e := range events {
+		recorded := RecordedEvent{
+			EventID:     e.EventID,
+			EventType:   e.EventType,
+			ContentType: e.ContentType,
+			StreamName:  streamName,
+			EventNumber: int64(len(stream)),
+			Position:    LogPosition(int64(len(s.all))),
+			Created:     time.Now().UTC(),
+			Data:        append([]byte(nil), e.Data...),
+			Metadata:    append([]byte(nil), e.Metadata...),
+		}
+		stream = append(stream, recorded)
+		s.all = append(s.all, recorded)
+	}
+
+	s.streams[streamName] = stream
+
+	// Wake up any subscribers waiting for events.
+	close(s.appended)
+	s.appended = make(chan struct{})
+	return int64(len(stream)) - 1, nil
+}
+
+// ReadStreamForwards reads at most count events from the stream starting
+// from and including the event number specified.
+//
+// If the stream does not exist an *ErrStreamNotFound is returned.
+func (s *InMemoryEventStore) ReadStreamForwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stream, ok := s.streams[streamName]
+	if !ok {
+		return nil, &ErrStreamNotFound{StreamName: streamName}
+	}
+	if from < 0 {
+		from = 0
+	}
+
+	ret := []RecordedEvent{}
+	for i := from; i < int64(len(stream)) && len(ret) < count; i++ {
+		ret = append(ret, stream[i])
+	}
+	return ret, nil
+}
+
+// ReadStreamBackwards reads at most count events from the stream in reverse
+// order starting from and including the event number specified.
+//
+// If the stream does not exist an *ErrStreamNotFound is returned.
+func (s *InMemoryEventStore) ReadStreamBackwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stream, ok := s.streams[streamName]
+	if !ok {
+		return nil, &ErrStreamNotFound{StreamName: streamName}
+	}
+	if from == StreamEnd || from >= int64(len(stream)) {
+		from = int64(len(stream)) - 1
+	}
+
+	ret := []RecordedEvent{}
+	for i := from; i >= 0 && len(ret) < count; i-- {
+		ret = append(ret, stream[i])
+	}
+	return ret, nil
+}
+
+// ReadAll reads at most count events from the global log with a position
+// greater than the one specified.
+func (s *InMemoryEventStore) ReadAll(ctx context.Context, after Position, count int) ([]RecordedEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start := after.Commit + 1
+	if start < 0 {
+		start = 0
+	}
+
+	ret := []RecordedEvent{}
+	for i := start; i < int64(len(s.all)) && len(ret) < count; i++ {
+		ret = append(ret, s.all[i])
+	}
+	return ret, nil
+}
+
+// SubscribeToAll calls handle with each event in the global log with a
+// position greater than the one specified, waiting for events to be appended,
+// until the context is done or handle returns an error.
+func (s *InMemoryEventStore) SubscribeToAll(ctx context.Context, after Position, handle func(RecordedEvent) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		start := after.Commit + 1
+		if start < 0 {
+			start = 0
+		}
+
+		s.mu.RLock()
+		var events []RecordedEvent
+		if start < int64(len(s.all)) {
+			events = append(events, s.all[start:]...)
+		}
+		appended := s.appended
+		s.mu.RUnlock()
+
+		for _, event := range events {
+			if err := handle(event); err != nil {
+				return err
+			}
+			after = event.Position
+		}
+
+		if len(events) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-appended:
+			}
+		}
+	}
+}
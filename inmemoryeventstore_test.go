@@ -0,0 +1,177 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&InMemoryEventStoreSuite{})
+
+type InMemoryEventStoreSuite struct {
+	store *InMemoryEventStore
+	ctx   context.Context
+}
+
+func (s *InMemoryEventStoreSuite) SetUpTest(c *C) {
+	s.store = NewInMemoryEventStore()
+	s.ctx = context.Background()
+}
+
+func NewTestEventData(n int) []EventData {
+	events := make([]EventData, n)
+	for i := range events {
+		events[i] = EventData{
+			EventID:     NewUUID(),
+			EventType:   "eventsourcing.SomeEvent",
+			ContentType: "application/json",
+			Data:        []byte(fmt.Sprintf(`{"Item":"item %d","Count":%d}`, i, i)),
+		}
+	}
+	return events
+}
+
+func (s *InMemoryEventStoreSuite) TestNewInMemoryEventStore(c *C) {
+	store := NewInMemoryEventStore()
+	c.Assert(store, NotNil)
+	c.Assert(store.streams, NotNil)
+}
+
+func (s *InMemoryEventStoreSuite) TestAppendToNewStream(c *C) {
+	events := NewTestEventData(2)
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, events)
+	c.Assert(err, IsNil)
+
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	for i, e := range got {
+		c.Assert(e.EventID, Equals, events[i].EventID)
+		c.Assert(e.EventType, Equals, events[i].EventType)
+		c.Assert(e.StreamName, Equals, "stream")
+		c.Assert(e.EventNumber, Equals, int64(i))
+		c.Assert(e.Data, DeepEquals, events[i].Data)
+	}
+}
+
+func (s *InMemoryEventStoreSuite) TestAppendWithWrongExpectedVersionReturnsAnError(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(2))
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", 0, NewTestEventData(1))
+
+	c.Assert(err, DeepEquals, &ErrWrongExpectedVersion{
+		StreamName:      "stream",
+		ExpectedVersion: 0,
+		ActualVersion:   1,
+	})
+
+	got, _ := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(got, HasLen, 2)
+}
+
+func (s *InMemoryEventStoreSuite) TestAppendWithExpectedVersionAny(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(2))
+
+	version, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionAny, NewTestEventData(1))
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, int64(2))
+
+	version, err = s.store.AppendToStream(s.ctx, "stream", 2, NewTestEventData(1))
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, int64(3))
+}
+
+func (s *InMemoryEventStoreSuite) TestReadStreamForwardsFromEventNumber(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(5))
+
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", 2, 2)
+
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0].EventNumber, Equals, int64(2))
+	c.Assert(got[1].EventNumber, Equals, int64(3))
+}
+
+func (s *InMemoryEventStoreSuite) TestReadStreamBackwardsFromEnd(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(5))
+
+	got, err := s.store.ReadStreamBackwards(s.ctx, "stream", StreamEnd, 2)
+
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0].EventNumber, Equals, int64(4))
+	c.Assert(got[1].EventNumber, Equals, int64(3))
+}
+
+func (s *InMemoryEventStoreSuite) TestReadAllAcrossStreams(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "a", ExpectedVersionAny, NewTestEventData(2))
+	_, _ = s.store.AppendToStream(s.ctx, "b", ExpectedVersionAny, NewTestEventData(1))
+	_, _ = s.store.AppendToStream(s.ctx, "a", ExpectedVersionAny, NewTestEventData(1))
+
+	got, err := s.store.ReadAll(s.ctx, PositionStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 4)
+
+	streams := []string{}
+	for i, e := range got {
+		c.Assert(e.Position, Equals, LogPosition(int64(i)))
+		streams = append(streams, e.StreamName)
+	}
+	c.Assert(streams, DeepEquals, []string{"a", "a", "b", "a"})
+
+	got, err = s.store.ReadAll(s.ctx, LogPosition(1), 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0].Position, Equals, LogPosition(2))
+}
+
+func (s *InMemoryEventStoreSuite) TestConcurrentAppendsWithExpectedVersion(c *C) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(1))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	c.Assert(succeeded, Equals, 1)
+}
+
+func (s *InMemoryEventStoreSuite) TestReadMissingStreamReturnsStreamNotFound(c *C) {
+	_, err := s.store.ReadStreamForwards(s.ctx, "missing", StreamStart, 10)
+	c.Assert(err, DeepEquals, &ErrStreamNotFound{StreamName: "missing"})
+
+	_, err = s.store.ReadStreamBackwards(s.ctx, "missing", StreamEnd, 10)
+	c.Assert(err, DeepEquals, &ErrStreamNotFound{StreamName: "missing"})
+}
+
+func (s *InMemoryEventStoreSuite) TestCancelledContextReturnsContextError(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.store.AppendToStream(ctx, "stream", ExpectedVersionAny, NewTestEventData(1))
+	c.Assert(err, Equals, context.Canceled)
+
+	_, err = s.store.ReadAll(ctx, PositionStart, 10)
+	c.Assert(err, Equals, context.Canceled)
+}
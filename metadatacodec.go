@@ -0,0 +1,67 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"encoding/json"
+)
+
+// Well known header keys.
+//
+// Any header set on an EventMessage is persisted, these are the keys used by
+// Go.CQRS itself and suggested for common metadata.
+const (
+	HeaderAggregateID   = "AggregateID"
+	HeaderEventID       = "EventID"
+	HeaderCommandID     = "CommandID"
+	HeaderCorrelationID = "CorrelationID"
+	HeaderCausationID   = "CausationID"
+	HeaderUserID        = "UserID"
+	HeaderTimestamp     = "Timestamp"
+	HeaderSchemaVersion = "SchemaVersion"
+)
+
+// MetadataCodec is the interface that a metadata codec should implement.
+//
+// A metadata codec serialises the headers of an EventMessage into the metadata
+// that is persisted alongside the event and deserialises the metadata back into
+// headers when the event is read.
+type MetadataCodec interface {
+	Encode(map[string]interface{}) ([]byte, error)
+	Decode([]byte) (map[string]interface{}, error)
+}
+
+// JSONMetadataCodec is the default MetadataCodec and stores headers as a JSON
+// object.
+//
+// Header values are decoded as the standard JSON types so a header that was
+// set as an int will be read back as a float64 and a time.Time as a string.
+type JSONMetadataCodec struct{}
+
+// NewJSONMetadataCodec constructs a new JSONMetadataCodec
+func NewJSONMetadataCodec() *JSONMetadataCodec {
+	return &JSONMetadataCodec{}
+}
+
+// Encode marshals the headers into a JSON object.
+func (c *JSONMetadataCodec) Encode(headers map[string]interface{}) ([]byte, error) {
+	return json.Marshal(headers)
+}
+
+// Decode unmarshals a JSON object into headers.
+//
+// Empty metadata is decoded as an empty collection of headers.
+func (c *JSONMetadataCodec) Decode(metadata []byte) (map[string]interface{}, error) {
+	headers := make(map[string]interface{})
+	if len(metadata) == 0 {
+		return headers, nil
+	}
+
+	if err := json.Unmarshal(metadata, &headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
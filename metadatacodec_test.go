@@ -0,0 +1,50 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&JSONMetadataCodecSuite{})
+
+type JSONMetadataCodecSuite struct {
+	codec *JSONMetadataCodec
+}
+
+func (s *JSONMetadataCodecSuite) SetUpTest(c *C) {
+	s.codec = NewJSONMetadataCodec()
+}
+
+func (s *JSONMetadataCodecSuite) TestEncodeAndDecodeHeaders(c *C) {
+	headers := map[string]interface{}{
+		HeaderAggregateID:   "some-id",
+		HeaderCorrelationID: "correlation",
+		"Count":             3,
+	}
+
+	metadata, err := s.codec.Encode(headers)
+	c.Assert(err, IsNil)
+
+	got, err := s.codec.Decode(metadata)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, map[string]interface{}{
+		HeaderAggregateID:   "some-id",
+		HeaderCorrelationID: "correlation",
+		"Count":             float64(3),
+	})
+}
+
+func (s *JSONMetadataCodecSuite) TestDecodeEmptyMetadata(c *C) {
+	got, err := s.codec.Decode(nil)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, map[string]interface{}{})
+}
+
+func (s *JSONMetadataCodecSuite) TestDecodeInvalidMetadataReturnsAnError(c *C) {
+	_, err := s.codec.Decode([]byte("not json"))
+	c.Assert(err, NotNil)
+}
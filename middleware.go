@@ -0,0 +1,323 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Middleware decorates a CommandHandler with behaviour that runs before and
+// after the handler, such as logging, validation or retries.
+//
+// Middleware should return a CommandHandlerFunc so that the context of the
+// dispatch is passed through the chain.
+type Middleware func(CommandHandler) CommandHandler
+
+// Chain decorates the handler with the middleware specified.
+//
+// The first middleware is the outermost, it is called first and returns last.
+func Chain(handler CommandHandler, middleware ...Middleware) CommandHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Validator is the interface that a command implements to be validated by
+// the ValidationMiddleware.
+type Validator interface {
+	Validate() error
+}
+
+// LoggingMiddleware logs the type and aggregate ID of each command with the
+// time taken to handle it and the error returned, if any.
+//
+// If logger is nil the standard logger is used.
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+			start := time.Now()
+			err := handleCommand(ctx, next, command)
+			if err != nil {
+				logger.Printf("command %s for aggregate %s failed after %s: %s",
+					command.CommandType(), command.AggregateID(), time.Since(start), err)
+				return err
+			}
+			logger.Printf("command %s for aggregate %s handled in %s",
+				command.CommandType(), command.AggregateID(), time.Since(start))
+			return nil
+		})
+	}
+}
+
+// ValidationMiddleware validates commands that implement the Validator
+// interface before they are handled.
+//
+// If a command is invalid an *ErrCommandExecution is returned with the
+// validation error as the reason and the handler is not called.
+func ValidationMiddleware() Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+			if v, ok := command.Command().(Validator); ok {
+				if err := v.Validate(); err != nil {
+					return &ErrCommandExecution{Command: command, Reason: err.Error()}
+				}
+			}
+			return handleCommand(ctx, next, command)
+		})
+	}
+}
+
+// AuthorizationMiddleware calls authorize before each command is handled.
+//
+// If authorize returns false an *ErrUnauthorized is returned and the handler
+// is not called.
+func AuthorizationMiddleware(authorize func(context.Context, CommandMessage) bool) Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+			if !authorize(ctx, command) {
+				return &ErrUnauthorized{}
+			}
+			return handleCommand(ctx, next, command)
+		})
+	}
+}
+
+// RecoveryMiddleware recovers from a panic in the handler and returns an
+// *ErrUnexpected describing the panic.
+func RecoveryMiddleware() Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &ErrUnexpected{Err: fmt.Errorf("panic handling command %s: %v", command.CommandType(), r)}
+				}
+			}()
+			return handleCommand(ctx, next, command)
+		})
+	}
+}
+
+// MetricsMiddleware calls record with the command type, the time taken to
+// handle the command and the error returned by the handler, if any.
+func MetricsMiddleware(record func(commandType string, duration time.Duration, err error)) Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+			start := time.Now()
+			err := handleCommand(ctx, next, command)
+			record(command.CommandType(), time.Since(start), err)
+			return err
+		})
+	}
+}
+
+// RetryMiddleware calls the handler again when it returns an
+// *ErrConcurrencyViolation, or an error wrapping one, up to the number of
+// attempts specified, waiting for the backoff between attempts.
+//
+// As the handler loads the aggregate each time it is called, a retry handles
+// the command against the latest version of the aggregate. Retries stop if
+// the context is cancelled.
+func RetryMiddleware(attempts int, backoff time.Duration) Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+			var err error
+			for attempt := 1; ; attempt++ {
+				err = handleCommand(ctx, next, command)
+				var violation *ErrConcurrencyViolation
+				if !errors.As(err, &violation) || attempt >= attempts {
+					return err
+				}
+
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(backoff):
+				}
+			}
+		})
+	}
+}
+
+// DeduplicationMiddleware handles each command with a CommandID header only
+// once. A command with the CommandID of a command that was handled without
+// error is ignored.
+//
+// The CommandID is reserved in the store before the handler is called so that
+// a duplicate dispatched while the command is being handled is not handled as
+// well. The duplicate returns an *ErrCommandInProgress instead, which the
+// caller can retry. The ID is only recorded once the handler succeeds, if the
+// handler returns an error or panics the reservation is released so that the
+// command can be handled again.
+//
+// If store is nil an InMemoryCommandIDStore with the default TTL and size is
+// used, so a command is only ignored if it is dispatched again to the same
+// process.
+func DeduplicationMiddleware(store CommandIDStore) Middleware {
+	if store == nil {
+		store = NewInMemoryCommandIDStore(DefaultCommandIDTTL, DefaultCommandIDStoreSize)
+	}
+
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) (err error) {
+			id, _ := command.Headers()[HeaderCommandID].(string)
+			if id == "" {
+				return handleCommand(ctx, next, command)
+			}
+
+			reserved, err := store.Reserve(ctx, id)
+			if err != nil || !reserved {
+				return err
+			}
+
+			handled := false
+			defer func() {
+				if !handled {
+					if rerr := store.Release(ctx, id); rerr != nil && err == nil {
+						err = rerr
+					}
+				}
+			}()
+
+			if err := handleCommand(ctx, next, command); err != nil {
+				return err
+			}
+			handled = true
+			return store.Commit(ctx, id)
+		})
+	}
+}
+
+const (
+	// DefaultCommandIDTTL is how long the DeduplicationMiddleware remembers a
+	// handled command by default.
+	DefaultCommandIDTTL = time.Hour
+
+	// DefaultCommandIDStoreSize is the number of handled commands the
+	// DeduplicationMiddleware remembers by default.
+	DefaultCommandIDStoreSize = 10000
+)
+
+// CommandIDStore records the IDs of the commands handled by the
+// DeduplicationMiddleware.
+type CommandIDStore interface {
+	// Reserve claims the ID for a command that is about to be handled. It
+	// returns false if a command with the ID has already been handled and an
+	// *ErrCommandInProgress if one is being handled. Checking and claiming
+	// the ID must be a single atomic step.
+	Reserve(ctx context.Context, id string) (bool, error)
+
+	// Commit records that the command with the ID was handled.
+	Commit(ctx context.Context, id string) error
+
+	// Release gives up the reservation of a command that was not handled so
+	// that it can be handled again.
+	Release(ctx context.Context, id string) error
+}
+
+// InMemoryCommandIDStore is a CommandIDStore that keeps the IDs of handled
+// commands in memory for a limited time. When it holds more IDs than its size
+// the oldest are forgotten first.
+type InMemoryCommandIDStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	size     int
+	reserved map[string]struct{}
+	handled  map[string]*list.Element
+	order    *list.List
+	now      func() time.Time
+}
+
+type handledCommandID struct {
+	id      string
+	expires time.Time
+}
+
+// NewInMemoryCommandIDStore constructs a new InMemoryCommandIDStore that
+// remembers each handled command for the ttl specified and at most size
+// commands. A ttl or size less than 1 is not limited.
+func NewInMemoryCommandIDStore(ttl time.Duration, size int) *InMemoryCommandIDStore {
+	return &InMemoryCommandIDStore{
+		ttl:      ttl,
+		size:     size,
+		reserved: make(map[string]struct{}),
+		handled:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Reserve claims the ID for a command that is about to be handled.
+func (s *InMemoryCommandIDStore) Reserve(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	if _, ok := s.handled[id]; ok {
+		return false, nil
+	}
+	if _, ok := s.reserved[id]; ok {
+		return false, &ErrCommandInProgress{CommandID: id}
+	}
+	s.reserved[id] = struct{}{}
+	return true, nil
+}
+
+// Commit records that the command with the ID was handled.
+func (s *InMemoryCommandIDStore) Commit(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.reserved, id)
+	if e, ok := s.handled[id]; ok {
+		s.order.Remove(e)
+	}
+	s.handled[id] = s.order.PushBack(handledCommandID{id: id, expires: s.now().Add(s.ttl)})
+	s.expire()
+	return nil
+}
+
+// Release gives up the reservation of a command that was not handled.
+func (s *InMemoryCommandIDStore) Release(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.reserved, id)
+	return nil
+}
+
+// Len returns the number of handled commands the store remembers.
+func (s *InMemoryCommandIDStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	return s.order.Len()
+}
+
+// expire forgets the commands that have outlived the ttl and the oldest
+// commands over the size of the store.
+func (s *InMemoryCommandIDStore) expire() {
+	now := s.now()
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		h := e.Value.(handledCommandID)
+		if (s.ttl <= 0 || now.Before(h.expires)) && (s.size <= 0 || s.order.Len() <= s.size) {
+			return
+		}
+		s.order.Remove(e)
+		delete(s.handled, h.id)
+	}
+}
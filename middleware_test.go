@@ -0,0 +1,306 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&MiddlewareSuite{})
+
+type MiddlewareSuite struct {
+	calls []string
+}
+
+func (s *MiddlewareSuite) SetUpTest(c *C) {
+	s.calls = nil
+}
+
+func (s *MiddlewareSuite) record(name string) Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+			s.calls = append(s.calls, name)
+			return handleCommand(ctx, next, command)
+		})
+	}
+}
+
+func (s *MiddlewareSuite) handler(err error) CommandHandler {
+	return CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		s.calls = append(s.calls, "handler")
+		return err
+	})
+}
+
+type ValidatedCommand struct {
+	Name string
+}
+
+func (v *ValidatedCommand) Validate() error {
+	if v.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	return nil
+}
+
+func (s *MiddlewareSuite) TestChainCallsMiddlewareInOrder(c *C) {
+	handler := Chain(s.handler(nil), s.record("first"), s.record("second"))
+
+	err := handler.Handle(NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(err, IsNil)
+	c.Assert(s.calls, DeepEquals, []string{"first", "second", "handler"})
+}
+
+func (s *MiddlewareSuite) TestLoggingMiddleware(c *C) {
+	var buf bytes.Buffer
+	handler := Chain(s.handler(fmt.Errorf("boom")), LoggingMiddleware(log.New(&buf, "", 0)))
+	cmd := NewSomeCommandMessage(NewUUID())
+
+	err := handler.Handle(cmd)
+
+	c.Assert(err, DeepEquals, fmt.Errorf("boom"))
+	c.Assert(strings.Contains(buf.String(), "command eventsourcing.SomeCommand for aggregate "+cmd.AggregateID()+" failed"), Equals, true)
+}
+
+func (s *MiddlewareSuite) TestValidationMiddlewareRejectsInvalidCommand(c *C) {
+	handler := Chain(s.handler(nil), ValidationMiddleware())
+	cmd := NewCommandMessage(NewUUID(), &ValidatedCommand{})
+
+	err := handler.Handle(cmd)
+
+	c.Assert(err, DeepEquals, &ErrCommandExecution{Command: cmd, Reason: "name is required"})
+	c.Assert(s.calls, HasLen, 0)
+}
+
+func (s *MiddlewareSuite) TestValidationMiddlewarePassesValidCommand(c *C) {
+	handler := Chain(s.handler(nil), ValidationMiddleware())
+
+	c.Assert(handler.Handle(NewCommandMessage(NewUUID(), &ValidatedCommand{Name: "valid"})), IsNil)
+	c.Assert(handler.Handle(NewSomeCommandMessage(NewUUID())), IsNil)
+	c.Assert(s.calls, DeepEquals, []string{"handler", "handler"})
+}
+
+func (s *MiddlewareSuite) TestAuthorizationMiddleware(c *C) {
+	handler := Chain(s.handler(nil), AuthorizationMiddleware(func(ctx context.Context, command CommandMessage) bool {
+		return ctx.Value(ctxKey("user")) == "admin"
+	}))
+
+	err := handler.Handle(NewSomeCommandMessage(NewUUID()))
+	c.Assert(err, DeepEquals, &ErrUnauthorized{})
+	c.Assert(s.calls, HasLen, 0)
+
+	ctx := context.WithValue(context.Background(), ctxKey("user"), "admin")
+	err = handleCommand(ctx, handler, NewSomeCommandMessage(NewUUID()))
+	c.Assert(err, IsNil)
+	c.Assert(s.calls, DeepEquals, []string{"handler"})
+}
+
+func (s *MiddlewareSuite) TestRecoveryMiddleware(c *C) {
+	handler := Chain(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		panic("something went wrong")
+	}), RecoveryMiddleware())
+
+	err := handler.Handle(NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(err, FitsTypeOf, &ErrUnexpected{})
+	c.Assert(err.(*ErrUnexpected).Err, ErrorMatches, "panic handling command eventsourcing.SomeCommand: something went wrong")
+}
+
+func (s *MiddlewareSuite) TestMetricsMiddleware(c *C) {
+	var commandType string
+	var recorded error
+	handler := Chain(s.handler(fmt.Errorf("boom")), MetricsMiddleware(func(t string, d time.Duration, err error) {
+		commandType = t
+		recorded = err
+	}))
+
+	_ = handler.Handle(NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(commandType, Equals, "eventsourcing.SomeCommand")
+	c.Assert(recorded, DeepEquals, fmt.Errorf("boom"))
+}
+
+func (s *MiddlewareSuite) TestRetryMiddlewareRetriesConcurrencyViolations(c *C) {
+	attempts := 0
+	handler := Chain(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		attempts++
+		if attempts < 3 {
+			return &ErrConcurrencyViolation{}
+		}
+		return nil
+	}), RetryMiddleware(3, time.Millisecond))
+
+	err := handler.Handle(NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 3)
+}
+
+func (s *MiddlewareSuite) TestRetryMiddlewareRetriesWrappedConcurrencyViolations(c *C) {
+	attempts := 0
+	handler := Chain(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("could not save order: %w", &ErrConcurrencyViolation{})
+		}
+		return nil
+	}), RetryMiddleware(3, time.Millisecond))
+
+	err := handler.Handle(NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 3)
+}
+
+func (s *MiddlewareSuite) TestRetryMiddlewareGivesUpAfterAttempts(c *C) {
+	attempts := 0
+	handler := Chain(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		attempts++
+		return &ErrConcurrencyViolation{}
+	}), RetryMiddleware(2, time.Millisecond))
+
+	err := handler.Handle(NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(err, FitsTypeOf, &ErrConcurrencyViolation{})
+	c.Assert(attempts, Equals, 2)
+}
+
+func (s *MiddlewareSuite) TestRetryMiddlewareDoesNotRetryOtherErrors(c *C) {
+	handler := Chain(s.handler(fmt.Errorf("boom")), RetryMiddleware(3, time.Millisecond))
+
+	err := handler.Handle(NewSomeCommandMessage(NewUUID()))
+
+	c.Assert(err, DeepEquals, fmt.Errorf("boom"))
+	c.Assert(s.calls, HasLen, 1)
+}
+
+func (s *MiddlewareSuite) TestDispatcherAppliesGlobalThenCommandMiddleware(c *C) {
+	dispatcher := NewInMemoryDispatcher()
+	_ = dispatcher.RegisterHandler(s.handler(nil), &SomeCommand{}, &SomeOtherCommand{})
+	c.Assert(dispatcher.UseFor(&SomeCommand{}, s.record("command")), IsNil)
+	dispatcher.Use(s.record("global"))
+
+	_ = dispatcher.Dispatch(NewSomeCommandMessage(NewUUID()))
+	c.Assert(s.calls, DeepEquals, []string{"global", "command", "handler"})
+
+	s.calls = nil
+	_ = dispatcher.Dispatch(NewSomeOtherCommandMessage(NewUUID()))
+	c.Assert(s.calls, DeepEquals, []string{"global", "handler"})
+}
+
+func (s *MiddlewareSuite) TestDeduplicationMiddlewareHandlesCommandIDOnce(c *C) {
+	failures := 1
+	handler := Chain(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		s.calls = append(s.calls, "handler")
+		if failures > 0 {
+			failures--
+			return fmt.Errorf("boom")
+		}
+		return nil
+	}), DeduplicationMiddleware(nil))
+	cmd := NewSomeCommandMessage(NewUUID())
+	cmd.SetHeader(HeaderCommandID, "command-1")
+
+	c.Assert(handler.Handle(cmd), ErrorMatches, "boom")
+	c.Assert(handler.Handle(cmd), IsNil)
+	c.Assert(handler.Handle(cmd), IsNil)
+	c.Assert(handler.Handle(NewSomeCommandMessage(NewUUID())), IsNil)
+
+	c.Assert(s.calls, HasLen, 3)
+}
+
+func (s *MiddlewareSuite) TestDeduplicationMiddlewareHandlesConcurrentDuplicatesOnce(c *C) {
+	var handled sync.WaitGroup
+	handled.Add(1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	handler := Chain(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		calls++
+		close(started)
+		<-release
+		return nil
+	}), DeduplicationMiddleware(nil))
+	cmd := NewSomeCommandMessage(NewUUID())
+	cmd.SetHeader(HeaderCommandID, "command-1")
+
+	go func() {
+		defer handled.Done()
+		c.Check(handler.Handle(cmd), IsNil)
+	}()
+	<-started
+
+	err := handler.Handle(cmd)
+	c.Assert(err, DeepEquals, &ErrCommandInProgress{CommandID: "command-1"})
+
+	close(release)
+	handled.Wait()
+	c.Assert(handler.Handle(cmd), IsNil)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *MiddlewareSuite) TestDeduplicationMiddlewareReleasesTheCommandIDWhenTheHandlerPanics(c *C) {
+	panics := true
+	handler := Chain(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		s.calls = append(s.calls, "handler")
+		if panics {
+			panics = false
+			panic("boom")
+		}
+		return nil
+	}), RecoveryMiddleware(), DeduplicationMiddleware(nil))
+	cmd := NewSomeCommandMessage(NewUUID())
+	cmd.SetHeader(HeaderCommandID, "command-1")
+
+	c.Assert(handler.Handle(cmd), FitsTypeOf, &ErrUnexpected{})
+	c.Assert(handler.Handle(cmd), IsNil)
+	c.Assert(handler.Handle(cmd), IsNil)
+
+	c.Assert(s.calls, HasLen, 2)
+}
+
+func (s *MiddlewareSuite) TestInMemoryCommandIDStoreForgetsExpiredCommands(c *C) {
+	ctx := context.Background()
+	now := time.Now()
+	store := NewInMemoryCommandIDStore(time.Minute, 0)
+	store.now = func() time.Time { return now }
+
+	_, _ = store.Reserve(ctx, "command-1")
+	_ = store.Commit(ctx, "command-1")
+	reserved, err := store.Reserve(ctx, "command-1")
+	c.Assert(err, IsNil)
+	c.Assert(reserved, Equals, false)
+
+	now = now.Add(time.Minute)
+	reserved, err = store.Reserve(ctx, "command-1")
+	c.Assert(err, IsNil)
+	c.Assert(reserved, Equals, true)
+}
+
+func (s *MiddlewareSuite) TestInMemoryCommandIDStoreForgetsTheOldestCommandsOverItsSize(c *C) {
+	ctx := context.Background()
+	store := NewInMemoryCommandIDStore(0, 2)
+
+	for _, id := range []string{"command-1", "command-2", "command-3"} {
+		_, _ = store.Reserve(ctx, id)
+		_ = store.Commit(ctx, id)
+	}
+
+	c.Assert(store.Len(), Equals, 2)
+	reserved, _ := store.Reserve(ctx, "command-1")
+	c.Assert(reserved, Equals, true)
+	reserved, _ = store.Reserve(ctx, "command-3")
+	c.Assert(reserved, Equals, false)
+}
@@ -0,0 +1,588 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Outbox is the interface that a store of events waiting to be published
+// must implement.
+//
+// An event is put in the outbox when it is persisted, in the same write, so
+// that it is published by an OutboxRelay even if the process that saved it
+// stops before publishing it.
+type Outbox interface {
+	// Pending returns at most limit events that have not been delivered, in
+	// the order they were persisted.
+	Pending(ctx context.Context, limit int) ([]RecordedEvent, error)
+
+	// MarkDelivered records that the events, returned by Pending, have been
+	// published.
+	MarkDelivered(ctx context.Context, events []RecordedEvent) error
+}
+
+// EventStoreOutbox is an Outbox over the $all stream of an EventStore.
+//
+// As every event appended to the EventStore is in the $all stream, the stream
+// itself is the outbox. The position of the last event delivered is kept in a
+// CheckpointStore.
+type EventStoreOutbox struct {
+	eventStore  EventStore
+	checkpoints CheckpointStore
+	name        string
+}
+
+// NewEventStoreOutbox constructs a new EventStoreOutbox that keeps the
+// position of the last event delivered in the CheckpointStore under the name
+// specified.
+func NewEventStoreOutbox(eventStore EventStore, checkpoints CheckpointStore, name string) (*EventStoreOutbox, error) {
+	if eventStore == nil {
+		return nil, fmt.Errorf("nil Eventstore injected into outbox")
+	}
+	if checkpoints == nil {
+		return nil, fmt.Errorf("nil CheckpointStore injected into outbox")
+	}
+
+	return &EventStoreOutbox{
+		eventStore:  eventStore,
+		checkpoints: checkpoints,
+		name:        name,
+	}, nil
+}
+
+// Pending returns the events after the last event delivered.
+func (o *EventStoreOutbox) Pending(ctx context.Context, limit int) ([]RecordedEvent, error) {
+	position, err := o.checkpoints.GetCheckpoint(ctx, o.name)
+	if err != nil {
+		return nil, err
+	}
+	return o.eventStore.ReadAll(ctx, position, limit)
+}
+
+// MarkDelivered moves the checkpoint to the last of the events.
+func (o *EventStoreOutbox) MarkDelivered(ctx context.Context, events []RecordedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return o.checkpoints.SaveCheckpoint(ctx, o.name, events[len(events)-1].Position)
+}
+
+// DefaultOutboxMaxAttempts is the number of times an OutboxRelay tries to
+// publish an event before it skips it.
+const DefaultOutboxMaxAttempts = 5
+
+// OutboxRelay publishes the events in an Outbox to an EventBus.
+//
+// Each event is marked as delivered once it has been published, so an event
+// is published at least once. If the process stops between publishing and
+// marking an event it is published again. Handlers that must see each event
+// only once can be wrapped in an IdempotentEventHandler, which uses the ID of
+// the event to ignore the repeat.
+//
+// If the event bus is an ErrorEventBus an event that a handler fails to
+// handle is not marked as delivered and is published again on the next pass.
+// If the bus is also a RepublishEventBus the event is only published again to
+// the handlers that have not handled it.
+// Events of a type the EventFactory does not know are marked as delivered
+// without being published.
+//
+// An event that can not be decoded, or that fails to be published on the
+// maximum number of passes, would stop every later event from being published.
+// It is put in the dead-letter sink, if there is one, reported to the error
+// handler as an *ErrUndeliverableEvent and marked as delivered.
+type OutboxRelay struct {
+	outbox         Outbox
+	eventFactory   EventFactory
+	metadataCodec  MetadataCodec
+	upcasters      *Upcasters
+	serializers    *Serializers
+	eventBus       EventBus
+	batchSize      int
+	pollInterval   time.Duration
+	errorHandler   func(error)
+	maxAttempts    int
+	deadLetterSink DeadLetterSink
+
+	// mu serialises passes. retry is the progress of the event that stopped
+	// the last pass, which is the only event that can be tried again.
+	mu    sync.Mutex
+	retry *relayRetry
+}
+
+// relayRetry is the progress of publishing an event that failed to be
+// published.
+type relayRetry struct {
+	eventID  string
+	attempts int
+
+	// published is the number of messages of the event published to every
+	// handler and handled the handlers that handled the next message.
+	published int
+	handled   []string
+}
+
+// NewOutboxRelay constructs a new OutboxRelay
+func NewOutboxRelay(outbox Outbox, eventFactory EventFactory, eventBus EventBus) (*OutboxRelay, error) {
+	if outbox == nil {
+		return nil, fmt.Errorf("nil Outbox injected into relay")
+	}
+	if eventFactory == nil {
+		return nil, fmt.Errorf("nil EventFactory injected into relay")
+	}
+	if eventBus == nil {
+		return nil, fmt.Errorf("nil EventBus injected into relay")
+	}
+
+	return &OutboxRelay{
+		outbox:        outbox,
+		eventFactory:  eventFactory,
+		metadataCodec: NewJSONMetadataCodec(),
+		serializers:   DefaultSerializers,
+		eventBus:      eventBus,
+		batchSize:     DefaultReadBatchSize,
+		pollInterval:  DefaultPollInterval,
+		maxAttempts:   DefaultOutboxMaxAttempts,
+	}, nil
+}
+
+// SetMetadataCodec sets the codec used to decode event headers.
+func (r *OutboxRelay) SetMetadataCodec(codec MetadataCodec) {
+	r.metadataCodec = codec
+}
+
+// SetUpcasters sets the upcasters that transform events persisted in an old
+// schema before they are published.
+func (r *OutboxRelay) SetUpcasters(upcasters *Upcasters) {
+	r.upcasters = upcasters
+}
+
+// SetSerializers sets the serializers used to read events by their content
+// type. DefaultSerializers is used by default.
+func (r *OutboxRelay) SetSerializers(serializers *Serializers) {
+	r.serializers = serializers
+}
+
+// SetReadBatchSize sets the number of events taken from the outbox at a time.
+// Values less than 1 are ignored.
+func (r *OutboxRelay) SetReadBatchSize(size int) {
+	if size > 0 {
+		r.batchSize = size
+	}
+}
+
+// SetPollInterval sets the time Run waits when the outbox is empty or could
+// not be relayed. Values less than 1 are ignored.
+func (r *OutboxRelay) SetPollInterval(interval time.Duration) {
+	if interval > 0 {
+		r.pollInterval = interval
+	}
+}
+
+// SetErrorHandler sets a function that is called with the errors that Run
+// recovers from.
+func (r *OutboxRelay) SetErrorHandler(handler func(error)) {
+	r.errorHandler = handler
+}
+
+// SetMaxAttempts sets the number of passes on which an event is published
+// before it is skipped. Values less than 1 are ignored.
+func (r *OutboxRelay) SetMaxAttempts(attempts int) {
+	if attempts > 0 {
+		r.maxAttempts = attempts
+	}
+}
+
+// SetDeadLetterSink sets the sink that events which can not be delivered are
+// put in.
+func (r *OutboxRelay) SetDeadLetterSink(sink DeadLetterSink) {
+	r.deadLetterSink = sink
+}
+
+// Relay publishes the events pending in the outbox until there are none left
+// and returns the number published.
+//
+// Relay stops at the first event that could not be published and returns the
+// error. The events before it are marked as delivered. An event that can not
+// be decoded, or has failed on the maximum number of passes, is skipped.
+//
+// Calls to Relay are serialised, a call waits for the pass in progress to
+// finish.
+func (r *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	published := 0
+	for {
+		events, err := r.outbox.Pending(ctx, r.batchSize)
+		if err != nil {
+			return published, err
+		}
+
+		for i, event := range events {
+			messages, _, err := decodeEventMessages(r.eventFactory, r.metadataCodec, r.upcasters, r.serializers, "", event)
+			if err != nil {
+				r.skip(ctx, event, nil, 1, err)
+				continue
+			}
+
+			retry := r.retryOf(event.EventID)
+			for ; retry.published < len(messages); retry.published++ {
+				if err = r.publish(ctx, messages[retry.published], retry.handled); err != nil {
+					retry.handled = append(retry.handled, handledBy(err)...)
+					break
+				}
+				retry.handled = nil
+			}
+			if err != nil && ctx.Err() == nil {
+				retry.attempts++
+				if retry.attempts >= r.maxAttempts {
+					r.skip(ctx, event, messages[0], retry.attempts, err)
+					continue
+				}
+			}
+			if err != nil {
+				if merr := r.outbox.MarkDelivered(ctx, events[:i]); merr != nil {
+					return published, merr
+				}
+				return published, err
+			}
+			r.retry = nil
+			published += len(messages)
+		}
+
+		if err := r.outbox.MarkDelivered(ctx, events); err != nil {
+			return published, err
+		}
+		if len(events) < r.batchSize {
+			return published, nil
+		}
+	}
+}
+
+// retryOf returns the progress of the event, which is only kept while the
+// event is the one that stopped the last pass.
+func (r *OutboxRelay) retryOf(eventID string) *relayRetry {
+	if r.retry == nil || r.retry.eventID != eventID {
+		r.retry = &relayRetry{eventID: eventID}
+	}
+	return r.retry
+}
+
+// publish publishes the message to the handlers that have not handled it.
+func (r *OutboxRelay) publish(ctx context.Context, em EventMessage, handled []string) error {
+	if b, ok := r.eventBus.(RepublishEventBus); ok && len(handled) > 0 {
+		return b.Republish(ctx, em, handled)
+	}
+	return publishEventErr(ctx, r.eventBus, em)
+}
+
+// handledBy returns the names of the handlers that handled, or were queued, an
+// event that failed to be published.
+func handledBy(err error) []string {
+	var failed *ErrEventHandlerFailed
+	if errors.As(err, &failed) {
+		return failed.Handled
+	}
+	var partial *ErrPartialPublish
+	if errors.As(err, &partial) {
+		return partial.Handlers
+	}
+	return nil
+}
+
+// skip puts an event that can not be delivered in the dead-letter sink and
+// reports it to the error handler. It is then marked as delivered with the
+// rest of its batch.
+func (r *OutboxRelay) skip(ctx context.Context, event RecordedEvent, em EventMessage, attempts int, err error) {
+	r.retry = nil
+
+	if r.deadLetterSink != nil {
+		recorded := event
+		_ = r.deadLetterSink.PutDeadLetter(ctx, DeadLetter{
+			Event:       em,
+			Recorded:    &recorded,
+			HandlerName: typeOf(r),
+			Err:         err,
+			Attempts:    attempts,
+			Failed:      time.Now(),
+		})
+	}
+	if r.errorHandler != nil {
+		r.errorHandler(&ErrUndeliverableEvent{
+			EventID:   event.EventID,
+			EventType: event.EventType,
+			Attempts:  attempts,
+			Err:       err,
+		})
+	}
+}
+
+// Run relays the outbox until the context is done, waiting for the poll
+// interval between passes. Errors are passed to the error handler and the
+// pass is tried again after the poll interval.
+//
+// Run returns the context error when the context is done.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	for {
+		if _, err := r.Relay(ctx); err != nil && ctx.Err() == nil && r.errorHandler != nil {
+			r.errorHandler(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// ProcessedEventStore is the interface that a store of the events processed
+// by event handlers must implement.
+type ProcessedEventStore interface {
+	// IsProcessed reports whether the handler has processed the event.
+	IsProcessed(ctx context.Context, handlerName, eventID string) (bool, error)
+
+	// MarkProcessed records that the handler has processed the event.
+	MarkProcessed(ctx context.Context, handlerName, eventID string) error
+}
+
+// InMemoryProcessedEventStore keeps the IDs of processed events in memory.
+type InMemoryProcessedEventStore struct {
+	mu        sync.RWMutex
+	processed map[string]map[string]struct{}
+}
+
+// NewInMemoryProcessedEventStore constructs a new InMemoryProcessedEventStore
+func NewInMemoryProcessedEventStore() *InMemoryProcessedEventStore {
+	return &InMemoryProcessedEventStore{
+		processed: make(map[string]map[string]struct{}),
+	}
+}
+
+// IsProcessed reports whether the handler has processed the event.
+func (s *InMemoryProcessedEventStore) IsProcessed(ctx context.Context, handlerName, eventID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.processed[handlerName][eventID]
+	return ok, nil
+}
+
+// MarkProcessed records that the handler has processed the event.
+func (s *InMemoryProcessedEventStore) MarkProcessed(ctx context.Context, handlerName, eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processed[handlerName] == nil {
+		s.processed[handlerName] = make(map[string]struct{})
+	}
+	s.processed[handlerName][eventID] = struct{}{}
+	return nil
+}
+
+// DefaultProcessedEventTable is the name of the table used by a
+// SQLProcessedEventStore unless another is set.
+const DefaultProcessedEventTable = "processed_events"
+
+// SQLProcessedEventStore keeps the IDs of processed events in a table of a SQL
+// database, so that they survive a restart.
+//
+// The table has a row for each event a handler has processed with the handler
+// name and event ID as its primary key. It can be created with CreateTable.
+// The statements use $n placeholders and ON CONFLICT, which are supported by
+// PostgreSQL and SQLite.
+//
+// A handler that writes to the same database should record the event with
+// MarkProcessedTx, or use ProcessOnce, so that the row is committed with the
+// writes of the handler. The unique row then means that an event delivered
+// more than once, even to several processes at the same time, only has its
+// writes committed once.
+type SQLProcessedEventStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLProcessedEventStore constructs a new SQLProcessedEventStore that keeps
+// the IDs of processed events in the DefaultProcessedEventTable of the
+// database.
+func NewSQLProcessedEventStore(db *sql.DB) (*SQLProcessedEventStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("nil database injected into SQLProcessedEventStore")
+	}
+
+	return &SQLProcessedEventStore{
+		db:    db,
+		table: DefaultProcessedEventTable,
+	}, nil
+}
+
+// SetTable sets the name of the table that holds the processed events.
+func (s *SQLProcessedEventStore) SetTable(table string) {
+	s.table = table
+}
+
+// CreateTable creates the table that holds the processed events if it does
+// not exist.
+func (s *SQLProcessedEventStore) CreateTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (handler_name VARCHAR(255) NOT NULL, event_id VARCHAR(255) NOT NULL, PRIMARY KEY (handler_name, event_id))`, s.table))
+	return err
+}
+
+// IsProcessed reports whether the handler has processed the event.
+func (s *SQLProcessedEventStore) IsProcessed(ctx context.Context, handlerName, eventID string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE handler_name = $1 AND event_id = $2`, s.table),
+		handlerName, eventID).Scan(&n)
+	if err != nil {
+		return false, sqlError(err)
+	}
+	return n > 0, nil
+}
+
+// MarkProcessed records that the handler has processed the event.
+func (s *SQLProcessedEventStore) MarkProcessed(ctx context.Context, handlerName, eventID string) error {
+	_, err := s.db.ExecContext(ctx, s.insert(), handlerName, eventID)
+	return sqlError(err)
+}
+
+// MarkProcessedTx records that the handler has processed the event in the
+// transaction, so that it is committed atomically with the writes of the
+// handler. It returns false if the event has already been processed, in which
+// case the transaction should be rolled back.
+func (s *SQLProcessedEventStore) MarkProcessedTx(ctx context.Context, tx *sql.Tx, handlerName, eventID string) (bool, error) {
+	result, err := tx.ExecContext(ctx, s.insert(), handlerName, eventID)
+	if err != nil {
+		return false, sqlError(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, sqlError(err)
+	}
+	return n > 0, nil
+}
+
+// ProcessOnce calls process with a transaction in which the event has been
+// marked as processed by the handler, and commits it if process succeeds. If
+// the event has already been processed process is not called.
+func (s *SQLProcessedEventStore) ProcessOnce(ctx context.Context, handlerName, eventID string, process func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	marked, err := s.MarkProcessedTx(ctx, tx, handlerName, eventID)
+	if err != nil || !marked {
+		return err
+	}
+	if err := process(tx); err != nil {
+		return err
+	}
+	return sqlError(tx.Commit())
+}
+
+func (s *SQLProcessedEventStore) insert() string {
+	return fmt.Sprintf(`INSERT INTO %s (handler_name, event_id) VALUES ($1, $2) ON CONFLICT (handler_name, event_id) DO NOTHING`, s.table)
+}
+
+// IdempotentEventHandler decorates an event handler so that an event that is
+// delivered more than once is only handled once.
+//
+// Events are identified by their EventID header or, failing that, by their
+// aggregate ID and version. Events that can not be identified are always
+// handled.
+//
+// A copy of an event that arrives while the event is being handled waits for
+// it to finish, so that the check and the record of the event are not
+// interleaved within the process. Across processes the store can only stop
+// the writes of a repeated event being committed if they are made in the same
+// transaction as its record, see SQLProcessedEventStore.ProcessOnce.
+type IdempotentEventHandler struct {
+	handler   EventHandler
+	processed ProcessedEventStore
+	mu        sync.Mutex
+	inFlight  map[string]chan struct{}
+}
+
+// NewIdempotentEventHandler constructs a new IdempotentEventHandler that
+// records the events the handler has processed in the store.
+func NewIdempotentEventHandler(handler EventHandler, processed ProcessedEventStore) *IdempotentEventHandler {
+	return &IdempotentEventHandler{
+		handler:   handler,
+		processed: processed,
+		inFlight:  make(map[string]chan struct{}),
+	}
+}
+
+// Handle handles the event if it has not been handled before.
+func (h *IdempotentEventHandler) Handle(event EventMessage) {
+	_ = h.HandleEvent(context.Background(), event)
+}
+
+// HandleEvent handles the event if it has not been handled before.
+func (h *IdempotentEventHandler) HandleEvent(ctx context.Context, event EventMessage) error {
+	eventID := eventIdentity(event)
+	if eventID == "" {
+		return handleEvent(ctx, h.handler, event)
+	}
+
+	if err := h.begin(ctx, eventID); err != nil {
+		return err
+	}
+	defer h.end(eventID)
+
+	name := h.HandlerName()
+	processed, err := h.processed.IsProcessed(ctx, name, eventID)
+	if err != nil || processed {
+		return err
+	}
+
+	if err := handleEvent(ctx, h.handler, event); err != nil {
+		return err
+	}
+	return h.processed.MarkProcessed(ctx, name, eventID)
+}
+
+// HandlerName returns the name of the decorated handler.
+func (h *IdempotentEventHandler) HandlerName() string {
+	return handlerName(h.handler)
+}
+
+// begin waits until no copy of the event is being handled and claims it.
+func (h *IdempotentEventHandler) begin(ctx context.Context, eventID string) error {
+	for {
+		h.mu.Lock()
+		done, busy := h.inFlight[eventID]
+		if !busy {
+			h.inFlight[eventID] = make(chan struct{})
+			h.mu.Unlock()
+			return nil
+		}
+		h.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// end releases the claim on the event taken by begin.
+func (h *IdempotentEventHandler) end(eventID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	close(h.inFlight[eventID])
+	delete(h.inFlight, eventID)
+}
@@ -0,0 +1,353 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&OutboxSuite{})
+
+type OutboxSuite struct {
+	ctx     context.Context
+	store   *InMemoryEventStore
+	outbox  *EventStoreOutbox
+	bus     *InternalEventBus
+	handler *MockEventHandler
+	relay   *OutboxRelay
+}
+
+func (s *OutboxSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+	s.store = NewInMemoryEventStore()
+	s.bus = NewInternalEventBus()
+	s.handler = NewMockEventHandler()
+	s.bus.AddHandler(s.handler, &SomeEvent{})
+
+	outbox, err := NewEventStoreOutbox(s.store, NewInMemoryCheckpointStore(), "outbox")
+	c.Assert(err, IsNil)
+	s.outbox = outbox
+
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+
+	relay, err := NewOutboxRelay(outbox, eventFactory, s.bus)
+	c.Assert(err, IsNil)
+	s.relay = relay
+}
+
+func (s *OutboxSuite) TestConstructorsRequireDependencies(c *C) {
+	_, err := NewEventStoreOutbox(nil, NewInMemoryCheckpointStore(), "outbox")
+	c.Assert(err, NotNil)
+	_, err = NewEventStoreOutbox(s.store, nil, "outbox")
+	c.Assert(err, NotNil)
+
+	_, err = NewOutboxRelay(nil, NewDelegateEventFactory(), s.bus)
+	c.Assert(err, NotNil)
+	_, err = NewOutboxRelay(s.outbox, nil, s.bus)
+	c.Assert(err, NotNil)
+	_, err = NewOutboxRelay(s.outbox, NewDelegateEventFactory(), nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *OutboxSuite) TestRepositoryInOutboxModeOnlyPublishesThroughRelay(c *C) {
+	repo, _ := NewCommonDomainRepository(s.store, s.bus)
+	streamNamer := NewDelegateStreamNamer()
+	_ = streamNamer.RegisterDelegate(func(t string, id string) string { return t + "-" + id },
+		&SomeAggregate{})
+	repo.SetStreamNameDelegate(streamNamer)
+	repo.SetPublishMode(PublishFromOutbox)
+
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "two", Count: 2}, nil))
+	c.Assert(repo.Save(agg, nil), IsNil)
+	c.Assert(s.handler.events, HasLen, 0)
+
+	published, err := s.relay.Relay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(published, Equals, 2)
+	c.Assert(s.handler.events, HasLen, 2)
+	c.Assert(s.handler.events[1].AggregateID(), Equals, id)
+	c.Assert(s.handler.events[1].Event(), DeepEquals, &SomeEvent{Item: "two", Count: 2})
+	c.Assert(*s.handler.events[1].Version(), Equals, int64(1))
+	c.Assert(s.handler.events[1].GetHeaders()[HeaderEventID], NotNil)
+
+	published, err = s.relay.Relay(s.ctx)
+	c.Assert(err, IsNil)
+	c.Assert(published, Equals, 0)
+	c.Assert(s.handler.events, HasLen, 2)
+}
+
+func (s *OutboxSuite) TestFailedEventIsPublishedAgainToTheFailingHandlers(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(3))
+	failing := &FailingEventHandler{Failures: 2}
+	s.bus.AddHandler(failing, &SomeEvent{})
+
+	published, err := s.relay.Relay(s.ctx)
+	c.Assert(err, FitsTypeOf, &ErrEventHandlerFailed{})
+	c.Assert(published, Equals, 0)
+
+	published, err = s.relay.Relay(s.ctx)
+	c.Assert(err, FitsTypeOf, &ErrEventHandlerFailed{})
+	c.Assert(published, Equals, 0)
+
+	published, err = s.relay.Relay(s.ctx)
+	c.Assert(err, IsNil)
+	c.Assert(published, Equals, 3)
+	c.Assert(s.handler.events, HasLen, 3)
+	c.Assert(failing.calls, Equals, 5)
+}
+
+func (s *OutboxSuite) TestConcurrentRelaysPublishEachEventOnce(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(20))
+	s.relay.SetReadBatchSize(3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.relay.Relay(s.ctx)
+			c.Check(err, IsNil)
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(s.handler.events, HasLen, 20)
+}
+
+func (s *OutboxSuite) TestUnknownEventsAreMarkedDelivered(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "Other-1", ExpectedVersionAny, []EventData{
+		{EventID: NewUUID(), EventType: "Unknown", Data: []byte(`{}`)},
+	})
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(1))
+	s.relay.SetReadBatchSize(1)
+
+	published, err := s.relay.Relay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(published, Equals, 1)
+	pending, _ := s.outbox.Pending(s.ctx, 10)
+	c.Assert(pending, HasLen, 0)
+}
+
+func (s *OutboxSuite) TestUndecodableEventIsSkipped(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, []EventData{
+		{EventID: "poison", EventType: "eventsourcing.SomeEvent", ContentType: ContentTypeJSON, Data: []byte(`not json`)},
+	})
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(1))
+	sink := NewInMemoryDeadLetterSink()
+	s.relay.SetDeadLetterSink(sink)
+	var reported []error
+	s.relay.SetErrorHandler(func(err error) { reported = append(reported, err) })
+
+	published, err := s.relay.Relay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(published, Equals, 1)
+	c.Assert(s.handler.events, HasLen, 1)
+	pending, _ := s.outbox.Pending(s.ctx, 10)
+	c.Assert(pending, HasLen, 0)
+
+	c.Assert(reported, HasLen, 1)
+	c.Assert(reported[0], FitsTypeOf, &ErrUndeliverableEvent{})
+	c.Assert(reported[0].(*ErrUndeliverableEvent).EventID, Equals, "poison")
+	letters := sink.DeadLetters()
+	c.Assert(letters, HasLen, 1)
+	c.Assert(letters[0].Event, IsNil)
+	c.Assert(letters[0].Recorded.EventID, Equals, "poison")
+	c.Assert(letters[0].HandlerName, Equals, "eventsourcing.OutboxRelay")
+}
+
+func (s *OutboxSuite) TestEventFailingOnEveryPassIsSkipped(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(2))
+	failing := &FailingEventHandler{Failures: 3}
+	s.bus.AddHandler(failing, &SomeEvent{})
+	s.relay.SetMaxAttempts(3)
+	sink := NewInMemoryDeadLetterSink()
+	s.relay.SetDeadLetterSink(sink)
+	var reported []error
+	s.relay.SetErrorHandler(func(err error) { reported = append(reported, err) })
+
+	for i := 0; i < 2; i++ {
+		_, err := s.relay.Relay(s.ctx)
+		c.Assert(err, FitsTypeOf, &ErrEventHandlerFailed{})
+	}
+	published, err := s.relay.Relay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(published, Equals, 1)
+	c.Assert(reported, HasLen, 1)
+	c.Assert(reported[0].(*ErrUndeliverableEvent).Attempts, Equals, 3)
+	c.Assert(sink.DeadLetters(), HasLen, 1)
+	c.Assert(sink.DeadLetters()[0].Event, NotNil)
+	pending, _ := s.outbox.Pending(s.ctx, 10)
+	c.Assert(pending, HasLen, 0)
+}
+
+func (s *OutboxSuite) TestRunRelaysUntilContextIsDone(c *C) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	bus := NewAsyncEventBus(AsyncEventBusConfig{})
+	handler := &SyncEventHandler{}
+	bus.AddHandler(handler, &SomeEvent{})
+	s.relay.eventBus = bus
+	s.relay.SetPollInterval(time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.relay.Run(ctx)
+	}()
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(2))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(handler.Events()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	c.Assert(<-done, Equals, context.Canceled)
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+	c.Assert(handler.Events(), HasLen, 2)
+}
+
+func (s *OutboxSuite) TestIdempotentEventHandlerHandlesEventOnce(c *C) {
+	processed := NewInMemoryProcessedEventStore()
+	failing := &FailingEventHandler{Failures: 1}
+	handler := NewIdempotentEventHandler(failing, processed)
+	event := NewTestEventMessage(NewUUID())
+	event.SetHeader(HeaderEventID, NewUUID())
+
+	c.Assert(handler.HandleEvent(s.ctx, event), ErrorMatches, "failure 1")
+	c.Assert(handler.HandleEvent(s.ctx, event), IsNil)
+	c.Assert(handler.HandleEvent(s.ctx, event), IsNil)
+
+	c.Assert(failing.calls, Equals, 2)
+	c.Assert(handler.HandlerName(), Equals, "failing")
+	ok, _ := processed.IsProcessed(s.ctx, "failing", event.GetHeaders()[HeaderEventID].(string))
+	c.Assert(ok, Equals, true)
+}
+
+func (s *OutboxSuite) TestIdempotentEventHandlerHandlesUnidentifiedEvents(c *C) {
+	handler := NewIdempotentEventHandler(s.handler, NewInMemoryProcessedEventStore())
+	event := NewEventMessage(NewUUID(), &SomeEvent{}, nil)
+
+	handler.Handle(event)
+	handler.Handle(event)
+
+	c.Assert(s.handler.events, HasLen, 2)
+}
+
+func (s *OutboxSuite) TestIdempotentEventHandlerHandlesConcurrentCopiesOnce(c *C) {
+	handler := NewIdempotentEventHandler(s.handler, NewInMemoryProcessedEventStore())
+	event := NewTestEventMessage(NewUUID())
+	event.SetHeader(HeaderEventID, NewUUID())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(handler.HandleEvent(s.ctx, event), IsNil)
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(s.handler.events, HasLen, 1)
+}
+
+func (s *OutboxSuite) TestSQLProcessedEventStoreSurvivesReopening(c *C) {
+	path := filepath.Join(c.MkDir(), "processed.db")
+	open := func() (*sql.DB, *SQLProcessedEventStore) {
+		db, err := sql.Open("sqlite", path)
+		c.Assert(err, IsNil)
+		store, err := NewSQLProcessedEventStore(db)
+		c.Assert(err, IsNil)
+		c.Assert(store.CreateTable(s.ctx), IsNil)
+		return db, store
+	}
+	event := NewTestEventMessage(NewUUID())
+	event.SetHeader(HeaderEventID, NewUUID())
+
+	db, store := open()
+	c.Assert(NewIdempotentEventHandler(s.handler, store).HandleEvent(s.ctx, event), IsNil)
+	c.Assert(db.Close(), IsNil)
+
+	db, store = open()
+	defer db.Close()
+	c.Assert(NewIdempotentEventHandler(s.handler, store).HandleEvent(s.ctx, event), IsNil)
+
+	c.Assert(s.handler.events, HasLen, 1)
+	ok, err := store.IsProcessed(s.ctx, "*eventsourcing.MockEventHandler", event.GetHeaders()[HeaderEventID].(string))
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *OutboxSuite) TestSQLProcessedEventStoreProcessesOnceInTheTransaction(c *C) {
+	db := openTestDB(c)
+	defer db.Close()
+	store, _ := NewSQLProcessedEventStore(db)
+	c.Assert(store.CreateTable(s.ctx), IsNil)
+	_, err := db.Exec("CREATE TABLE totals (total INTEGER NOT NULL)")
+	c.Assert(err, IsNil)
+	_, _ = db.Exec("INSERT INTO totals (total) VALUES (0)")
+
+	add := func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE totals SET total = total + 1")
+		return err
+	}
+	fail := func(tx *sql.Tx) error {
+		_ = add(tx)
+		return fmt.Errorf("boom")
+	}
+
+	c.Assert(store.ProcessOnce(s.ctx, "totals", "event-1", fail), ErrorMatches, "boom")
+	c.Assert(store.ProcessOnce(s.ctx, "totals", "event-1", add), IsNil)
+	c.Assert(store.ProcessOnce(s.ctx, "totals", "event-1", add), IsNil)
+	c.Assert(store.ProcessOnce(s.ctx, "totals", "event-2", add), IsNil)
+
+	var total int
+	c.Assert(db.QueryRow("SELECT total FROM totals").Scan(&total), IsNil)
+	c.Assert(total, Equals, 2)
+}
+
+func (s *OutboxSuite) TestSQLOutboxHoldsTheEventsAppendedUntilDelivered(c *C) {
+	db := openTestDB(c)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	store, _ := NewSQLEventStore(db, SQLiteDialect{})
+	c.Assert(store.Migrate(s.ctx), IsNil)
+	_, _ = store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(1))
+	store.SetOutbox(true)
+	_, _ = store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(2))
+
+	outbox, err := NewSQLOutbox(store)
+	c.Assert(err, IsNil)
+	pending, err := outbox.Pending(s.ctx, 10)
+	c.Assert(err, IsNil)
+	c.Assert(pending, HasLen, 2)
+	c.Assert(pending[0].EventNumber, Equals, int64(1))
+
+	s.relay.outbox = outbox
+	published, err := s.relay.Relay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(published, Equals, 2)
+	c.Assert(s.handler.events, HasLen, 2)
+	pending, _ = outbox.Pending(s.ctx, 10)
+	c.Assert(pending, HasLen, 0)
+}
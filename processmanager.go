@@ -0,0 +1,235 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+)
+
+// ProcessManager is the interface that a process manager, or saga, must
+// implement.
+//
+// A process manager coordinates aggregates by reacting to their events with
+// commands. It is itself event sourced: Transition applies events that record
+// the progress of the process, in the same way as an aggregate handles a
+// command, and returns the commands to dispatch.
+type ProcessManager interface {
+	AggregateRoot
+
+	// Transition moves the process on in response to the event and returns
+	// the commands to dispatch.
+	Transition(EventMessage) ([]CommandMessage, error)
+
+	// HasHandled reports whether the process has already handled the event
+	// with the ID specified.
+	HasHandled(eventID string) bool
+}
+
+// ProcessManagerBase is a type that can be embedded in a ProcessManager
+// implementation to keep track of the events the process has handled.
+//
+// Its Apply method routes events to the appliers registered with
+// RegisterApplier or RegisterOnMethods, and its Raise method raises new
+// events, as those of AggregateBase do. An embedding type that implements its
+// own Apply method must call the Apply method of ProcessManagerBase in place
+// of calling TrackChange, and pass the events it applies itself to
+// IgnoreEvents.
+type ProcessManagerBase struct {
+	*AggregateBase
+	handled map[string]struct{}
+}
+
+// NewProcessManagerBase constructs a new ProcessManagerBase
+func NewProcessManagerBase(id string) *ProcessManagerBase {
+	return &ProcessManagerBase{
+		AggregateBase: NewAggregateBase(id),
+		handled:       make(map[string]struct{}),
+	}
+}
+
+// Apply tracks new events, passes the event to the applier registered for its
+// type and records the event that caused the event, found in its CausationID
+// header, as handled.
+func (p *ProcessManagerBase) Apply(event EventMessage, isNew bool) {
+	p.AggregateBase.Apply(event, isNew)
+	p.recordCausation(event)
+}
+
+// Raise applies a new event to the process and tracks it as a change, as
+// AggregateBase.Raise does, and records the event that caused it as handled.
+func (p *ProcessManagerBase) Raise(event interface{}) error {
+	if err := p.AggregateBase.Raise(event); err != nil {
+		return err
+	}
+	changes := p.GetChanges()
+	p.recordCausation(changes[len(changes)-1])
+	return nil
+}
+
+// recordCausation records the event found in the CausationID header of the
+// event as handled.
+func (p *ProcessManagerBase) recordCausation(event EventMessage) {
+	if id, ok := event.GetHeaders()[HeaderCausationID].(string); ok && id != "" {
+		p.handled[id] = struct{}{}
+	}
+}
+
+// HasHandled reports whether the process has already handled the event with
+// the ID specified.
+func (p *ProcessManagerBase) HasHandled(eventID string) bool {
+	_, ok := p.handled[eventID]
+	return ok
+}
+
+// CorrelationFunc returns the ID of the process manager instance that handles
+// the event, or false if the event is not for any instance.
+type CorrelationFunc func(EventMessage) (string, bool)
+
+// ProcessManagerHandler is an event handler that feeds events to process
+// manager instances.
+//
+// For each event the handler finds the instance with the CorrelationFunc,
+// loads it from the repository, or creates it if it does not exist, and calls
+// Transition. The commands returned are dispatched and then the events of the
+// instance are saved.
+//
+// Commands are dispatched at least once. If dispatching or saving fails the
+// error is returned so that the event is handled again. The events an
+// instance saves carry the ID of the event that caused them, so an event that
+// is delivered again after the instance was saved is ignored. Each command has
+// a CommandID header derived from the ID of the event that caused it, so that
+// a handler can ignore a command that was dispatched again after a failure,
+// for example with the DeduplicationMiddleware.
+//
+// An event must have an EventID header or a version to be identified. An
+// event with neither is rejected with an *ErrNoEventIdentity, as the process
+// could not tell whether it had handled the event and the commands it caused
+// could not be given stable IDs.
+type ProcessManagerHandler struct {
+	repository  DomainRepository
+	dispatcher  Dispatcher
+	newProcess  func(id string) ProcessManager
+	processType string
+	correlate   CorrelationFunc
+}
+
+// NewProcessManagerHandler constructs a new ProcessManagerHandler.
+//
+// newProcess constructs a new instance of the process manager. The repository
+// must be able to load instances of the type it returns.
+func NewProcessManagerHandler(newProcess func(id string) ProcessManager, correlate CorrelationFunc,
+	repository DomainRepository, dispatcher Dispatcher) (*ProcessManagerHandler, error) {
+
+	if newProcess == nil {
+		return nil, fmt.Errorf("nil process manager constructor injected into ProcessManagerHandler")
+	}
+	if correlate == nil {
+		return nil, fmt.Errorf("nil CorrelationFunc injected into ProcessManagerHandler")
+	}
+	if repository == nil {
+		return nil, fmt.Errorf("nil DomainRepository injected into ProcessManagerHandler")
+	}
+	if dispatcher == nil {
+		return nil, fmt.Errorf("nil Dispatcher injected into ProcessManagerHandler")
+	}
+
+	return &ProcessManagerHandler{
+		repository:  repository,
+		dispatcher:  dispatcher,
+		newProcess:  newProcess,
+		processType: typeOf(newProcess("")),
+		correlate:   correlate,
+	}, nil
+}
+
+// Handle feeds the event to the process manager instance it is for. Failures
+// are only reported by HandleEvent, which event buses call in preference.
+func (h *ProcessManagerHandler) Handle(event EventMessage) {
+	_ = h.HandleEvent(context.Background(), event)
+}
+
+// HandleEvent feeds the event to the process manager instance it is for.
+func (h *ProcessManagerHandler) HandleEvent(ctx context.Context, event EventMessage) error {
+	id, ok := h.correlate(event)
+	if !ok || id == "" {
+		return nil
+	}
+
+	eventID := eventIdentity(event)
+	if eventID == "" {
+		return &ErrNoEventIdentity{AggregateID: event.AggregateID(), EventType: event.EventType()}
+	}
+
+	process, err := h.load(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if process.HasHandled(eventID) {
+		return nil
+	}
+
+	commands, err := process.Transition(event)
+	if err != nil {
+		return err
+	}
+
+	recorder, _ := process.(interface{ recordCausation(EventMessage) })
+	for _, change := range process.GetChanges() {
+		change.SetHeader(HeaderCausationID, eventID)
+		change.SetHeader(HeaderCorrelationID, id)
+		if recorder != nil {
+			recorder.recordCausation(change)
+		}
+	}
+
+	for i, command := range commands {
+		command.SetHeader(HeaderCausationID, eventID)
+		command.SetHeader(HeaderCorrelationID, id)
+		command.SetHeader(HeaderCommandID, fmt.Sprintf("%s-%d", eventID, i))
+
+		if err := dispatchCommand(ctx, h.dispatcher, command); err != nil {
+			return err
+		}
+	}
+
+	return saveAggregate(ctx, h.repository, process, nil)
+}
+
+// HandlerName returns the name of the handler used in dead letters.
+func (h *ProcessManagerHandler) HandlerName() string {
+	return h.processType
+}
+
+func (h *ProcessManagerHandler) load(ctx context.Context, id string) (ProcessManager, error) {
+	aggregate, err := loadAggregate(ctx, h.repository, h.processType, id)
+	if _, ok := err.(*ErrAggregateNotFound); ok {
+		return h.newProcess(id), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	process, ok := aggregate.(ProcessManager)
+	if !ok {
+		return nil, fmt.Errorf("aggregate %s of type %s is not a ProcessManager", id, h.processType)
+	}
+	return process, nil
+}
+
+// eventIdentity returns the EventID header of the event or, if it has none,
+// an ID made from the aggregate ID and version of the event. An empty string is
+// returned if the event has neither.
+func eventIdentity(event EventMessage) string {
+	if id, ok := event.GetHeaders()[HeaderEventID].(string); ok && id != "" {
+		return id
+	}
+	if event.Version() != nil {
+		return fmt.Sprintf("%s-%d", event.AggregateID(), *event.Version())
+	}
+	return ""
+}
@@ -0,0 +1,284 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ProcessManagerSuite{})
+
+type ProcessManagerSuite struct {
+	ctx      context.Context
+	repo     *CommonDomainRepository
+	commands []CommandMessage
+	failures int
+	handler  *ProcessManagerHandler
+}
+
+// OrderProcess counts the pallets of an order and issues a SomeCommand for
+// the order for each one.
+type OrderProcess struct {
+	*ProcessManagerBase
+	Pallets int
+}
+
+type PalletCounted struct {
+	Pallets int
+}
+
+func NewOrderProcess(id string) ProcessManager {
+	p := &OrderProcess{
+		ProcessManagerBase: NewProcessManagerBase(id),
+	}
+	p.IgnoreEvents(&PalletCounted{})
+	return p
+}
+
+func (p *OrderProcess) Apply(event EventMessage, isNew bool) {
+	p.ProcessManagerBase.Apply(event, isNew)
+	if e, ok := event.Event().(*PalletCounted); ok {
+		p.Pallets = e.Pallets
+	}
+}
+
+func (p *OrderProcess) Transition(event EventMessage) ([]CommandMessage, error) {
+	switch e := event.Event().(type) {
+	case *SomeOtherEvent:
+		p.Apply(NewEventMessage(p.AggregateID(), &PalletCounted{Pallets: p.Pallets + 1}, Int64(p.CurrentVersion())), true)
+		return []CommandMessage{NewCommandMessage(e.OrderID, &SomeCommand{Count: p.Pallets})}, nil
+	case *SomeEvent:
+		return nil, fmt.Errorf("can not handle %s", event.EventType())
+	}
+	return nil, nil
+}
+
+// RoutedOrderProcess counts pallets like OrderProcess but applies its events
+// with a registered applier and raises them with Raise.
+type RoutedOrderProcess struct {
+	*ProcessManagerBase
+	Pallets int
+}
+
+func NewRoutedOrderProcess(id string) ProcessManager {
+	p := &RoutedOrderProcess{ProcessManagerBase: NewProcessManagerBase(id)}
+	RegisterApplier(p.AggregateBase, func(e *PalletCounted) {
+		p.Pallets = e.Pallets
+	})
+	return p
+}
+
+func (p *RoutedOrderProcess) Transition(event EventMessage) ([]CommandMessage, error) {
+	if e, ok := event.Event().(*SomeOtherEvent); ok {
+		if err := p.Raise(&PalletCounted{Pallets: p.Pallets + 1}); err != nil {
+			return nil, err
+		}
+		return []CommandMessage{NewCommandMessage(e.OrderID, &SomeCommand{Count: p.Pallets})}, nil
+	}
+	return nil, nil
+}
+
+func (s *ProcessManagerSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+	s.commands = nil
+	s.failures = 0
+
+	repo, _ := NewCommonDomainRepository(NewInMemoryEventStore(), &MockEventBus{})
+	aggregateFactory := NewDelegateAggregateFactory()
+	_ = aggregateFactory.RegisterDelegate(&OrderProcess{},
+		func(id string) AggregateRoot { return NewOrderProcess(id) })
+	_ = aggregateFactory.RegisterDelegate(&RoutedOrderProcess{},
+		func(id string) AggregateRoot { return NewRoutedOrderProcess(id) })
+	repo.SetAggregateFactory(aggregateFactory)
+	streamNamer := NewDelegateStreamNamer()
+	_ = streamNamer.RegisterDelegate(func(t string, id string) string { return t + "-" + id },
+		&OrderProcess{}, &RoutedOrderProcess{})
+	repo.SetStreamNameDelegate(streamNamer)
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&PalletCounted{},
+		func() interface{} { return &PalletCounted{} })
+	repo.SetEventFactory(eventFactory)
+	s.repo = repo
+
+	dispatcher := NewInMemoryDispatcher()
+	_ = dispatcher.RegisterHandler(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		if s.failures > 0 {
+			s.failures--
+			return fmt.Errorf("dispatch failed")
+		}
+		s.commands = append(s.commands, command)
+		return nil
+	}), &SomeCommand{})
+
+	handler, err := NewProcessManagerHandler(NewOrderProcess, correlateByOrderID, repo, dispatcher)
+	c.Assert(err, IsNil)
+	s.handler = handler
+}
+
+func correlateByOrderID(event EventMessage) (string, bool) {
+	if e, ok := event.Event().(*SomeOtherEvent); ok {
+		return e.OrderID, true
+	}
+	return "", false
+}
+
+func newPalletEvent(orderID string) EventMessage {
+	em := NewEventMessage(NewUUID(), &SomeOtherEvent{OrderID: orderID}, Int64(0))
+	em.SetHeader(HeaderEventID, NewUUID())
+	return em
+}
+
+func (s *ProcessManagerSuite) load(c *C, id string) *OrderProcess {
+	process, err := s.repo.Load(typeOf(&OrderProcess{}), id)
+	c.Assert(err, IsNil)
+	return process.(*OrderProcess)
+}
+
+func (s *ProcessManagerSuite) TestNewProcessManagerHandlerRequiresDependencies(c *C) {
+	dispatcher := NewInMemoryDispatcher()
+
+	_, err := NewProcessManagerHandler(nil, correlateByOrderID, s.repo, dispatcher)
+	c.Assert(err, NotNil)
+	_, err = NewProcessManagerHandler(NewOrderProcess, nil, s.repo, dispatcher)
+	c.Assert(err, NotNil)
+	_, err = NewProcessManagerHandler(NewOrderProcess, correlateByOrderID, nil, dispatcher)
+	c.Assert(err, NotNil)
+	_, err = NewProcessManagerHandler(NewOrderProcess, correlateByOrderID, s.repo, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *ProcessManagerSuite) TestHandlesEventsForAnInstance(c *C) {
+	orderID := NewUUID()
+	first := newPalletEvent(orderID)
+
+	c.Assert(s.handler.HandleEvent(s.ctx, first), IsNil)
+	c.Assert(s.handler.HandleEvent(s.ctx, newPalletEvent(orderID)), IsNil)
+
+	c.Assert(s.load(c, orderID).Pallets, Equals, 2)
+	c.Assert(s.commands, HasLen, 2)
+	c.Assert(s.commands[1].Command(), DeepEquals, &SomeCommand{Count: 2})
+
+	headers := s.commands[0].Headers()
+	eventID := first.GetHeaders()[HeaderEventID].(string)
+	c.Assert(headers[HeaderCausationID], Equals, eventID)
+	c.Assert(headers[HeaderCorrelationID], Equals, orderID)
+	c.Assert(headers[HeaderCommandID], Equals, eventID+"-0")
+}
+
+func (s *ProcessManagerSuite) TestIgnoresEventsAlreadyHandled(c *C) {
+	orderID := NewUUID()
+	event := newPalletEvent(orderID)
+
+	c.Assert(s.handler.HandleEvent(s.ctx, event), IsNil)
+	c.Assert(s.handler.HandleEvent(s.ctx, event), IsNil)
+
+	c.Assert(s.load(c, orderID).Pallets, Equals, 1)
+	c.Assert(s.commands, HasLen, 1)
+}
+
+func (s *ProcessManagerSuite) TestIgnoresEventsWithoutAnInstance(c *C) {
+	c.Assert(s.handler.HandleEvent(s.ctx, NewEventMessage(NewUUID(), &SomeOtherCommand{}, nil)), IsNil)
+	c.Assert(s.commands, HasLen, 0)
+}
+
+func (s *ProcessManagerSuite) TestDispatchFailureDoesNotSaveInstance(c *C) {
+	orderID := NewUUID()
+	event := newPalletEvent(orderID)
+	s.failures = 1
+
+	err := s.handler.HandleEvent(s.ctx, event)
+	c.Assert(err, ErrorMatches, "dispatch failed")
+	_, err = s.repo.Load(typeOf(&OrderProcess{}), orderID)
+	c.Assert(err, FitsTypeOf, &ErrAggregateNotFound{})
+
+	c.Assert(s.handler.HandleEvent(s.ctx, event), IsNil)
+	c.Assert(s.commands, HasLen, 1)
+	c.Assert(s.load(c, orderID).Pallets, Equals, 1)
+}
+
+func (s *ProcessManagerSuite) TestTransitionErrorIsReturned(c *C) {
+	s.handler.correlate = func(EventMessage) (string, bool) { return "order", true }
+
+	event := NewTestEventMessage(NewUUID())
+	event.SetHeader(HeaderEventID, NewUUID())
+
+	err := s.handler.HandleEvent(s.ctx, event)
+
+	c.Assert(err, ErrorMatches, "can not handle eventsourcing.SomeEvent")
+}
+
+func (s *ProcessManagerSuite) TestRejectsEventsWithoutAnIdentity(c *C) {
+	orderID := NewUUID()
+	event := NewEventMessage(orderID, &SomeOtherEvent{OrderID: orderID}, nil)
+
+	err := s.handler.HandleEvent(s.ctx, event)
+
+	c.Assert(err, DeepEquals, &ErrNoEventIdentity{AggregateID: orderID, EventType: "eventsourcing.SomeOtherEvent"})
+	c.Assert(s.commands, HasLen, 0)
+}
+
+func (s *ProcessManagerSuite) TestHandlesEventsFromEventBus(c *C) {
+	bus := NewInternalEventBus()
+	bus.AddHandler(s.handler, &SomeOtherEvent{})
+	orderID := NewUUID()
+
+	c.Assert(bus.Publish(s.ctx, newPalletEvent(orderID)), IsNil)
+
+	c.Assert(s.commands, HasLen, 1)
+	c.Assert(s.commands[0].AggregateID(), Equals, orderID)
+}
+
+func (s *ProcessManagerSuite) TestEventIdentity(c *C) {
+	em := NewEventMessage("order", &SomeEvent{}, Int64(3))
+	c.Assert(eventIdentity(em), Equals, "order-3")
+
+	em.SetHeader(HeaderEventID, "id")
+	c.Assert(eventIdentity(em), Equals, "id")
+
+	c.Assert(eventIdentity(NewEventMessage("order", &SomeEvent{}, nil)), Equals, "")
+}
+
+func (s *ProcessManagerSuite) TestProcessWithAppliers(c *C) {
+	dispatcher := NewInMemoryDispatcher()
+	_ = dispatcher.RegisterHandler(CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		s.commands = append(s.commands, command)
+		return nil
+	}), &SomeCommand{})
+	handler, err := NewProcessManagerHandler(NewRoutedOrderProcess, correlateByOrderID, s.repo, dispatcher)
+	c.Assert(err, IsNil)
+
+	orderID := NewUUID()
+	first := newPalletEvent(orderID)
+	c.Assert(handler.HandleEvent(s.ctx, first), IsNil)
+	c.Assert(handler.HandleEvent(s.ctx, newPalletEvent(orderID)), IsNil)
+	c.Assert(handler.HandleEvent(s.ctx, first), IsNil)
+
+	loaded, err := s.repo.Load(typeOf(&RoutedOrderProcess{}), orderID)
+	c.Assert(err, IsNil)
+	process := loaded.(*RoutedOrderProcess)
+	c.Assert(process.Pallets, Equals, 2)
+	c.Assert(process.CurrentVersion(), Equals, int64(1))
+	c.Assert(process.HasHandled(first.GetHeaders()[HeaderEventID].(string)), Equals, true)
+	c.Assert(s.commands, HasLen, 2)
+	c.Assert(s.commands[1].Command(), DeepEquals, &SomeCommand{Count: 2})
+}
+
+func (s *ProcessManagerSuite) TestRaiseAndApplyWithAppliers(c *C) {
+	process := NewRoutedOrderProcess("order").(*RoutedOrderProcess)
+
+	c.Assert(process.Raise(&PalletCounted{Pallets: 1}), IsNil)
+	c.Assert(process.Pallets, Equals, 1)
+	c.Assert(process.GetChanges(), HasLen, 1)
+
+	em := NewEventMessage("order", &PalletCounted{Pallets: 2}, Int64(1))
+	em.SetHeader(HeaderCausationID, "cause")
+	process.Apply(em, true)
+	c.Assert(process.Pallets, Equals, 2)
+	c.Assert(process.HasHandled("cause"), Equals, true)
+}
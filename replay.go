@@ -0,0 +1,187 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReplayProgress reports how far a replay has got.
+type ReplayProgress struct {
+	// Read is the number of events read from the EventStore.
+	Read int
+
+	// Replayed is the number of events passed to the handlers, or that would
+	// have been in a dry run.
+	Replayed int
+
+	// Skipped is the number of events outside the category or time range of
+	// the replay, or of a type the EventFactory does not know.
+	Skipped int
+
+	// Position is the position of the last event read.
+	Position Position
+}
+
+// Replayer replays the history in an EventStore into event handlers, such as
+// a read model that has changed and needs to be rebuilt.
+//
+// The events are read from the $all stream in batches. A replay can be
+// restricted to a category of streams and to a time range. Recorded events
+// are turned into EventMessages with the EventFactory and published to the
+// handlers added to the replayer in the order they were recorded.
+type Replayer struct {
+	eventStore    EventStore
+	eventFactory  EventFactory
+	metadataCodec MetadataCodec
+	upcasters     *Upcasters
+	serializers   *Serializers
+	bus           *InternalEventBus
+	category      string
+	from          time.Time
+	to            time.Time
+	batchSize     int
+	dryRun        bool
+	progress      func(ReplayProgress)
+}
+
+// NewReplayer constructs a new Replayer that reads events from the EventStore.
+func NewReplayer(eventStore EventStore, eventFactory EventFactory) (*Replayer, error) {
+	if eventStore == nil {
+		return nil, fmt.Errorf("nil Eventstore injected into replayer")
+	}
+	if eventFactory == nil {
+		return nil, fmt.Errorf("nil EventFactory injected into replayer")
+	}
+
+	return &Replayer{
+		eventStore:    eventStore,
+		eventFactory:  eventFactory,
+		metadataCodec: NewJSONMetadataCodec(),
+		serializers:   DefaultSerializers,
+		bus:           NewInternalEventBus(),
+		batchSize:     DefaultReadBatchSize,
+	}, nil
+}
+
+// AddHandler registers an event handler for all of the events specified in the
+// variadic events parameter.
+func (r *Replayer) AddHandler(handler EventHandler, events ...interface{}) {
+	r.bus.AddHandler(handler, events...)
+}
+
+// SetCategory restricts the replay to the streams of a category.
+func (r *Replayer) SetCategory(category string) {
+	r.category = category
+}
+
+// SetTimeRange restricts the replay to the events recorded at or after from
+// and before to. A zero time leaves that end of the range open.
+func (r *Replayer) SetTimeRange(from, to time.Time) {
+	r.from = from
+	r.to = to
+}
+
+// SetReadBatchSize sets the number of events read at a time. Values less than
+// 1 are ignored.
+func (r *Replayer) SetReadBatchSize(size int) {
+	if size > 0 {
+		r.batchSize = size
+	}
+}
+
+// SetDryRun sets whether the replay only reads and decodes the events without
+// passing them to the handlers.
+func (r *Replayer) SetDryRun(dryRun bool) {
+	r.dryRun = dryRun
+}
+
+// SetProgressFunc sets a function that is called with the progress of the
+// replay after each batch of events.
+func (r *Replayer) SetProgressFunc(progress func(ReplayProgress)) {
+	r.progress = progress
+}
+
+// SetMetadataCodec sets the codec used to decode event headers.
+func (r *Replayer) SetMetadataCodec(codec MetadataCodec) {
+	r.metadataCodec = codec
+}
+
+// SetUpcasters sets the upcasters that transform events persisted in an old
+// schema before they are replayed.
+func (r *Replayer) SetUpcasters(upcasters *Upcasters) {
+	r.upcasters = upcasters
+}
+
+// SetSerializers sets the serializers used to read events by their content
+// type. DefaultSerializers is used by default.
+func (r *Replayer) SetSerializers(serializers *Serializers) {
+	r.serializers = serializers
+}
+
+// Replay reads all of the events in the EventStore and passes those in the
+// category and time range of the replay to the handlers.
+//
+// The replay stops at the first event that a handler fails to handle, or that
+// can not be decoded, and returns the error with the progress so far.
+func (r *Replayer) Replay(ctx context.Context) (ReplayProgress, error) {
+	progress := ReplayProgress{Position: PositionStart}
+
+	for {
+		events, err := r.eventStore.ReadAll(ctx, progress.Position, r.batchSize)
+		if err != nil {
+			return progress, err
+		}
+
+		for _, event := range events {
+			progress.Read++
+			progress.Position = event.Position
+
+			messages, err := r.decode(event)
+			if err != nil {
+				return progress, err
+			}
+			if len(messages) == 0 {
+				progress.Skipped++
+				continue
+			}
+
+			if !r.dryRun {
+				for _, em := range messages {
+					if err := r.bus.Publish(ctx, em); err != nil {
+						return progress, err
+					}
+				}
+			}
+			progress.Replayed++
+		}
+
+		if len(events) > 0 && r.progress != nil {
+			r.progress(progress)
+		}
+		if len(events) < r.batchSize {
+			return progress, nil
+		}
+	}
+}
+
+// decode returns the messages for the event, or none if the event is not to be
+// replayed.
+func (r *Replayer) decode(event RecordedEvent) ([]EventMessage, error) {
+	if r.category != "" && streamCategory(event.StreamName) != r.category {
+		return nil, nil
+	}
+	if !r.from.IsZero() && event.Created.Before(r.from) {
+		return nil, nil
+	}
+	if !r.to.IsZero() && !event.Created.Before(r.to) {
+		return nil, nil
+	}
+	messages, _, err := decodeEventMessages(r.eventFactory, r.metadataCodec, r.upcasters, r.serializers, "", event)
+	return messages, err
+}
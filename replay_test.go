@@ -0,0 +1,127 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ReplayerSuite{})
+
+type ReplayerSuite struct {
+	ctx      context.Context
+	store    *InMemoryEventStore
+	replayer *Replayer
+	handler  *MockEventHandler
+}
+
+func (s *ReplayerSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+	s.store = NewInMemoryEventStore()
+	s.handler = NewMockEventHandler()
+
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+
+	replayer, err := NewReplayer(s.store, eventFactory)
+	c.Assert(err, IsNil)
+	replayer.AddHandler(s.handler, &SomeEvent{})
+	s.replayer = replayer
+}
+
+func (s *ReplayerSuite) TestNewReplayerRequiresEventStoreAndFactory(c *C) {
+	replayer, err := NewReplayer(nil, NewDelegateEventFactory())
+	c.Assert(replayer, IsNil)
+	c.Assert(err, DeepEquals, fmt.Errorf("nil Eventstore injected into replayer"))
+
+	replayer, err = NewReplayer(s.store, nil)
+	c.Assert(replayer, IsNil)
+	c.Assert(err, DeepEquals, fmt.Errorf("nil EventFactory injected into replayer"))
+}
+
+func (s *ReplayerSuite) TestReplaysAllEventsInBatches(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(3))
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-2", ExpectedVersionAny, NewTestEventData(2))
+	var reported []ReplayProgress
+	s.replayer.SetReadBatchSize(2)
+	s.replayer.SetProgressFunc(func(p ReplayProgress) {
+		reported = append(reported, p)
+	})
+
+	progress, err := s.replayer.Replay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(progress, Equals, ReplayProgress{Read: 5, Replayed: 5, Position: LogPosition(4)})
+	c.Assert(reported, HasLen, 3)
+	c.Assert(reported[0], Equals, ReplayProgress{Read: 2, Replayed: 2, Position: LogPosition(1)})
+	c.Assert(s.handler.events, HasLen, 5)
+	c.Assert(s.handler.events[3].AggregateID(), Equals, "2")
+	c.Assert(s.handler.events[3].Event(), DeepEquals, &SomeEvent{Item: "item 0", Count: 0})
+}
+
+func (s *ReplayerSuite) TestReplaysCategory(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "Other-1", ExpectedVersionAny, NewTestEventData(2))
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(1))
+	s.replayer.SetCategory("SomeAggregate")
+
+	progress, err := s.replayer.Replay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(progress, Equals, ReplayProgress{Read: 3, Replayed: 1, Skipped: 2, Position: LogPosition(2)})
+	c.Assert(s.handler.events, HasLen, 1)
+}
+
+func (s *ReplayerSuite) TestReplaysTimeRange(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(1))
+	time.Sleep(2 * time.Millisecond)
+	from := time.Now()
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(2))
+	time.Sleep(2 * time.Millisecond)
+	to := time.Now()
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(1))
+	s.replayer.SetTimeRange(from, to)
+
+	progress, err := s.replayer.Replay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(progress.Replayed, Equals, 2)
+	c.Assert(progress.Skipped, Equals, 2)
+	c.Assert(*s.handler.events[0].Version(), Equals, int64(1))
+}
+
+func (s *ReplayerSuite) TestDryRunDoesNotCallHandlers(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(3))
+	s.replayer.SetDryRun(true)
+
+	progress, err := s.replayer.Replay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(progress.Replayed, Equals, 3)
+	c.Assert(s.handler.events, HasLen, 0)
+}
+
+func (s *ReplayerSuite) TestStopsWhenHandlerFails(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(3))
+	s.replayer.AddHandler(&FailingEventHandler{Failures: 2}, &SomeEvent{})
+
+	progress, err := s.replayer.Replay(s.ctx)
+
+	c.Assert(err, FitsTypeOf, &ErrEventHandlerFailed{})
+	c.Assert(progress, Equals, ReplayProgress{Read: 1, Position: LogPosition(0)})
+}
+
+func (s *ReplayerSuite) TestReturnsEventStoreErrors(c *C) {
+	replayer, _ := NewReplayer(&FailingEventStore{err: fmt.Errorf("boom")}, NewDelegateEventFactory())
+
+	_, err := replayer.Replay(s.ctx)
+
+	c.Assert(err, ErrorMatches, "boom")
+}
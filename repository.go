@@ -7,16 +7,14 @@ package eventsourcing
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-
-	esDb "github.com/EventStore/EventStore-Client-Go/client"
-	"github.com/EventStore/EventStore-Client-Go/direction"
-	"github.com/EventStore/EventStore-Client-Go/messages"
-	"github.com/EventStore/EventStore-Client-Go/streamrevision"
-	"github.com/gofrs/uuid"
+	"time"
 )
 
+// DefaultReadBatchSize is the number of events read from the event store in
+// each request when an aggregate is loaded.
+const DefaultReadBatchSize = 500
+
 // DomainRepository is the interface that all domain repositories should implement.
 type DomainRepository interface {
 	//Loads an aggregate of the given type and ID
@@ -26,18 +24,78 @@ type DomainRepository interface {
 	Save(aggregate AggregateRoot, expectedVersion *int64) error
 }
 
-// GetEventStoreCommonDomainRepo is an implementation of the DomainRepository
-// that uses GetEventStore for persistence
-type GetEventStoreCommonDomainRepo struct {
-	eventStore         *esDb.Client
+// ContextDomainRepository is the interface that domain repositories implement
+// to accept a context for their I/O.
+//
+// When the context is cancelled or its deadline passes any in flight read or
+// append to the event store is aborted.
+type ContextDomainRepository interface {
+	DomainRepository
+
+	//Loads an aggregate of the given type and ID
+	LoadContext(ctx context.Context, aggregateTypeName string, aggregateID string) (AggregateRoot, error)
+
+	//Saves the aggregate.
+	SaveContext(ctx context.Context, aggregate AggregateRoot, expectedVersion *int64) error
+}
+
+// loadAggregate passes the context to the repository if it is a
+// ContextDomainRepository, otherwise the context is dropped.
+func loadAggregate(ctx context.Context, repository DomainRepository, aggregateType, id string) (AggregateRoot, error) {
+	if r, ok := repository.(ContextDomainRepository); ok {
+		return r.LoadContext(ctx, aggregateType, id)
+	}
+	return repository.Load(aggregateType, id)
+}
+
+// saveAggregate passes the context to the repository if it is a
+// ContextDomainRepository, otherwise the context is dropped.
+func saveAggregate(ctx context.Context, repository DomainRepository, aggregate AggregateRoot, expectedVersion *int64) error {
+	if r, ok := repository.(ContextDomainRepository); ok {
+		return r.SaveContext(ctx, aggregate, expectedVersion)
+	}
+	return repository.Save(aggregate, expectedVersion)
+}
+
+// PublishMode determines how the events saved by a repository are published.
+type PublishMode int
+
+const (
+	// PublishOnSave publishes events to the event bus once they have been
+	// appended to the event store, before Save returns. Events are lost if the
+	// process stops between the append and the publish.
+	PublishOnSave PublishMode = iota
+
+	// PublishFromOutbox leaves publishing to an OutboxRelay that reads the
+	// events from the event store, so that every persisted event is published
+	// and no event is published unless it was persisted.
+	PublishFromOutbox
+)
+
+// CommonDomainRepository is an implementation of the DomainRepository
+// that persists events in any EventStore.
+//
+// The same repository can be used over an InMemoryEventStore in tests and
+// over GetEventStore in production.
+type CommonDomainRepository struct {
+	eventStore         EventStore
 	eventBus           EventBus
 	streamNameDelegate StreamNamer
 	aggregateFactory   AggregateFactory
 	eventFactory       EventFactory
+	metadataCodec      MetadataCodec
+	snapshotStore      SnapshotStore
+	snapshotPolicy     SnapshotPolicy
+	readBatchSize      int
+	publishMode        PublishMode
+	upcasters          *Upcasters
+	serializer         Serializer
+	serializers        *Serializers
+	types              *TypeRegistry
 }
 
 // NewCommonDomainRepository constructs a new CommonDomainRepository
-func NewCommonDomainRepository(eventStore *esDb.Client, eventBus EventBus) (*GetEventStoreCommonDomainRepo, error) {
+func NewCommonDomainRepository(eventStore EventStore, eventBus EventBus) (*CommonDomainRepository, error) {
 	if eventStore == nil {
 		return nil, fmt.Errorf("nil Eventstore injected into repository")
 	}
@@ -46,9 +104,14 @@ func NewCommonDomainRepository(eventStore *esDb.Client, eventBus EventBus) (*Get
 		return nil, fmt.Errorf("nil EventBus injected into repository")
 	}
 
-	d := &GetEventStoreCommonDomainRepo{
-		eventStore: eventStore,
-		eventBus:   eventBus,
+	d := &CommonDomainRepository{
+		eventStore:    eventStore,
+		eventBus:      eventBus,
+		metadataCodec: NewJSONMetadataCodec(),
+		serializer:    NewJSONSerializer(),
+		serializers:   DefaultSerializers,
+		readBatchSize: DefaultReadBatchSize,
+		types:         DefaultTypeRegistry,
 	}
 	return d, nil
 }
@@ -58,7 +121,7 @@ func NewCommonDomainRepository(eventStore *esDb.Client, eventBus EventBus) (*Get
 //
 // Only one AggregateFactory can be registered at any one time.
 // Any registration will overwrite the provious registration.
-func (r *GetEventStoreCommonDomainRepo) SetAggregateFactory(factory AggregateFactory) {
+func (r *CommonDomainRepository) SetAggregateFactory(factory AggregateFactory) {
 	r.aggregateFactory = factory
 }
 
@@ -67,21 +130,115 @@ func (r *GetEventStoreCommonDomainRepo) SetAggregateFactory(factory AggregateFac
 //
 // Only one event factory can be set at a time. Any subsequent registration will
 // overwrite the previous factory.
-func (r *GetEventStoreCommonDomainRepo) SetEventFactory(factory EventFactory) {
+func (r *CommonDomainRepository) SetEventFactory(factory EventFactory) {
 	r.eventFactory = factory
 }
 
 // SetStreamNameDelegate sets the stream name delegate
-func (r *GetEventStoreCommonDomainRepo) SetStreamNameDelegate(delegate StreamNamer) {
+func (r *CommonDomainRepository) SetStreamNameDelegate(delegate StreamNamer) {
 	r.streamNameDelegate = delegate
 }
 
+// SetMetadataCodec sets the codec used to persist the headers of events as
+// event metadata.
+//
+// The JSONMetadataCodec is used by default.
+func (r *CommonDomainRepository) SetMetadataCodec(codec MetadataCodec) {
+	r.metadataCodec = codec
+}
+
+// SetSnapshotStore sets the snapshot store used to load and save snapshots of
+// aggregates that implement the Snapshotter interface.
+//
+// If no snapshot store is set aggregates are always loaded from all events.
+func (r *CommonDomainRepository) SetSnapshotStore(store SnapshotStore) {
+	r.snapshotStore = store
+}
+
+// SetSnapshotPolicy sets the policy that decides when a snapshot is taken as
+// an aggregate is saved.
+//
+// If no policy is set snapshots are only taken on demand by calling SaveSnapshot.
+func (r *CommonDomainRepository) SetSnapshotPolicy(policy SnapshotPolicy) {
+	r.snapshotPolicy = policy
+}
+
+// SetReadBatchSize sets the number of events read from the event store in each
+// request when an aggregate is loaded.
+//
+// Sizes less than one are ignored.
+func (r *CommonDomainRepository) SetReadBatchSize(size int) {
+	if size > 0 {
+		r.readBatchSize = size
+	}
+}
+
+// SetUpcasters sets the upcasters that transform events persisted in an old
+// schema as they are loaded. The current schema version of each event is
+// recorded in its SchemaVersion header when it is saved.
+func (r *CommonDomainRepository) SetUpcasters(upcasters *Upcasters) {
+	r.upcasters = upcasters
+}
+
+// SetSerializer sets the serializer that events and snapshots are saved with.
+// Events are saved as JSON by default.
+//
+// The content type of the serializer is recorded with each event. Events are
+// read with the serializer for their content type in the Serializers of the
+// repository, so a stream can hold events saved with different serializers.
+func (r *CommonDomainRepository) SetSerializer(serializer Serializer) {
+	r.serializer = serializer
+}
+
+// SetSerializers sets the serializers used to read events and snapshots by
+// their content type. DefaultSerializers is used by default.
+func (r *CommonDomainRepository) SetSerializers(serializers *Serializers) {
+	r.serializers = serializers
+}
+
+// SetTypeRegistry sets the registry used to name the types of aggregates and
+// events. The DefaultTypeRegistry is used by default.
+func (r *CommonDomainRepository) SetTypeRegistry(types *TypeRegistry) {
+	r.types = types
+}
+
+// SetPublishMode sets how saved events are published. The default is
+// PublishOnSave.
+func (r *CommonDomainRepository) SetPublishMode(mode PublishMode) {
+	r.publishMode = mode
+}
+
 // Load will load all events from a stream and apply those events to an aggregate
 // of the type specified.
 //
 // The aggregate type and id will be passed to the configured StreamNamer to
 // get the stream name.
-func (r *GetEventStoreCommonDomainRepo) Load(aggregateType, id string) (AggregateRoot, error) {
+//
+// The stream is read in batches of the configured read batch size until the
+// end of the stream is reached. Each event is instantiated using the
+// EventFactory and unmarshalled before it is applied to the aggregate. The
+// headers of each event are restored from the persisted metadata.
+//
+// If upcasters are set, events persisted in an old schema are upcast first.
+// An event that is split is applied as several events but counts as one
+// version.
+//
+// If the aggregate implements Snapshotter and a snapshot store is set the
+// aggregate is restored from the latest snapshot and only the events appended
+// after the snapshot are applied.
+//
+// If the stream does not exist an *ErrAggregateNotFound is returned. If the
+// event store can not be reached an *ErrRepositoryUnavailable is returned.
+func (r *CommonDomainRepository) Load(aggregateType, id string) (AggregateRoot, error) {
+	return r.LoadContext(context.Background(), aggregateType, id)
+}
+
+// LoadContext loads an aggregate in the same way as Load using the context
+// for all reads from the event store and snapshot store.
+//
+// If the context is cancelled while the aggregate is loaded the context error
+// is returned.
+func (r *CommonDomainRepository) LoadContext(ctx context.Context, aggregateType, id string) (AggregateRoot, error) {
 
 	if r.aggregateFactory == nil {
 		return nil, fmt.Errorf("the common domain repository has no Aggregate Factory")
@@ -91,10 +248,6 @@ func (r *GetEventStoreCommonDomainRepo) Load(aggregateType, id string) (Aggregat
 		return nil, fmt.Errorf("the common domain repository has no stream name delegate")
 	}
 
-	if r.eventFactory == nil {
-		return nil, fmt.Errorf("the common domain has no Event Factory")
-	}
-
 	aggregate := r.aggregateFactory.GetAggregate(aggregateType, id)
 	if aggregate == nil {
 		return nil, fmt.Errorf("the repository has no aggregate factory registered for aggregate type: %s", aggregateType)
@@ -105,81 +258,404 @@ func (r *GetEventStoreCommonDomainRepo) Load(aggregateType, id string) (Aggregat
 		return nil, err
 	}
 
-	events, err := r.eventStore.ReadStreamEvents(context.Background(), direction.Forwards, streamName, streamrevision.StreamRevisionStart, 1, false)
-	if err != nil {
-		return nil, fmt.Errorf("could not read events from stream %s", streamName)
+	if err := r.load(ctx, aggregate, aggregateType, streamName); err != nil {
+		return nil, err
 	}
+	return aggregate, nil
+}
 
-	for _, event := range events {
-		evtNum := int64(event.EventNumber)
-		em := NewEventMessage(id, event, &evtNum)
-		aggregate.Apply(em, false)
-		aggregate.IncrementVersion()
+// applyErrorer is implemented by aggregates, such as those embedding an
+// AggregateBase, that record the events they could not apply.
+type applyErrorer interface {
+	ApplyErr() error
+}
+
+// load applies the events of the stream to the aggregate.
+//
+// If the aggregate records an error applying an event, such as an
+// *ErrNoApplier, the error is returned.
+func (r *CommonDomainRepository) load(ctx context.Context, aggregate AggregateRoot, aggregateType, streamName string) error {
+	if r.eventFactory == nil {
+		return fmt.Errorf("the common domain has no Event Factory")
 	}
 
-	return aggregate, nil
+	id := aggregate.AggregateID()
+	from := StreamStart
+	if snapshotter, ok := aggregate.(Snapshotter); ok && r.snapshotStore != nil {
+		version, err := r.restoreSnapshot(ctx, snapshotter, streamName)
+		if err != nil {
+			return err
+		}
+		from = version + 1
+	}
+
+	for {
+		events, err := r.eventStore.ReadStreamForwards(ctx, streamName, from, r.readBatchSize)
+		if _, ok := err.(*ErrStreamNotFound); ok {
+			return &ErrAggregateNotFound{AggregateID: id, AggregateType: aggregateType}
+		}
+		if _, ok := err.(*ErrRepositoryUnavailable); ok {
+			return err
+		}
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("could not read events from stream %s", streamName)
+		}
+
+		for _, event := range events {
+			messages, err := r.newEventMessages(id, event)
+			if err != nil {
+				return err
+			}
+			for _, em := range messages {
+				aggregate.Apply(em, false)
+			}
+			if applied, ok := aggregate.(applyErrorer); ok && applied.ApplyErr() != nil {
+				return applied.ApplyErr()
+			}
+			aggregate.IncrementVersion()
+		}
+
+		if len(events) < r.readBatchSize {
+			break
+		}
+		from = events[len(events)-1].EventNumber + 1
+	}
 
+	return nil
 }
 
 // Save persists an aggregate
-func (r *GetEventStoreCommonDomainRepo) Save(aggregate AggregateRoot, expectedVersion *int64) error {
+//
+// If a snapshot policy is set and the aggregate implements Snapshotter a
+// snapshot is taken when the policy requires it.
+//
+// The headers of each event, including the AggregateID and a Timestamp which
+// are set by the repository, are persisted as event metadata using the
+// configured MetadataCodec.
+//
+// The events are appended to the stream only if the stream is at the expected
+// version. If expectedVersion is nil the OriginalVersion of the aggregate is
+// used, so a nil expectedVersion is checked too. Earlier versions appended
+// without any check when it was nil; pass Int64(ExpectedVersionAny) for that
+// behaviour.
+//
+// Once the events are appended the version of the aggregate is moved on to the
+// version of the last event, so the same aggregate can raise and save further
+// events.
+//
+// If the stream has been modified since the aggregate was loaded an
+// *ErrConcurrencyViolation is returned and no events are published.
+func (r *CommonDomainRepository) Save(aggregate AggregateRoot, expectedVersion *int64) error {
+	return r.SaveContext(context.Background(), aggregate, expectedVersion)
+}
+
+// SaveContext persists an aggregate in the same way as Save using the context
+// for the append to the event store and when publishing events.
+//
+// If the context is cancelled before the events are appended the context
+// error is returned.
+func (r *CommonDomainRepository) SaveContext(ctx context.Context, aggregate AggregateRoot, expectedVersion *int64) error {
 
 	if r.streamNameDelegate == nil {
 		return fmt.Errorf("the common domain repository has no stream name delagate")
 	}
 
-	resultEvents := aggregate.GetChanges()
+	aggregateType, err := r.types.Name(aggregate)
+	if err != nil {
+		return err
+	}
 
-	streamName, err := r.streamNameDelegate.GetStreamName(typeOf(aggregate), aggregate.AggregateID())
+	streamName, err := r.streamNameDelegate.GetStreamName(aggregateType, aggregate.AggregateID())
 	if err != nil {
 		return err
 	}
 
+	return r.save(ctx, aggregate, streamName, expectedVersion)
+}
+
+// save appends the changes of the aggregate to the stream and publishes them.
+func (r *CommonDomainRepository) save(ctx context.Context, aggregate AggregateRoot, streamName string, expectedVersion *int64) error {
+	resultEvents := aggregate.GetChanges()
+
+	expected := aggregate.OriginalVersion()
+	if expectedVersion != nil {
+		expected = *expectedVersion
+	}
+
 	if len(resultEvents) > 0 {
 
-		events := make([]messages.ProposedEvent, len(resultEvents))
+		events := make([]EventData, len(resultEvents))
 
 		for k, v := range resultEvents {
-			//TODO: There is no test for this code
-			v.SetHeader("AggregateID", aggregate.AggregateID())
-			//evs[k] = goes.NewEvent("", v.EventType(), v.Event(), v.GetHeaders())
-			eventID, err := uuid.NewV4()
+			eventType, err := r.types.Name(v.Event())
+			if err != nil {
+				return err
+			}
+
+			v.SetHeader(HeaderAggregateID, aggregate.AggregateID())
+			eventID, _ := v.GetHeaders()[HeaderEventID].(string)
+			if eventID == "" {
+				eventID = NewUUID()
+				v.SetHeader(HeaderEventID, eventID)
+			}
+			v.SetHeader(HeaderSchemaVersion, r.upcasters.CurrentVersion(eventType))
+			if _, ok := v.GetHeaders()[HeaderTimestamp]; !ok {
+				v.SetHeader(HeaderTimestamp, time.Now().UTC().Format(time.RFC3339Nano))
+			}
+
+			data, err := r.serializer.Marshal(v.Event())
 			if err != nil {
-				return fmt.Errorf("could not generate UUID")
+				return fmt.Errorf("could not serialize event %s. Error: %+v", eventType, err)
 			}
 
-			json, err := json.Marshal(v.Event())
+			metadata, err := r.metadataCodec.Encode(v.GetHeaders())
 			if err != nil {
-				return fmt.Errorf("Error parsing %v", v.Event())
+				return fmt.Errorf("could not encode headers of %s. Error: %+v", eventType, err)
+			}
+
+			events[k] = EventData{
+				EventID:     eventID,
+				EventType:   eventType,
+				ContentType: r.serializer.ContentType(),
+				Metadata:    metadata,
+				Data:        data,
 			}
+		}
+
+		saved, err := r.eventStore.AppendToStream(ctx, streamName, expected, events)
 
-			events[k] = messages.ProposedEvent{
-				EventID:      eventID,
-				EventType:    v.EventType(),
-				ContentType:  "application/json",
-				UserMetadata: nil,
-				Data:         json,
+		if _, ok := err.(*ErrWrongExpectedVersion); ok {
+			return &ErrConcurrencyViolation{
+				Aggregate:       aggregate,
+				ExpectedVersion: Int64(expected),
+				StreamName:      streamName,
 			}
 		}
 
-		_, err := r.eventStore.AppendToStream(context.Background(), streamName, streamrevision.StreamRevisionAny, events)
+		if _, ok := err.(*ErrRepositoryUnavailable); ok {
+			return err
+		}
+
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
 
 		if err != nil {
 			return fmt.Errorf("unexpected failure appending to stream %s. Error: %+v", streamName, err)
 		}
+
+		// A failure to take a snapshot does not fail the save as the events
+		// are persisted and the aggregate can still be loaded without it.
+		if r.snapshotPolicy != nil && expected != ExpectedVersionAny {
+			current := expected + int64(len(resultEvents))
+			if r.snapshotPolicy.ShouldSnapshot(expected, current) {
+				_ = r.saveSnapshot(ctx, aggregate, streamName, current)
+			}
+		}
+
+		setVersion(aggregate, saved)
 	}
 
 	aggregate.ClearChanges()
 
+	if r.publishMode == PublishFromOutbox {
+		return nil
+	}
+
 	for k, v := range resultEvents {
-		if expectedVersion == nil {
-			r.eventBus.PublishEvent(v)
+		if expected == ExpectedVersionAny {
+			publishEvent(ctx, r.eventBus, v)
 		} else {
-			ver := int64(*expectedVersion + int64(k) + 1)
+			ver := int64(expected + int64(k) + 1)
 			em := NewEventMessage(v.AggregateID(), v.Event(), &ver)
-			r.eventBus.PublishEvent(em)
+			for key, value := range v.GetHeaders() {
+				em.SetHeader(key, value)
+			}
+			publishEvent(ctx, r.eventBus, em)
 		}
 	}
 
 	return nil
 }
+
+// setVersion moves the version of a saved aggregate on to the version of the
+// last event saved, so that it can raise and save further events.
+func setVersion(aggregate AggregateRoot, version int64) {
+	if a, ok := aggregate.(interface{ SetVersion(int64) }); ok {
+		a.SetVersion(version)
+		return
+	}
+	for v := aggregate.OriginalVersion(); v < version; v++ {
+		aggregate.IncrementVersion()
+	}
+}
+
+// SaveSnapshot takes a snapshot of the aggregate on demand.
+//
+// The aggregate must implement Snapshotter and must not have any unsaved
+// changes. The snapshot is taken at the OriginalVersion of the aggregate so it
+// should be taken from an aggregate that has just been loaded.
+func (r *CommonDomainRepository) SaveSnapshot(aggregate AggregateRoot) error {
+	return r.SaveSnapshotContext(context.Background(), aggregate)
+}
+
+// SaveSnapshotContext takes a snapshot of the aggregate on demand in the same
+// way as SaveSnapshot using the context when storing the snapshot.
+func (r *CommonDomainRepository) SaveSnapshotContext(ctx context.Context, aggregate AggregateRoot) error {
+	if r.snapshotStore == nil {
+		return fmt.Errorf("the common domain repository has no snapshot store")
+	}
+
+	if r.streamNameDelegate == nil {
+		return fmt.Errorf("the common domain repository has no stream name delegate")
+	}
+
+	if len(aggregate.GetChanges()) > 0 {
+		return fmt.Errorf("can not snapshot aggregate %s with unsaved changes", aggregate.AggregateID())
+	}
+
+	aggregateType, err := r.types.Name(aggregate)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := r.streamNameDelegate.GetStreamName(aggregateType, aggregate.AggregateID())
+	if err != nil {
+		return err
+	}
+
+	return r.saveSnapshot(ctx, aggregate, streamName, aggregate.OriginalVersion())
+}
+
+func (r *CommonDomainRepository) saveSnapshot(ctx context.Context, aggregate AggregateRoot, streamName string, version int64) error {
+	snapshotter, ok := aggregate.(Snapshotter)
+	if !ok || r.snapshotStore == nil {
+		return fmt.Errorf("aggregate of type %T does not support snapshots", aggregate)
+	}
+
+	data, err := r.serializer.Marshal(snapshotter.Snapshot())
+	if err != nil {
+		return fmt.Errorf("could not marshal snapshot of stream %s. Error: %+v", streamName, err)
+	}
+
+	return r.snapshotStore.SaveSnapshot(ctx, Snapshot{
+		StreamName:  streamName,
+		Version:     version,
+		Created:     time.Now().UTC(),
+		ContentType: r.serializer.ContentType(),
+		Data:        data,
+	})
+}
+
+// restoreSnapshot restores the aggregate from the latest snapshot of the stream
+// and returns the version it was restored to.
+//
+// If there is no snapshot the aggregate is untouched and ExpectedVersionNoStream
+// is returned so that the stream is read from the start.
+func (r *CommonDomainRepository) restoreSnapshot(ctx context.Context, aggregate Snapshotter, streamName string) (int64, error) {
+	snapshot, err := r.snapshotStore.GetSnapshot(ctx, streamName)
+	if err != nil {
+		return 0, fmt.Errorf("could not read snapshot of stream %s. Error: %+v", streamName, err)
+	}
+	if snapshot == nil {
+		return ExpectedVersionNoStream, nil
+	}
+
+	serializer, err := r.serializers.Get(snapshot.ContentType)
+	if err != nil {
+		return 0, err
+	}
+	state := aggregate.SnapshotState()
+	if err := serializer.Unmarshal(snapshot.Data, state); err != nil {
+		return 0, fmt.Errorf("could not unmarshal snapshot of stream %s. Error: %+v", streamName, err)
+	}
+
+	if err := aggregate.RestoreSnapshot(state); err != nil {
+		return 0, err
+	}
+	aggregate.SetVersion(snapshot.Version)
+
+	return snapshot.Version, nil
+}
+
+// newEventMessages uses the event factory to instantiate the event types of
+// the recorded event, after it has been upcast, and unmarshals the recorded
+// data into them.
+func (r *CommonDomainRepository) newEventMessages(id string, event RecordedEvent) ([]EventMessage, error) {
+	messages, unknown, err := decodeEventMessages(r.eventFactory, r.metadataCodec, r.upcasters, r.serializers, id, event)
+	if err != nil {
+		return nil, err
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("the repository has no event factory registered for event type: %s", unknown[0])
+	}
+	return messages, nil
+}
+
+// decodeEventMessages passes the recorded event through the upcasters, then
+// uses the event factory to instantiate the event type of each of the events
+// returned and unmarshals their data into it with the serializer for their
+// content type.
+//
+// The messages have the headers of the recorded event, with the SchemaVersion
+// header set to the current version. When the event is split into several
+// events the EventID header of each but the first is suffixed with its index
+// so that the events can be told apart.
+//
+// Events of a type that the factory does not know are skipped and their types
+// returned.
+func decodeEventMessages(factory EventFactory, codec MetadataCodec, upcasters *Upcasters, serializers *Serializers, id string, event RecordedEvent) ([]EventMessage, []string, error) {
+	headers, err := codec.Decode(event.Metadata)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not decode metadata of event %s from stream %s. Error: %+v", event.EventType, event.StreamName, err)
+	}
+
+	raws, err := upcasters.Upcast(RawEvent{
+		EventType:     event.EventType,
+		SchemaVersion: schemaVersion(headers),
+		ContentType:   event.ContentType,
+		Data:          event.Data,
+		Headers:       headers,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not upcast event %s from stream %s. Error: %+v", event.EventType, event.StreamName, err)
+	}
+
+	if id == "" {
+		id, _ = headers[HeaderAggregateID].(string)
+	}
+	if id == "" {
+		id = streamID(event.StreamName)
+	}
+
+	var messages []EventMessage
+	var unknown []string
+	for i, raw := range raws {
+		ev, err := deserializeEvent(factory, serializers, raw.EventType, raw.ContentType, raw.Data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not unmarshal event %s from stream %s. Error: %+v", raw.EventType, event.StreamName, err)
+		}
+		if ev == nil {
+			unknown = append(unknown, raw.EventType)
+			continue
+		}
+
+		evtNum := event.EventNumber
+		em := NewEventMessage(id, ev, &evtNum)
+		for key, value := range raw.Headers {
+			em.SetHeader(key, value)
+		}
+		em.SetHeader(HeaderAggregateID, id)
+		em.SetHeader(HeaderSchemaVersion, raw.SchemaVersion)
+		if event.EventID != "" && i == 0 {
+			em.SetHeader(HeaderEventID, event.EventID)
+		} else if event.EventID != "" {
+			em.SetHeader(HeaderEventID, fmt.Sprintf("%s-%d", event.EventID, i))
+		}
+		messages = append(messages, em)
+	}
+	return messages, unknown, nil
+}
@@ -0,0 +1,509 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&CommonDomainRepositorySuite{})
+
+type CommonDomainRepositorySuite struct {
+	store *InMemoryEventStore
+	bus   *MockEventBus
+	repo  *CommonDomainRepository
+}
+
+func (s *CommonDomainRepositorySuite) SetUpTest(c *C) {
+	s.store = NewInMemoryEventStore()
+	s.bus = &MockEventBus{}
+
+	repo, err := NewCommonDomainRepository(s.store, s.bus)
+	c.Assert(err, IsNil)
+
+	aggregateFactory := NewDelegateAggregateFactory()
+	_ = aggregateFactory.RegisterDelegate(&SomeAggregate{},
+		func(id string) AggregateRoot { return NewSomeAggregate(id) })
+	repo.SetAggregateFactory(aggregateFactory)
+
+	streamNamer := NewDelegateStreamNamer()
+	_ = streamNamer.RegisterDelegate(func(t string, id string) string { return t + "-" + id },
+		&SomeAggregate{})
+	repo.SetStreamNameDelegate(streamNamer)
+
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	repo.SetEventFactory(eventFactory)
+
+	s.repo = repo
+}
+
+func (s *CommonDomainRepositorySuite) TestNewCommonDomainRepositoryRequiresEventStore(c *C) {
+	repo, err := NewCommonDomainRepository(nil, s.bus)
+	c.Assert(repo, IsNil)
+	c.Assert(err, DeepEquals, fmt.Errorf("nil Eventstore injected into repository"))
+}
+
+func (s *CommonDomainRepositorySuite) TestNewCommonDomainRepositoryRequiresEventBus(c *C) {
+	repo, err := NewCommonDomainRepository(s.store, nil)
+	c.Assert(repo, IsNil)
+	c.Assert(err, DeepEquals, fmt.Errorf("nil EventBus injected into repository"))
+}
+
+func (s *CommonDomainRepositorySuite) TestSaveAndLoadAggregate(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	ev1 := &SomeEvent{Item: "one", Count: 1}
+	ev2 := &SomeEvent{Item: "two", Count: 2}
+	agg.TrackChange(NewEventMessage(id, ev1, nil))
+	agg.TrackChange(NewEventMessage(id, ev2, nil))
+
+	err := s.repo.Save(agg, Int64(agg.OriginalVersion()))
+	c.Assert(err, IsNil)
+	c.Assert(agg.GetChanges(), HasLen, 0)
+
+	loaded, err := s.repo.Load(typeOf(&SomeAggregate{}), id)
+	c.Assert(err, IsNil)
+
+	got := loaded.(*SomeAggregate)
+	c.Assert(got.AggregateID(), Equals, id)
+	c.Assert(got.OriginalVersion(), Equals, int64(1))
+	c.Assert(got.events, HasLen, 2)
+	c.Assert(got.events[0].Event(), DeepEquals, ev1)
+	c.Assert(*got.events[0].Version(), Equals, int64(0))
+	c.Assert(got.events[1].Event(), DeepEquals, ev2)
+	c.Assert(*got.events[1].Version(), Equals, int64(1))
+}
+
+func (s *CommonDomainRepositorySuite) TestSetTypeRegistryNamesAggregatesAndEvents(c *C) {
+	types := NewTypeRegistry()
+	c.Assert(types.RegisterName(&SomeAggregate{}, "orders.Order"), IsNil)
+	c.Assert(types.RegisterName(&SomeEvent{}, "orders.Created"), IsNil)
+	s.repo.SetTypeRegistry(types)
+
+	aggregateFactory := NewDelegateAggregateFactory()
+	aggregateFactory.SetTypeRegistry(types)
+	_ = aggregateFactory.RegisterDelegate(&SomeAggregate{},
+		func(id string) AggregateRoot { return NewSomeAggregate(id) })
+	s.repo.SetAggregateFactory(aggregateFactory)
+	streamNamer := NewDelegateStreamNamer()
+	streamNamer.SetTypeRegistry(types)
+	_ = streamNamer.RegisterDelegate(func(t string, id string) string { return t + "-" + id },
+		&SomeAggregate{})
+	s.repo.SetStreamNameDelegate(streamNamer)
+	eventFactory := NewDelegateEventFactory()
+	eventFactory.SetTypeRegistry(types)
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	s.repo.SetEventFactory(eventFactory)
+
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+
+	events, err := s.store.ReadStreamForwards(context.Background(), "orders.Order-"+id, StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].EventType, Equals, "orders.Created")
+
+	loaded, err := s.repo.Load("orders.Order", id)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.(*SomeAggregate).events, HasLen, 1)
+}
+
+func (s *CommonDomainRepositorySuite) TestSavePublishesEvents(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+
+	err := s.repo.Save(agg, Int64(agg.OriginalVersion()))
+	c.Assert(err, IsNil)
+
+	c.Assert(s.bus.events, HasLen, 1)
+	c.Assert(*s.bus.events[0].Version(), Equals, int64(0))
+}
+
+func (s *CommonDomainRepositorySuite) TestLoadReturnsErrorForUnregisteredEventType(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeOtherEvent{OrderID: id}, nil))
+	_ = s.repo.Save(agg, nil)
+
+	_, err := s.repo.Load(typeOf(&SomeAggregate{}), id)
+
+	c.Assert(err, DeepEquals, fmt.Errorf("the repository has no event factory registered for event type: %s",
+		typeOf(&SomeOtherEvent{})))
+}
+
+func (s *CommonDomainRepositorySuite) TestSaveWithStaleVersionReturnsConcurrencyViolation(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	_ = s.repo.Save(agg, Int64(agg.OriginalVersion()))
+
+	first, _ := s.repo.Load(typeOf(&SomeAggregate{}), id)
+	second, _ := s.repo.Load(typeOf(&SomeAggregate{}), id)
+
+	first.TrackChange(NewEventMessage(id, &SomeEvent{Item: "two", Count: 2}, nil))
+	err := s.repo.Save(first, Int64(first.OriginalVersion()))
+	c.Assert(err, IsNil)
+
+	s.bus.events = nil
+	second.TrackChange(NewEventMessage(id, &SomeEvent{Item: "three", Count: 3}, nil))
+	err = s.repo.Save(second, Int64(second.OriginalVersion()))
+
+	c.Assert(err, DeepEquals, &ErrConcurrencyViolation{
+		Aggregate:       second,
+		ExpectedVersion: Int64(0),
+		StreamName:      "eventsourcing.SomeAggregate-" + id,
+	})
+	c.Assert(s.bus.events, HasLen, 0)
+}
+
+func (s *CommonDomainRepositorySuite) TestSaveUsesOriginalVersionWhenExpectedVersionIsNil(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	_ = s.repo.Save(agg, nil)
+
+	stale := NewSomeAggregate(id)
+	stale.TrackChange(NewEventMessage(id, &SomeEvent{Item: "two", Count: 2}, nil))
+	err := s.repo.Save(stale, nil)
+
+	c.Assert(err, FitsTypeOf, &ErrConcurrencyViolation{})
+}
+
+func (s *CommonDomainRepositorySuite) TestSaveWithExpectedVersionAnySkipsConcurrencyCheck(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	_ = s.repo.Save(agg, nil)
+
+	stale := NewSomeAggregate(id)
+	stale.TrackChange(NewEventMessage(id, &SomeEvent{Item: "two", Count: 2}, nil))
+	err := s.repo.Save(stale, Int64(ExpectedVersionAny))
+
+	c.Assert(err, IsNil)
+}
+
+func (s *CommonDomainRepositorySuite) TestSaveMovesVersionOn(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "two", Count: 2}, nil))
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+	c.Assert(agg.OriginalVersion(), Equals, int64(1))
+	c.Assert(agg.CurrentVersion(), Equals, int64(1))
+
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "three", Count: 3}, nil))
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+	c.Assert(agg.OriginalVersion(), Equals, int64(2))
+}
+
+func (s *CommonDomainRepositorySuite) TestSaveWithExpectedVersionAnyMovesVersionToStreamVersion(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "two", Count: 2}, nil))
+	_ = s.repo.Save(agg, nil)
+
+	stale := NewSomeAggregate(id)
+	stale.TrackChange(NewEventMessage(id, &SomeEvent{Item: "three", Count: 3}, nil))
+	c.Assert(s.repo.Save(stale, Int64(ExpectedVersionAny)), IsNil)
+	c.Assert(stale.OriginalVersion(), Equals, int64(2))
+
+	stale.TrackChange(NewEventMessage(id, &SomeEvent{Item: "four", Count: 4}, nil))
+	c.Assert(s.repo.Save(stale, nil), IsNil)
+}
+
+func (s *CommonDomainRepositorySuite) TestLoadReadsStreamInBatches(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	for i := 0; i < 7; i++ {
+		agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "item", Count: i}, nil))
+	}
+	_ = s.repo.Save(agg, nil)
+
+	s.repo.SetReadBatchSize(3)
+	loaded, err := s.repo.Load(typeOf(&SomeAggregate{}), id)
+	c.Assert(err, IsNil)
+
+	got := loaded.(*SomeAggregate)
+	c.Assert(got.OriginalVersion(), Equals, int64(6))
+	c.Assert(got.events, HasLen, 7)
+	for i, em := range got.events {
+		c.Assert(em.Event(), DeepEquals, &SomeEvent{Item: "item", Count: i})
+		c.Assert(*em.Version(), Equals, int64(i))
+		c.Assert(em.GetHeaders()[HeaderAggregateID], Equals, id)
+	}
+}
+
+func (s *CommonDomainRepositorySuite) TestLoadStreamOfExactlyOneBatch(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	for i := 0; i < 3; i++ {
+		agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "item", Count: i}, nil))
+	}
+	_ = s.repo.Save(agg, nil)
+
+	s.repo.SetReadBatchSize(3)
+	loaded, err := s.repo.Load(typeOf(&SomeAggregate{}), id)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.(*SomeAggregate).events, HasLen, 3)
+}
+
+func (s *CommonDomainRepositorySuite) TestSetReadBatchSizeIgnoresInvalidSize(c *C) {
+	s.repo.SetReadBatchSize(0)
+	c.Assert(s.repo.readBatchSize, Equals, DefaultReadBatchSize)
+}
+
+func (s *CommonDomainRepositorySuite) TestLoadMissingAggregateReturnsErrAggregateNotFound(c *C) {
+	id := NewUUID()
+
+	agg, err := s.repo.Load(typeOf(&SomeAggregate{}), id)
+
+	c.Assert(agg, IsNil)
+	c.Assert(err, DeepEquals, &ErrAggregateNotFound{
+		AggregateID:   id,
+		AggregateType: typeOf(&SomeAggregate{}),
+	})
+}
+
+func (s *CommonDomainRepositorySuite) TestLoadReturnsErrRepositoryUnavailable(c *C) {
+	unavailable := &ErrRepositoryUnavailable{Err: fmt.Errorf("connection refused")}
+	repo, _ := NewCommonDomainRepository(&FailingEventStore{err: unavailable}, s.bus)
+	repo.SetAggregateFactory(s.repo.aggregateFactory)
+	repo.SetStreamNameDelegate(s.repo.streamNameDelegate)
+	repo.SetEventFactory(s.repo.eventFactory)
+
+	_, err := repo.Load(typeOf(&SomeAggregate{}), NewUUID())
+	c.Assert(err, Equals, unavailable)
+
+	agg := NewSomeAggregate(NewUUID())
+	agg.TrackChange(NewEventMessage(agg.AggregateID(), &SomeEvent{}, nil))
+	err = repo.Save(agg, nil)
+	c.Assert(err, Equals, unavailable)
+}
+
+// FailingEventStore is an EventStore that returns the same error for every call.
+type FailingEventStore struct {
+	err error
+}
+
+func (s *FailingEventStore) AppendToStream(ctx context.Context, streamName string, expectedVersion int64, events []EventData) (int64, error) {
+	return 0, s.err
+}
+
+func (s *FailingEventStore) ReadStreamForwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	return nil, s.err
+}
+
+func (s *FailingEventStore) ReadStreamBackwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	return nil, s.err
+}
+
+func (s *FailingEventStore) ReadAll(ctx context.Context, after Position, count int) ([]RecordedEvent, error) {
+	return nil, s.err
+}
+
+func (s *CommonDomainRepositorySuite) TestHeadersArePersistedAndRestored(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	em := NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil)
+	em.SetHeader(HeaderCorrelationID, "correlation")
+	em.SetHeader(HeaderUserID, "user")
+	agg.TrackChange(em)
+	_ = s.repo.Save(agg, nil)
+
+	c.Assert(s.bus.events[0].GetHeaders()[HeaderCorrelationID], Equals, "correlation")
+
+	loaded, err := s.repo.Load(typeOf(&SomeAggregate{}), id)
+	c.Assert(err, IsNil)
+
+	headers := loaded.(*SomeAggregate).events[0].GetHeaders()
+	c.Assert(headers[HeaderAggregateID], Equals, id)
+	c.Assert(headers[HeaderCorrelationID], Equals, "correlation")
+	c.Assert(headers[HeaderUserID], Equals, "user")
+	c.Assert(headers[HeaderTimestamp], NotNil)
+}
+
+func (s *CommonDomainRepositorySuite) TestEventIDIsPersistedAsHeader(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	_ = s.repo.Save(agg, nil)
+
+	recorded, _ := s.store.ReadStreamForwards(context.Background(), "eventsourcing.SomeAggregate-"+id, StreamStart, 1)
+	c.Assert(s.bus.events[0].GetHeaders()[HeaderEventID], Equals, recorded[0].EventID)
+
+	loaded, _ := s.repo.Load(typeOf(&SomeAggregate{}), id)
+	c.Assert(loaded.(*SomeAggregate).events[0].GetHeaders()[HeaderEventID], Equals, recorded[0].EventID)
+}
+
+func (s *CommonDomainRepositorySuite) TestSaveUsesConfiguredMetadataCodec(c *C) {
+	codec := &MockMetadataCodec{}
+	s.repo.SetMetadataCodec(codec)
+
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	_ = s.repo.Save(agg, nil)
+
+	c.Assert(codec.encoded, HasLen, 1)
+	c.Assert(codec.encoded[0][HeaderAggregateID], Equals, id)
+
+	events, _ := s.store.ReadStreamForwards(context.Background(), "eventsourcing.SomeAggregate-"+id, StreamStart, 10)
+	c.Assert(events[0].Metadata, DeepEquals, []byte("metadata"))
+
+	loaded, err := s.repo.Load(typeOf(&SomeAggregate{}), id)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.(*SomeAggregate).events[0].GetHeaders()["decoded"], Equals, "metadata")
+}
+
+type MockMetadataCodec struct {
+	encoded []map[string]interface{}
+}
+
+func (m *MockMetadataCodec) Encode(headers map[string]interface{}) ([]byte, error) {
+	m.encoded = append(m.encoded, headers)
+	return []byte("metadata"), nil
+}
+
+func (m *MockMetadataCodec) Decode(metadata []byte) (map[string]interface{}, error) {
+	return map[string]interface{}{"decoded": string(metadata)}, nil
+}
+
+var _ = Suite(&SnapshotRepositorySuite{})
+
+type SnapshotRepositorySuite struct {
+	store     *InMemoryEventStore
+	snapshots *InMemorySnapshotStore
+	repo      *CommonDomainRepository
+}
+
+func (s *SnapshotRepositorySuite) SetUpTest(c *C) {
+	s.store = NewInMemoryEventStore()
+	s.snapshots = NewInMemorySnapshotStore()
+
+	repo, _ := NewCommonDomainRepository(s.store, &MockEventBus{})
+
+	aggregateFactory := NewDelegateAggregateFactory()
+	_ = aggregateFactory.RegisterDelegate(&SnapshotAggregate{}, NewSnapshotAggregate)
+	repo.SetAggregateFactory(aggregateFactory)
+
+	streamNamer := NewDelegateStreamNamer()
+	_ = streamNamer.RegisterDelegate(func(t string, id string) string { return t + "-" + id },
+		&SnapshotAggregate{})
+	repo.SetStreamNameDelegate(streamNamer)
+
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	repo.SetEventFactory(eventFactory)
+
+	repo.SetSnapshotStore(s.snapshots)
+	s.repo = repo
+}
+
+func (s *SnapshotRepositorySuite) saveEvents(c *C, id string, counts ...int) {
+	agg, err := s.repo.Load(typeOf(&SnapshotAggregate{}), id)
+	if _, ok := err.(*ErrAggregateNotFound); ok {
+		agg = NewSnapshotAggregate(id)
+	}
+
+	for _, count := range counts {
+		agg.Apply(NewEventMessage(id, &SomeEvent{Item: "item", Count: count}, nil), true)
+	}
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+}
+
+func (s *SnapshotRepositorySuite) TestLoadRestoresFromSnapshotAndAppliesTail(c *C) {
+	id := NewUUID()
+	s.saveEvents(c, id, 1, 2, 3)
+
+	agg, _ := s.repo.Load(typeOf(&SnapshotAggregate{}), id)
+	c.Assert(s.repo.SaveSnapshot(agg), IsNil)
+
+	s.saveEvents(c, id, 4)
+
+	loaded, err := s.repo.Load(typeOf(&SnapshotAggregate{}), id)
+	c.Assert(err, IsNil)
+
+	got := loaded.(*SnapshotAggregate)
+	c.Assert(got.Total, Equals, 10)
+	c.Assert(got.applied, Equals, 1)
+	c.Assert(got.OriginalVersion(), Equals, int64(3))
+}
+
+func (s *SnapshotRepositorySuite) TestSnapshotPolicyTakesSnapshotOnSave(c *C) {
+	s.repo.SetSnapshotPolicy(NewEveryNEvents(2))
+	id := NewUUID()
+	streamName := typeOf(&SnapshotAggregate{}) + "-" + id
+
+	s.saveEvents(c, id, 1)
+	snapshot, _ := s.snapshots.GetSnapshot(context.Background(), streamName)
+	c.Assert(snapshot, IsNil)
+
+	s.saveEvents(c, id, 2)
+	snapshot, _ = s.snapshots.GetSnapshot(context.Background(), streamName)
+	c.Assert(snapshot, NotNil)
+	c.Assert(snapshot.Version, Equals, int64(1))
+	c.Assert(string(snapshot.Data), Equals, `{"Total":3}`)
+
+	s.saveEvents(c, id, 3)
+	loaded, _ := s.repo.Load(typeOf(&SnapshotAggregate{}), id)
+	c.Assert(loaded.(*SnapshotAggregate).Total, Equals, 6)
+	c.Assert(loaded.(*SnapshotAggregate).applied, Equals, 1)
+}
+
+func (s *SnapshotRepositorySuite) TestSaveSnapshotRequiresSnapshotter(c *C) {
+	err := s.repo.SaveSnapshot(NewSomeAggregate(NewUUID()))
+	c.Assert(err, NotNil)
+}
+
+func (s *SnapshotRepositorySuite) TestSaveSnapshotWithUnsavedChangesReturnsAnError(c *C) {
+	agg := NewSnapshotAggregate(NewUUID())
+	agg.Apply(NewEventMessage(agg.AggregateID(), &SomeEvent{}, nil), true)
+
+	err := s.repo.SaveSnapshot(agg)
+	c.Assert(err, NotNil)
+}
+
+func (s *CommonDomainRepositorySuite) TestLoadContextReturnsContextErrorWhenCancelled(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+	_ = s.repo.Save(agg, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	loaded, err := s.repo.LoadContext(ctx, typeOf(&SomeAggregate{}), id)
+
+	c.Assert(loaded, IsNil)
+	c.Assert(err, Equals, context.Canceled)
+}
+
+func (s *CommonDomainRepositorySuite) TestSaveContextDoesNotAppendWhenCancelled(c *C) {
+	id := NewUUID()
+	agg := NewSomeAggregate(id)
+	agg.TrackChange(NewEventMessage(id, &SomeEvent{Item: "one", Count: 1}, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := s.repo.SaveContext(ctx, agg, nil)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(s.bus.events, HasLen, 0)
+
+	_, err = s.repo.Load(typeOf(&SomeAggregate{}), id)
+	c.Assert(err, FitsTypeOf, &ErrAggregateNotFound{})
+}
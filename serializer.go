@@ -0,0 +1,231 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Content types of the serializers provided.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/x-msgpack"
+	ContentTypeGob      = "application/x-gob"
+)
+
+// Serializer is the interface that a serializer should implement.
+//
+// A serializer marshals events and snapshots into the data that is persisted
+// and unmarshals the data back into an instance of the type. The content type
+// of the serializer is persisted with each event so that the event can be
+// read with the same serializer.
+type Serializer interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONSerializer is the default Serializer and stores values as JSON.
+type JSONSerializer struct{}
+
+// NewJSONSerializer constructs a new JSONSerializer
+func NewJSONSerializer() *JSONSerializer {
+	return &JSONSerializer{}
+}
+
+// ContentType returns application/json.
+func (s *JSONSerializer) ContentType() string {
+	return ContentTypeJSON
+}
+
+// Marshal marshals the value into JSON.
+func (s *JSONSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal unmarshals JSON into the value.
+func (s *JSONSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufSerializer stores values in the Protocol Buffers wire format.
+//
+// Only values that implement proto.Message, such as the structs generated by
+// protoc-gen-go, can be serialized.
+type ProtobufSerializer struct{}
+
+// NewProtobufSerializer constructs a new ProtobufSerializer
+func NewProtobufSerializer() *ProtobufSerializer {
+	return &ProtobufSerializer{}
+}
+
+// ContentType returns application/x-protobuf.
+func (s *ProtobufSerializer) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+// Marshal marshals the message into the Protocol Buffers wire format.
+func (s *ProtobufSerializer) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal unmarshals the Protocol Buffers wire format into the message.
+func (s *ProtobufSerializer) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// MsgpackSerializer stores values as MessagePack.
+type MsgpackSerializer struct{}
+
+// NewMsgpackSerializer constructs a new MsgpackSerializer
+func NewMsgpackSerializer() *MsgpackSerializer {
+	return &MsgpackSerializer{}
+}
+
+// ContentType returns application/x-msgpack.
+func (s *MsgpackSerializer) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+// Marshal marshals the value into MessagePack.
+func (s *MsgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal unmarshals MessagePack into the value.
+func (s *MsgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// GobSerializer stores values with encoding/gob.
+//
+// Each value is encoded on its own so the type information is repeated in
+// every event. Gob is only readable from Go.
+type GobSerializer struct{}
+
+// NewGobSerializer constructs a new GobSerializer
+func NewGobSerializer() *GobSerializer {
+	return &GobSerializer{}
+}
+
+// ContentType returns application/x-gob.
+func (s *GobSerializer) ContentType() string {
+	return ContentTypeGob
+}
+
+// Marshal encodes the value with gob.
+func (s *GobSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes gob into the value.
+func (s *GobSerializer) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// DefaultSerializers knows all of the serializers provided and is used to read
+// events and snapshots unless other Serializers are set.
+var DefaultSerializers = NewSerializers(
+	NewJSONSerializer(),
+	NewProtobufSerializer(),
+	NewMsgpackSerializer(),
+	NewGobSerializer(),
+)
+
+// Serializers finds the Serializer for the content type of a persisted event,
+// so that a stream in which events were written with different serializers
+// can be read.
+//
+// Events persisted without a content type were written as JSON.
+type Serializers struct {
+	mu          sync.RWMutex
+	serializers map[string]Serializer
+}
+
+// NewSerializers constructs a new Serializers that knows the serializers
+// specified.
+func NewSerializers(serializers ...Serializer) *Serializers {
+	s := &Serializers{
+		serializers: make(map[string]Serializer),
+	}
+	for _, serializer := range serializers {
+		s.serializers[serializer.ContentType()] = serializer
+	}
+	return s
+}
+
+// Register adds the serializer, replacing any serializer registered for the
+// same content type.
+func (s *Serializers) Register(serializer Serializer) error {
+	if serializer == nil {
+		return fmt.Errorf("nil Serializer registered")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.serializers[serializer.ContentType()] = serializer
+	return nil
+}
+
+// Get returns the serializer for the content type.
+//
+// An *ErrUnknownContentType is returned if no serializer is registered for
+// the content type.
+func (s *Serializers) Get(contentType string) (Serializer, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	serializer, ok := s.serializers[contentType]
+	if !ok {
+		return nil, &ErrUnknownContentType{ContentType: contentType}
+	}
+	return serializer, nil
+}
+
+// deserializeEvent uses the event factory to instantiate the event type and
+// unmarshals the data into it with the serializer for the content type.
+//
+// nil is returned if the factory does not know the event type.
+func deserializeEvent(factory EventFactory, serializers *Serializers, eventType string, contentType string, data []byte) (interface{}, error) {
+	ev := factory.GetEvent(eventType)
+	if ev == nil {
+		return nil, nil
+	}
+
+	serializer, err := serializers.Get(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if err := serializer.Unmarshal(data, ev); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
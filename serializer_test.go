@@ -0,0 +1,154 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SerializerSuite{})
+
+type SerializerSuite struct {
+	ctx    context.Context
+	store  *InMemoryEventStore
+	common *CommonDomainRepository
+	repo   *Repository[*SnapshotAggregate]
+}
+
+func (s *SerializerSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+	s.store = NewInMemoryEventStore()
+
+	common, err := NewCommonDomainRepository(s.store, &MockEventBus{})
+	c.Assert(err, IsNil)
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	common.SetEventFactory(eventFactory)
+	s.common = common
+
+	repo, err := NewRepository(common, newTypedSnapshotAggregate)
+	c.Assert(err, IsNil)
+	s.repo = repo
+}
+
+func (s *SerializerSuite) TestRoundTrips(c *C) {
+	for _, serializer := range []Serializer{NewJSONSerializer(), NewMsgpackSerializer(), NewGobSerializer()} {
+		data, err := serializer.Marshal(&SomeEvent{Item: "item", Count: 3})
+		c.Assert(err, IsNil)
+
+		event := &SomeEvent{}
+		c.Assert(serializer.Unmarshal(data, event), IsNil)
+		c.Assert(event, DeepEquals, &SomeEvent{Item: "item", Count: 3}, Commentf(serializer.ContentType()))
+	}
+}
+
+func (s *SerializerSuite) TestProtobufSerializer(c *C) {
+	serializer := NewProtobufSerializer()
+
+	data, err := serializer.Marshal(wrapperspb.String("item"))
+	c.Assert(err, IsNil)
+	event := &wrapperspb.StringValue{}
+	c.Assert(serializer.Unmarshal(data, event), IsNil)
+	c.Assert(event.GetValue(), Equals, "item")
+
+	_, err = serializer.Marshal(&SomeEvent{})
+	c.Assert(err, ErrorMatches, ".*SomeEvent is not a proto.Message")
+	c.Assert(serializer.Unmarshal(data, &SomeEvent{}), ErrorMatches, ".*SomeEvent is not a proto.Message")
+}
+
+func (s *SerializerSuite) TestSerializersFindTheContentType(c *C) {
+	serializers := NewSerializers(NewJSONSerializer())
+
+	serializer, err := serializers.Get("")
+	c.Assert(err, IsNil)
+	c.Assert(serializer.ContentType(), Equals, ContentTypeJSON)
+
+	_, err = serializers.Get(ContentTypeGob)
+	c.Assert(err, DeepEquals, &ErrUnknownContentType{ContentType: ContentTypeGob})
+
+	c.Assert(serializers.Register(nil), NotNil)
+	c.Assert(serializers.Register(NewGobSerializer()), IsNil)
+	serializer, err = serializers.Get(ContentTypeGob)
+	c.Assert(err, IsNil)
+	c.Assert(serializer.ContentType(), Equals, ContentTypeGob)
+}
+
+func (s *SerializerSuite) TestMixedStreamIsLoaded(c *C) {
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 1}, nil), true)
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+
+	for _, serializer := range []Serializer{NewMsgpackSerializer(), NewGobSerializer()} {
+		s.common.SetSerializer(serializer)
+		agg, err := s.repo.Load(id)
+		c.Assert(err, IsNil)
+		agg.Apply(NewEventMessage(id, &SomeEvent{Count: 2}, nil), true)
+		c.Assert(s.repo.Save(agg, nil), IsNil)
+	}
+
+	loaded, err := s.repo.Load(id)
+
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Total, Equals, 5)
+	events, err := s.store.ReadStreamForwards(s.ctx, s.repo.StreamName(id), StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(events[0].ContentType, Equals, ContentTypeJSON)
+	c.Assert(events[1].ContentType, Equals, ContentTypeMsgpack)
+	c.Assert(events[2].ContentType, Equals, ContentTypeGob)
+}
+
+func (s *SerializerSuite) TestUnknownContentTypeFailsLoad(c *C) {
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 1}, nil), true)
+	s.common.SetSerializer(NewGobSerializer())
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+
+	s.common.SetSerializers(NewSerializers(NewJSONSerializer()))
+	_, err := s.repo.Load(id)
+
+	c.Assert(err, ErrorMatches, ".*no serializer for content type: application/x-gob")
+}
+
+func (s *SerializerSuite) TestSnapshotsUseTheSerializer(c *C) {
+	snapshots, err := NewStreamSnapshotStore(s.store)
+	c.Assert(err, IsNil)
+	s.common.SetSnapshotStore(snapshots)
+	s.common.SetSerializer(NewGobSerializer())
+
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 4}, nil), true)
+	c.Assert(s.repo.Save(agg, nil), IsNil)
+	loaded, _ := s.repo.Load(id)
+	c.Assert(s.repo.SaveSnapshot(loaded), IsNil)
+
+	snapshot, err := snapshots.GetSnapshot(s.ctx, s.repo.StreamName(id))
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.ContentType, Equals, ContentTypeGob)
+
+	loaded, err = s.repo.Load(id)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Total, Equals, 4)
+	c.Assert(loaded.applied, Equals, 0)
+}
+
+func (s *SerializerSuite) TestDeserializeProtobufEvent(c *C) {
+	eventFactory := NewDelegateEventFactory()
+	c.Assert(eventFactory.RegisterDelegate(&wrapperspb.StringValue{},
+		func() interface{} { return &wrapperspb.StringValue{} }), IsNil)
+	data, _ := NewProtobufSerializer().Marshal(wrapperspb.String("item"))
+
+	event, err := deserializeEvent(eventFactory, DefaultSerializers, "wrapperspb.StringValue", ContentTypeProtobuf, data)
+
+	c.Assert(err, IsNil)
+	c.Assert(event.(*wrapperspb.StringValue).GetValue(), Equals, "item")
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Snapshotter is the interface that an aggregate implements to opt in to
+// snapshotting.
+//
+// When a snapshot is available the repository restores the aggregate from the
+// snapshot and only applies the events that were appended after it.
+type Snapshotter interface {
+
+	// Snapshot returns the state of the aggregate to be stored in a snapshot.
+	Snapshot() interface{}
+
+	// SnapshotState returns a pointer to an empty instance of the snapshot
+	// state that a stored snapshot will be unmarshalled into.
+	SnapshotState() interface{}
+
+	// RestoreSnapshot restores the state of the aggregate from the state
+	// returned by SnapshotState once it has been populated.
+	RestoreSnapshot(state interface{}) error
+
+	// SetVersion sets the version of the aggregate. This is provided by
+	// AggregateBase.
+	SetVersion(int64)
+}
+
+// Snapshot is the persisted state of an aggregate at a given version.
+type Snapshot struct {
+	StreamName  string
+	Version     int64
+	Created     time.Time
+	ContentType string
+	Data        []byte
+}
+
+// SnapshotStore is the interface that a snapshot store must implement.
+//
+// Only the latest snapshot of a stream is of interest to the repository.
+type SnapshotStore interface {
+
+	// SaveSnapshot stores the snapshot of the stream it was taken from.
+	SaveSnapshot(ctx context.Context, snapshot Snapshot) error
+
+	// GetSnapshot returns the latest snapshot of the stream specified or nil
+	// if there is no snapshot for the stream.
+	GetSnapshot(ctx context.Context, streamName string) (*Snapshot, error)
+}
+
+// SnapshotPolicy is the interface that a snapshot policy must implement.
+//
+// A snapshot policy decides if a snapshot should be taken when an aggregate is
+// saved given the version of the aggregate before and after the save.
+type SnapshotPolicy interface {
+	ShouldSnapshot(previousVersion int64, currentVersion int64) bool
+}
+
+// EveryNEvents is a SnapshotPolicy that takes a snapshot each time the number
+// of events in a stream passes a multiple of N.
+type EveryNEvents struct {
+	N int64
+}
+
+// NewEveryNEvents constructs a new EveryNEvents snapshot policy.
+func NewEveryNEvents(n int64) *EveryNEvents {
+	return &EveryNEvents{N: n}
+}
+
+// ShouldSnapshot returns true if a multiple of N events was passed by the save.
+func (p *EveryNEvents) ShouldSnapshot(previousVersion int64, currentVersion int64) bool {
+	if p.N <= 0 {
+		return false
+	}
+	return (currentVersion+1)/p.N > (previousVersion+1)/p.N
+}
+
+// InMemorySnapshotStore is an implementation of the SnapshotStore interface
+// that holds the latest snapshot of each stream in memory.
+type InMemorySnapshotStore struct {
+	mu        sync.RWMutex
+	snapshots map[string]Snapshot
+}
+
+// NewInMemorySnapshotStore constructs a new InMemorySnapshotStore
+func NewInMemorySnapshotStore() *InMemorySnapshotStore {
+	return &InMemorySnapshotStore{
+		snapshots: make(map[string]Snapshot),
+	}
+}
+
+// SaveSnapshot stores the snapshot replacing any previous snapshot of the stream.
+func (s *InMemorySnapshotStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot.Data = append([]byte(nil), snapshot.Data...)
+	s.snapshots[snapshot.StreamName] = snapshot
+	return nil
+}
+
+// GetSnapshot returns the latest snapshot of the stream or nil if there is none.
+func (s *InMemorySnapshotStore) GetSnapshot(ctx context.Context, streamName string) (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot, ok := s.snapshots[streamName]
+	if !ok {
+		return nil, nil
+	}
+	return &snapshot, nil
+}
+
+// SnapshotEventType is the event type of the events used to store snapshots
+// in a StreamSnapshotStore.
+const SnapshotEventType = "Snapshot"
+
+// StreamSnapshotStore is an implementation of the SnapshotStore interface that
+// stores snapshots as events in a stream of an EventStore.
+//
+// The snapshots of a stream are appended to a stream of the same name prefixed
+// with "snapshot-". Used over a GetEventStore this stores snapshots in
+// GetEventStore alongside the events themselves. It is recommended to set the
+// $maxCount of the snapshot streams so that old snapshots are scavenged.
+type StreamSnapshotStore struct {
+	eventStore EventStore
+}
+
+// NewStreamSnapshotStore constructs a new StreamSnapshotStore
+func NewStreamSnapshotStore(eventStore EventStore) (*StreamSnapshotStore, error) {
+	if eventStore == nil {
+		return nil, fmt.Errorf("nil Eventstore injected into snapshot store")
+	}
+
+	return &StreamSnapshotStore{
+		eventStore: eventStore,
+	}, nil
+}
+
+type snapshotMetadata struct {
+	Version int64
+}
+
+// SaveSnapshot appends the snapshot to the snapshot stream of the stream.
+func (s *StreamSnapshotStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	metadata, err := json.Marshal(snapshotMetadata{Version: snapshot.Version})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.eventStore.AppendToStream(ctx, snapshotStreamName(snapshot.StreamName), ExpectedVersionAny, []EventData{{
+		EventID:     NewUUID(),
+		EventType:   SnapshotEventType,
+		ContentType: snapshot.ContentType,
+		Data:        snapshot.Data,
+		Metadata:    metadata,
+	}})
+	return err
+}
+
+// GetSnapshot reads the last event of the snapshot stream of the stream.
+func (s *StreamSnapshotStore) GetSnapshot(ctx context.Context, streamName string) (*Snapshot, error) {
+	events, err := s.eventStore.ReadStreamBackwards(ctx, snapshotStreamName(streamName), StreamEnd, 1)
+	if _, ok := err.(*ErrStreamNotFound); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	var metadata snapshotMetadata
+	if err := json.Unmarshal(events[0].Metadata, &metadata); err != nil {
+		return nil, fmt.Errorf("could not unmarshal snapshot metadata of stream %s. Error: %+v", streamName, err)
+	}
+
+	return &Snapshot{
+		StreamName:  streamName,
+		Version:     metadata.Version,
+		Created:     events[0].Created,
+		ContentType: events[0].ContentType,
+		Data:        events[0].Data,
+	}, nil
+}
+
+func snapshotStreamName(streamName string) string {
+	return "snapshot-" + streamName
+}
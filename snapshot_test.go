@@ -0,0 +1,124 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SnapshotSuite{})
+
+type SnapshotSuite struct {
+	ctx context.Context
+}
+
+func (s *SnapshotSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+}
+
+func (s *SnapshotSuite) TestEveryNEventsPolicy(c *C) {
+	policy := NewEveryNEvents(3)
+
+	c.Assert(policy.ShouldSnapshot(-1, 0), Equals, false)
+	c.Assert(policy.ShouldSnapshot(-1, 1), Equals, false)
+	c.Assert(policy.ShouldSnapshot(-1, 2), Equals, true)
+	c.Assert(policy.ShouldSnapshot(2, 3), Equals, false)
+	c.Assert(policy.ShouldSnapshot(3, 5), Equals, true)
+	c.Assert(policy.ShouldSnapshot(1, 9), Equals, true)
+}
+
+func (s *SnapshotSuite) TestEveryNEventsPolicyWithInvalidN(c *C) {
+	policy := NewEveryNEvents(0)
+	c.Assert(policy.ShouldSnapshot(-1, 100), Equals, false)
+}
+
+func (s *SnapshotSuite) TestInMemorySnapshotStore(c *C) {
+	store := NewInMemorySnapshotStore()
+
+	got, err := store.GetSnapshot(s.ctx, "stream")
+	c.Assert(err, IsNil)
+	c.Assert(got, IsNil)
+
+	_ = store.SaveSnapshot(s.ctx, Snapshot{StreamName: "stream", Version: 3, Data: []byte("3")})
+	_ = store.SaveSnapshot(s.ctx, Snapshot{StreamName: "stream", Version: 7, Data: []byte("7")})
+
+	got, err = store.GetSnapshot(s.ctx, "stream")
+	c.Assert(err, IsNil)
+	c.Assert(got.Version, Equals, int64(7))
+	c.Assert(got.Data, DeepEquals, []byte("7"))
+}
+
+func (s *SnapshotSuite) TestStreamSnapshotStore(c *C) {
+	eventStore := NewInMemoryEventStore()
+	store, err := NewStreamSnapshotStore(eventStore)
+	c.Assert(err, IsNil)
+
+	got, err := store.GetSnapshot(s.ctx, "stream")
+	c.Assert(err, IsNil)
+	c.Assert(got, IsNil)
+
+	_ = store.SaveSnapshot(s.ctx, Snapshot{StreamName: "stream", Version: 3, Data: []byte(`{"Total":3}`)})
+	_ = store.SaveSnapshot(s.ctx, Snapshot{StreamName: "stream", Version: 7, Data: []byte(`{"Total":7}`)})
+
+	got, err = store.GetSnapshot(s.ctx, "stream")
+	c.Assert(err, IsNil)
+	c.Assert(got.StreamName, Equals, "stream")
+	c.Assert(got.Version, Equals, int64(7))
+	c.Assert(got.Data, DeepEquals, []byte(`{"Total":7}`))
+
+	events, _ := eventStore.ReadStreamForwards(s.ctx, "snapshot-stream", StreamStart, 10)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].EventType, Equals, SnapshotEventType)
+}
+
+func (s *SnapshotSuite) TestNewStreamSnapshotStoreRequiresEventStore(c *C) {
+	store, err := NewStreamSnapshotStore(nil)
+	c.Assert(store, IsNil)
+	c.Assert(err, NotNil)
+}
+
+// SnapshotAggregate is an aggregate that supports snapshots. The total is the
+// sum of the counts of all SomeEvents applied.
+type SnapshotAggregate struct {
+	*AggregateBase
+	Total   int
+	applied int
+}
+
+type snapshotAggregateState struct {
+	Total int
+}
+
+func NewSnapshotAggregate(id string) AggregateRoot {
+	return &SnapshotAggregate{
+		AggregateBase: NewAggregateBase(id),
+	}
+}
+
+func (a *SnapshotAggregate) Apply(event EventMessage, isNew bool) {
+	if isNew {
+		a.TrackChange(event)
+	}
+	if e, ok := event.Event().(*SomeEvent); ok {
+		a.Total += e.Count
+		a.applied++
+	}
+}
+
+func (a *SnapshotAggregate) Snapshot() interface{} {
+	return &snapshotAggregateState{Total: a.Total}
+}
+
+func (a *SnapshotAggregate) SnapshotState() interface{} {
+	return &snapshotAggregateState{}
+}
+
+func (a *SnapshotAggregate) RestoreSnapshot(state interface{}) error {
+	a.Total = state.(*snapshotAggregateState).Total
+	return nil
+}
@@ -0,0 +1,516 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// SQLDialect is the interface that the SQL dialect of a database must
+// implement to be used by a SQLEventStore.
+//
+// The statements of the SQLEventStore itself use $n placeholders, which are
+// supported by PostgreSQL and SQLite.
+type SQLDialect interface {
+
+	// Migrations returns the statements that create and update the schema,
+	// in order. Migrations are only ever added to the end of the list.
+	Migrations() []string
+
+	// LockStatement returns a statement that is executed at the start of each
+	// append so that appends are committed in the order of their positions,
+	// or "" if the database already serialises writes.
+	LockStatement() string
+
+	// IsUniqueViolation reports if the error is a violation of a unique
+	// constraint.
+	IsUniqueViolation(err error) bool
+}
+
+// SQLiteDialect is the SQLDialect of SQLite.
+type SQLiteDialect struct{}
+
+// Migrations returns the SQLite schema.
+func (d SQLiteDialect) Migrations() []string {
+	return []string{
+		`CREATE TABLE es_streams (
+			stream_name TEXT PRIMARY KEY,
+			version INTEGER NOT NULL
+		)`,
+		`CREATE TABLE es_events (
+			position INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_id TEXT NOT NULL UNIQUE,
+			stream_name TEXT NOT NULL REFERENCES es_streams (stream_name),
+			version INTEGER NOT NULL,
+			event_type TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			data BLOB NOT NULL,
+			metadata BLOB NOT NULL,
+			created TIMESTAMP NOT NULL,
+			UNIQUE (stream_name, version)
+		)`,
+		`CREATE TABLE es_outbox (
+			position INTEGER PRIMARY KEY REFERENCES es_events (position)
+		)`,
+	}
+}
+
+// LockStatement returns "" as SQLite serialises writes.
+func (d SQLiteDialect) LockStatement() string {
+	return ""
+}
+
+// The extended result codes of SQLite for a failed UNIQUE or PRIMARY KEY
+// constraint.
+const (
+	sqliteConstraintPrimaryKey = 1555
+	sqliteConstraintUnique     = 2067
+)
+
+// IsUniqueViolation reports if the error is a SQLite UNIQUE or PRIMARY KEY
+// constraint failure.
+//
+// The error is recognised by its extended result code, which the errors of
+// the modernc.org/sqlite driver return from a Code method.
+func (d SQLiteDialect) IsUniqueViolation(err error) bool {
+	var sqliteErr interface{ Code() int }
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code()
+	return code == sqliteConstraintUnique || code == sqliteConstraintPrimaryKey
+}
+
+// PostgresDialect is the SQLDialect of PostgreSQL.
+type PostgresDialect struct{}
+
+// Migrations returns the PostgreSQL schema.
+func (d PostgresDialect) Migrations() []string {
+	return []string{
+		`CREATE TABLE es_streams (
+			stream_name TEXT PRIMARY KEY,
+			version BIGINT NOT NULL
+		)`,
+		`CREATE TABLE es_events (
+			position BIGSERIAL PRIMARY KEY,
+			event_id TEXT NOT NULL UNIQUE,
+			stream_name TEXT NOT NULL REFERENCES es_streams (stream_name),
+			version BIGINT NOT NULL,
+			event_type TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			data BYTEA NOT NULL,
+			metadata BYTEA NOT NULL,
+			created TIMESTAMPTZ NOT NULL,
+			UNIQUE (stream_name, version)
+		)`,
+		`CREATE TABLE es_outbox (
+			position BIGINT PRIMARY KEY REFERENCES es_events (position)
+		)`,
+	}
+}
+
+// LockStatement locks the events table against other appends. Without it an
+// append could commit after a later append that took a higher position, and a
+// subscription reading the global log would miss its events.
+func (d PostgresDialect) LockStatement() string {
+	return "LOCK TABLE es_events IN EXCLUSIVE MODE"
+}
+
+// IsUniqueViolation reports if the error is a PostgreSQL unique_violation.
+//
+// The error is recognised by its SQLSTATE, 23505, which the errors of both the
+// pgx and lib/pq drivers return from a SQLState method.
+func (d PostgresDialect) IsUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "23505"
+}
+
+// SQLEventStore is an implementation of the EventStore interface over a
+// relational database accessed with database/sql.
+//
+// The schema is created by Migrate and has three tables:
+//
+//	es_streams  stream_name, version
+//	es_events   position, event_id, stream_name, version, event_type,
+//	            content_type, data, metadata, created
+//	es_outbox   position
+//
+// es_streams holds the version of each stream, the event number of its last
+// event. es_events holds the events, with the headers of each event in the
+// metadata column. The position is the global order of the events and is
+// what ReadAll and subscriptions read by. A unique constraint on stream_name
+// and version means that two appends to the same stream at the same version
+// can not both succeed, and the one that fails returns an
+// *ErrWrongExpectedVersion.
+//
+// es_outbox holds the positions of the events that have not yet been
+// published by an OutboxRelay reading a SQLOutbox. Events are only put in it
+// when the outbox is enabled with SetOutbox, in the transaction that appends
+// them.
+//
+// Migrations applied are recorded in the es_schema_migrations table.
+//
+// SQLite allows one writer at a time, so use db.SetMaxOpenConns(1) with SQLite
+// to have appends wait for each other rather than fail with SQLITE_BUSY.
+type SQLEventStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+	outbox  bool
+}
+
+// NewSQLEventStore constructs a new SQLEventStore over the database using the
+// dialect specified.
+//
+// Call Migrate to create the schema before the store is used.
+func NewSQLEventStore(db *sql.DB, dialect SQLDialect) (*SQLEventStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("nil database injected into SQLEventStore")
+	}
+	if dialect == nil {
+		return nil, fmt.Errorf("nil SQLDialect injected into SQLEventStore")
+	}
+
+	return &SQLEventStore{
+		db:      db,
+		dialect: dialect,
+	}, nil
+}
+
+// SetOutbox sets whether appended events are put in the es_outbox table to be
+// published from a SQLOutbox.
+func (s *SQLEventStore) SetOutbox(enabled bool) {
+	s.outbox = enabled
+}
+
+// Migrate brings the schema up to date by applying the migrations of the
+// dialect that have not been applied. Each migration is applied in its own
+// transaction.
+func (s *SQLEventStore) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS es_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	var applied int
+	err = s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM es_schema_migrations").Scan(&applied)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	for i, migration := range s.dialect.Migrations() {
+		version := i + 1
+		if version <= applied {
+			continue
+		}
+		if err := s.migrate(ctx, version, migration); err != nil {
+			return fmt.Errorf("could not apply migration %d. Error: %+v", version, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLEventStore) migrate(ctx context.Context, version int, migration string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migration); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO es_schema_migrations (version, applied) VALUES ($1, $2)", version, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AppendToStream appends events to the stream specified in a single
+// transaction and returns the event number of the last event in the stream.
+//
+// If the expectedVersion does not match the version of the stream, or another
+// append to the stream commits first, an *ErrWrongExpectedVersion is returned
+// and no events are appended. No events are appended either if the ID of one
+// of the events is already in use.
+func (s *SQLEventStore) AppendToStream(ctx context.Context, streamName string, expectedVersion int64, events []EventData) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, sqlError(err)
+	}
+	defer tx.Rollback()
+
+	if lock := s.dialect.LockStatement(); lock != "" {
+		if _, err := tx.ExecContext(ctx, lock); err != nil {
+			return 0, sqlError(err)
+		}
+	}
+
+	current, err := s.streamVersion(ctx, tx, streamName)
+	if err != nil {
+		return 0, err
+	}
+	if expectedVersion != ExpectedVersionAny && expectedVersion != current {
+		return 0, &ErrWrongExpectedVersion{
+			StreamName:      streamName,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   current,
+		}
+	}
+	if len(events) == 0 {
+		return current, nil
+	}
+
+	// A stream created or appended to by another transaction leaves no row
+	// affected rather than failing the statement, as a failed statement aborts
+	// the transaction on PostgreSQL.
+	version := current + int64(len(events))
+	var result sql.Result
+	if current == ExpectedVersionNoStream {
+		result, err = tx.ExecContext(ctx, "INSERT INTO es_streams (stream_name, version) VALUES ($1, $2) ON CONFLICT (stream_name) DO NOTHING",
+			streamName, version)
+	} else {
+		result, err = tx.ExecContext(ctx, "UPDATE es_streams SET version = $1 WHERE stream_name = $2 AND version = $3",
+			version, streamName, current)
+	}
+	if err != nil {
+		return 0, sqlError(err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return 0, sqlError(err)
+	} else if n == 0 {
+		return 0, s.wrongExpectedVersion(ctx, tx, streamName, expectedVersion)
+	}
+
+	insert := `INSERT INTO es_events (event_id, stream_name, version, event_type, content_type, data, metadata, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	created := time.Now().UTC()
+	for i, e := range events {
+		data := e.Data
+		if data == nil {
+			data = []byte{}
+		}
+		metadata := e.Metadata
+		if metadata == nil {
+			metadata = []byte{}
+		}
+
+		_, err := tx.ExecContext(ctx, insert, e.EventID, streamName, current+1+int64(i),
+			e.EventType, e.ContentType, data, metadata, created)
+		if s.dialect.IsUniqueViolation(err) {
+			return 0, s.uniqueViolation(ctx, tx, streamName, expectedVersion, current, e.EventID, err)
+		}
+		if err != nil {
+			return 0, sqlError(err)
+		}
+
+		if s.outbox {
+			_, err = tx.ExecContext(ctx, "INSERT INTO es_outbox (position) SELECT position FROM es_events WHERE event_id = $1", e.EventID)
+			if err != nil {
+				return 0, sqlError(err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, sqlError(err)
+	}
+	return version, nil
+}
+
+// ReadStreamForwards reads at most count events from the stream starting
+// from and including the event number specified.
+//
+// If the stream does not exist an *ErrStreamNotFound is returned.
+func (s *SQLEventStore) ReadStreamForwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	events, err := s.query(ctx, "WHERE stream_name = $1 AND version >= $2 ORDER BY version LIMIT $3",
+		streamName, from, count)
+	if err != nil {
+		return nil, err
+	}
+	return s.streamEvents(ctx, streamName, events)
+}
+
+// ReadStreamBackwards reads at most count events from the stream in reverse
+// order starting from and including the event number specified.
+//
+// If the stream does not exist an *ErrStreamNotFound is returned.
+func (s *SQLEventStore) ReadStreamBackwards(ctx context.Context, streamName string, from int64, count int) ([]RecordedEvent, error) {
+	if from == StreamEnd {
+		from = math.MaxInt64
+	}
+
+	events, err := s.query(ctx, "WHERE stream_name = $1 AND version <= $2 ORDER BY version DESC LIMIT $3",
+		streamName, from, count)
+	if err != nil {
+		return nil, err
+	}
+	return s.streamEvents(ctx, streamName, events)
+}
+
+// ReadAll reads at most count events from the global log with a position
+// greater than the one specified.
+func (s *SQLEventStore) ReadAll(ctx context.Context, after Position, count int) ([]RecordedEvent, error) {
+	return s.query(ctx, "WHERE position > $1 ORDER BY position LIMIT $2", after.Commit, count)
+}
+
+// SQLOutbox is an Outbox over the es_outbox table of a SQLEventStore.
+//
+// Events are put in the outbox in the transaction that appends them, so an
+// event is in the outbox if and only if it was saved. Events marked as
+// delivered are removed from it.
+type SQLOutbox struct {
+	store *SQLEventStore
+}
+
+// NewSQLOutbox constructs a new SQLOutbox over the SQLEventStore. The outbox
+// of the store must be enabled with SetOutbox for events to be put in it.
+func NewSQLOutbox(store *SQLEventStore) (*SQLOutbox, error) {
+	if store == nil {
+		return nil, fmt.Errorf("nil SQLEventStore injected into outbox")
+	}
+
+	return &SQLOutbox{
+		store: store,
+	}, nil
+}
+
+// Pending returns the events in the outbox in the order they were appended.
+func (o *SQLOutbox) Pending(ctx context.Context, limit int) ([]RecordedEvent, error) {
+	return o.store.query(ctx, "WHERE position IN (SELECT position FROM es_outbox) ORDER BY position LIMIT $1", limit)
+}
+
+// MarkDelivered removes the events from the outbox.
+func (o *SQLOutbox) MarkDelivered(ctx context.Context, events []RecordedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	tx, err := o.store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	for _, e := range events {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM es_outbox WHERE position = $1", e.Position.Commit); err != nil {
+			return sqlError(err)
+		}
+	}
+	return sqlError(tx.Commit())
+}
+
+// query returns the events selected by the clause.
+func (s *SQLEventStore) query(ctx context.Context, clause string, args ...interface{}) ([]RecordedEvent, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT position, event_id, stream_name, version, event_type, content_type, data, metadata, created FROM es_events "+
+		clause, args...)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	ret := []RecordedEvent{}
+	for rows.Next() {
+		var e RecordedEvent
+		var position int64
+		err := rows.Scan(&position, &e.EventID, &e.StreamName, &e.EventNumber, &e.EventType,
+			&e.ContentType, &e.Data, &e.Metadata, &e.Created)
+		if err != nil {
+			return nil, err
+		}
+		e.Position = LogPosition(position)
+		e.Created = e.Created.UTC()
+		ret = append(ret, e)
+	}
+	return ret, sqlError(rows.Err())
+}
+
+// streamEvents returns the events read from the stream, or an
+// *ErrStreamNotFound if none were read because the stream does not exist.
+func (s *SQLEventStore) streamEvents(ctx context.Context, streamName string, events []RecordedEvent) ([]RecordedEvent, error) {
+	if len(events) > 0 {
+		return events, nil
+	}
+
+	version, err := s.streamVersion(ctx, s.db, streamName)
+	if err != nil {
+		return nil, err
+	}
+	if version == ExpectedVersionNoStream {
+		return nil, &ErrStreamNotFound{StreamName: streamName}
+	}
+	return events, nil
+}
+
+// streamVersion returns the version of the stream, or
+// ExpectedVersionNoStream if the stream does not exist.
+func (s *SQLEventStore) streamVersion(ctx context.Context, q queryRower, streamName string) (int64, error) {
+	var version int64
+	err := q.QueryRowContext(ctx, "SELECT version FROM es_streams WHERE stream_name = $1", streamName).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ExpectedVersionNoStream, nil
+	}
+	if err != nil {
+		return 0, sqlError(err)
+	}
+	return version, nil
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// wrongExpectedVersion rolls back the transaction of an append that lost a
+// race with another append to the stream and returns the error for it, with
+// the version of the stream read after the rollback.
+func (s *SQLEventStore) wrongExpectedVersion(ctx context.Context, tx *sql.Tx, streamName string, expectedVersion int64) error {
+	if err := tx.Rollback(); err != nil {
+		return sqlError(err)
+	}
+	actual, err := s.streamVersion(ctx, s.db, streamName)
+	if err != nil {
+		return err
+	}
+	return &ErrWrongExpectedVersion{
+		StreamName:      streamName,
+		ExpectedVersion: expectedVersion,
+		ActualVersion:   actual,
+	}
+}
+
+// uniqueViolation rolls back the transaction of an append whose event could
+// not be inserted because of a unique constraint and returns the error for it.
+//
+// If the stream was appended to by another transaction the version of the
+// event was taken and an *ErrWrongExpectedVersion is returned, with the
+// version of the stream read after the rollback. Otherwise the ID of the event
+// is already in use.
+func (s *SQLEventStore) uniqueViolation(ctx context.Context, tx *sql.Tx, streamName string, expectedVersion, current int64, eventID string, cause error) error {
+	err := s.wrongExpectedVersion(ctx, tx, streamName, expectedVersion)
+	if wrong, ok := err.(*ErrWrongExpectedVersion); ok && wrong.ActualVersion == current {
+		return fmt.Errorf("could not append event %s to stream %s. Error: %+v", eventID, streamName, cause)
+	}
+	return err
+}
+
+// sqlError translates the errors of a database that can not be reached into
+// an *ErrRepositoryUnavailable.
+func sqlError(err error) error {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return &ErrRepositoryUnavailable{Err: err}
+	}
+	return err
+}
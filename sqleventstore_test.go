@@ -0,0 +1,326 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+	_ "modernc.org/sqlite"
+)
+
+var _ = Suite(&SQLEventStoreSuite{})
+
+type SQLEventStoreSuite struct {
+	ctx   context.Context
+	db    *sql.DB
+	store *SQLEventStore
+}
+
+func (s *SQLEventStoreSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+
+	db, err := sql.Open("sqlite", filepath.Join(c.MkDir(), "events.db"))
+	c.Assert(err, IsNil)
+	db.SetMaxOpenConns(1)
+	s.db = db
+
+	store, err := NewSQLEventStore(db, SQLiteDialect{})
+	c.Assert(err, IsNil)
+	c.Assert(store.Migrate(s.ctx), IsNil)
+	s.store = store
+}
+
+func (s *SQLEventStoreSuite) TearDownTest(c *C) {
+	_ = s.db.Close()
+}
+
+func (s *SQLEventStoreSuite) TestNewSQLEventStoreRequiresDependencies(c *C) {
+	_, err := NewSQLEventStore(nil, SQLiteDialect{})
+	c.Assert(err, ErrorMatches, "nil database injected into SQLEventStore")
+
+	_, err = NewSQLEventStore(s.db, nil)
+	c.Assert(err, ErrorMatches, "nil SQLDialect injected into SQLEventStore")
+}
+
+func (s *SQLEventStoreSuite) TestMigrateIsIdempotent(c *C) {
+	c.Assert(s.store.Migrate(s.ctx), IsNil)
+
+	var applied int
+	c.Assert(s.db.QueryRow("SELECT COUNT(*) FROM es_schema_migrations").Scan(&applied), IsNil)
+	c.Assert(applied, Equals, len(SQLiteDialect{}.Migrations()))
+}
+
+func (s *SQLEventStoreSuite) TestAppendToNewStream(c *C) {
+	events := NewTestEventData(2)
+	events[0].Metadata = []byte(`{"UserID":"user"}`)
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, events)
+	c.Assert(err, IsNil)
+
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	for i, e := range got {
+		c.Assert(e.EventID, Equals, events[i].EventID)
+		c.Assert(e.EventType, Equals, events[i].EventType)
+		c.Assert(e.ContentType, Equals, events[i].ContentType)
+		c.Assert(e.StreamName, Equals, "stream")
+		c.Assert(e.EventNumber, Equals, int64(i))
+		c.Assert(e.Data, DeepEquals, events[i].Data)
+		c.Assert(time.Since(e.Created) < time.Minute, Equals, true)
+	}
+	c.Assert(string(got[0].Metadata), Equals, `{"UserID":"user"}`)
+}
+
+func (s *SQLEventStoreSuite) TestAppendWithWrongExpectedVersionReturnsAnError(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(2))
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", 0, NewTestEventData(1))
+	c.Assert(err, DeepEquals, &ErrWrongExpectedVersion{
+		StreamName:      "stream",
+		ExpectedVersion: 0,
+		ActualVersion:   1,
+	})
+
+	_, err = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(1))
+	c.Assert(err, FitsTypeOf, &ErrWrongExpectedVersion{})
+
+	got, _ := s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(got, HasLen, 2)
+}
+
+func (s *SQLEventStoreSuite) TestWrongExpectedVersionReadsVersionAfterRollback(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(2))
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	c.Assert(err, IsNil)
+	_, err = tx.ExecContext(s.ctx, "INSERT INTO es_streams (stream_name, version) VALUES ('stream', 0)")
+	c.Assert(SQLiteDialect{}.IsUniqueViolation(err), Equals, true)
+
+	err = s.store.wrongExpectedVersion(s.ctx, tx, "stream", ExpectedVersionNoStream)
+	c.Assert(err, DeepEquals, &ErrWrongExpectedVersion{
+		StreamName:      "stream",
+		ExpectedVersion: ExpectedVersionNoStream,
+		ActualVersion:   1,
+	})
+	c.Assert(tx.Commit(), Equals, sql.ErrTxDone)
+}
+
+func (s *SQLEventStoreSuite) TestWrongExpectedVersionReturnsReadErrors(c *C) {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.db.Close(), IsNil)
+
+	err = s.store.wrongExpectedVersion(s.ctx, tx, "stream", 0)
+	c.Assert(err, NotNil)
+	c.Assert(err, Not(FitsTypeOf), &ErrWrongExpectedVersion{})
+}
+
+func (s *SQLEventStoreSuite) TestAppendWithExpectedVersionAny(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(2))
+
+	version, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionAny, NewTestEventData(1))
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, int64(2))
+	version, err = s.store.AppendToStream(s.ctx, "stream", 2, NewTestEventData(1))
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, int64(3))
+
+	got, _ := s.store.ReadStreamBackwards(s.ctx, "stream", StreamEnd, 1)
+	c.Assert(got[0].EventNumber, Equals, int64(3))
+}
+
+func (s *SQLEventStoreSuite) TestStreamVersionIsUnique(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(1))
+
+	_, err := s.db.Exec(`INSERT INTO es_events (event_id, stream_name, version, event_type, content_type, data, metadata, created)
+		VALUES ('id', 'stream', 0, 'type', 'application/json', x'', x'', CURRENT_TIMESTAMP)`)
+
+	c.Assert(SQLiteDialect{}.IsUniqueViolation(err), Equals, true)
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func (s *SQLEventStoreSuite) TestUniqueViolationsAreRecognisedByCode(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(1))
+	_, err := s.db.Exec("INSERT INTO es_streams (stream_name, version) VALUES ('stream', 0)")
+	c.Assert(SQLiteDialect{}.IsUniqueViolation(err), Equals, true)
+	c.Assert(SQLiteDialect{}.IsUniqueViolation(errors.New("UNIQUE constraint failed")), Equals, false)
+	c.Assert(SQLiteDialect{}.IsUniqueViolation(nil), Equals, false)
+
+	c.Assert(PostgresDialect{}.IsUniqueViolation(fmt.Errorf("insert: %w", sqlStateError("23505"))), Equals, true)
+	c.Assert(PostgresDialect{}.IsUniqueViolation(sqlStateError("23503")), Equals, false)
+	c.Assert(PostgresDialect{}.IsUniqueViolation(errors.New("duplicate key value violates unique constraint")), Equals, false)
+	c.Assert(PostgresDialect{}.IsUniqueViolation(nil), Equals, false)
+}
+
+func (s *SQLEventStoreSuite) TestUniqueViolationOfARacedAppendIsAWrongExpectedVersion(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(2))
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	c.Assert(err, IsNil)
+	err = s.store.uniqueViolation(s.ctx, tx, "stream", ExpectedVersionAny, 0, "id", errors.New("unique"))
+	c.Assert(err, DeepEquals, &ErrWrongExpectedVersion{
+		StreamName:      "stream",
+		ExpectedVersion: ExpectedVersionAny,
+		ActualVersion:   1,
+	})
+	c.Assert(tx.Commit(), Equals, sql.ErrTxDone)
+
+	tx, err = s.db.BeginTx(s.ctx, nil)
+	c.Assert(err, IsNil)
+	err = s.store.uniqueViolation(s.ctx, tx, "stream", 1, 1, "id", errors.New("unique"))
+	c.Assert(err, ErrorMatches, "could not append event id to stream stream.*")
+}
+
+func (s *SQLEventStoreSuite) TestFailedAppendLeavesNoEvents(c *C) {
+	events := NewTestEventData(2)
+	events[1].EventID = events[0].EventID
+
+	_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, events)
+	c.Assert(err, ErrorMatches, "could not append event .*")
+
+	_, err = s.store.ReadStreamForwards(s.ctx, "stream", StreamStart, 10)
+	c.Assert(err, DeepEquals, &ErrStreamNotFound{StreamName: "stream"})
+}
+
+func (s *SQLEventStoreSuite) TestReadStream(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(5))
+
+	got, err := s.store.ReadStreamForwards(s.ctx, "stream", 2, 2)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0].EventNumber, Equals, int64(2))
+	c.Assert(got[1].EventNumber, Equals, int64(3))
+
+	got, err = s.store.ReadStreamBackwards(s.ctx, "stream", StreamEnd, 2)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0].EventNumber, Equals, int64(4))
+	c.Assert(got[1].EventNumber, Equals, int64(3))
+
+	got, err = s.store.ReadStreamForwards(s.ctx, "stream", 5, 2)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 0)
+}
+
+func (s *SQLEventStoreSuite) TestReadMissingStreamReturnsStreamNotFound(c *C) {
+	_, err := s.store.ReadStreamForwards(s.ctx, "missing", StreamStart, 10)
+	c.Assert(err, DeepEquals, &ErrStreamNotFound{StreamName: "missing"})
+
+	_, err = s.store.ReadStreamBackwards(s.ctx, "missing", StreamEnd, 10)
+	c.Assert(err, DeepEquals, &ErrStreamNotFound{StreamName: "missing"})
+}
+
+func (s *SQLEventStoreSuite) TestReadAllAcrossStreams(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "a", ExpectedVersionAny, NewTestEventData(2))
+	_, _ = s.store.AppendToStream(s.ctx, "b", ExpectedVersionAny, NewTestEventData(1))
+	_, _ = s.store.AppendToStream(s.ctx, "a", ExpectedVersionAny, NewTestEventData(1))
+
+	got, err := s.store.ReadAll(s.ctx, PositionStart, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 4)
+
+	streams := []string{}
+	for i, e := range got {
+		if i > 0 {
+			c.Assert(e.Position.After(got[i-1].Position), Equals, true)
+		}
+		streams = append(streams, e.StreamName)
+	}
+	c.Assert(streams, DeepEquals, []string{"a", "a", "b", "a"})
+
+	got, err = s.store.ReadAll(s.ctx, got[1].Position, 10)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0].StreamName, Equals, "b")
+}
+
+func (s *SQLEventStoreSuite) TestConcurrentAppendsWithExpectedVersion(c *C) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.store.AppendToStream(s.ctx, "stream", ExpectedVersionNoStream, NewTestEventData(1))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else {
+			c.Assert(err, DeepEquals, &ErrWrongExpectedVersion{
+				StreamName:      "stream",
+				ExpectedVersion: ExpectedVersionNoStream,
+				ActualVersion:   0,
+			})
+		}
+	}
+	c.Assert(succeeded, Equals, 1)
+}
+
+func (s *SQLEventStoreSuite) TestRepositoryAndSubscription(c *C) {
+	common, err := NewCommonDomainRepository(s.store, &MockEventBus{})
+	c.Assert(err, IsNil)
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	common.SetEventFactory(eventFactory)
+	repo, err := NewRepository(common, newTypedSnapshotAggregate)
+	c.Assert(err, IsNil)
+
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 2}, nil), true)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 3}, nil), true)
+	c.Assert(repo.Save(agg, nil), IsNil)
+
+	loaded, err := repo.Load(id)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Total, Equals, 5)
+
+	stale := newTypedSnapshotAggregate(id)
+	stale.Apply(NewEventMessage(id, &SomeEvent{Count: 1}, nil), true)
+	c.Assert(repo.Save(stale, nil), FitsTypeOf, &ErrConcurrencyViolation{})
+
+	sub, err := NewSubscription(s.store, eventFactory)
+	c.Assert(err, IsNil)
+	sub.SetPollInterval(time.Millisecond)
+	handler := NewMockEventHandler()
+	sub.AddHandler(handler, &SomeEvent{})
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- sub.Run(ctx) }()
+
+	select {
+	case <-sub.CaughtUp():
+	case <-time.After(5 * time.Second):
+		c.Fatal("subscription did not catch up")
+	}
+	cancel()
+	<-done
+
+	c.Assert(handler.events, HasLen, 2)
+	c.Assert(handler.events[1].Event(), DeepEquals, &SomeEvent{Count: 3})
+}
@@ -18,20 +18,31 @@ type StreamNamer interface {
 // control of stream names for event streams.
 type DelegateStreamNamer struct {
 	delegates map[string]func(string, string) string
+	types     *TypeRegistry
 }
 
 // NewDelegateStreamNamer constructs a delegate stream namer
 func NewDelegateStreamNamer() *DelegateStreamNamer {
 	return &DelegateStreamNamer{
 		delegates: make(map[string]func(string, string) string),
+		types:     DefaultTypeRegistry,
 	}
 }
 
+// SetTypeRegistry sets the registry used to name the aggregate types. The
+// DefaultTypeRegistry is used by default.
+func (r *DelegateStreamNamer) SetTypeRegistry(types *TypeRegistry) {
+	r.types = types
+}
+
 // RegisterDelegate allows registration of a stream name delegate function for
 // the aggregates specified in the variadic aggregates argument.
 func (r *DelegateStreamNamer) RegisterDelegate(delegate func(string, string) string, aggregates ...AggregateRoot) error {
 	for _, aggregate := range aggregates {
-		typeName := typeOf(aggregate)
+		typeName, err := r.types.Name(aggregate)
+		if err != nil {
+			return err
+		}
 		if _, ok := r.delegates[typeName]; ok {
 			return fmt.Errorf("the stream name delegate for \"%s\" is already registered with the stream namer",
 				typeName)
@@ -42,7 +53,10 @@ func (r *DelegateStreamNamer) RegisterDelegate(delegate func(string, string) str
 }
 
 // GetStreamName gets the result of the stream name delgate registered for the aggregate type.
+//
+// An alias of the aggregate type is resolved to its name.
 func (r *DelegateStreamNamer) GetStreamName(aggregateTypeName string, id string) (string, error) {
+	aggregateTypeName = r.types.Resolve(aggregateTypeName)
 	if f, ok := r.delegates[aggregateTypeName]; ok {
 		return f(aggregateTypeName, id), nil
 	}
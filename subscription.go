@@ -0,0 +1,383 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPollInterval is the time a Subscription waits between reads of
+	// an EventStore that can not push events to it.
+	DefaultPollInterval = time.Second
+
+	// DefaultReconnectDelay is the time a Subscription waits before it
+	// reconnects to an EventStore that could not be read.
+	DefaultReconnectDelay = time.Second
+)
+
+// AllSubscriber is the interface that an EventStore implements to push events
+// to a Subscription as they are appended instead of being polled.
+type AllSubscriber interface {
+	// SubscribeToAll calls handle with each event with a position greater than
+	// the one specified, in order, as the events are appended.
+	//
+	// SubscribeToAll blocks until the context is done, handle returns an error
+	// or the subscription is dropped, and returns the error. A dropped
+	// subscription is reported as an *ErrRepositoryUnavailable.
+	SubscribeToAll(ctx context.Context, after Position, handle func(RecordedEvent) error) error
+}
+
+// Subscription feeds the events in an EventStore to event handlers.
+//
+// A subscription catches up by reading the events after its start position
+// from the $all stream, or from a single category of streams, and then goes
+// live. If the EventStore implements AllSubscriber live events are pushed to
+// the subscription, otherwise the EventStore is polled.
+//
+// Recorded events are turned into EventMessages with the EventFactory. Events
+// of a type that the factory does not know are skipped. The messages are
+// published to the handlers added to the subscription with the retry policy
+// and dead-letter sink of the subscription. If a handler fails and there is no
+// dead-letter sink the subscription stops.
+//
+// If the EventStore can not be read the subscription waits for the reconnect
+// delay and carries on from the last event it handled.
+//
+// The position of a subscription is kept by the subscription, or in its
+// CheckpointStore. Persistent subscriptions, whose position is kept by
+// EventStoreDB and whose events are shared among the members of a consumer
+// group, are not provided.
+type Subscription struct {
+	eventStore     EventStore
+	eventFactory   EventFactory
+	metadataCodec  MetadataCodec
+	upcasters      *Upcasters
+	serializers    *Serializers
+	bus            *InternalEventBus
+	deadLetterSink DeadLetterSink
+	category       string
+	batchSize      int
+	pollInterval   time.Duration
+	reconnectDelay time.Duration
+	maxReconnects  int
+	checkpoint     func(context.Context, Position) error
+	checkpoints    CheckpointStore
+	name           string
+
+	mu       sync.Mutex
+	position Position
+	caughtUp chan struct{}
+	live     bool
+}
+
+// NewSubscription constructs a new Subscription that reads events from the
+// EventStore from the start of the $all stream.
+func NewSubscription(eventStore EventStore, eventFactory EventFactory) (*Subscription, error) {
+	if eventStore == nil {
+		return nil, fmt.Errorf("nil Eventstore injected into subscription")
+	}
+	if eventFactory == nil {
+		return nil, fmt.Errorf("nil EventFactory injected into subscription")
+	}
+
+	return &Subscription{
+		eventStore:     eventStore,
+		eventFactory:   eventFactory,
+		metadataCodec:  NewJSONMetadataCodec(),
+		serializers:    DefaultSerializers,
+		bus:            NewInternalEventBus(),
+		batchSize:      DefaultReadBatchSize,
+		pollInterval:   DefaultPollInterval,
+		reconnectDelay: DefaultReconnectDelay,
+		position:       PositionStart,
+		caughtUp:       make(chan struct{}),
+	}, nil
+}
+
+// AddHandler registers an event handler for all of the events specified in the
+// variadic events parameter.
+func (s *Subscription) AddHandler(handler EventHandler, events ...interface{}) {
+	s.bus.AddHandler(handler, events...)
+}
+
+// SetCategory restricts the subscription to the streams of a category.
+//
+// The category of a stream is the part of its name before the first hyphen,
+// so the category "ProductionOrder" includes the stream "ProductionOrder-1".
+func (s *Subscription) SetCategory(category string) {
+	s.category = category
+}
+
+// SetStartPosition sets the position after which the subscription starts,
+// such as the last position a projection stored.
+func (s *Subscription) SetStartPosition(after Position) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.position = after
+}
+
+// SetCheckpointStore sets the store that holds the checkpoint of the
+// subscription under the name specified.
+//
+// When the subscription runs it starts after the stored checkpoint and the
+// checkpoint is saved after each event is handled. Handlers that save the
+// checkpoint in the same transaction as their own writes can find the
+// position of the event with EventPosition.
+func (s *Subscription) SetCheckpointStore(store CheckpointStore, name string) {
+	s.checkpoints = store
+	s.name = name
+}
+
+// SetCheckpointFunc sets a function that is called with the position of each
+// event after its handlers have handled it.
+//
+// If the function returns an error the subscription stops.
+func (s *Subscription) SetCheckpointFunc(checkpoint func(ctx context.Context, position Position) error) {
+	s.checkpoint = checkpoint
+}
+
+// SetMetadataCodec sets the codec used to decode event headers.
+func (s *Subscription) SetMetadataCodec(codec MetadataCodec) {
+	s.metadataCodec = codec
+}
+
+// SetUpcasters sets the upcasters that transform events persisted in an old
+// schema before they are published.
+func (s *Subscription) SetUpcasters(upcasters *Upcasters) {
+	s.upcasters = upcasters
+}
+
+// SetSerializers sets the serializers used to read events by their content
+// type. DefaultSerializers is used by default.
+func (s *Subscription) SetSerializers(serializers *Serializers) {
+	s.serializers = serializers
+}
+
+// SetRetryPolicy sets the policy used to retry handlers that fail.
+func (s *Subscription) SetRetryPolicy(policy RetryPolicy) {
+	s.bus.SetRetryPolicy(policy)
+}
+
+// SetDeadLetterSink sets the sink that receives events that handlers fail to
+// handle after all retries. With a sink the subscription carries on when a
+// handler fails.
+func (s *Subscription) SetDeadLetterSink(sink DeadLetterSink) {
+	s.deadLetterSink = sink
+	s.bus.SetDeadLetterSink(sink)
+}
+
+// SetReadBatchSize sets the number of events read at a time while catching
+// up. Values less than 1 are ignored.
+func (s *Subscription) SetReadBatchSize(size int) {
+	if size > 0 {
+		s.batchSize = size
+	}
+}
+
+// SetPollInterval sets the time waited between reads of an EventStore that
+// does not implement AllSubscriber. Values less than 1 are ignored.
+func (s *Subscription) SetPollInterval(interval time.Duration) {
+	if interval > 0 {
+		s.pollInterval = interval
+	}
+}
+
+// SetReconnectDelay sets the time waited before reconnecting to an EventStore
+// that could not be read and the number of consecutive reconnects allowed
+// before the subscription stops. A maxReconnects of 0 means no limit.
+func (s *Subscription) SetReconnectDelay(delay time.Duration, maxReconnects int) {
+	s.reconnectDelay = delay
+	s.maxReconnects = maxReconnects
+}
+
+// Position returns the position of the last event handled by the subscription.
+func (s *Subscription) Position() Position {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position
+}
+
+// CaughtUp returns a channel that is closed when the subscription has handled
+// all of the events that were in the EventStore when it started.
+func (s *Subscription) CaughtUp() <-chan struct{} {
+	return s.caughtUp
+}
+
+// Run catches up and then handles live events until the context is done, a
+// handler fails with no dead-letter sink set, or the EventStore could not be
+// read after the maximum number of reconnects.
+//
+// Run returns the context error when the context is done.
+func (s *Subscription) Run(ctx context.Context) error {
+	if s.checkpoints != nil {
+		position, err := s.checkpoints.GetCheckpoint(ctx, s.name)
+		if err != nil {
+			return fmt.Errorf("could not read checkpoint %s. Error: %+v", s.name, err)
+		}
+		s.SetStartPosition(position)
+	}
+
+	reconnects := 0
+	for {
+		start := s.Position()
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := err.(*ErrRepositoryUnavailable); !ok {
+			return err
+		}
+
+		if s.Position() != start {
+			reconnects = 0
+		}
+		reconnects++
+		if s.maxReconnects > 0 && reconnects > s.maxReconnects {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.reconnectDelay):
+		}
+	}
+}
+
+// run catches up and goes live until an error stops it.
+//
+// Failures to read the EventStore are returned as *ErrRepositoryUnavailable,
+// other errors stop the subscription.
+func (s *Subscription) run(ctx context.Context) error {
+	for {
+		if err := s.catchUp(ctx); err != nil {
+			return err
+		}
+		s.goLive()
+
+		if subscriber, ok := s.eventStore.(AllSubscriber); ok {
+			var handleErr error
+			err := subscriber.SubscribeToAll(ctx, s.Position(), func(event RecordedEvent) error {
+				handleErr = s.handle(ctx, event)
+				return handleErr
+			})
+			if handleErr != nil {
+				return handleErr
+			}
+			return unavailable(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+// catchUp handles the events after the current position in batches until
+// there are no more.
+func (s *Subscription) catchUp(ctx context.Context) error {
+	for {
+		events, err := s.eventStore.ReadAll(ctx, s.Position(), s.batchSize)
+		if err != nil {
+			return unavailable(err)
+		}
+
+		for _, event := range events {
+			if err := s.handle(ctx, event); err != nil {
+				return err
+			}
+		}
+
+		if len(events) < s.batchSize {
+			return nil
+		}
+	}
+}
+
+// handle publishes the event to the handlers if it is in the category of the
+// subscription and of a known type, then moves the position on.
+func (s *Subscription) handle(ctx context.Context, event RecordedEvent) error {
+	if !event.Position.After(s.Position()) {
+		return nil
+	}
+
+	if s.category == "" || streamCategory(event.StreamName) == s.category {
+		messages, _, err := decodeEventMessages(s.eventFactory, s.metadataCodec, s.upcasters, s.serializers, "", event)
+		if err != nil {
+			return err
+		}
+
+		if len(messages) > 0 {
+			for _, em := range messages {
+				err = s.bus.Publish(withEventPosition(ctx, event.Position), em)
+				if err != nil && s.deadLetterSink == nil {
+					return err
+				}
+			}
+			if s.checkpoints != nil {
+				if err := s.checkpoints.SaveCheckpoint(ctx, s.name, event.Position); err != nil {
+					return err
+				}
+			}
+			if s.checkpoint != nil {
+				if err := s.checkpoint(ctx, event.Position); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.position = event.Position
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Subscription) goLive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.live {
+		s.live = true
+		close(s.caughtUp)
+	}
+}
+
+// unavailable returns errors that are not context errors as an
+// *ErrRepositoryUnavailable so that the subscription reconnects.
+func unavailable(err error) error {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	if _, ok := err.(*ErrRepositoryUnavailable); ok {
+		return err
+	}
+	return &ErrRepositoryUnavailable{Err: err}
+}
+
+// streamCategory returns the part of the stream name before the first hyphen,
+// as the $by_category projection of EventStoreDB does. Aggregate type names
+// therefore must not contain a hyphen, while aggregate IDs may.
+func streamCategory(streamName string) string {
+	if i := strings.Index(streamName, "-"); i >= 0 {
+		return streamName[:i]
+	}
+	return streamName
+}
+
+// streamID returns the part of the stream name after the first hyphen.
+func streamID(streamName string) string {
+	if i := strings.Index(streamName, "-"); i >= 0 {
+		return streamName[i+1:]
+	}
+	return streamName
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SubscriptionSuite{})
+
+type SubscriptionSuite struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	store   *InMemoryEventStore
+	sub     *Subscription
+	handler *SyncEventHandler
+}
+
+func (s *SubscriptionSuite) SetUpTest(c *C) {
+	s.ctx, s.cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	s.store = NewInMemoryEventStore()
+	s.handler = &SyncEventHandler{}
+	s.sub = s.newSubscription(c, s.store)
+}
+
+func (s *SubscriptionSuite) TearDownTest(c *C) {
+	s.cancel()
+}
+
+func (s *SubscriptionSuite) newSubscription(c *C, store EventStore) *Subscription {
+	eventFactory := NewDelegateEventFactory()
+	_ = eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+
+	sub, err := NewSubscription(store, eventFactory)
+	c.Assert(err, IsNil)
+	sub.AddHandler(s.handler, &SomeEvent{})
+	return sub
+}
+
+// run runs the subscription in the background and returns a channel that
+// receives the error it stops with.
+func (s *SubscriptionSuite) run(sub *Subscription) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- sub.Run(s.ctx)
+	}()
+	return done
+}
+
+// waitForEvents waits until the handler has received n events.
+func (s *SubscriptionSuite) waitForEvents(c *C, n int) []EventMessage {
+	for s.ctx.Err() == nil {
+		if events := s.handler.Events(); len(events) >= n {
+			return events
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for %d events, received %d", n, len(s.handler.Events()))
+	return nil
+}
+
+func (s *SubscriptionSuite) TestNewSubscriptionRequiresEventStoreAndFactory(c *C) {
+	sub, err := NewSubscription(nil, NewDelegateEventFactory())
+	c.Assert(sub, IsNil)
+	c.Assert(err, DeepEquals, fmt.Errorf("nil Eventstore injected into subscription"))
+
+	sub, err = NewSubscription(s.store, nil)
+	c.Assert(sub, IsNil)
+	c.Assert(err, DeepEquals, fmt.Errorf("nil EventFactory injected into subscription"))
+}
+
+func (s *SubscriptionSuite) TestCatchesUpAndGoesLive(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(3))
+	done := s.run(s.sub)
+
+	<-s.sub.CaughtUp()
+	c.Assert(s.waitForEvents(c, 3), HasLen, 3)
+
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-2", ExpectedVersionAny, NewTestEventData(2))
+	events := s.waitForEvents(c, 5)
+
+	c.Assert(events[0].AggregateID(), Equals, "1")
+	c.Assert(events[0].Event(), DeepEquals, &SomeEvent{Item: "item 0", Count: 0})
+	c.Assert(*events[2].Version(), Equals, int64(2))
+	c.Assert(events[4].AggregateID(), Equals, "2")
+	c.Assert(s.sub.Position(), Equals, LogPosition(4))
+
+	s.cancel()
+	c.Assert(<-done, Equals, context.Canceled)
+}
+
+func (s *SubscriptionSuite) TestStartsAfterStartPositionAndCheckpoints(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(4))
+	var mu sync.Mutex
+	var checkpoints []Position
+	s.sub.SetStartPosition(LogPosition(1))
+	s.sub.SetCheckpointFunc(func(ctx context.Context, position Position) error {
+		mu.Lock()
+		defer mu.Unlock()
+		checkpoints = append(checkpoints, position)
+		return nil
+	})
+	s.run(s.sub)
+
+	events := s.waitForEvents(c, 2)
+	<-s.sub.CaughtUp()
+
+	c.Assert(*events[0].Version(), Equals, int64(2))
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(checkpoints, DeepEquals, []Position{LogPosition(2), LogPosition(3)})
+}
+
+func (s *SubscriptionSuite) TestCategoryAndUnknownEventsAreSkipped(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "Other-1", ExpectedVersionAny, NewTestEventData(1))
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, []EventData{
+		{EventID: NewUUID(), EventType: "Unknown", Data: []byte(`{}`)},
+	})
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(1))
+	s.sub.SetCategory("SomeAggregate")
+	s.run(s.sub)
+
+	<-s.sub.CaughtUp()
+	events := s.waitForEvents(c, 1)
+
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].AggregateID(), Equals, "1")
+	c.Assert(s.sub.Position(), Equals, LogPosition(2))
+}
+
+// PollingEventStore hides the AllSubscriber implementation of an event store.
+type PollingEventStore struct {
+	EventStore
+}
+
+func (s *SubscriptionSuite) TestPollsEventStoreThatCanNotPush(c *C) {
+	sub := s.newSubscription(c, &PollingEventStore{s.store})
+	sub.SetPollInterval(time.Millisecond)
+	s.run(sub)
+
+	<-sub.CaughtUp()
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(2))
+
+	c.Assert(s.waitForEvents(c, 2), HasLen, 2)
+}
+
+// FlakyEventStore fails the first Failures reads of the $all stream.
+type FlakyEventStore struct {
+	EventStore
+	mu       sync.Mutex
+	Failures int
+	reads    int
+}
+
+func (s *FlakyEventStore) ReadAll(ctx context.Context, after Position, count int) ([]RecordedEvent, error) {
+	s.mu.Lock()
+	s.reads++
+	failed := s.reads <= s.Failures
+	s.mu.Unlock()
+
+	if failed {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return s.EventStore.ReadAll(ctx, after, count)
+}
+
+func (s *SubscriptionSuite) TestReconnectsWhenEventStoreCanNotBeRead(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(2))
+	sub := s.newSubscription(c, &FlakyEventStore{EventStore: &PollingEventStore{s.store}, Failures: 2})
+	sub.SetReconnectDelay(time.Millisecond, 3)
+	s.run(sub)
+
+	<-sub.CaughtUp()
+	c.Assert(s.waitForEvents(c, 2), HasLen, 2)
+}
+
+func (s *SubscriptionSuite) TestStopsAfterMaxReconnects(c *C) {
+	sub := s.newSubscription(c, &FlakyEventStore{EventStore: s.store, Failures: 10})
+	sub.SetReconnectDelay(time.Millisecond, 2)
+
+	err := sub.Run(s.ctx)
+
+	c.Assert(err, FitsTypeOf, &ErrRepositoryUnavailable{})
+	c.Assert(err.(*ErrRepositoryUnavailable).Err, ErrorMatches, "connection refused")
+}
+
+func (s *SubscriptionSuite) TestStopsWhenHandlerFailsWithoutDeadLetterSink(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(2))
+	s.sub.AddHandler(&FailingEventHandler{Failures: 1}, &SomeEvent{})
+
+	err := s.sub.Run(s.ctx)
+
+	c.Assert(err, FitsTypeOf, &ErrEventHandlerFailed{})
+	c.Assert(s.sub.Position(), Equals, PositionStart)
+}
+
+func (s *SubscriptionSuite) TestCarriesOnWhenHandlerFailsWithDeadLetterSink(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(2))
+	sink := NewInMemoryDeadLetterSink()
+	s.sub.SetDeadLetterSink(sink)
+	s.sub.AddHandler(&FailingEventHandler{Failures: 1}, &SomeEvent{})
+	s.run(s.sub)
+
+	<-s.sub.CaughtUp()
+	c.Assert(s.waitForEvents(c, 2), HasLen, 2)
+	c.Assert(sink.DeadLetters(), HasLen, 1)
+}
+
+// CommitEventStore is an EventStore whose events share commit positions, as
+// the events appended together to GetEventStore do.
+type CommitEventStore struct {
+	EventStore
+	events []RecordedEvent
+}
+
+func (s *CommitEventStore) ReadAll(ctx context.Context, after Position, count int) ([]RecordedEvent, error) {
+	ret := []RecordedEvent{}
+	for _, e := range s.events {
+		if e.Position.After(after) && len(ret) < count {
+			ret = append(ret, e)
+		}
+	}
+	return ret, nil
+}
+
+func (s *SubscriptionSuite) TestResumesWithinATransaction(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(3))
+	events, _ := s.store.ReadAll(s.ctx, PositionStart, 10)
+	for i := range events {
+		events[i].Position = Position{Commit: 100, Prepare: int64(10 * (i + 1))}
+	}
+	checkpoints := NewInMemoryCheckpointStore()
+	_ = checkpoints.SaveCheckpoint(s.ctx, "list", Position{Commit: 100, Prepare: 10})
+	sub := s.newSubscription(c, &CommitEventStore{EventStore: s.store, events: events})
+	sub.SetCheckpointStore(checkpoints, "list")
+	s.run(sub)
+
+	<-sub.CaughtUp()
+	handled := s.waitForEvents(c, 2)
+
+	c.Assert(handled, HasLen, 2)
+	c.Assert(*handled[0].Version(), Equals, int64(1))
+	c.Assert(*handled[1].Version(), Equals, int64(2))
+	position, _ := checkpoints.GetCheckpoint(s.ctx, "list")
+	c.Assert(position, Equals, Position{Commit: 100, Prepare: 30})
+}
+
+func (s *SubscriptionSuite) TestStreamCategoryAndID(c *C) {
+	c.Assert(streamCategory("ProductionOrder-1-2"), Equals, "ProductionOrder")
+	c.Assert(streamID("ProductionOrder-1-2"), Equals, "1-2")
+	c.Assert(streamCategory("stream"), Equals, "stream")
+	c.Assert(streamID("stream"), Equals, "stream")
+}
+
+func (s *SubscriptionSuite) TestResumesFromCheckpointStore(c *C) {
+	_, _ = s.store.AppendToStream(s.ctx, "SomeAggregate-1", ExpectedVersionAny, NewTestEventData(4))
+	checkpoints := NewInMemoryCheckpointStore()
+	_ = checkpoints.SaveCheckpoint(s.ctx, "list", LogPosition(1))
+	s.sub.SetCheckpointStore(checkpoints, "list")
+
+	var mu sync.Mutex
+	var positions []Position
+	s.sub.AddHandler(EventHandlerFunc(func(ctx context.Context, event EventMessage) error {
+		position, _ := EventPosition(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		positions = append(positions, position)
+		return nil
+	}), &SomeEvent{})
+	s.run(s.sub)
+
+	<-s.sub.CaughtUp()
+	c.Assert(s.waitForEvents(c, 2), HasLen, 2)
+
+	position, _ := checkpoints.GetCheckpoint(s.ctx, "list")
+	c.Assert(position, Equals, LogPosition(3))
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(positions, DeepEquals, []Position{LogPosition(2), LogPosition(3)})
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// HandleCommand registers fn with the dispatcher as the handler of commands
+// of type C.
+//
+// fn receives the command already asserted to *C so there is no need for a
+// type switch. A command dispatched as a C value is passed as a pointer to a
+// copy. An error is returned if fn is nil or if a handler is already
+// registered for a command with the name of C.
+//
+//	err := HandleCommand(dispatcher, func(ctx context.Context, m CommandMessage, c *CreateOrder) error {
+//		...
+//	})
+func HandleCommand[C any](dispatcher Dispatcher, fn func(context.Context, CommandMessage, *C) error) error {
+	if dispatcher == nil {
+		return fmt.Errorf("nil Dispatcher injected into HandleCommand")
+	}
+	if fn == nil {
+		return fmt.Errorf("nil handler injected into HandleCommand")
+	}
+
+	handler := CommandHandlerFunc(func(ctx context.Context, command CommandMessage) error {
+		c, ok := asPointer[C](command.Command())
+		if !ok {
+			return &ErrCommandExecution{
+				Command: command,
+				Reason:  fmt.Sprintf("command is a %T not a %T", command.Command(), c),
+			}
+		}
+		return fn(ctx, command, c)
+	})
+
+	return dispatcher.RegisterHandler(handler, new(C))
+}
+
+// OnEvent adds fn to the event bus as a handler of events of type E.
+//
+// fn receives the event already asserted to *E so there is no need for a type
+// switch. An event published as an E value is passed as a pointer to a copy.
+//
+// If the bus has a RegisterHandler method, as InternalEventBus and
+// AsyncEventBus do, an error is returned when E can not be named by the
+// TypeRegistry of the bus, for example because another type has the same name.
+//
+//	err := OnEvent(bus, func(ctx context.Context, m EventMessage, e *OrderCreated) error {
+//		...
+//	})
+func OnEvent[E any](bus EventBus, fn func(context.Context, EventMessage, *E) error) error {
+	if bus == nil {
+		return fmt.Errorf("nil EventBus injected into OnEvent")
+	}
+	if fn == nil {
+		return fmt.Errorf("nil handler injected into OnEvent")
+	}
+
+	handler := &typedEventHandler[E]{fn: fn}
+	if r, ok := bus.(handlerRegistrar); ok {
+		return r.RegisterHandler(handler, new(E))
+	}
+
+	bus.AddHandler(handler, new(E))
+	return nil
+}
+
+// typedEventHandler is the event handler added by OnEvent.
+type typedEventHandler[E any] struct {
+	fn func(context.Context, EventMessage, *E) error
+}
+
+// Handle calls HandleEvent with a background context.
+func (h *typedEventHandler[E]) Handle(event EventMessage) {
+	_ = h.HandleEvent(context.Background(), event)
+}
+
+// HandleEvent asserts the type of the event and calls the handler function.
+func (h *typedEventHandler[E]) HandleEvent(ctx context.Context, event EventMessage) error {
+	e, ok := asPointer[E](event.Event())
+	if !ok {
+		return fmt.Errorf("event %s is a %T not a %T", event.EventType(), event.Event(), e)
+	}
+	return h.fn(ctx, event, e)
+}
+
+// HandlerName returns the name of the handler used in dead letters.
+func (h *typedEventHandler[E]) HandlerName() string {
+	return fmt.Sprintf("OnEvent[%s]", reflect.TypeOf((*E)(nil)).Elem())
+}
+
+// handlerRegistrar is implemented by the event buses that return an error
+// when a handler can not be registered.
+type handlerRegistrar interface {
+	RegisterHandler(handler EventHandler, events ...interface{}) error
+}
+
+// asPointer returns v as a *T if it is a *T, or a pointer to a copy of v if it
+// is a T.
+func asPointer[T any](v interface{}) (*T, bool) {
+	switch t := v.(type) {
+	case *T:
+		return t, true
+	case T:
+		return &t, true
+	}
+	return nil, false
+}
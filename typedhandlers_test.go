@@ -0,0 +1,164 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TypedHandlersSuite{})
+
+type TypedHandlersSuite struct {
+	ctx        context.Context
+	dispatcher *InMemoryDispatcher
+	bus        *InternalEventBus
+}
+
+func (s *TypedHandlersSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+	s.dispatcher = NewInMemoryDispatcher()
+	s.bus = NewInternalEventBus()
+}
+
+func (s *TypedHandlersSuite) TestHandleCommandDeliversTypedCommand(c *C) {
+	var got *SomeCommand
+	err := HandleCommand(s.dispatcher, func(ctx context.Context, m CommandMessage, cmd *SomeCommand) error {
+		got = cmd
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	cmd := &SomeCommand{Item: "item", Count: 2}
+	c.Assert(s.dispatcher.Dispatch(NewCommandMessage(NewUUID(), cmd)), IsNil)
+
+	c.Assert(got, Equals, cmd)
+}
+
+func (s *TypedHandlersSuite) TestHandleCommandDeliversCommandValues(c *C) {
+	var got *SomeCommand
+	_ = HandleCommand(s.dispatcher, func(ctx context.Context, m CommandMessage, cmd *SomeCommand) error {
+		got = cmd
+		return nil
+	})
+
+	c.Assert(s.dispatcher.Dispatch(NewCommandMessage(NewUUID(), SomeCommand{Item: "item", Count: 2})), IsNil)
+
+	c.Assert(got, DeepEquals, &SomeCommand{Item: "item", Count: 2})
+}
+
+func (s *TypedHandlersSuite) TestHandleCommandPassesContextAndErrors(c *C) {
+	type key struct{}
+	var got interface{}
+	_ = HandleCommand(s.dispatcher, func(ctx context.Context, m CommandMessage, cmd *SomeCommand) error {
+		got = ctx.Value(key{})
+		return fmt.Errorf("failed")
+	})
+
+	err := s.dispatcher.DispatchContext(context.WithValue(s.ctx, key{}, "value"), NewCommandMessage(NewUUID(), &SomeCommand{}))
+
+	c.Assert(err, ErrorMatches, "failed")
+	c.Assert(got, Equals, "value")
+}
+
+func (s *TypedHandlersSuite) TestHandleCommandFailsOnConflict(c *C) {
+	handle := func(ctx context.Context, m CommandMessage, cmd *SomeCommand) error { return nil }
+
+	c.Assert(HandleCommand(s.dispatcher, handle), IsNil)
+	c.Assert(HandleCommand(s.dispatcher, handle), ErrorMatches, "duplicate command handler registration .*SomeCommand")
+}
+
+func (s *TypedHandlersSuite) TestHandleCommandRejectsCommandWithTheSameName(c *C) {
+	s.dispatcher.SetTypeRegistry(NewTypeRegistry())
+	_ = HandleCommand(s.dispatcher, func(ctx context.Context, m CommandMessage, cmd *SomeCommand) error { return nil })
+
+	type SomeCommand struct{}
+	err := HandleCommand(s.dispatcher, func(ctx context.Context, m CommandMessage, cmd *SomeCommand) error { return nil })
+	c.Assert(err, FitsTypeOf, &ErrTypeNameConflict{})
+
+	err = s.dispatcher.Dispatch(NewCommandMessage(NewUUID(), &SomeCommand{}))
+	c.Assert(err, FitsTypeOf, &ErrTypeNameConflict{})
+}
+
+func (s *TypedHandlersSuite) TestHandleCommandRequiresDependencies(c *C) {
+	c.Assert(HandleCommand[SomeCommand](nil, func(context.Context, CommandMessage, *SomeCommand) error { return nil }), NotNil)
+	c.Assert(HandleCommand[SomeCommand](s.dispatcher, nil), NotNil)
+}
+
+func (s *TypedHandlersSuite) TestOnEventDeliversTypedEvent(c *C) {
+	var got []*SomeEvent
+	handle := func(ctx context.Context, m EventMessage, e *SomeEvent) error {
+		got = append(got, e)
+		return nil
+	}
+	c.Assert(OnEvent(s.bus, handle), IsNil)
+	c.Assert(OnEvent(s.bus, handle), IsNil)
+
+	event := NewTestEventMessage(NewUUID())
+	c.Assert(s.bus.Publish(s.ctx, event), IsNil)
+
+	c.Assert(got, HasLen, 2)
+	c.Assert(got[0], Equals, event.Event())
+}
+
+func (s *TypedHandlersSuite) TestOnEventDeliversEventValues(c *C) {
+	var got *SomeEvent
+	_ = OnEvent(s.bus, func(ctx context.Context, m EventMessage, e *SomeEvent) error {
+		got = e
+		return nil
+	})
+
+	c.Assert(s.bus.Publish(s.ctx, NewEventMessage(NewUUID(), SomeEvent{Item: "item", Count: 2}, nil)), IsNil)
+
+	c.Assert(got, DeepEquals, &SomeEvent{Item: "item", Count: 2})
+}
+
+func (s *TypedHandlersSuite) TestOnEventReportsFailures(c *C) {
+	_ = OnEvent(s.bus, func(ctx context.Context, m EventMessage, e *SomeEvent) error {
+		return fmt.Errorf("failed")
+	})
+
+	err := s.bus.Publish(s.ctx, NewTestEventMessage(NewUUID()))
+
+	c.Assert(err, FitsTypeOf, &ErrEventHandlerFailed{})
+	c.Assert(err.(*ErrEventHandlerFailed).Failures[0].HandlerName, Equals, "OnEvent[eventsourcing.SomeEvent]")
+}
+
+func (s *TypedHandlersSuite) TestOnEventFailsOnTypeNameConflict(c *C) {
+	s.bus.SetTypeRegistry(NewTypeRegistry())
+	handle := func(ctx context.Context, m EventMessage, e *SomeEvent) error { return nil }
+	c.Assert(OnEvent(s.bus, handle), IsNil)
+
+	type SomeEvent struct{}
+	err := OnEvent(s.bus, func(ctx context.Context, m EventMessage, e *SomeEvent) error { return nil })
+
+	c.Assert(err, FitsTypeOf, &ErrTypeNameConflict{})
+}
+
+func (s *TypedHandlersSuite) TestOnEventWithAsyncEventBus(c *C) {
+	bus := NewAsyncEventBus(AsyncEventBusConfig{TypeRegistry: NewTypeRegistry()})
+	got := make(chan *SomeEvent, 1)
+	c.Assert(OnEvent(bus, func(ctx context.Context, m EventMessage, e *SomeEvent) error {
+		got <- e
+		return nil
+	}), IsNil)
+
+	type SomeEvent struct{}
+	c.Assert(OnEvent(bus, func(ctx context.Context, m EventMessage, e *SomeEvent) error { return nil }), NotNil)
+
+	event := NewTestEventMessage(NewUUID())
+	c.Assert(bus.Publish(s.ctx, event), IsNil)
+	c.Assert(bus.Shutdown(s.ctx), IsNil)
+
+	c.Assert(<-got, Equals, event.Event())
+}
+
+func (s *TypedHandlersSuite) TestOnEventRequiresDependencies(c *C) {
+	c.Assert(OnEvent[SomeEvent](nil, func(context.Context, EventMessage, *SomeEvent) error { return nil }), NotNil)
+	c.Assert(OnEvent[SomeEvent](s.bus, nil), NotNil)
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// DefaultTypeRegistry is the TypeRegistry used to name commands, events and
+// aggregates unless another registry is set.
+//
+// The names of events in EventMessages and the names of events persisted by
+// the CommonDomainRepository are always taken from the DefaultTypeRegistry.
+var DefaultTypeRegistry = NewTypeRegistry()
+
+// QualifiedTypeName returns the name of the type qualified by the name of its
+// package, for example orders.Created. This is the default naming scheme.
+//
+// The name of the package is not its import path, so types of the same name
+// in two packages of the same name, such as shop/orders.Created and
+// billing/orders.Created, are given the same name. The registry rejects the
+// second of them with an *ErrTypeNameConflict, and one of them must be given
+// another name with RegisterName. Use ImportPathTypeName to name types by the
+// import path of their package instead.
+func QualifiedTypeName(t reflect.Type) string {
+	return t.String()
+}
+
+// ImportPathTypeName returns the name of the type qualified by the import path
+// of its package, for example example.com/shop/orders.Created. Names are
+// unique but change when the package is moved, and are persisted in stream
+// names and event types.
+//
+// Hyphens in the name, as in example.com/my-shop/orders.Created, are escaped
+// as %2D. Stream names are split into their category and aggregate ID at the
+// first hyphen, so a hyphen in the aggregate type name would put the stream in
+// the wrong category.
+func ImportPathTypeName(t reflect.Type) string {
+	if t.PkgPath() == "" {
+		return escapeHyphens(t.Name())
+	}
+	return escapeHyphens(t.PkgPath() + "." + t.Name())
+}
+
+// escapeHyphens replaces the hyphens in the name with %2D. A percent sign can
+// not appear in an import path, so escaped names remain unique.
+func escapeHyphens(name string) string {
+	return strings.ReplaceAll(name, "-", "%2D")
+}
+
+// ShortTypeName returns the name of the type without its package, for example
+// Created. This is the naming scheme of earlier versions.
+func ShortTypeName(t reflect.Type) string {
+	return t.Name()
+}
+
+// TypeRegistry maps the Go types of commands, events and aggregates to the
+// names used to route them and to persist them.
+//
+// A type is named by the naming scheme, QualifiedTypeName by default, unless
+// a name has been registered for it with RegisterName. The first type that
+// takes a name keeps it. Any other type that would be given the same name is
+// rejected with an *ErrTypeNameConflict, so two types can never be confused,
+// and must be registered with a different name.
+//
+// Aliases are extra names that resolve to a type, for example the name the
+// type was persisted under before it was moved to another package.
+//
+// A value and a pointer to a value of the same type have the same name.
+type TypeRegistry struct {
+	mu     sync.RWMutex
+	naming func(reflect.Type) string
+	names  map[reflect.Type]string
+	types  map[string]reflect.Type
+}
+
+// NewTypeRegistry constructs a new TypeRegistry that uses QualifiedTypeName.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		naming: QualifiedTypeName,
+		names:  make(map[reflect.Type]string),
+		types:  make(map[string]reflect.Type),
+	}
+}
+
+// SetNaming sets the function that names types that have no registered name.
+// It must be set before any type is named.
+func (r *TypeRegistry) SetNaming(naming func(reflect.Type) string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.naming = naming
+}
+
+// Name returns the name of the type of the value.
+//
+// An *ErrInvalidType is returned if the value is nil or its type has no name
+// and an *ErrTypeNameConflict if the name is taken by another type.
+func (r *TypeRegistry) Name(value interface{}) (string, error) {
+	t, err := namedType(value)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.RLock()
+	name, ok := r.names[t]
+	r.mu.RUnlock()
+	if ok {
+		return name, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name, ok := r.names[t]; ok {
+		return name, nil
+	}
+	name = r.naming(t)
+	if err := r.claim(name, t); err != nil {
+		return "", err
+	}
+	r.names[t] = name
+	return name, nil
+}
+
+// RegisterName registers the name of the type of the value.
+//
+// A type can only have one name, so the name can not be changed once the
+// type has been named.
+func (r *TypeRegistry) RegisterName(value interface{}, name string) error {
+	t, err := namedType(value)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return &ErrInvalidType{Type: t.String(), Reason: "the name is empty"}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.names[t]; ok && existing != name {
+		return &ErrInvalidType{Type: t.String(), Reason: "the type is already named " + existing}
+	}
+	if err := r.claim(name, t); err != nil {
+		return err
+	}
+	r.names[t] = name
+	return nil
+}
+
+// RegisterAlias registers an extra name that resolves to the type of the
+// value.
+func (r *TypeRegistry) RegisterAlias(value interface{}, alias string) error {
+	t, err := namedType(value)
+	if err != nil {
+		return err
+	}
+	if alias == "" {
+		return &ErrInvalidType{Type: t.String(), Reason: "the alias is empty"}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.claim(alias, t)
+}
+
+// Resolve returns the name of the type that the name or alias specified
+// resolves to. Names that are not known are returned unchanged.
+func (r *TypeRegistry) Resolve(name string) string {
+	r.mu.RLock()
+	t, ok := r.types[name]
+	r.mu.RUnlock()
+	if !ok {
+		return name
+	}
+
+	resolved, err := r.Name(reflect.Zero(reflect.PtrTo(t)).Interface())
+	if err != nil {
+		return name
+	}
+	return resolved
+}
+
+// claim takes the name for the type unless another type has it.
+func (r *TypeRegistry) claim(name string, t reflect.Type) error {
+	if existing, ok := r.types[name]; ok && existing != t {
+		return &ErrTypeNameConflict{Name: name, Registered: existing.String(), Type: t.String()}
+	}
+	r.types[name] = t
+	return nil
+}
+
+// namedType returns the type of the value, or the type it points to.
+func namedType(value interface{}) (reflect.Type, error) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		return nil, &ErrInvalidType{Type: "nil", Reason: "a nil value has no type"}
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Name() == "" {
+		return nil, &ErrInvalidType{Type: t.String(), Reason: "the type has no name"}
+	}
+	return t, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TypeRegistrySuite{})
+
+type TypeRegistrySuite struct {
+	types *TypeRegistry
+}
+
+func (s *TypeRegistrySuite) SetUpTest(c *C) {
+	s.types = NewTypeRegistry()
+}
+
+func (s *TypeRegistrySuite) TestNamesArePackageQualified(c *C) {
+	name, err := s.types.Name(&SomeEvent{})
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "eventsourcing.SomeEvent")
+
+	name, err = s.types.Name(SomeEvent{})
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "eventsourcing.SomeEvent")
+}
+
+func (s *TypeRegistrySuite) TestShortNames(c *C) {
+	s.types.SetNaming(ShortTypeName)
+
+	name, err := s.types.Name(&SomeEvent{})
+
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "SomeEvent")
+}
+
+func (s *TypeRegistrySuite) TestImportPathNames(c *C) {
+	s.types.SetNaming(ImportPathTypeName)
+
+	name, err := s.types.Name(&SomeEvent{})
+
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "github.com/fabiobentoluiz/eventsourcing.SomeEvent")
+}
+
+func (s *TypeRegistrySuite) TestImportPathNamesKeepStreamCategories(c *C) {
+	name := escapeHyphens("example.com/my-shop/orders.Order")
+	c.Assert(name, Equals, "example.com/my%2Dshop/orders.Order")
+
+	streamName := name + "-" + "3f0c8a1e-9d2b-4c1a-8f7e-2b6d5a4c3e1f"
+	c.Assert(streamCategory(streamName), Equals, name)
+	c.Assert(streamID(streamName), Equals, "3f0c8a1e-9d2b-4c1a-8f7e-2b6d5a4c3e1f")
+}
+
+func (s *TypeRegistrySuite) TestValuesWithoutANamedTypeAreRejected(c *C) {
+	_, err := s.types.Name(nil)
+	c.Assert(err, DeepEquals, &ErrInvalidType{Type: "nil", Reason: "a nil value has no type"})
+
+	_, err = s.types.Name(&struct{ Item string }{})
+	c.Assert(err, FitsTypeOf, &ErrInvalidType{})
+
+	_, err = s.types.Name(map[string]string{})
+	c.Assert(err, FitsTypeOf, &ErrInvalidType{})
+}
+
+func (s *TypeRegistrySuite) TestTypesWithTheSameNameConflict(c *C) {
+	_, err := s.types.Name(&SomeEvent{})
+	c.Assert(err, IsNil)
+
+	type SomeEvent struct{}
+	_, err = s.types.Name(&SomeEvent{})
+
+	c.Assert(err, DeepEquals, &ErrTypeNameConflict{
+		Name:       "eventsourcing.SomeEvent",
+		Registered: "eventsourcing.SomeEvent",
+		Type:       "eventsourcing.SomeEvent",
+	})
+}
+
+func (s *TypeRegistrySuite) TestRegisterName(c *C) {
+	c.Assert(s.types.RegisterName(&SomeEvent{}, "orders.SomeEvent.v1"), IsNil)
+	c.Assert(s.types.RegisterName(&SomeEvent{}, "orders.SomeEvent.v1"), IsNil)
+
+	name, err := s.types.Name(&SomeEvent{})
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "orders.SomeEvent.v1")
+
+	c.Assert(s.types.RegisterName(&SomeEvent{}, "other"), FitsTypeOf, &ErrInvalidType{})
+	c.Assert(s.types.RegisterName(&SomeOtherEvent{}, "orders.SomeEvent.v1"), FitsTypeOf, &ErrTypeNameConflict{})
+	c.Assert(s.types.RegisterName(&SomeOtherEvent{}, ""), FitsTypeOf, &ErrInvalidType{})
+}
+
+func (s *TypeRegistrySuite) TestTypeWithTheSameNameCanBeRenamed(c *C) {
+	_, _ = s.types.Name(&SomeEvent{})
+
+	type SomeEvent struct{}
+	c.Assert(s.types.RegisterName(&SomeEvent{}, "local.SomeEvent"), IsNil)
+
+	name, err := s.types.Name(&SomeEvent{})
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "local.SomeEvent")
+}
+
+func (s *TypeRegistrySuite) TestAliasesResolveToTheName(c *C) {
+	c.Assert(s.types.RegisterAlias(&SomeEvent{}, "SomeEvent"), IsNil)
+	c.Assert(s.types.RegisterAlias(&SomeOtherEvent{}, "SomeEvent"), FitsTypeOf, &ErrTypeNameConflict{})
+	c.Assert(s.types.RegisterAlias(&SomeEvent{}, ""), FitsTypeOf, &ErrInvalidType{})
+
+	c.Assert(s.types.Resolve("SomeEvent"), Equals, "eventsourcing.SomeEvent")
+	c.Assert(s.types.Resolve("eventsourcing.SomeEvent"), Equals, "eventsourcing.SomeEvent")
+	c.Assert(s.types.Resolve("Unknown"), Equals, "Unknown")
+}
+
+func (s *TypeRegistrySuite) TestFactoriesAndStreamNamerUseTheRegistry(c *C) {
+	c.Assert(s.types.RegisterName(&SomeAggregate{}, "Some"), IsNil)
+	c.Assert(s.types.RegisterAlias(&SomeAggregate{}, "SomeAggregate"), IsNil)
+	c.Assert(s.types.RegisterAlias(&SomeEvent{}, "SomeEvent"), IsNil)
+
+	eventFactory := NewDelegateEventFactory()
+	eventFactory.SetTypeRegistry(s.types)
+	c.Assert(eventFactory.RegisterDelegate(&SomeEvent{}, func() interface{} { return &SomeEvent{} }), IsNil)
+	c.Assert(eventFactory.RegisterDelegate(nil, func() interface{} { return nil }), FitsTypeOf, &ErrInvalidType{})
+	c.Assert(eventFactory.GetEvent("SomeEvent"), FitsTypeOf, &SomeEvent{})
+	c.Assert(eventFactory.GetEvent("eventsourcing.SomeEvent"), FitsTypeOf, &SomeEvent{})
+
+	aggregateFactory := NewDelegateAggregateFactory()
+	aggregateFactory.SetTypeRegistry(s.types)
+	c.Assert(aggregateFactory.RegisterDelegate(&SomeAggregate{}, NewSomeAggregate), IsNil)
+	c.Assert(aggregateFactory.GetAggregate("SomeAggregate", "1"), FitsTypeOf, &SomeAggregate{})
+	c.Assert(aggregateFactory.GetAggregate("Some", "1"), FitsTypeOf, &SomeAggregate{})
+
+	streamNamer := NewDelegateStreamNamer()
+	streamNamer.SetTypeRegistry(s.types)
+	c.Assert(streamNamer.RegisterDelegate(func(t string, id string) string { return t + "-" + id }, &SomeAggregate{}), IsNil)
+	name, err := streamNamer.GetStreamName("SomeAggregate", "1")
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "Some-1")
+}
+
+func (s *TypeRegistrySuite) TestDispatcherAndEventBusUseTheRegistry(c *C) {
+	c.Assert(s.types.RegisterName(&SomeCommand{}, "Some"), IsNil)
+	c.Assert(s.types.RegisterName(&SomeEvent{}, "Some"), FitsTypeOf, &ErrTypeNameConflict{})
+
+	dispatcher := NewInMemoryDispatcher()
+	dispatcher.SetTypeRegistry(s.types)
+	c.Assert(dispatcher.RegisterHandler(&TestCommandHandler{}, nil), FitsTypeOf, &ErrInvalidType{})
+	c.Assert(dispatcher.UseFor(nil, RecoveryMiddleware()), FitsTypeOf, &ErrInvalidType{})
+	c.Assert(dispatcher.Dispatch(NewCommandMessage("1", &SomeOtherCommand{})), ErrorMatches,
+		".*does not have a handler for commands of type: eventsourcing.SomeOtherCommand")
+
+	bus := NewInternalEventBus()
+	bus.SetTypeRegistry(s.types)
+	handler := NewMockEventHandler()
+	c.Assert(bus.RegisterHandler(handler, &SomeEvent{}, nil), FitsTypeOf, &ErrInvalidType{})
+	c.Assert(func() { bus.AddHandler(handler, nil) }, PanicMatches, "Invalid type.*")
+	c.Assert(bus.Publish(context.Background(), NewTestEventMessage("1")), IsNil)
+	c.Assert(handler.events, HasLen, 0)
+
+	c.Assert(bus.RegisterHandler(handler, &SomeEvent{}), IsNil)
+	c.Assert(bus.Publish(context.Background(), NewEventMessage("1", nil, nil)), FitsTypeOf, &ErrInvalidType{})
+	c.Assert(bus.Publish(context.Background(), NewTestEventMessage("1")), IsNil)
+	c.Assert(handler.events, HasLen, 1)
+}
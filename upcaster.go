@@ -0,0 +1,221 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// maxUpcasts is the number of times an event can be upcast before the chain
+// is considered to be a loop.
+const maxUpcasts = 100
+
+// RawEvent is a persisted event before it is unmarshalled into its Go type.
+type RawEvent struct {
+	EventType     string
+	SchemaVersion int
+	ContentType   string
+	Data          []byte
+	Headers       map[string]interface{}
+}
+
+// Upcaster is the interface that an upcaster must implement.
+//
+// An upcaster transforms an event persisted in an old schema into the events
+// of the schema that follows it. It can change the data of the event, change
+// its type or split it into several events. Returning no events drops the
+// event.
+type Upcaster interface {
+	Upcast(RawEvent) ([]RawEvent, error)
+}
+
+// UpcasterFunc is an adapter to allow the use of ordinary functions as
+// upcasters.
+type UpcasterFunc func(RawEvent) ([]RawEvent, error)
+
+// Upcast calls f.
+func (f UpcasterFunc) Upcast(event RawEvent) ([]RawEvent, error) {
+	return f(event)
+}
+
+// Upcasters is a chain of upcasters registered per event type and schema
+// version.
+//
+// An event is passed to the upcaster registered for its type and schema
+// version, and the events returned are passed on in the same way, until there
+// is no upcaster for the type and version of an event.
+//
+// The current schema version of an event type is one more than the highest
+// version an upcaster is registered for, or 1 if there are none. It is
+// recorded in the SchemaVersion header when an event is saved. Events saved
+// without a SchemaVersion header are at version 1.
+type Upcasters struct {
+	mu        sync.RWMutex
+	upcasters map[string]map[int]Upcaster
+}
+
+// NewUpcasters constructs a new, empty, chain of upcasters
+func NewUpcasters() *Upcasters {
+	return &Upcasters{
+		upcasters: make(map[string]map[int]Upcaster),
+	}
+}
+
+// Register registers the upcaster for events of the type and schema version
+// specified.
+//
+// The events returned by the upcaster that have the same type and do not have
+// a later schema version are given the next version. Events of another type
+// that have no schema version are given version 1.
+func (u *Upcasters) Register(eventType string, version int, upcaster Upcaster) error {
+	if upcaster == nil {
+		return fmt.Errorf("nil Upcaster registered for event type %s", eventType)
+	}
+	if version < 1 {
+		return fmt.Errorf("invalid schema version %d for event type %s", version, eventType)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.upcasters[eventType][version]; ok {
+		return fmt.Errorf("upcaster already registered for event type %s version %d", eventType, version)
+	}
+	if u.upcasters[eventType] == nil {
+		u.upcasters[eventType] = make(map[int]Upcaster)
+	}
+	u.upcasters[eventType][version] = upcaster
+	return nil
+}
+
+// CurrentVersion returns the current schema version of the event type.
+func (u *Upcasters) CurrentVersion(eventType string) int {
+	if u == nil {
+		return 1
+	}
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	current := 1
+	for version := range u.upcasters[eventType] {
+		if version >= current {
+			current = version + 1
+		}
+	}
+	return current
+}
+
+// Upcast passes the event through the chain and returns the events in the
+// current schema.
+func (u *Upcasters) Upcast(event RawEvent) ([]RawEvent, error) {
+	if event.SchemaVersion < 1 {
+		event.SchemaVersion = 1
+	}
+	if u == nil {
+		return []RawEvent{event}, nil
+	}
+	return u.upcast(event, 0)
+}
+
+func (u *Upcasters) upcast(event RawEvent, depth int) ([]RawEvent, error) {
+	u.mu.RLock()
+	upcaster, ok := u.upcasters[event.EventType][event.SchemaVersion]
+	u.mu.RUnlock()
+	if !ok {
+		return []RawEvent{event}, nil
+	}
+	if depth >= maxUpcasts {
+		return nil, fmt.Errorf("event type %s version %d was upcast %d times, the upcasters may loop",
+			event.EventType, event.SchemaVersion, depth)
+	}
+
+	upcast, err := upcaster.Upcast(event)
+	if err != nil {
+		return nil, fmt.Errorf("could not upcast event type %s version %d. Error: %+v",
+			event.EventType, event.SchemaVersion, err)
+	}
+
+	var result []RawEvent
+	for _, next := range upcast {
+		if next.EventType == event.EventType && next.SchemaVersion <= event.SchemaVersion {
+			next.SchemaVersion = event.SchemaVersion + 1
+		}
+		if next.SchemaVersion < 1 {
+			next.SchemaVersion = 1
+		}
+		events, err := u.upcast(next, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, events...)
+	}
+	return result, nil
+}
+
+// RenameEventType returns an upcaster that changes the type of an event.
+func RenameEventType(eventType string) UpcasterFunc {
+	return func(event RawEvent) ([]RawEvent, error) {
+		event.EventType = eventType
+		event.SchemaVersion = 0
+		return []RawEvent{event}, nil
+	}
+}
+
+// RenameFields returns an upcaster that renames the fields of the JSON object
+// of an event, from the keys of the map to the values.
+func RenameFields(fields map[string]string) UpcasterFunc {
+	return TransformData(func(data map[string]interface{}) error {
+		for from, to := range fields {
+			if value, ok := data[from]; ok {
+				delete(data, from)
+				data[to] = value
+			}
+		}
+		return nil
+	})
+}
+
+// TransformData returns an upcaster that calls the function to change the
+// JSON object of an event. Events that are not JSON can not be transformed.
+func TransformData(transform func(map[string]interface{}) error) UpcasterFunc {
+	return func(event RawEvent) ([]RawEvent, error) {
+		if event.ContentType != "" && event.ContentType != ContentTypeJSON {
+			return nil, fmt.Errorf("can not transform data of content type %s", event.ContentType)
+		}
+
+		data := make(map[string]interface{})
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return nil, err
+		}
+		if err := transform(data); err != nil {
+			return nil, err
+		}
+
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		event.Data = b
+		return []RawEvent{event}, nil
+	}
+}
+
+// schemaVersion returns the schema version in the headers, or 1 if there is
+// none.
+func schemaVersion(headers map[string]interface{}) int {
+	switch v := headers[HeaderSchemaVersion].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 1
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 Jet Basrawi. All rights reserved.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package eventsourcing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&UpcasterSuite{})
+
+type UpcasterSuite struct {
+	ctx          context.Context
+	store        *InMemoryEventStore
+	eventFactory *DelegateEventFactory
+	upcasters    *Upcasters
+}
+
+func (s *UpcasterSuite) SetUpTest(c *C) {
+	s.ctx = context.Background()
+	s.store = NewInMemoryEventStore()
+	s.eventFactory = NewDelegateEventFactory()
+	_ = s.eventFactory.RegisterDelegate(&SomeEvent{},
+		func() interface{} { return &SomeEvent{} })
+	s.upcasters = NewUpcasters()
+}
+
+// appendV1 appends an event with a SchemaVersion 1 header and the data given.
+func (s *UpcasterSuite) appendV1(c *C, stream string, eventType string, data string) {
+	metadata, err := json.Marshal(map[string]interface{}{HeaderSchemaVersion: 1})
+	c.Assert(err, IsNil)
+	_, err = s.store.AppendToStream(s.ctx, stream, ExpectedVersionAny, []EventData{{
+		EventID:     NewUUID(),
+		EventType:   eventType,
+		ContentType: "application/json",
+		Data:        []byte(data),
+		Metadata:    metadata,
+	}})
+	c.Assert(err, IsNil)
+}
+
+func (s *UpcasterSuite) TestRegister(c *C) {
+	noop := func(e RawEvent) ([]RawEvent, error) { return []RawEvent{e}, nil }
+
+	c.Assert(s.upcasters.Register("SomeEvent", 1, nil), ErrorMatches, "nil Upcaster .*")
+	c.Assert(s.upcasters.Register("SomeEvent", 0, UpcasterFunc(noop)), ErrorMatches, "invalid schema version 0 .*")
+	c.Assert(s.upcasters.Register("SomeEvent", 1, UpcasterFunc(noop)), IsNil)
+	c.Assert(s.upcasters.Register("SomeEvent", 1, UpcasterFunc(noop)), ErrorMatches, "upcaster already registered .*")
+}
+
+func (s *UpcasterSuite) TestCurrentVersion(c *C) {
+	var none *Upcasters
+	c.Assert(none.CurrentVersion("SomeEvent"), Equals, 1)
+	c.Assert(s.upcasters.CurrentVersion("SomeEvent"), Equals, 1)
+
+	_ = s.upcasters.Register("SomeEvent", 1, RenameFields(nil))
+	_ = s.upcasters.Register("SomeEvent", 2, RenameFields(nil))
+
+	c.Assert(s.upcasters.CurrentVersion("SomeEvent"), Equals, 3)
+}
+
+func (s *UpcasterSuite) TestUpcastsThroughTheChain(c *C) {
+	_ = s.upcasters.Register("SomeEvent", 1, RenameFields(map[string]string{"Name": "Title"}))
+	_ = s.upcasters.Register("SomeEvent", 2, RenameFields(map[string]string{"Title": "Item"}))
+
+	events, err := s.upcasters.Upcast(RawEvent{EventType: "SomeEvent", SchemaVersion: 1, Data: []byte(`{"Name":"item"}`)})
+
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].SchemaVersion, Equals, 3)
+	c.Assert(string(events[0].Data), Equals, `{"Item":"item"}`)
+}
+
+func (s *UpcasterSuite) TestEventsAtTheCurrentVersionAreNotUpcast(c *C) {
+	_ = s.upcasters.Register("SomeEvent", 1, RenameFields(map[string]string{"Name": "Item"}))
+
+	events, err := s.upcasters.Upcast(RawEvent{EventType: "SomeEvent", SchemaVersion: 2, Data: []byte(`{"Name":"item"}`)})
+
+	c.Assert(err, IsNil)
+	c.Assert(string(events[0].Data), Equals, `{"Name":"item"}`)
+}
+
+func (s *UpcasterSuite) TestRenameEventType(c *C) {
+	_ = s.upcasters.Register("ItemAdded", 1, RenameEventType("SomeEvent"))
+	_ = s.upcasters.Register("SomeEvent", 1, TransformData(func(data map[string]interface{}) error {
+		data["Count"] = 1
+		return nil
+	}))
+
+	events, err := s.upcasters.Upcast(RawEvent{EventType: "ItemAdded", Data: []byte(`{"Item":"item"}`)})
+
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].EventType, Equals, "SomeEvent")
+	c.Assert(events[0].SchemaVersion, Equals, 2)
+	c.Assert(string(events[0].Data), Equals, `{"Count":1,"Item":"item"}`)
+}
+
+func (s *UpcasterSuite) TestDetectsLoops(c *C) {
+	_ = s.upcasters.Register("A", 1, RenameEventType("B"))
+	_ = s.upcasters.Register("B", 1, RenameEventType("A"))
+
+	_, err := s.upcasters.Upcast(RawEvent{EventType: "A"})
+
+	c.Assert(err, ErrorMatches, ".*the upcasters may loop")
+}
+
+func (s *UpcasterSuite) TestReportsFailures(c *C) {
+	_ = s.upcasters.Register("SomeEvent", 1, RenameFields(nil))
+
+	_, err := s.upcasters.Upcast(RawEvent{EventType: "SomeEvent", Data: []byte(`not json`)})
+
+	c.Assert(err, ErrorMatches, "could not upcast event type SomeEvent version 1.*")
+}
+
+func (s *UpcasterSuite) TestSaveRecordsSchemaVersion(c *C) {
+	_ = s.upcasters.Register("eventsourcing.SomeEvent", 1, RenameFields(nil))
+	common, err := NewCommonDomainRepository(s.store, &MockEventBus{})
+	c.Assert(err, IsNil)
+	common.SetEventFactory(s.eventFactory)
+	common.SetUpcasters(s.upcasters)
+	repo, err := NewRepository(common, newTypedSnapshotAggregate)
+	c.Assert(err, IsNil)
+
+	id := NewUUID()
+	agg := newTypedSnapshotAggregate(id)
+	agg.Apply(NewEventMessage(id, &SomeEvent{Count: 1}, nil), true)
+	c.Assert(repo.Save(agg, nil), IsNil)
+
+	loaded, err := repo.Load(id)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Total, Equals, 1)
+
+	events, err := s.store.ReadStreamForwards(s.ctx, repo.StreamName(id), StreamStart, 10)
+	c.Assert(err, IsNil)
+	headers, err := NewJSONMetadataCodec().Decode(events[0].Metadata)
+	c.Assert(err, IsNil)
+	c.Assert(schemaVersion(headers), Equals, 2)
+}
+
+func (s *UpcasterSuite) TestLoadSplitsOldEvents(c *C) {
+	_ = s.upcasters.Register("eventsourcing.SomeEvent", 1, UpcasterFunc(func(e RawEvent) ([]RawEvent, error) {
+		var old struct{ Items []int }
+		if err := json.Unmarshal(e.Data, &old); err != nil {
+			return nil, err
+		}
+		var events []RawEvent
+		for i, count := range old.Items {
+			e.Data = []byte(fmt.Sprintf(`{"Item":"item %d","Count":%d}`, i, count))
+			events = append(events, e)
+		}
+		return events, nil
+	}))
+	common, _ := NewCommonDomainRepository(s.store, &MockEventBus{})
+	common.SetEventFactory(s.eventFactory)
+	common.SetUpcasters(s.upcasters)
+	repo, _ := NewRepository(common, newTypedSnapshotAggregate)
+
+	id := NewUUID()
+	s.appendV1(c, repo.StreamName(id), "eventsourcing.SomeEvent", `{"Items":[2,3]}`)
+	s.appendV1(c, repo.StreamName(id), "eventsourcing.SomeEvent", `{"Items":[4]}`)
+
+	loaded, err := repo.Load(id)
+
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Total, Equals, 9)
+	c.Assert(loaded.applied, Equals, 3)
+	c.Assert(loaded.CurrentVersion(), Equals, int64(1))
+}
+
+func (s *UpcasterSuite) TestSplitEventsHaveDistinctIDs(c *C) {
+	_ = s.upcasters.Register("eventsourcing.SomeEvent", 1, UpcasterFunc(func(e RawEvent) ([]RawEvent, error) {
+		return []RawEvent{e, e}, nil
+	}))
+	event := RecordedEvent{
+		EventID:    "event",
+		EventType:  "eventsourcing.SomeEvent",
+		StreamName: "SomeAggregate-1",
+		Data:       []byte(`{"Item":"item"}`),
+	}
+
+	messages, unknown, err := decodeEventMessages(s.eventFactory, NewJSONMetadataCodec(), s.upcasters, DefaultSerializers, "", event)
+
+	c.Assert(err, IsNil)
+	c.Assert(unknown, HasLen, 0)
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].AggregateID(), Equals, "1")
+	c.Assert(messages[0].GetHeaders()[HeaderEventID], Equals, "event")
+	c.Assert(messages[1].GetHeaders()[HeaderEventID], Equals, "event-1")
+	c.Assert(messages[1].GetHeaders()[HeaderSchemaVersion], Equals, 2)
+}
+
+func (s *UpcasterSuite) TestReplayUpcastsEvents(c *C) {
+	_ = s.upcasters.Register("ItemAdded", 1, RenameEventType("eventsourcing.SomeEvent"))
+	_ = s.upcasters.Register("eventsourcing.SomeEvent", 1, RenameFields(map[string]string{"Quantity": "Count"}))
+	s.appendV1(c, "SomeAggregate-1", "ItemAdded", `{"Item":"item","Quantity":5}`)
+	handler := NewMockEventHandler()
+	replayer, err := NewReplayer(s.store, s.eventFactory)
+	c.Assert(err, IsNil)
+	replayer.SetUpcasters(s.upcasters)
+	replayer.AddHandler(handler, &SomeEvent{})
+
+	progress, err := replayer.Replay(s.ctx)
+
+	c.Assert(err, IsNil)
+	c.Assert(progress.Replayed, Equals, 1)
+	c.Assert(handler.events, HasLen, 1)
+	c.Assert(handler.events[0].Event(), DeepEquals, &SomeEvent{Item: "item", Count: 5})
+}